@@ -0,0 +1,421 @@
+package amqp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// fakeBroker is an in-memory stand-in for an AMQP broker, with
+// just enough of the protocol for the transports: the default and
+// topic exchanges, queues, prefetch, acks and publisher confirms.
+type fakeBroker struct {
+	lock     sync.Mutex
+	queues   map[string]*fakeQueue
+	bindings []fakeBinding
+	conns    map[*fakeConn]struct{}
+	names    int
+	// down refuses new connections, and nack refuses messages.
+	down bool
+	nack bool
+}
+
+type fakeBinding struct {
+	queue, key, exchange string
+}
+
+type fakeMessage struct {
+	exchange, key string
+	body          []byte
+	redelivered   bool
+}
+
+type fakeQueue struct {
+	name       string
+	autoDelete bool
+	messages   []*fakeMessage
+	consumers  []*fakeConsumer
+	next       int
+}
+
+type fakeConsumer struct {
+	ch         *fakeChannel
+	queue      *fakeQueue
+	tag        string
+	deliveries chan amqp.Delivery
+	unacked    int
+}
+
+type fakeUnacked struct {
+	consumer *fakeConsumer
+	msg      *fakeMessage
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{
+		queues: make(map[string]*fakeQueue),
+		conns:  make(map[*fakeConn]struct{}),
+	}
+}
+
+// dial connects to the broker, and is used in place of amqp.Dial.
+func (b *fakeBroker) dial(url string) (connection, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.down {
+		return nil, errors.New("connection refused")
+	}
+	c := &fakeConn{broker: b, channels: make(map[*fakeChannel]struct{})}
+	b.conns[c] = struct{}{}
+	return c, nil
+}
+
+// drop closes every connection, as if the broker had restarted.
+func (b *fakeBroker) drop() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for c := range b.conns {
+		c.close(&amqp.Error{Code: 320, Reason: "CONNECTION_FORCED"})
+	}
+}
+
+// route gets the queues a message published with the key to the
+// exchange goes to.
+// Callers must hold the lock.
+func (b *fakeBroker) route(exchange, key string) []*fakeQueue {
+	if exchange == "" {
+		if q, ok := b.queues[key]; ok {
+			return []*fakeQueue{q}
+		}
+		return nil
+	}
+	var queues []*fakeQueue
+	seen := make(map[string]bool)
+	for _, binding := range b.bindings {
+		if binding.exchange != exchange || seen[binding.queue] || !topicMatch(binding.key, key) {
+			continue
+		}
+		if q, ok := b.queues[binding.queue]; ok {
+			seen[binding.queue] = true
+			queues = append(queues, q)
+		}
+	}
+	return queues
+}
+
+// topicMatch matches a routing key against an AMQP binding key.
+func topicMatch(binding, key string) bool {
+	return matchWords(strings.Split(binding, "."), strings.Split(key, "."))
+}
+
+func matchWords(binding, key []string) bool {
+	if len(binding) == 0 {
+		return len(key) == 0
+	}
+	switch binding[0] {
+	case "#":
+		for i := 0; i <= len(key); i++ {
+			if matchWords(binding[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(key) > 0 && matchWords(binding[1:], key[1:])
+	}
+	return len(key) > 0 && binding[0] == key[0] && matchWords(binding[1:], key[1:])
+}
+
+// deliver hands the queue's messages to its consumers in turn, as
+// far as their prefetch allows.
+// Callers must hold the lock.
+func (b *fakeBroker) deliver(q *fakeQueue) {
+	for len(q.messages) > 0 {
+		var next *fakeConsumer
+		for i := range q.consumers {
+			c := q.consumers[(q.next+i)%len(q.consumers)]
+			if c.ch.prefetch == 0 || c.unacked < c.ch.prefetch {
+				next = c
+				q.next = (q.next + i + 1) % len(q.consumers)
+				break
+			}
+		}
+		if next == nil {
+			return
+		}
+		msg := q.messages[0]
+		q.messages = q.messages[1:]
+		next.unacked++
+		next.ch.deliveryTag++
+		next.ch.unacked[next.ch.deliveryTag] = &fakeUnacked{consumer: next, msg: msg}
+		next.deliveries <- amqp.Delivery{
+			Acknowledger: next.ch,
+			ConsumerTag:  next.tag,
+			DeliveryTag:  next.ch.deliveryTag,
+			Redelivered:  msg.redelivered,
+			Exchange:     msg.exchange,
+			RoutingKey:   msg.key,
+			Body:         msg.body,
+		}
+	}
+}
+
+// requeue puts the message back at the front of the queue.
+// Callers must hold the lock.
+func (b *fakeBroker) requeue(q *fakeQueue, msg *fakeMessage) {
+	if _, ok := b.queues[q.name]; !ok {
+		return
+	}
+	msg.redelivered = true
+	q.messages = append([]*fakeMessage{msg}, q.messages...)
+	b.deliver(q)
+}
+
+// cancel removes the consumer from its queue.
+// Callers must hold the lock.
+func (b *fakeBroker) cancel(c *fakeConsumer) {
+	q := c.queue
+	for i, existing := range q.consumers {
+		if existing == c {
+			q.consumers = append(q.consumers[:i:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+	q.next = 0
+	delete(c.ch.consumers, c.tag)
+	close(c.deliveries)
+	if q.autoDelete && len(q.consumers) == 0 {
+		delete(b.queues, q.name)
+	}
+}
+
+type fakeConn struct {
+	broker   *fakeBroker
+	channels map[*fakeChannel]struct{}
+	closers  []chan *amqp.Error
+	closed   bool
+}
+
+func (c *fakeConn) Channel() (amqpChannel, error) {
+	c.broker.lock.Lock()
+	defer c.broker.lock.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	ch := &fakeChannel{
+		conn:      c,
+		consumers: make(map[string]*fakeConsumer),
+		unacked:   make(map[uint64]*fakeUnacked),
+	}
+	c.channels[ch] = struct{}{}
+	return ch, nil
+}
+
+func (c *fakeConn) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.broker.lock.Lock()
+	defer c.broker.lock.Unlock()
+	c.closers = append(c.closers, receiver)
+	return receiver
+}
+
+func (c *fakeConn) Close() error {
+	c.broker.lock.Lock()
+	defer c.broker.lock.Unlock()
+	c.close(nil)
+	return nil
+}
+
+// close closes the connection and its channels.
+// Callers must hold the lock.
+func (c *fakeConn) close(err *amqp.Error) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	for ch := range c.channels {
+		ch.close()
+	}
+	for _, closer := range c.closers {
+		if err != nil {
+			closer <- err
+		}
+		close(closer)
+	}
+	delete(c.broker.conns, c)
+}
+
+type fakeChannel struct {
+	conn        *fakeConn
+	prefetch    int
+	confirms    []chan amqp.Confirmation
+	published   uint64
+	deliveryTag uint64
+	consumers   map[string]*fakeConsumer
+	unacked     map[uint64]*fakeUnacked
+	closed      bool
+}
+
+func (ch *fakeChannel) Confirm(noWait bool) error {
+	return nil
+}
+
+func (ch *fakeChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.conn.broker.lock.Lock()
+	defer ch.conn.broker.lock.Unlock()
+	ch.confirms = append(ch.confirms, confirm)
+	return confirm
+}
+
+func (ch *fakeChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	ch.prefetch = prefetchCount
+	return nil
+}
+
+func (ch *fakeChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	if kind != amqp.ExchangeTopic {
+		return fmt.Errorf("unsupported exchange kind %q", kind)
+	}
+	return nil
+}
+
+func (ch *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.conn.broker
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	if name == "" {
+		b.names++
+		name = fmt.Sprintf("amq.gen-%d", b.names)
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		q = &fakeQueue{name: name, autoDelete: autoDelete}
+		b.queues[name] = q
+	}
+	return amqp.Queue{Name: name, Messages: len(q.messages), Consumers: len(q.consumers)}, nil
+}
+
+func (ch *fakeChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	b := ch.conn.broker
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.bindings = append(b.bindings, fakeBinding{queue: name, key: key, exchange: exchange})
+	return nil
+}
+
+func (ch *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	b := ch.conn.broker
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if !b.nack {
+		for _, q := range b.route(exchange, key) {
+			q.messages = append(q.messages, &fakeMessage{exchange: exchange, key: key, body: msg.Body})
+			b.deliver(q)
+		}
+	}
+	ch.published++
+	for _, confirm := range ch.confirms {
+		confirm <- amqp.Confirmation{DeliveryTag: ch.published, Ack: !b.nack}
+	}
+	return nil
+}
+
+func (ch *fakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b := ch.conn.broker
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, &amqp.Error{Code: 404, Reason: "NOT_FOUND - no queue '" + queue + "'"}
+	}
+	c := &fakeConsumer{ch: ch, queue: q, tag: consumer, deliveries: make(chan amqp.Delivery, 10000)}
+	ch.consumers[consumer] = c
+	q.consumers = append(q.consumers, c)
+	b.deliver(q)
+	return c.deliveries, nil
+}
+
+func (ch *fakeChannel) Cancel(consumer string, noWait bool) error {
+	b := ch.conn.broker
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if c, ok := ch.consumers[consumer]; ok {
+		b.cancel(c)
+	}
+	return nil
+}
+
+func (ch *fakeChannel) Close() error {
+	ch.conn.broker.lock.Lock()
+	defer ch.conn.broker.lock.Unlock()
+	ch.close()
+	return nil
+}
+
+// close cancels the channel's consumers and requeues the messages
+// they had not acked.
+// Callers must hold the lock.
+func (ch *fakeChannel) close() {
+	if ch.closed {
+		return
+	}
+	ch.closed = true
+	b := ch.conn.broker
+	for _, c := range ch.consumers {
+		b.cancel(c)
+	}
+	for tag, u := range ch.unacked {
+		delete(ch.unacked, tag)
+		b.requeue(u.consumer.queue, u.msg)
+	}
+	for _, confirm := range ch.confirms {
+		close(confirm)
+	}
+	delete(ch.conn.channels, ch)
+}
+
+func (ch *fakeChannel) Ack(tag uint64, multiple bool) error {
+	return ch.settle(tag, false, false)
+}
+
+func (ch *fakeChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+	return ch.settle(tag, true, requeue)
+}
+
+func (ch *fakeChannel) Reject(tag uint64, requeue bool) error {
+	return ch.settle(tag, true, requeue)
+}
+
+// settle finishes with a delivery, requeueing it if it was
+// rejected and should be.
+func (ch *fakeChannel) settle(tag uint64, reject, requeue bool) error {
+	b := ch.conn.broker
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	u, ok := ch.unacked[tag]
+	if !ok {
+		return &amqp.Error{Code: 406, Reason: "PRECONDITION_FAILED - unknown delivery tag"}
+	}
+	delete(ch.unacked, tag)
+	u.consumer.unacked--
+	if reject && requeue {
+		b.requeue(u.consumer.queue, u.msg)
+	} else {
+		b.deliver(u.consumer.queue)
+	}
+	return nil
+}
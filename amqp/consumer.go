@@ -0,0 +1,203 @@
+package amqp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/streadway/amqp"
+)
+
+// consumerTag is the tag every consumer uses. Each consumer has its
+// own AMQP channel, so the tags never clash.
+const consumerTag = "qp"
+
+// consumer takes messages from a queue and dispatches them to
+// handlers, acking each once every handler has returned.
+type consumer struct {
+	session *session
+	acks    *acker
+	// declare declares the queue to consume and anything bound to
+	// it, returning the queue's name.
+	declare func(ch amqpChannel) (string, error)
+	// dispatchers gets the dispatchers to hand each message to.
+	dispatchers func() []*qp.Dispatcher
+	// match reports whether a message belongs to the consumer.
+	match    func(channel string) bool
+	prefetch int
+	// requeue is whether messages that could not be handed to a
+	// handler go back on the queue, or are dropped.
+	requeue bool
+
+	quit     chan qp.Signal
+	abandon  chan qp.Signal
+	inflight sync.WaitGroup
+}
+
+// run consumes until quit is closed, starting again each time the
+// session reconnects. Once quit is closed, it waits for the messages
+// in flight to be acked, or for abandon to be closed, before
+// closing the AMQP channel.
+func (c *consumer) run() {
+	for {
+		conn, changed := c.session.connection()
+		if conn != nil {
+			err := c.consume(conn)
+			if err == nil {
+				return
+			}
+			if c.session.log.Warn() {
+				c.session.log.Warn("stopped consuming:", err)
+			}
+		}
+		select {
+		case <-c.quit:
+			return
+		case <-changed:
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+// consume takes messages on the connection, returning nil once
+// quit is closed or an error if it stopped for any other reason.
+func (c *consumer) consume(conn connection) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	if c.prefetch > 0 {
+		if err := ch.Qos(c.prefetch, 0, false); err != nil {
+			ch.Close()
+			return err
+		}
+	}
+	queue, err := c.declare(ch)
+	if err != nil {
+		ch.Close()
+		return err
+	}
+	deliveries, err := ch.Consume(queue, consumerTag, false, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return err
+	}
+	for {
+		select {
+		case <-c.quit:
+			ch.Cancel(consumerTag, false)
+			// anything delivered before the cancel goes back
+			for delivery := range deliveries {
+				delivery.Nack(false, c.requeue)
+			}
+			c.wait()
+			ch.Close()
+			return nil
+		case delivery, ok := <-deliveries:
+			if !ok {
+				ch.Close()
+				return ErrDisconnected
+			}
+			c.dispatch(delivery)
+		}
+	}
+}
+
+// dispatch hands the delivery to the handlers.
+func (c *consumer) dispatch(delivery amqp.Delivery) {
+	if c.match != nil && !c.match(delivery.RoutingKey) {
+		delivery.Ack(false)
+		return
+	}
+	dispatchers := c.dispatchers()
+	if len(dispatchers) == 0 {
+		delivery.Nack(false, c.requeue)
+		return
+	}
+	msg := &qp.Message{Source: delivery.RoutingKey, Data: delivery.Body}
+	c.inflight.Add(1)
+	c.acks.track(msg, delivery, len(dispatchers), c.requeue, c.inflight.Done)
+	for _, dispatcher := range dispatchers {
+		// blocks while the channel is at capacity
+		if err := dispatcher.Dispatch(msg); err != nil {
+			c.acks.handled(msg, false)
+		}
+	}
+}
+
+// wait waits for the messages in flight to be acked, or for
+// abandon to be closed.
+func (c *consumer) wait() {
+	acked := make(chan qp.Signal)
+	go func() {
+		c.inflight.Wait()
+		close(acked)
+	}()
+	select {
+	case <-acked:
+	case <-c.abandon:
+	}
+}
+
+// acker acks each delivery once every handler it was dispatched to
+// has returned.
+type acker struct {
+	lock    sync.Mutex
+	pending map[*qp.Message]*pending
+}
+
+// pending is a delivery that is being handled.
+type pending struct {
+	delivery amqp.Delivery
+	handlers int
+	failed   bool
+	requeue  bool
+	done     func()
+}
+
+func newAcker() *acker {
+	return &acker{pending: make(map[*qp.Message]*pending)}
+}
+
+// wrap makes a handler that tells the acker when the handler has
+// returned.
+func (a *acker) wrap(handler qp.Handler) qp.Handler {
+	return qp.HandlerFunc(func(msg *qp.Message) {
+		handler.Handle(msg)
+		a.handled(msg, true)
+	})
+}
+
+// track starts tracking the delivery of the message to the number
+// of handlers.
+func (a *acker) track(msg *qp.Message, delivery amqp.Delivery, handlers int, requeue bool, done func()) {
+	a.lock.Lock()
+	a.pending[msg] = &pending{delivery: delivery, handlers: handlers, requeue: requeue, done: done}
+	a.lock.Unlock()
+}
+
+// handled records that one handler of the message has returned,
+// or could not be given it. Once all have, the delivery is acked,
+// or nacked if any of them failed.
+func (a *acker) handled(msg *qp.Message, ok bool) {
+	a.lock.Lock()
+	p, found := a.pending[msg]
+	if !found {
+		a.lock.Unlock()
+		return
+	}
+	p.handlers--
+	p.failed = p.failed || !ok
+	if p.handlers > 0 {
+		a.lock.Unlock()
+		return
+	}
+	delete(a.pending, msg)
+	a.lock.Unlock()
+	if p.failed {
+		p.delivery.Nack(false, p.requeue)
+	} else {
+		p.delivery.Ack(false)
+	}
+	p.done()
+}
@@ -0,0 +1,108 @@
+package amqp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/qp/go/transporttest"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDirect makes a Direct that connects to the fake broker.
+func fakeDirect(broker *fakeBroker) *Direct {
+	d := NewDirect("amqp://fake")
+	d.session.dial = broker.dial
+	return d
+}
+
+func TestDirectConformance(t *testing.T) {
+	broker := newFakeBroker()
+	transporttest.Direct(t, func() qp.DirectTransport {
+		return fakeDirect(broker)
+	})
+}
+
+func TestDirectNacked(t *testing.T) {
+
+	broker := newFakeBroker()
+	d := fakeDirect(broker)
+	require.NoError(t, d.Start())
+	defer d.Stop(stop.NoWait)
+	broker.lock.Lock()
+	broker.nack = true
+	broker.lock.Unlock()
+	require.Equal(t, ErrNacked, d.Send("nacked", []byte("refused")))
+
+}
+
+func TestDirectAbandonedRedelivered(t *testing.T) {
+
+	broker := newFakeBroker()
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan *qp.Message, 1)
+	first := fakeDirect(broker)
+	require.NoError(t, first.OnMessage("abandoned", qp.HandlerFunc(func(msg *qp.Message) {
+		started <- msg
+		<-release
+	})))
+	require.NoError(t, first.Start())
+	require.NoError(t, first.Send("abandoned", []byte("one")))
+	<-started
+
+	// the handler never acks, so the message goes to the next consumer
+	first.Stop(10 * time.Millisecond)
+	<-first.StopChan()
+	require.Equal(t, 1, first.Abandoned())
+	second := fakeDirect(broker)
+	msgs := make(chan *qp.Message, 1)
+	require.NoError(t, second.OnMessage("abandoned", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	})))
+	require.NoError(t, second.Start())
+	defer second.Stop(stop.NoWait)
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "one", string(msg.Data))
+	case <-time.After(1 * time.Second):
+		require.FailNow(t, "message was not delivered again")
+	}
+
+}
+
+func TestDirectReconnect(t *testing.T) {
+
+	broker := newFakeBroker()
+	d := fakeDirect(broker)
+	msgs := make(chan *qp.Message, 10)
+	require.NoError(t, d.OnMessage("reconnect", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	})))
+	require.NoError(t, d.Start())
+	defer d.Stop(stop.NoWait)
+
+	broker.lock.Lock()
+	broker.down = true
+	broker.lock.Unlock()
+	broker.drop()
+	require.Error(t, d.Send("reconnect", []byte("lost")))
+	broker.lock.Lock()
+	broker.down = false
+	broker.lock.Unlock()
+
+	// the consumer starts again once the transport reconnects
+	deadline := time.Now().Add(2 * time.Second)
+	for d.Send("reconnect", []byte("found")) != nil {
+		require.True(t, time.Now().Before(deadline), "did not reconnect")
+		time.Sleep(20 * time.Millisecond)
+	}
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "found", string(msg.Data))
+	case <-time.After(2 * time.Second):
+		require.FailNow(t, "no message received after reconnecting")
+	}
+
+}
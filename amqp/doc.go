@@ -0,0 +1,14 @@
+// Package amqp implements the qp transports on an AMQP 0-9-1
+// broker, such as RabbitMQ.
+//
+// Direct channels are durable queues, so each message goes to one
+// consumer and waits on the broker until there is one. PubSub
+// channels are bound to a topic exchange, with "*" and ">" turned
+// into AMQP's "*" and "#".
+//
+// Send and Publish wait for the broker to confirm each message.
+// Consumers ack each message once its handlers have returned, so
+// messages whose handlers were abandoned, or that were being
+// handled when the connection was lost, are delivered again. The
+// transports reconnect whenever the connection is lost.
+package amqp
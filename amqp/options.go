@@ -0,0 +1,39 @@
+package amqp
+
+import "github.com/qp/go"
+
+// Options controls how a transport uses the broker.
+type Options struct {
+	// Exchange is the topic exchange PubSub publishes to. Empty
+	// means DefaultExchange.
+	Exchange string
+	// Prefetch is the number of unacked messages the broker may
+	// deliver to each consumer, for channels whose options do not
+	// limit how many messages are handled at once. Zero means no
+	// limit.
+	Prefetch int
+}
+
+// DefaultExchange is the Exchange used when Options does not set
+// one.
+const DefaultExchange = "qp"
+
+// exchange gets the exchange to publish to.
+func (o Options) exchange() string {
+	if o.Exchange == "" {
+		return DefaultExchange
+	}
+	return o.Exchange
+}
+
+// prefetch gets the number of unacked messages a consumer may be
+// given on a channel with the options.
+func (o Options) prefetch(options qp.ChannelOptions) int {
+	if options.Workers > 0 {
+		return options.Workers
+	}
+	if options.MaxInFlight > 0 {
+		return options.MaxInFlight
+	}
+	return o.Prefetch
+}
@@ -0,0 +1,43 @@
+package amqp
+
+import (
+	"testing"
+
+	"github.com/qp/go"
+	"github.com/qp/go/transporttest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPubSubConformance(t *testing.T) {
+	broker := newFakeBroker()
+	transporttest.PubSub(t, func() qp.PubSubTransport {
+		p := NewPubSub("amqp://fake")
+		p.session.dial = broker.dial
+		return p
+	})
+}
+
+func TestTopic(t *testing.T) {
+
+	assert.Equal(t, "a.b", topic("a.b"))
+	assert.Equal(t, "a.*.c", topic("a.*.c"))
+	assert.Equal(t, "a.*.#", topic("a.>"))
+	assert.Equal(t, "*.#", topic(">"))
+	// only a trailing > is a wildcard
+	assert.Equal(t, "a.>.b", topic("a.>.b"))
+
+	// the binding keys match what the patterns match
+	for _, c := range []struct {
+		pattern, channel string
+	}{
+		{"a.>", "a.b"},
+		{"a.>", "a.b.c"},
+		{"a.>", "a"},
+		{"a.*", "a.b"},
+		{"a.*", "a.b.c"},
+		{">", "a"},
+	} {
+		assert.Equal(t, qp.MatchChannel(c.pattern, c.channel), topicMatch(topic(c.pattern), c.channel), c.pattern+" "+c.channel)
+	}
+
+}
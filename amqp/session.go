@@ -0,0 +1,260 @@
+package amqp
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/slog"
+)
+
+// ErrDisconnected is returned when sending while the transport is
+// not connected to the broker, or loses its connection before the
+// broker confirms the message.
+var ErrDisconnected = errors.New("not connected to the AMQP broker")
+
+// ErrNacked is returned when the broker refuses to take a message.
+var ErrNacked = errors.New("message was not confirmed by the AMQP broker")
+
+// ErrTimeout is returned when the broker does not confirm a message
+// within ConfirmTimeout.
+var ErrTimeout = errors.New("timed out waiting for the AMQP broker to confirm the message")
+
+// ConfirmTimeout is how long Send and Publish wait for the broker
+// to confirm a message.
+var ConfirmTimeout = 5 * time.Second
+
+// connection is the part of *amqp.Connection the transports use.
+type connection interface {
+	Channel() (amqpChannel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// amqpChannel is the part of *amqp.Channel the transports use.
+type amqpChannel interface {
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	Close() error
+}
+
+// dialedConnection adapts *amqp.Connection to connection.
+type dialedConnection struct {
+	*amqp.Connection
+}
+
+func (c dialedConnection) Channel() (amqpChannel, error) {
+	return c.Connection.Channel()
+}
+
+// dial connects to a real broker.
+func dial(url string) (connection, error) {
+	c, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return dialedConnection{c}, nil
+}
+
+// session is a connection to the broker that a transport shares
+// between publishing and its consumers. It reconnects whenever the
+// connection is lost.
+type session struct {
+	url  string
+	dial func(url string) (connection, error)
+	// setup declares whatever publishing needs on each new
+	// connection.
+	setup func(ch amqpChannel) error
+	log   slog.Logger
+
+	lock     sync.Mutex
+	conn     connection
+	changed  chan qp.Signal
+	shutdown chan qp.Signal
+	done     chan qp.Signal
+
+	// publishing guards the channel messages are published on,
+	// which is in confirm mode, and the tag of the last message
+	// published on it.
+	publishing sync.Mutex
+	publisher  amqpChannel
+	confirms   chan amqp.Confirmation
+	tag        uint64
+	declared   map[string]struct{}
+}
+
+func newSession(url string) *session {
+	return &session{
+		url:   url,
+		dial:  dial,
+		setup: func(amqpChannel) error { return nil },
+		log:   slog.NilLogger,
+	}
+}
+
+// start connects to the broker, and keeps reconnecting until stop
+// is called.
+func (s *session) start() error {
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.conn = conn
+	s.changed = make(chan qp.Signal)
+	s.shutdown = make(chan qp.Signal)
+	s.done = make(chan qp.Signal)
+	s.lock.Unlock()
+	go s.run(conn.NotifyClose(make(chan *amqp.Error, 1)))
+	return nil
+}
+
+// stop disconnects from the broker. Consumers must have finished
+// first.
+func (s *session) stop() {
+	close(s.shutdown)
+	<-s.done
+	s.lock.Lock()
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	s.lock.Unlock()
+	s.publishing.Lock()
+	s.publisher = nil
+	s.publishing.Unlock()
+}
+
+// connect dials the broker and opens the channel to publish on.
+func (s *session) connect() (connection, error) {
+	conn, err := s.dial(s.url)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err == nil {
+		err = ch.Confirm(false)
+	}
+	if err == nil {
+		err = s.setup(ch)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.publishing.Lock()
+	s.publisher = ch
+	s.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	s.tag = 0
+	s.declared = make(map[string]struct{})
+	s.publishing.Unlock()
+	return conn, nil
+}
+
+// run waits for the connection to close, and reconnects with a
+// growing delay between attempts.
+func (s *session) run(closed chan *amqp.Error) {
+	defer close(s.done)
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case err := <-closed:
+			if s.log.Warn() {
+				s.log.Warn("lost connection to AMQP broker:", err)
+			}
+		}
+		s.publishing.Lock()
+		s.publisher = nil
+		s.publishing.Unlock()
+		s.change(nil)
+		delay := 50 * time.Millisecond
+		for {
+			select {
+			case <-s.shutdown:
+				return
+			case <-time.After(delay):
+			}
+			conn, err := s.connect()
+			if err == nil {
+				closed = conn.NotifyClose(make(chan *amqp.Error, 1))
+				s.change(conn)
+				if s.log.Warn() {
+					s.log.Warn("reconnected to AMQP broker")
+				}
+				break
+			}
+			if delay < 5*time.Second {
+				delay *= 2
+			}
+		}
+	}
+}
+
+// change replaces the connection, and tells consumers waiting
+// on the old one.
+func (s *session) change(conn connection) {
+	s.lock.Lock()
+	s.conn = conn
+	close(s.changed)
+	s.changed = make(chan qp.Signal)
+	s.lock.Unlock()
+}
+
+// connection gets the current connection, which is nil while
+// disconnected, and a channel that is closed when it changes.
+func (s *session) connection() (connection, <-chan qp.Signal) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.conn, s.changed
+}
+
+// publish publishes the message and waits for the broker to
+// confirm it. If declare is not nil, it is called the first time
+// the key is published to on each connection.
+func (s *session) publish(exchange, key string, data []byte, declare func(ch amqpChannel) error) error {
+	s.publishing.Lock()
+	defer s.publishing.Unlock()
+	if s.publisher == nil {
+		return ErrDisconnected
+	}
+	if _, ok := s.declared[key]; !ok && declare != nil {
+		if err := declare(s.publisher); err != nil {
+			return err
+		}
+		s.declared[key] = struct{}{}
+	}
+	msg := amqp.Publishing{DeliveryMode: amqp.Persistent, Body: data}
+	if err := s.publisher.Publish(exchange, key, false, false, msg); err != nil {
+		return err
+	}
+	s.tag++
+	timeout := time.After(ConfirmTimeout)
+	for {
+		select {
+		case confirm, ok := <-s.confirms:
+			if !ok {
+				return ErrDisconnected
+			}
+			if confirm.DeliveryTag < s.tag {
+				// a message that already timed out
+				continue
+			}
+			if !confirm.Ack {
+				return ErrNacked
+			}
+			return nil
+		case <-timeout:
+			return ErrTimeout
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package composite
+
+import (
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+)
+
+// DirectRoute sends the channels that match the pattern to the
+// transport.
+type DirectRoute struct {
+	Pattern   string
+	Transport qp.DirectTransport
+}
+
+// Direct is a qp.DirectTransport that sends each channel to one of
+// several others.
+type Direct struct {
+	qp.Lifecycle
+	routes routes
+	log    slog.Logger
+}
+
+// ensure the interface is satisfied
+var _ qp.DirectTransport = (*Direct)(nil)
+
+// NewDirect makes a new Direct that sends each channel to the
+// transport of the first route whose pattern it matches, or to the
+// fallback if it matches none. Start and Stop start and stop them
+// all, so they should not be started on their own.
+func NewDirect(fallback qp.DirectTransport, routes ...DirectRoute) *Direct {
+	d := &Direct{log: slog.NilLogger}
+	d.routes.fallback = fallback
+	for _, r := range routes {
+		d.routes.list = append(d.routes.list, route{pattern: r.Pattern, transport: r.Transport})
+	}
+	return d
+}
+
+// SetLogger sets the Logger to log to.
+func (d *Direct) SetLogger(log slog.Logger) {
+	d.log = log
+}
+
+// pick gets the transport the channel goes to.
+func (d *Direct) pick(channel string) qp.DirectTransport {
+	return d.routes.pick(channel).(qp.DirectTransport)
+}
+
+// Send sends data on the channel, with the transport it goes to.
+func (d *Direct) Send(channel string, data []byte) error {
+	if !d.Running() {
+		return qp.ErrNotRunning
+	}
+	return d.pick(channel).Send(channel, data)
+}
+
+// OnMessage binds the handler to the specified channel, on the
+// transport it goes to.
+func (d *Direct) OnMessage(channel string, handler qp.Handler) error {
+	return d.pick(channel).OnMessage(channel, handler)
+}
+
+// RemoveHandler unbinds the handler from the specified channel.
+func (d *Direct) RemoveHandler(channel string) error {
+	return d.pick(channel).RemoveHandler(channel)
+}
+
+// SetChannelOptions sets the options that control how messages on
+// the specified channel are dispatched to its handler, on the
+// transport it goes to.
+func (d *Direct) SetChannelOptions(channel string, options qp.ChannelOptions) error {
+	return setChannelOptions(d.routes.spanning(channel), channel, options)
+}
+
+// Start starts every transport. If one of them fails to start, the
+// others are stopped again and its error is returned.
+func (d *Direct) Start() error {
+	if err := d.BeginStart(); err != nil {
+		return err
+	}
+	if d.log.Info() {
+		d.log.Info("start composite direct")
+	}
+	return d.EndStart(startAll(d.routes.all()))
+}
+
+// Stop stops every transport, giving each of them the grace period
+// to finish handling messages, and closes StopChan() when they have
+// all stopped. It is safe to call Stop more than once.
+func (d *Direct) Stop(grace time.Duration) {
+	if !d.BeginStop() {
+		return
+	}
+	if d.log.Info() {
+		d.log.Info("stop composite direct")
+	}
+	abandoned := stopAll(grace, d.routes.all())
+	if abandoned > 0 && d.log.Warn() {
+		d.log.Warn("abandoned", abandoned, "in-flight handlers")
+	}
+	d.EndStop(abandoned)
+}
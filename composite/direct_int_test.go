@@ -0,0 +1,210 @@
+package composite
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/qp/go/inproc"
+	"github.com/qp/go/transporttest"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+// collect makes a handler that sends messages to the returned
+// channel.
+func collect() (qp.Handler, chan *qp.Message) {
+	msgs := make(chan *qp.Message, 100)
+	return qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	}), msgs
+}
+
+// receive waits for a message.
+func receive(t *testing.T, msgs chan *qp.Message) *qp.Message {
+	select {
+	case msg := <-msgs:
+		return msg
+	case <-time.After(time.Second):
+		require.FailNow(t, "no message")
+	}
+	return nil
+}
+
+// receiveNone fails if a message arrives soon.
+func receiveNone(t *testing.T, msgs chan *qp.Message) {
+	select {
+	case msg := <-msgs:
+		require.FailNow(t, "unexpected message", "%v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDirectConformance(t *testing.T) {
+	routed, fallback := inproc.NewBus(), inproc.NewBus()
+	defer routed.Close()
+	defer fallback.Close()
+	t.Run("Routed", func(t *testing.T) {
+		transporttest.Direct(t, func() qp.DirectTransport {
+			return NewDirect(fallback.NewDirect(), DirectRoute{"transporttest.>", routed.NewDirect()})
+		})
+	})
+	t.Run("Fallback", func(t *testing.T) {
+		transporttest.Direct(t, func() qp.DirectTransport {
+			return NewDirect(fallback.NewDirect(), DirectRoute{"other.>", routed.NewDirect()})
+		})
+	})
+}
+
+func TestDirectRoutes(t *testing.T) {
+
+	audit, cache, fallback := inproc.NewBus(), inproc.NewBus(), inproc.NewBus()
+	defer audit.Close()
+	defer cache.Close()
+	defer fallback.Close()
+	d := NewDirect(fallback.NewDirect(),
+		DirectRoute{"audit.>", audit.NewDirect()},
+		DirectRoute{"cache.*", cache.NewDirect()},
+	)
+	require.NoError(t, d.Start())
+	defer d.Stop(stop.NoWait)
+
+	// a transport on each bus sees only the channels routed to it
+	buses := map[string]*inproc.Bus{"audit.log.entry": audit, "cache.user": cache, "cache.user.name": fallback, "orders": fallback}
+	for channel, bus := range buses {
+		handler, msgs := collect()
+		plain := bus.NewDirect()
+		require.NoError(t, plain.OnMessage(channel, handler))
+		require.NoError(t, plain.Start())
+		require.NoError(t, d.Send(channel, []byte(channel)))
+		require.Equal(t, channel, string(receive(t, msgs).Data))
+		plain.Stop(stop.NoWait)
+	}
+
+}
+
+func TestDirectRequester(t *testing.T) {
+
+	services, fallback := inproc.NewBus(), inproc.NewBus()
+	defer services.Close()
+	defer fallback.Close()
+	d := NewDirect(fallback.NewDirect(), DirectRoute{"service.>", services.NewDirect()})
+
+	// the request goes to the services bus, and the response comes
+	// back on the fallback
+	requester, err := qp.NewRequester("requester", "one", qp.JSON, d)
+	require.NoError(t, err)
+	responder := qp.NewResponder("service", "one", qp.JSON, d)
+	require.NoError(t, responder.HandleFunc("service.echo", func(tx *qp.Transaction) *qp.Transaction {
+		return tx
+	}))
+	require.NoError(t, d.Start())
+	defer d.Stop(stop.NoWait)
+
+	future, err := requester.Issue([]string{"service.echo"}, "hello")
+	require.NoError(t, err)
+	response, err := future.Response(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "hello", response.Data)
+
+}
+
+func TestDirectStartFails(t *testing.T) {
+
+	good, closed := inproc.NewBus(), inproc.NewBus()
+	defer good.Close()
+	closed.Close()
+	fallback := good.NewDirect()
+	d := NewDirect(fallback, DirectRoute{"closed.>", closed.NewDirect()})
+
+	require.Equal(t, qp.ErrNotRunning, d.Start())
+	select {
+	case <-d.StopChan():
+	default:
+		require.FailNow(t, "StopChan should be closed when Start fails")
+	}
+	require.Equal(t, qp.StateStopped, fallback.State())
+
+}
+
+func TestDirectStopWaitsForAll(t *testing.T) {
+
+	routed, fallback := inproc.NewBus(), inproc.NewBus()
+	defer routed.Close()
+	defer fallback.Close()
+	d := NewDirect(fallback.NewDirect(), DirectRoute{"slow.>", routed.NewDirect()})
+	started, release := make(chan struct{}), make(chan struct{})
+	require.NoError(t, d.OnMessage("slow.one", qp.HandlerFunc(func(msg *qp.Message) {
+		close(started)
+		<-release
+	})))
+	require.NoError(t, d.Start())
+	require.NoError(t, d.Send("slow.one", nil))
+	<-started
+
+	go d.Stop(time.Second)
+	select {
+	case <-d.StopChan():
+		require.FailNow(t, "StopChan closed before the routed transport stopped")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-d.StopChan():
+	case <-time.After(time.Second):
+		require.FailNow(t, "transport did not stop")
+	}
+	require.Equal(t, 0, d.Abandoned())
+
+}
+
+// optionsDirect records the channels it is given options for.
+type optionsDirect struct {
+	*inproc.Direct
+	channels []string
+}
+
+func (o *optionsDirect) SetChannelOptions(channel string, options qp.ChannelOptions) error {
+	o.channels = append(o.channels, channel)
+	return o.Direct.SetChannelOptions(channel, options)
+}
+
+func TestDirectChannelOptions(t *testing.T) {
+
+	audit, fallback := inproc.NewBus(), inproc.NewBus()
+	defer audit.Close()
+	defer fallback.Close()
+	routed := &optionsDirect{Direct: audit.NewDirect()}
+	plain := &optionsDirect{Direct: fallback.NewDirect()}
+	d := NewDirect(plain, DirectRoute{"audit.>", routed})
+
+	// each channel's options go to the transport it goes to
+	require.NoError(t, d.SetChannelOptions("audit.log", qp.ChannelOptions{Workers: 1}))
+	require.NoError(t, d.SetChannelOptions("orders", qp.ChannelOptions{Workers: 1}))
+	require.Equal(t, []string{"audit.log"}, routed.channels)
+	require.Equal(t, []string{"orders"}, plain.channels)
+
+	// and are used for its handler
+	started, release := make(chan struct{}, 2), make(chan struct{})
+	require.NoError(t, d.OnMessage("audit.log", qp.HandlerFunc(func(msg *qp.Message) {
+		started <- struct{}{}
+		<-release
+	})))
+	require.NoError(t, d.Start())
+	defer d.Stop(stop.NoWait)
+	require.NoError(t, d.Send("audit.log", nil))
+	require.NoError(t, d.Send("audit.log", nil))
+	<-started
+	select {
+	case <-started:
+		require.FailNow(t, "second message handled while the only worker was busy")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		require.FailNow(t, "second message not handled")
+	}
+
+}
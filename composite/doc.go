@@ -0,0 +1,25 @@
+// Package composite provides transports that send each channel to
+// one of several other transports, chosen by the channel's name, so
+// that one Requester, Responder, Publisher or Subscriber can span
+// several backends.
+//
+// Routes are tried in order, and each channel goes to the transport
+// of the first route whose pattern it matches, or to the fallback:
+//
+//	transport := composite.NewDirect(redis.NewDirect("127.0.0.1:6379"),
+//	  composite.DirectRoute{Pattern: "audit.>", Transport: store.NewDirect()},
+//	  composite.DirectRoute{Pattern: "cache.>", Transport: inproc.NewDirect()},
+//	)
+//	transport.Start()
+//	defer transport.Stop(stop.NoWait)
+//
+// Start and Stop start and stop every transport, and StopChan is
+// closed once they have all stopped. SetChannelOptions is passed on
+// to every transport the channel goes to.
+//
+// A PubSub subscribes to a pattern on every transport that channels
+// matching it go to, so a subscription to "orders.>" gets events
+// from all of them. Each transport only delivers the events on
+// channels that go to it: events published on it directly, on a
+// channel routed elsewhere, are not delivered.
+package composite
@@ -0,0 +1,141 @@
+package composite
+
+import (
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+)
+
+// PubSubRoute sends the channels that match the pattern to the
+// transport.
+type PubSubRoute struct {
+	Pattern   string
+	Transport qp.PubSubTransport
+}
+
+// PubSub is a qp.PubSubTransport that publishes each channel on one
+// of several others.
+type PubSub struct {
+	qp.Lifecycle
+	routes routes
+	log    slog.Logger
+}
+
+// ensure the interface is satisfied
+var _ qp.PubSubTransport = (*PubSub)(nil)
+
+// NewPubSub makes a new PubSub that publishes each channel on the
+// transport of the first route whose pattern it matches, or on the
+// fallback if it matches none. Start and Stop start and stop them
+// all, so they should not be started on their own.
+func NewPubSub(fallback qp.PubSubTransport, routes ...PubSubRoute) *PubSub {
+	p := &PubSub{log: slog.NilLogger}
+	p.routes.fallback = fallback
+	for _, r := range routes {
+		p.routes.list = append(p.routes.list, route{pattern: r.Pattern, transport: r.Transport})
+	}
+	return p
+}
+
+// SetLogger sets the Logger to log to.
+func (p *PubSub) SetLogger(log slog.Logger) {
+	p.log = log
+}
+
+// Publish publishes data on the specified channel, with the
+// transport it goes to.
+func (p *PubSub) Publish(channel string, data []byte) error {
+	if !p.Running() {
+		return qp.ErrNotRunning
+	}
+	return p.routes.pick(channel).(qp.PubSubTransport).Publish(channel, data)
+}
+
+// Subscribe binds the handler to the specified channel. A pattern
+// that matches channels that go to different transports is
+// subscribed to on each of them. Whatever the pattern, the handler
+// only gets the messages each transport carries on the channels
+// that go to it.
+func (p *PubSub) Subscribe(channel string, handler qp.Handler) (qp.Subscription, error) {
+	transports := p.routes.spanning(channel)
+	subscriptions := make([]qp.Subscription, 0, len(transports))
+	for _, transport := range transports {
+		h := p.filter(transport.(qp.PubSubTransport), handler)
+		s, err := transport.(qp.PubSubTransport).Subscribe(channel, h)
+		if err != nil {
+			for _, s := range subscriptions {
+				s.Unsubscribe()
+			}
+			return nil, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+	return qp.SubscriptionFunc(func() error {
+		var first error
+		for _, s := range subscriptions {
+			if err := s.Unsubscribe(); err != nil && first == nil {
+				first = err
+			}
+		}
+		return first
+	}), nil
+}
+
+// filter wraps the handler so that it only gets the messages on
+// channels that go to the transport.
+func (p *PubSub) filter(transport qp.PubSubTransport, handler qp.Handler) qp.Handler {
+	return qp.HandlerFunc(func(msg *qp.Message) {
+		if p.routes.pick(msg.Source) == transport {
+			handler.Handle(msg)
+		}
+	})
+}
+
+// Unsubscribe unbinds all handlers from the specified channel, on
+// every transport it was subscribed to on.
+func (p *PubSub) Unsubscribe(channel string) error {
+	var first error
+	for _, transport := range p.routes.spanning(channel) {
+		if err := transport.(qp.PubSubTransport).Unsubscribe(channel); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// SetChannelOptions sets the options that control how messages on
+// the specified channel are dispatched to its handlers, on every
+// transport it is subscribed to on.
+func (p *PubSub) SetChannelOptions(channel string, options qp.ChannelOptions) error {
+	return setChannelOptions(p.routes.spanning(channel), channel, options)
+}
+
+// Start starts every transport. If one of them fails to start, the
+// others are stopped again and its error is returned.
+func (p *PubSub) Start() error {
+	if err := p.BeginStart(); err != nil {
+		return err
+	}
+	if p.log.Info() {
+		p.log.Info("start composite pubsub")
+	}
+	return p.EndStart(startAll(p.routes.all()))
+}
+
+// Stop stops every transport, giving each of them the grace period
+// to finish handling messages, and closes StopChan() when they have
+// all stopped. It is safe to call Stop more than once.
+func (p *PubSub) Stop(grace time.Duration) {
+	if !p.BeginStop() {
+		return
+	}
+	if p.log.Info() {
+		p.log.Info("stop composite pubsub")
+	}
+	abandoned := stopAll(grace, p.routes.all())
+	if abandoned > 0 && p.log.Warn() {
+		p.log.Warn("abandoned", abandoned, "in-flight handlers")
+	}
+	p.EndStop(abandoned)
+}
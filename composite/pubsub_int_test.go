@@ -0,0 +1,173 @@
+package composite
+
+import (
+	"testing"
+
+	"github.com/qp/go"
+	"github.com/qp/go/inproc"
+	"github.com/qp/go/transporttest"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPubSubConformance(t *testing.T) {
+	routed, fallback := inproc.NewBus(), inproc.NewBus()
+	defer routed.Close()
+	defer fallback.Close()
+	t.Run("Routed", func(t *testing.T) {
+		transporttest.PubSub(t, func() qp.PubSubTransport {
+			return NewPubSub(fallback.NewPubSub(), PubSubRoute{"transporttest.>", routed.NewPubSub()})
+		})
+	})
+	// the conformance channels are split between the transports
+	t.Run("Split", func(t *testing.T) {
+		transporttest.PubSub(t, func() qp.PubSubTransport {
+			return NewPubSub(fallback.NewPubSub(), PubSubRoute{"transporttest.delivery.>", routed.NewPubSub()})
+		})
+	})
+}
+
+func TestPubSubSpans(t *testing.T) {
+
+	audit, fallback := inproc.NewBus(), inproc.NewBus()
+	defer audit.Close()
+	defer fallback.Close()
+	p := NewPubSub(fallback.NewPubSub(), PubSubRoute{"events.audit.>", audit.NewPubSub()})
+	handler, msgs := collect()
+	subscription, err := p.Subscribe("events.>", handler)
+	require.NoError(t, err)
+	require.NoError(t, p.Start())
+	defer p.Stop(stop.NoWait)
+
+	// events from both transports arrive once each
+	require.NoError(t, p.Publish("events.audit.login", []byte("audit")))
+	require.Equal(t, "audit", string(receive(t, msgs).Data))
+	require.NoError(t, p.Publish("events.orders", []byte("orders")))
+	require.Equal(t, "orders", string(receive(t, msgs).Data))
+	receiveNone(t, msgs)
+
+	// an event published on the fallback directly, on a channel
+	// that goes to the audit transport, is not delivered
+	plain := fallback.NewPubSub()
+	require.NoError(t, plain.Start())
+	defer plain.Stop(stop.NoWait)
+	require.NoError(t, plain.Publish("events.audit.login", []byte("stray")))
+	receiveNone(t, msgs)
+
+	require.NoError(t, subscription.Unsubscribe())
+	require.NoError(t, p.Publish("events.audit.login", []byte("audit")))
+	require.NoError(t, p.Publish("events.orders", []byte("orders")))
+	receiveNone(t, msgs)
+
+}
+
+// recordingPubSub records the handlers bound to it, so that tests
+// can deliver messages that a looser broker might.
+type recordingPubSub struct {
+	*inproc.PubSub
+	handlers chan qp.Handler
+}
+
+func (r *recordingPubSub) Subscribe(channel string, handler qp.Handler) (qp.Subscription, error) {
+	r.handlers <- handler
+	return r.PubSub.Subscribe(channel, handler)
+}
+
+func TestPubSubFiltersOneTransport(t *testing.T) {
+
+	audit, fallback := inproc.NewBus(), inproc.NewBus()
+	defer audit.Close()
+	defer fallback.Close()
+	recording := &recordingPubSub{PubSub: fallback.NewPubSub(), handlers: make(chan qp.Handler, 1)}
+	p := NewPubSub(recording, PubSubRoute{"events.audit.>", audit.NewPubSub()})
+	handler, msgs := collect()
+	_, err := p.Subscribe("events.orders.>", handler)
+	require.NoError(t, err)
+	bound := <-recording.handlers
+
+	// a message the fallback carries on a channel that goes to the
+	// audit transport is not delivered, even though the pattern
+	// only spans the fallback
+	bound.Handle(&qp.Message{Source: "events.audit.login", Data: []byte("stray")})
+	receiveNone(t, msgs)
+	bound.Handle(&qp.Message{Source: "events.orders.created", Data: []byte("orders")})
+	require.Equal(t, "orders", string(receive(t, msgs).Data))
+
+}
+
+func TestPubSubUnsubscribeSpans(t *testing.T) {
+
+	audit, fallback := inproc.NewBus(), inproc.NewBus()
+	defer audit.Close()
+	defer fallback.Close()
+	p := NewPubSub(fallback.NewPubSub(), PubSubRoute{"events.audit.>", audit.NewPubSub()})
+	handler, msgs := collect()
+	_, err := p.Subscribe("events.>", handler)
+	require.NoError(t, err)
+	require.NoError(t, p.Start())
+	defer p.Stop(stop.NoWait)
+
+	require.NoError(t, p.Unsubscribe("events.>"))
+	require.NoError(t, p.Publish("events.audit.login", []byte("audit")))
+	require.NoError(t, p.Publish("events.orders", []byte("orders")))
+	receiveNone(t, msgs)
+
+}
+
+// optionsPubSub records the channels it is given options for.
+type optionsPubSub struct {
+	*inproc.PubSub
+	channels []string
+}
+
+func (o *optionsPubSub) SetChannelOptions(channel string, options qp.ChannelOptions) error {
+	o.channels = append(o.channels, channel)
+	return o.PubSub.SetChannelOptions(channel, options)
+}
+
+func TestPubSubChannelOptions(t *testing.T) {
+
+	audit, fallback := inproc.NewBus(), inproc.NewBus()
+	defer audit.Close()
+	defer fallback.Close()
+	routed := &optionsPubSub{PubSub: audit.NewPubSub()}
+	plain := &optionsPubSub{PubSub: fallback.NewPubSub()}
+	p := NewPubSub(plain, PubSubRoute{"events.audit.>", routed})
+
+	// a pattern's options go to every transport it spans, and a
+	// channel's to the one it goes to
+	options := qp.ChannelOptions{Workers: 1}
+	require.NoError(t, p.SetChannelOptions("events.>", options))
+	require.NoError(t, p.SetChannelOptions("events.audit.login", options))
+	require.NoError(t, p.SetChannelOptions("events.orders", options))
+	require.Equal(t, []string{"events.>", "events.audit.login"}, routed.channels)
+	require.Equal(t, []string{"events.>", "events.orders"}, plain.channels)
+
+}
+
+func TestPatterns(t *testing.T) {
+
+	for _, c := range []struct {
+		a, b             string
+		overlaps, covers bool
+	}{
+		{"a.b", "a.b", true, true},
+		{"a.b", "a.c", false, false},
+		{"a.*", "a.b", true, true},
+		{"a.b", "a.*", true, false},
+		{"a.>", "a.b.c", true, true},
+		{"a.>", "a.*", true, true},
+		{"a.*", "a.>", true, false},
+		{"a.>", "a", false, false},
+		{"a", "a.>", false, false},
+		{"a.>", "b.>", false, false},
+		{"*.b", "a.*", true, false},
+		{">", "a.b.>", true, true},
+		{"a.b.>", "a.>", true, false},
+	} {
+		require.Equal(t, c.overlaps, overlaps(c.a, c.b), "overlaps(%q, %q)", c.a, c.b)
+		require.Equal(t, c.overlaps, overlaps(c.b, c.a), "overlaps(%q, %q)", c.b, c.a)
+		require.Equal(t, c.covers, covers(c.a, c.b), "covers(%q, %q)", c.a, c.b)
+	}
+
+}
@@ -0,0 +1,165 @@
+package composite
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/pat/start"
+	"github.com/stretchr/pat/stop"
+)
+
+// route sends the channels that match the pattern to the transport.
+type route struct {
+	pattern   string
+	transport start.StartStopper
+}
+
+// routes picks the transport each channel goes to: the transport of
+// the first route whose pattern the channel matches, or the fallback
+// if there is none.
+type routes struct {
+	list     []route
+	fallback start.StartStopper
+}
+
+// pick gets the transport the channel goes to.
+func (r *routes) pick(channel string) start.StartStopper {
+	for _, route := range r.list {
+		if qp.MatchChannel(route.pattern, channel) {
+			return route.transport
+		}
+	}
+	return r.fallback
+}
+
+// spanning gets the transports that channels matching the pattern
+// may go to.
+func (r *routes) spanning(pattern string) []start.StartStopper {
+	var transports []start.StartStopper
+	for _, route := range r.list {
+		if overlaps(route.pattern, pattern) {
+			transports = appendDistinct(transports, route.transport)
+		}
+		if covers(route.pattern, pattern) {
+			// no channel gets past this route
+			return transports
+		}
+	}
+	return appendDistinct(transports, r.fallback)
+}
+
+// all gets every transport there is a route to, and the fallback.
+func (r *routes) all() []start.StartStopper {
+	transports := []start.StartStopper{r.fallback}
+	for _, route := range r.list {
+		transports = appendDistinct(transports, route.transport)
+	}
+	return transports
+}
+
+// optioner is implemented by transports that dispatch messages
+// according to qp.ChannelOptions.
+type optioner interface {
+	SetChannelOptions(channel string, options qp.ChannelOptions) error
+}
+
+// setChannelOptions sets the options for the channel on each of the
+// transports that take them, and returns the first error.
+func setChannelOptions(transports []start.StartStopper, channel string, options qp.ChannelOptions) error {
+	var first error
+	for _, transport := range transports {
+		if o, ok := transport.(optioner); ok {
+			if err := o.SetChannelOptions(channel, options); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// appendDistinct appends the transport, unless it is already there.
+func appendDistinct(transports []start.StartStopper, transport start.StartStopper) []start.StartStopper {
+	for _, t := range transports {
+		if t == transport {
+			return transports
+		}
+	}
+	return append(transports, transport)
+}
+
+// overlaps gets whether any channel matches both patterns.
+func overlaps(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; ; i++ {
+		switch {
+		case i == len(as) || i == len(bs):
+			return len(as) == len(bs)
+		case i == len(as)-1 && as[i] == ">", i == len(bs)-1 && bs[i] == ">":
+			return true
+		case as[i] != "*" && bs[i] != "*" && as[i] != bs[i]:
+			return false
+		}
+	}
+}
+
+// covers gets whether every channel that matches the pattern also
+// matches the route's pattern.
+func covers(route, pattern string) bool {
+	rs, ps := strings.Split(route, "."), strings.Split(pattern, ".")
+	for i := 0; ; i++ {
+		switch {
+		case i == len(rs) || i == len(ps):
+			return len(rs) == len(ps)
+		case i == len(rs)-1 && rs[i] == ">":
+			return true
+		case i == len(ps)-1 && ps[i] == ">":
+			return false
+		case rs[i] != "*" && (ps[i] == "*" || rs[i] != ps[i]):
+			return false
+		}
+	}
+}
+
+// startAll starts the transports in order. If one of them fails to
+// start, the ones already started are stopped again, and its error
+// is returned.
+func startAll(transports []start.StartStopper) error {
+	for i, transport := range transports {
+		if err := transport.Start(); err != nil {
+			stopAll(stop.NoWait, transports[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+// abandoner is implemented by transports that embed a qp.Lifecycle.
+type abandoner interface {
+	Abandoned() int
+}
+
+// stopAll stops the transports together, giving each of them the
+// grace period, and waits until they have all stopped. It returns
+// the number of in-flight handlers they abandoned, as far as they
+// report it.
+func stopAll(grace time.Duration, transports []start.StartStopper) int {
+	var wg sync.WaitGroup
+	for _, transport := range transports {
+		wg.Add(1)
+		go func(transport start.StartStopper) {
+			defer wg.Done()
+			transport.Stop(grace)
+			<-transport.StopChan()
+		}(transport)
+	}
+	wg.Wait()
+	abandoned := 0
+	for _, transport := range transports {
+		if a, ok := transport.(abandoner); ok {
+			abandoned += a.Abandoned()
+		}
+	}
+	return abandoned
+}
@@ -0,0 +1,172 @@
+package disk
+
+import (
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+)
+
+// Direct represents a qp.DirectTransport. Messages sent wait in the
+// log until a handler on a running Direct of the same Store has
+// finished with them.
+type Direct struct {
+	qp.Lifecycle
+	store       *Store
+	lock        sync.RWMutex
+	handlers    map[string]qp.Handler
+	options     map[string]qp.ChannelOptions
+	dispatchers map[string]*qp.Dispatcher
+	log         slog.Logger
+}
+
+// ensure the interface is satisfied
+var _ qp.DirectTransport = (*Direct)(nil)
+
+// NewDirect makes a new Direct on the Store.
+func (s *Store) NewDirect() *Direct {
+	return &Direct{
+		store:       s,
+		handlers:    make(map[string]qp.Handler),
+		options:     make(map[string]qp.ChannelOptions),
+		dispatchers: make(map[string]*qp.Dispatcher),
+		log:         slog.NilLogger,
+	}
+}
+
+// SetLogger sets the Logger to log to.
+func (d *Direct) SetLogger(log slog.Logger) {
+	d.log = log
+}
+
+// Send sends data on the channel. It returns once the message is in
+// the log, and synced to disk if the Store's Sync is SyncAlways, or
+// ErrFull if the Store's MaxSize has been reached.
+func (d *Direct) Send(channel string, data []byte) error {
+	if !d.Running() {
+		return qp.ErrNotRunning
+	}
+	if d.log.Info() {
+		d.log.Info("sending to", channel, string(data))
+	}
+	if err := d.store.send(recSend, channel, data); err != nil {
+		if d.log.Err() {
+			d.log.Err("send failed", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// OnMessage binds the handler to the specified channel.
+func (d *Direct) OnMessage(channel string, handler qp.Handler) error {
+	if d.log.Info() {
+		d.log.Info("listening to", channel)
+	}
+	d.lock.Lock()
+	d.handlers[channel] = handler
+	d.setDispatcher(channel)
+	d.lock.Unlock()
+	d.store.wakeDirect(channel)
+	return nil
+}
+
+// RemoveHandler unbinds the handler from the specified channel.
+// Messages sent on the channel from then on wait in the log for
+// another handler.
+func (d *Direct) RemoveHandler(channel string) error {
+	if d.log.Info() {
+		d.log.Info("no longer listening to", channel)
+	}
+	d.lock.Lock()
+	delete(d.handlers, channel)
+	if dispatcher, ok := d.dispatchers[channel]; ok {
+		dispatcher.Close()
+		delete(d.dispatchers, channel)
+	}
+	d.lock.Unlock()
+	return nil
+}
+
+// SetChannelOptions sets the options that control how messages
+// on the specified channel are dispatched to its handler.
+func (d *Direct) SetChannelOptions(channel string, options qp.ChannelOptions) error {
+	d.lock.Lock()
+	d.options[channel] = options
+	_, ok := d.handlers[channel]
+	if ok {
+		d.setDispatcher(channel)
+	}
+	d.lock.Unlock()
+	if ok {
+		d.store.wakeDirect(channel)
+	}
+	return nil
+}
+
+// setDispatcher replaces the dispatcher for the channel.
+// Callers must hold the lock.
+func (d *Direct) setDispatcher(channel string) {
+	if dispatcher, ok := d.dispatchers[channel]; ok {
+		dispatcher.Close()
+	}
+	d.dispatchers[channel] = qp.NewDispatcher(d.store.wrap(d.handlers[channel]), d.options[channel])
+}
+
+// Start starts taking messages for the handlers, beginning with
+// those already waiting in the log.
+// A stopped transport may be started again.
+func (d *Direct) Start() error {
+	if err := d.BeginStart(); err != nil {
+		return err
+	}
+	if d.store.closed() {
+		return d.EndStart(qp.ErrNotRunning)
+	}
+	if d.log.Info() {
+		d.log.Info("starting")
+	}
+	d.lock.Lock()
+	for channel := range d.handlers {
+		d.setDispatcher(channel)
+	}
+	d.lock.Unlock()
+	d.store.addDirect(d)
+	return d.EndStart(nil)
+}
+
+// Stop stops the transport and closes StopChan() when finished.
+//
+// No new messages are taken once Stop is called, and messages
+// already being handled have the grace period to finish before
+// they are abandoned. Abandoned messages stay in the log, and are
+// handed on again when the Store is next opened.
+// It is safe to call Stop more than once.
+func (d *Direct) Stop(grace time.Duration) {
+	if !d.BeginStop() {
+		return
+	}
+	if d.log.Info() {
+		d.log.Info("stopping...")
+	}
+	d.store.removeDirect(d)
+	d.lock.RLock()
+	dispatchers := make([]*qp.Dispatcher, 0, len(d.dispatchers))
+	for _, dispatcher := range d.dispatchers {
+		dispatchers = append(dispatchers, dispatcher)
+	}
+	d.lock.RUnlock()
+	abandoned := qp.Drain(grace, dispatchers...)
+	for _, dispatcher := range dispatchers {
+		dispatcher.Close()
+	}
+	if abandoned > 0 && d.log.Warn() {
+		d.log.Warn("abandoned", abandoned, "in-flight handlers")
+	}
+	// inform caller of stop complete
+	d.EndStop(abandoned)
+	if d.log.Info() {
+		d.log.Info("stopped")
+	}
+}
@@ -0,0 +1,190 @@
+package disk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/qp/go/transporttest"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+// openStore opens a Store in a new directory, and makes a func that
+// closes it and removes the directory.
+func openStore(t *testing.T) (*Store, string, func()) {
+	dir, remove := tempDir(t)
+	s, err := Open(dir)
+	require.NoError(t, err)
+	return s, dir, func() {
+		s.Close()
+		remove()
+	}
+}
+
+func TestDirectConformance(t *testing.T) {
+	s, _, done := openStore(t)
+	defer done()
+	transporttest.Direct(t, func() qp.DirectTransport {
+		return s.NewDirect()
+	})
+}
+
+func TestDirectNotRunningAfterClose(t *testing.T) {
+
+	s, _, done := openStore(t)
+	defer done()
+	d := s.NewDirect()
+	require.NoError(t, d.Start())
+	defer d.Stop(stop.NoWait)
+	require.NoError(t, s.Close())
+	require.Equal(t, qp.ErrNotRunning, d.Send("closed", []byte("one")))
+
+}
+
+func TestDirectDurable(t *testing.T) {
+
+	s, dir, done := openStore(t)
+	defer done()
+	sender := s.NewDirect()
+	require.NoError(t, sender.Start())
+	require.NoError(t, sender.Send("durable", []byte("one")))
+	require.NoError(t, sender.Send("durable", []byte("two")))
+	sender.Stop(stop.NoWait)
+	require.NoError(t, s.Close())
+
+	// the messages wait in the log for a handler
+	s, err := Open(dir)
+	require.NoError(t, err)
+	defer s.Close()
+	msgs := make(chan *qp.Message, 10)
+	d := s.NewDirect()
+	require.NoError(t, d.SetChannelOptions("durable", qp.ChannelOptions{Workers: 1}))
+	require.NoError(t, d.OnMessage("durable", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	})))
+	require.NoError(t, d.Start())
+	defer d.Stop(stop.NoWait)
+	for _, data := range []string{"one", "two"} {
+		select {
+		case msg := <-msgs:
+			require.Equal(t, "durable", msg.Source)
+			require.Equal(t, data, string(msg.Data))
+		case <-time.After(1 * time.Second):
+			require.FailNow(t, "waiting message not received")
+		}
+	}
+
+}
+
+func TestDirectAbandonedRedelivered(t *testing.T) {
+
+	s, dir, done := openStore(t)
+	defer done()
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan *qp.Message, 1)
+	first := s.NewDirect()
+	require.NoError(t, first.OnMessage("abandoned", qp.HandlerFunc(func(msg *qp.Message) {
+		started <- msg
+		<-release
+	})))
+	require.NoError(t, first.Start())
+	require.NoError(t, first.Send("abandoned", []byte("one")))
+	<-started
+	first.Stop(10 * time.Millisecond)
+	<-first.StopChan()
+	require.Equal(t, 1, first.Abandoned())
+	require.NoError(t, s.Close())
+
+	// the message was never handled, so it is handed on again
+	s, err := Open(dir)
+	require.NoError(t, err)
+	defer s.Close()
+	msgs := make(chan *qp.Message, 1)
+	second := s.NewDirect()
+	require.NoError(t, second.OnMessage("abandoned", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	})))
+	require.NoError(t, second.Start())
+	defer second.Stop(stop.NoWait)
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "one", string(msg.Data))
+	case <-time.After(1 * time.Second):
+		require.FailNow(t, "message was not delivered again")
+	}
+
+}
+
+func TestDirectHandledNotRedelivered(t *testing.T) {
+
+	s, dir, done := openStore(t)
+	defer done()
+	msgs := make(chan *qp.Message, 10)
+	d := s.NewDirect()
+	require.NoError(t, d.OnMessage("handled", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	})))
+	require.NoError(t, d.Start())
+	require.NoError(t, d.Send("handled", []byte("one")))
+	<-msgs
+	d.Stop(1 * time.Second)
+	<-d.StopChan()
+	require.NoError(t, s.Close())
+
+	s, err := Open(dir)
+	require.NoError(t, err)
+	defer s.Close()
+	d = s.NewDirect()
+	require.NoError(t, d.OnMessage("handled", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	})))
+	require.NoError(t, d.Start())
+	defer d.Stop(stop.NoWait)
+	select {
+	case msg := <-msgs:
+		require.FailNow(t, "handled message delivered again", string(msg.Data))
+	case <-time.After(100 * time.Millisecond):
+	}
+
+}
+
+func TestDirectFull(t *testing.T) {
+
+	dir, remove := tempDir(t)
+	defer remove()
+	size := int64(len(encodeRecord(recSend, 1, "full", []byte("message"))))
+	s, err := OpenOptions(dir, Options{MaxSize: 2 * size})
+	require.NoError(t, err)
+	defer s.Close()
+	d := s.NewDirect()
+	require.NoError(t, d.Start())
+	defer d.Stop(stop.NoWait)
+
+	// with no handler the messages wait, up to the maximum size
+	require.NoError(t, d.Send("full", []byte("message")))
+	require.NoError(t, d.Send("full", []byte("message")))
+	require.Equal(t, ErrFull, d.Send("full", []byte("message")))
+
+	// once they have been handled there is room again
+	handled := make(chan *qp.Message, 2)
+	require.NoError(t, d.OnMessage("full", qp.HandlerFunc(func(msg *qp.Message) {
+		handled <- msg
+	})))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-handled:
+		case <-time.After(1 * time.Second):
+			require.FailNow(t, "waiting message not received")
+		}
+	}
+	// messages are acked once their handlers return
+	err = d.Send("full", []byte("message"))
+	for deadline := time.Now().Add(time.Second); err == ErrFull && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+		err = d.Send("full", []byte("message"))
+	}
+	require.NoError(t, err)
+
+}
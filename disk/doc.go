@@ -0,0 +1,39 @@
+// Package disk provides transports that keep their messages in a
+// log on local disk, so that they outlive the process without an
+// external server.
+//
+// Transports are made from a Store, which holds the log for a
+// directory and carries messages between the transports made from
+// it, as an inproc Bus does:
+//
+//	s, err := disk.Open("/var/lib/myservice/qp")
+//	if err != nil {
+//		return err
+//	}
+//	defer s.Close()
+//
+//	d := s.NewDirect()
+//	p := s.NewPubSub()
+//
+// Send and Publish append the message to the log, and it stays
+// there until every handler it was handed to has returned. When the
+// Store is opened again after the process stopped, messages that
+// were waiting or being handled are handed on again, so each is
+// handled at least once. Messages sent on a channel with no handler
+// wait until there is one, and messages published are handed to the
+// subscriptions on the PubSubs running at the time.
+//
+// The log is split into segment files. Options.Sync chooses whether
+// each record is synced to disk before Send or Publish returns,
+// every so often, or whenever the operating system chooses. A
+// record that was only partly written when the process or machine
+// stopped is cut off when the log is opened. Segments are deleted
+// once all of their messages have been handled, and compacted in the
+// background when most of them have.
+//
+// Messages that have not been handled are also kept in memory, and
+// Options.MaxSize bounds how much room they may take: once it is
+// reached, Send and Publish return ErrFull until handlers catch up.
+// Published messages wait while no PubSub is running, so they count
+// towards it too.
+package disk
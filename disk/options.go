@@ -0,0 +1,72 @@
+package disk
+
+import "time"
+
+// Sync is when a Store makes sure the records it writes are on
+// disk, rather than only in the operating system's cache.
+type Sync int
+
+const (
+	// SyncAlways syncs each record before Send or Publish returns, so
+	// that no message they accepted is lost, even if the machine
+	// crashes.
+	SyncAlways Sync = iota
+	// SyncPeriodic syncs every SyncInterval, so messages accepted
+	// since the last sync are lost if the machine crashes, but not
+	// if only the process does.
+	SyncPeriodic
+	// SyncNever leaves the operating system to write records out
+	// when it chooses.
+	SyncNever
+)
+
+// Options controls how a Store keeps its log.
+type Options struct {
+	// Sync is when records are synced to disk. The zero value is
+	// SyncAlways.
+	Sync Sync
+	// SyncInterval is how often records are synced under
+	// SyncPeriodic. Zero means DefaultSyncInterval.
+	SyncInterval time.Duration
+	// SegmentSize is the size, in bytes, a segment file may grow to
+	// before the Store starts a new one. Zero means
+	// DefaultSegmentSize.
+	SegmentSize int64
+	// MaxSize is the size, in bytes, the records of the messages
+	// waiting in the log may add up to. Waiting messages are kept in
+	// memory as well as in the log, so this also bounds the memory
+	// they take. Send and Publish return ErrFull rather than go
+	// over it. Zero means DefaultMaxSize.
+	MaxSize int64
+}
+
+// the defaults used when Options does not set a value
+const (
+	DefaultSyncInterval = 1 * time.Second
+	DefaultSegmentSize  = 16 << 20
+	DefaultMaxSize      = 256 << 20
+)
+
+// syncInterval gets how often to sync under SyncPeriodic.
+func (o Options) syncInterval() time.Duration {
+	if o.SyncInterval == 0 {
+		return DefaultSyncInterval
+	}
+	return o.SyncInterval
+}
+
+// segmentSize gets the size segment files may grow to.
+func (o Options) segmentSize() int64 {
+	if o.SegmentSize == 0 {
+		return DefaultSegmentSize
+	}
+	return o.SegmentSize
+}
+
+// maxSize gets the size waiting messages may add up to.
+func (o Options) maxSize() int64 {
+	if o.MaxSize == 0 {
+		return DefaultMaxSize
+	}
+	return o.MaxSize
+}
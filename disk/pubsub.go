@@ -0,0 +1,191 @@
+package disk
+
+import (
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+)
+
+// PubSub represents a qp.PubSubTransport. Messages published go to
+// every matching subscription on the running PubSubs of the same
+// Store, and wait in the log until those handlers have finished with
+// them.
+type PubSub struct {
+	qp.Lifecycle
+	store         *Store
+	lock          sync.RWMutex
+	subscriptions map[string][]*subscription
+	options       map[string]qp.ChannelOptions
+	log           slog.Logger
+}
+
+// subscription is a single handler bound to a channel.
+type subscription struct {
+	handler    qp.Handler
+	dispatcher *qp.Dispatcher
+}
+
+// ensure the interface is satisfied
+var _ qp.PubSubTransport = (*PubSub)(nil)
+
+// NewPubSub makes a new PubSub on the Store.
+func (s *Store) NewPubSub() *PubSub {
+	return &PubSub{
+		store:         s,
+		subscriptions: make(map[string][]*subscription),
+		options:       make(map[string]qp.ChannelOptions),
+		log:           slog.NilLogger,
+	}
+}
+
+// SetLogger sets the Logger to log to.
+func (p *PubSub) SetLogger(log slog.Logger) {
+	p.log = log
+}
+
+// Publish publishes data on the specified channel. It returns once
+// the message is in the log, and synced to disk if the Store's Sync
+// is SyncAlways, or ErrFull if the Store's MaxSize has been reached.
+func (p *PubSub) Publish(channel string, data []byte) error {
+	if !p.Running() {
+		return qp.ErrNotRunning
+	}
+	if p.log.Info() {
+		p.log.Info("publish to", channel, string(data))
+	}
+	if err := p.store.send(recPublish, channel, data); err != nil {
+		if p.log.Err() {
+			p.log.Err("publish failed", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// Subscribe binds the handler to the specified channel.
+func (p *PubSub) Subscribe(channel string, handler qp.Handler) (qp.Subscription, error) {
+	if p.log.Info() {
+		p.log.Info("subscribing to", channel)
+	}
+	p.lock.Lock()
+	s := &subscription{
+		handler:    handler,
+		dispatcher: qp.NewDispatcher(p.store.wrap(handler), p.options[channel]),
+	}
+	p.subscriptions[channel] = append(p.subscriptions[channel], s)
+	p.lock.Unlock()
+	return qp.SubscriptionFunc(func() error {
+		p.remove(channel, s)
+		return nil
+	}), nil
+}
+
+// remove unbinds a single subscription from the channel.
+func (p *PubSub) remove(channel string, s *subscription) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	subscriptions := p.subscriptions[channel]
+	for i, existing := range subscriptions {
+		if existing == s {
+			s.dispatcher.Close()
+			subscriptions = append(subscriptions[:i:i], subscriptions[i+1:]...)
+			break
+		}
+	}
+	if len(subscriptions) == 0 {
+		delete(p.subscriptions, channel)
+	} else {
+		p.subscriptions[channel] = subscriptions
+	}
+}
+
+// Unsubscribe unbinds all handlers from the specified channel.
+func (p *PubSub) Unsubscribe(channel string) error {
+	if p.log.Info() {
+		p.log.Info("unsubscribing from", channel)
+	}
+	p.lock.Lock()
+	for _, s := range p.subscriptions[channel] {
+		s.dispatcher.Close()
+	}
+	delete(p.subscriptions, channel)
+	p.lock.Unlock()
+	return nil
+}
+
+// SetChannelOptions sets the options that control how messages
+// on the specified channel are dispatched to its handlers.
+func (p *PubSub) SetChannelOptions(channel string, options qp.ChannelOptions) error {
+	p.lock.Lock()
+	p.options[channel] = options
+	for _, s := range p.subscriptions[channel] {
+		s.dispatcher.Close()
+		s.dispatcher = qp.NewDispatcher(p.store.wrap(s.handler), options)
+	}
+	p.lock.Unlock()
+	return nil
+}
+
+// Start starts handing on published messages, beginning with those
+// left in the log when the Store was opened.
+// A stopped transport may be started again.
+func (p *PubSub) Start() error {
+	if err := p.BeginStart(); err != nil {
+		return err
+	}
+	if p.store.closed() {
+		return p.EndStart(qp.ErrNotRunning)
+	}
+	if p.log.Info() {
+		p.log.Info("starting")
+	}
+	p.lock.Lock()
+	for channel, subscriptions := range p.subscriptions {
+		for _, s := range subscriptions {
+			s.dispatcher.Close()
+			s.dispatcher = qp.NewDispatcher(p.store.wrap(s.handler), p.options[channel])
+		}
+	}
+	p.lock.Unlock()
+	p.store.addPubSub(p)
+	return p.EndStart(nil)
+}
+
+// Stop stops the transport and closes StopChan() when finished.
+//
+// No new messages are taken once Stop is called, and messages
+// already being handled have the grace period to finish before
+// they are abandoned. Abandoned messages stay in the log, and are
+// handed on again when the Store is next opened.
+// It is safe to call Stop more than once.
+func (p *PubSub) Stop(grace time.Duration) {
+	if !p.BeginStop() {
+		return
+	}
+	if p.log.Info() {
+		p.log.Info("stopping...")
+	}
+	p.store.removePubSub(p)
+	var dispatchers []*qp.Dispatcher
+	p.lock.RLock()
+	for _, subscriptions := range p.subscriptions {
+		for _, s := range subscriptions {
+			dispatchers = append(dispatchers, s.dispatcher)
+		}
+	}
+	p.lock.RUnlock()
+	abandoned := qp.Drain(grace, dispatchers...)
+	for _, dispatcher := range dispatchers {
+		dispatcher.Close()
+	}
+	if abandoned > 0 && p.log.Warn() {
+		p.log.Warn("abandoned", abandoned, "in-flight handlers")
+	}
+	// inform caller of stop complete
+	p.EndStop(abandoned)
+	if p.log.Info() {
+		p.log.Info("stopped")
+	}
+}
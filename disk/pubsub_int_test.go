@@ -0,0 +1,70 @@
+package disk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/qp/go/transporttest"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPubSubConformance(t *testing.T) {
+	for name, sync := range map[string]Sync{"SyncAlways": SyncAlways, "SyncPeriodic": SyncPeriodic} {
+		sync := sync
+		t.Run(name, func(t *testing.T) {
+			dir, remove := tempDir(t)
+			defer remove()
+			s, err := OpenOptions(dir, Options{Sync: sync, SyncInterval: 10 * time.Millisecond})
+			require.NoError(t, err)
+			defer s.Close()
+			transporttest.PubSub(t, func() qp.PubSubTransport {
+				return s.NewPubSub()
+			})
+		})
+	}
+}
+
+func TestPubSubAbandonedRedelivered(t *testing.T) {
+
+	s, dir, done := openStore(t)
+	defer done()
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan *qp.Message, 1)
+	first := s.NewPubSub()
+	_, err := first.Subscribe("events.*", qp.HandlerFunc(func(msg *qp.Message) {
+		started <- msg
+		<-release
+	}))
+	require.NoError(t, err)
+	require.NoError(t, first.Start())
+	require.NoError(t, first.Publish("events.created", []byte("one")))
+	<-started
+	first.Stop(10 * time.Millisecond)
+	<-first.StopChan()
+	require.Equal(t, 1, first.Abandoned())
+	require.NoError(t, s.Close())
+
+	// the message is handed on once a PubSub starts
+	s, err = Open(dir)
+	require.NoError(t, err)
+	defer s.Close()
+	msgs := make(chan *qp.Message, 1)
+	second := s.NewPubSub()
+	_, err = second.Subscribe("events.created", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	}))
+	require.NoError(t, err)
+	require.NoError(t, second.Start())
+	defer second.Stop(stop.NoWait)
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "events.created", msg.Source)
+		require.Equal(t, "one", string(msg.Data))
+	case <-time.After(1 * time.Second):
+		require.FailNow(t, "message was not delivered again")
+	}
+
+}
@@ -0,0 +1,437 @@
+package disk
+
+import (
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+)
+
+// Store keeps messages in a log on disk, and carries them between
+// the transports made from it. Messages wait in the log until their
+// handlers have returned, so those that were waiting, or being
+// handled, when the process stopped are handed on again once the
+// Store is opened again.
+//
+// Only one Store may have a directory open at a time.
+type Store struct {
+	wal  *wal
+	quit chan qp.Signal
+	once sync.Once
+	log  slog.Logger
+	// compactor is done once the goroutine compacting the log has
+	// returned.
+	compactor sync.WaitGroup
+
+	lock sync.Mutex
+	// queues holds the messages sent on each channel that have not
+	// yet been handed to a handler, and events those published.
+	queues map[string]*queue
+	events *queue
+	// pending holds the messages handed to handlers, and the number
+	// of handlers that have yet to return.
+	pending map[*qp.Message]*delivery
+
+	directLock sync.RWMutex
+	// directInstances holds the running Direct instances in the
+	// order they started, and directNext holds the position of the
+	// next instance to take a message from each channel.
+	directInstances []*Direct
+	directNext      map[string]int
+
+	pubSubLock      sync.RWMutex
+	pubSubInstances map[*PubSub]struct{}
+}
+
+// queue is the messages waiting to be handed on, oldest first.
+type queue struct {
+	entries []*entry
+	wake    chan qp.Signal
+}
+
+// delivery is a message being handled.
+type delivery struct {
+	entry    *entry
+	handlers int
+}
+
+var exists = struct{}{}
+
+// Open opens the Store in the directory, creating the directory if
+// it does not exist, with the default options.
+func Open(dir string) (*Store, error) {
+	return OpenOptions(dir, Options{})
+}
+
+// OpenOptions opens the Store in the directory, creating the
+// directory if it does not exist, with the specified options. The
+// log is replayed, so that the messages in it are handed on again
+// once there are handlers for them.
+func OpenOptions(dir string, options Options) (*Store, error) {
+	w, waiting, err := openWAL(dir, options)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		wal:             w,
+		quit:            make(chan qp.Signal),
+		log:             slog.NilLogger,
+		queues:          make(map[string]*queue),
+		events:          newQueue(),
+		pending:         make(map[*qp.Message]*delivery),
+		directNext:      make(map[string]int),
+		pubSubInstances: make(map[*PubSub]struct{}),
+	}
+	for _, e := range waiting {
+		s.enqueue(e)
+	}
+	go s.processPubSub()
+	s.compactor.Add(1)
+	go s.compactWhenDue()
+	if options.Sync == SyncPeriodic {
+		go s.syncEvery(options.syncInterval())
+	}
+	return s, nil
+}
+
+// SetLogger sets the Logger to log to.
+func (s *Store) SetLogger(log slog.Logger) {
+	s.log = log
+}
+
+// Close syncs and closes the log. Transports on a closed Store
+// cannot be started, and sending on them returns qp.ErrNotRunning.
+// Messages that have not been handled stay in the log for the next
+// time it is opened.
+// It is safe to call Close more than once.
+func (s *Store) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.quit)
+		s.compactor.Wait()
+		err = s.wal.close()
+	})
+	return err
+}
+
+// closed gets whether the Store has been closed.
+func (s *Store) closed() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func newQueue() *queue {
+	return &queue{wake: make(chan qp.Signal, 1)}
+}
+
+// signal wakes the goroutine handing on the queue's messages.
+func (q *queue) signal() {
+	select {
+	case q.wake <- qp.Signal{}:
+	default:
+	}
+}
+
+// send writes a message to the log, then queues it to be handed on.
+func (s *Store) send(op byte, channel string, data []byte) error {
+	if s.closed() {
+		return qp.ErrNotRunning
+	}
+	e, err := s.wal.append(op, channel, data)
+	if err != nil {
+		return err
+	}
+	s.enqueue(e)
+	return nil
+}
+
+// enqueue adds the message to the back of its queue.
+func (s *Store) enqueue(e *entry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	q := s.events
+	if e.op == recSend {
+		q = s.queue(e.channel)
+	}
+	q.entries = append(q.entries, e)
+	q.signal()
+}
+
+// queue gets the queue for the channel, starting a goroutine to hand
+// on its messages if there was not one already.
+// Callers must hold the lock.
+func (s *Store) queue(channel string) *queue {
+	q, ok := s.queues[channel]
+	if !ok {
+		q = newQueue()
+		s.queues[channel] = q
+		go s.processDirect(channel, q)
+	}
+	return q
+}
+
+// wakeDirect wakes the goroutine handing on the channel's messages,
+// now that there may be a handler for them.
+func (s *Store) wakeDirect(channel string) {
+	s.lock.Lock()
+	if q, ok := s.queues[channel]; ok {
+		q.signal()
+	}
+	s.lock.Unlock()
+}
+
+// wakePubSub wakes the goroutine handing on published messages, now
+// that there may be a running PubSub.
+func (s *Store) wakePubSub() {
+	s.events.signal()
+}
+
+// take gets the oldest message in the queue once pick gets a
+// dispatcher to hand it to, waiting until then. It returns false if
+// the Store is closed while waiting.
+func (s *Store) take(q *queue, pick func(e *entry) []*qp.Dispatcher) (*entry, []*qp.Dispatcher, bool) {
+	for {
+		s.lock.Lock()
+		if len(q.entries) > 0 {
+			e := q.entries[0]
+			if dispatchers := pick(e); dispatchers != nil {
+				q.entries[0] = nil
+				q.entries = q.entries[1:]
+				s.lock.Unlock()
+				return e, dispatchers, true
+			}
+		}
+		s.lock.Unlock()
+		select {
+		case <-q.wake:
+		case <-s.quit:
+			return nil, nil, false
+		}
+	}
+}
+
+func (s *Store) processDirect(channel string, q *queue) {
+	pick := func(e *entry) []*qp.Dispatcher {
+		if d := s.nextDirect(channel); d != nil {
+			return []*qp.Dispatcher{d}
+		}
+		return nil
+	}
+	for {
+		e, dispatchers, ok := s.take(q, pick)
+		if !ok {
+			return
+		}
+		msg := s.track(e, 1)
+		// blocks the queue while the channel is at capacity
+		if err := dispatchers[0].Dispatch(msg); err != nil {
+			// the handler went away, so the message goes back to wait
+			// for the next one
+			s.untrack(msg)
+			s.lock.Lock()
+			q.entries = append([]*entry{e}, q.entries...)
+			s.lock.Unlock()
+		}
+	}
+}
+
+// nextDirect picks the dispatcher of the instance that should
+// take the next message from the channel. Each message goes to
+// exactly one instance, and the instances handling a channel take
+// turns.
+// Callers must hold the lock.
+func (s *Store) nextDirect(channel string) *qp.Dispatcher {
+	var dispatchers []*qp.Dispatcher
+	s.directLock.RLock()
+	defer s.directLock.RUnlock()
+	for _, instance := range s.directInstances {
+		instance.lock.RLock()
+		if d, ok := instance.dispatchers[channel]; ok {
+			dispatchers = append(dispatchers, d)
+		}
+		instance.lock.RUnlock()
+	}
+	if len(dispatchers) == 0 {
+		delete(s.directNext, channel)
+		return nil
+	}
+	next := s.directNext[channel] % len(dispatchers)
+	s.directNext[channel] = next + 1
+	return dispatchers[next]
+}
+
+func (s *Store) addDirect(d *Direct) {
+	s.directLock.Lock()
+	s.directInstances = append(s.directInstances, d)
+	s.directLock.Unlock()
+	d.lock.RLock()
+	channels := make([]string, 0, len(d.dispatchers))
+	for channel := range d.dispatchers {
+		channels = append(channels, channel)
+	}
+	d.lock.RUnlock()
+	for _, channel := range channels {
+		s.wakeDirect(channel)
+	}
+}
+
+func (s *Store) removeDirect(d *Direct) {
+	s.directLock.Lock()
+	for i, instance := range s.directInstances {
+		if instance == d {
+			s.directInstances = append(s.directInstances[:i:i], s.directInstances[i+1:]...)
+			break
+		}
+	}
+	s.directLock.Unlock()
+}
+
+func (s *Store) processPubSub() {
+	pick := func(e *entry) []*qp.Dispatcher {
+		s.pubSubLock.RLock()
+		running := len(s.pubSubInstances) > 0
+		s.pubSubLock.RUnlock()
+		if !running {
+			// wait for a PubSub to start, as none would be after a
+			// restart
+			return nil
+		}
+		// no matching subscriptions still means the message is taken
+		return append([]*qp.Dispatcher{}, s.matchPubSub(e.channel)...)
+	}
+	for {
+		e, dispatchers, ok := s.take(s.events, pick)
+		if !ok {
+			return
+		}
+		// the extra handler keeps the message from being acked until
+		// it has been handed to them all
+		msg := s.track(e, len(dispatchers)+1)
+		for _, d := range dispatchers {
+			// blocks the queue while a channel is at capacity
+			if err := d.Dispatch(msg); err != nil {
+				s.handled(msg)
+			}
+		}
+		s.handled(msg)
+	}
+}
+
+// matchPubSub gets the dispatchers of every subscription, on every
+// running instance, whose channel matches.
+func (s *Store) matchPubSub(channel string) []*qp.Dispatcher {
+	var dispatchers []*qp.Dispatcher
+	s.pubSubLock.RLock()
+	defer s.pubSubLock.RUnlock()
+	for instance := range s.pubSubInstances {
+		instance.lock.RLock()
+		for pattern, subscriptions := range instance.subscriptions {
+			if !qp.MatchChannel(pattern, channel) {
+				continue
+			}
+			for _, sub := range subscriptions {
+				dispatchers = append(dispatchers, sub.dispatcher)
+			}
+		}
+		instance.lock.RUnlock()
+	}
+	return dispatchers
+}
+
+func (s *Store) addPubSub(p *PubSub) {
+	s.pubSubLock.Lock()
+	s.pubSubInstances[p] = exists
+	s.pubSubLock.Unlock()
+	s.wakePubSub()
+}
+
+func (s *Store) removePubSub(p *PubSub) {
+	s.pubSubLock.Lock()
+	delete(s.pubSubInstances, p)
+	s.pubSubLock.Unlock()
+}
+
+// track makes the message to hand to the handlers, and remembers
+// how many must return before it is acked.
+func (s *Store) track(e *entry, handlers int) *qp.Message {
+	msg := &qp.Message{Source: e.channel, Data: e.data}
+	s.lock.Lock()
+	s.pending[msg] = &delivery{entry: e, handlers: handlers}
+	s.lock.Unlock()
+	return msg
+}
+
+// untrack forgets a message that could not be handed on.
+func (s *Store) untrack(msg *qp.Message) {
+	s.lock.Lock()
+	delete(s.pending, msg)
+	s.lock.Unlock()
+}
+
+// wrap makes a handler that tells the Store when the handler has
+// returned.
+func (s *Store) wrap(handler qp.Handler) qp.Handler {
+	return qp.HandlerFunc(func(msg *qp.Message) {
+		handler.Handle(msg)
+		s.handled(msg)
+	})
+}
+
+// handled records that one of the message's handlers has returned,
+// and acks the message once they all have.
+func (s *Store) handled(msg *qp.Message) {
+	s.lock.Lock()
+	d, ok := s.pending[msg]
+	if ok {
+		d.handlers--
+		if d.handlers > 0 {
+			ok = false
+		} else {
+			delete(s.pending, msg)
+		}
+	}
+	s.lock.Unlock()
+	if !ok {
+		return
+	}
+	if err := s.wal.ack(d.entry); err != nil && err != qp.ErrNotRunning && s.log.Warn() {
+		s.log.Warn("failed to ack message on", d.entry.channel+":", err)
+	}
+}
+
+// syncEvery syncs the log every interval until the Store is closed.
+func (s *Store) syncEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.wal.sync(); err != nil && s.log.Warn() {
+				s.log.Warn("failed to sync log:", err)
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// compactWhenDue compacts the log whenever it is due, until the
+// Store is closed.
+func (s *Store) compactWhenDue() {
+	defer s.compactor.Done()
+	for {
+		select {
+		case <-s.wal.due:
+			if err := s.wal.compact(); err != nil && s.log.Warn() {
+				s.log.Warn("failed to compact log:", err)
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,581 @@
+package disk
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/qp/go"
+)
+
+// log records
+const (
+	// recSend adds a message to a channel's queue.
+	recSend byte = iota + 1
+	// recPublish adds a published message.
+	recPublish
+	// recAck removes a message once it has been handled.
+	recAck
+)
+
+// headerSize is the size of the header before each record's body:
+// the CRC-32C of the body, then the body's length, both big endian
+// uint32s.
+const headerSize = 8
+
+// maxRecord is the longest body a record may have; longer lengths
+// can only be read from a damaged log.
+const maxRecord = 1 << 30
+
+// segmentExt is the extension of segment files.
+const segmentExt = ".wal"
+
+// ErrCorrupt is returned by Open when a segment other than the
+// last is damaged. Damage at the end of the last segment is what a
+// crash leaves behind, and is cut off instead.
+var ErrCorrupt = errors.New("disk: log is corrupt")
+
+// ErrFull is returned by Send and Publish when the messages waiting
+// in the log would add up to more than Options.MaxSize.
+var ErrFull = errors.New("disk: store is full")
+
+// errRecord is returned when reading a record that was not fully
+// written or has been damaged since.
+var errRecord = errors.New("bad record")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// segment is one of the files the log is split into.
+type segment struct {
+	seq  uint64
+	path string
+	// size is the number of bytes written to the file.
+	size int64
+	// live counts the messages first written to the segment that
+	// have not been acked, and liveSize their size in bytes.
+	live     int
+	liveSize int64
+}
+
+// entry is a message in the log that has not been acked.
+type entry struct {
+	id      uint64
+	op      byte
+	channel string
+	data    []byte
+	segment *segment
+	size    int64
+}
+
+// wal is a write-ahead log of messages, split into segment files
+// named by their sequence numbers. Records are only ever appended
+// to the last segment, and a new one is started once it reaches the
+// segment size.
+//
+// Earlier segments are deleted once every message first written to
+// them has been acked. Once more than half of their bytes are for
+// acked messages, a signal on due asks for them to be compacted
+// into one that only holds the messages still waiting.
+type wal struct {
+	dir      string
+	options  Options
+	lock     sync.Mutex
+	segments []*segment
+	file     *os.File
+	next     uint64
+	entries  map[uint64]*entry
+	// waiting is the size of the records of the entries.
+	waiting int64
+	dirty   bool
+	closed  bool
+	due     chan qp.Signal
+}
+
+// openWAL opens the log in the directory, creating it if it does not
+// exist, and returns the messages waiting in it, oldest first.
+func openWAL(dir string, options Options) (*wal, []*entry, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+	w := &wal{dir: dir, options: options, next: 1, entries: make(map[uint64]*entry), due: make(chan qp.Signal, 1)}
+	if err := w.replay(); err != nil {
+		return nil, nil, err
+	}
+	waiting := make([]*entry, 0, len(w.entries))
+	for _, e := range w.entries {
+		waiting = append(waiting, e)
+	}
+	sort.Slice(waiting, func(i, j int) bool { return waiting[i].id < waiting[j].id })
+	return w, waiting, nil
+}
+
+// replay reads the segments, cutting off a partly written record at
+// the end of the last one, and opens the last one to append to.
+func (w *wal) replay() error {
+	names, err := filepath.Glob(filepath.Join(w.dir, "*"+segmentExt+".tmp"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		// left by a compaction that did not finish
+		os.Remove(name)
+	}
+	names, err = filepath.Glob(filepath.Join(w.dir, "*"+segmentExt))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), segmentExt), 16, 64)
+		if err != nil {
+			continue
+		}
+		w.segments = append(w.segments, &segment{seq: seq, path: name})
+	}
+	sort.Slice(w.segments, func(i, j int) bool { return w.segments[i].seq < w.segments[j].seq })
+	if len(w.segments) == 0 {
+		return w.create(1)
+	}
+	acked := make(map[uint64]bool)
+	for i, s := range w.segments {
+		last := i == len(w.segments)-1
+		if err := w.read(s, acked, last); err != nil {
+			return err
+		}
+	}
+	active := w.segments[len(w.segments)-1]
+	w.file, err = os.OpenFile(active.path, os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+// read reads the records in the segment. A bad record ends the last
+// segment, which is cut off there, and is an error in any other.
+func (w *wal) read(s *segment, acked map[uint64]bool, last bool) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		op, id, channel, data, size, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err == errRecord {
+			if !last {
+				return ErrCorrupt
+			}
+			// the record was being written when the process stopped
+			if err := os.Truncate(s.path, s.size); err != nil {
+				return err
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.size += size
+		if id >= w.next {
+			w.next = id + 1
+		}
+		switch op {
+		case recSend, recPublish:
+			// a compaction that did not finish leaves messages in
+			// more than one segment
+			if _, ok := w.entries[id]; ok || acked[id] {
+				continue
+			}
+			w.entries[id] = &entry{id: id, op: op, channel: channel, data: data, segment: s, size: size}
+			s.live++
+			s.liveSize += size
+			w.waiting += size
+		case recAck:
+			acked[id] = true
+			if e, ok := w.entries[id]; ok {
+				delete(w.entries, id)
+				e.segment.live--
+				e.segment.liveSize -= e.size
+				w.waiting -= e.size
+			}
+		}
+	}
+}
+
+// create starts a new, empty segment to append to.
+// Callers must hold the lock, unless the log is being opened.
+func (w *wal) create(seq uint64) error {
+	s := &segment{seq: seq, path: filepath.Join(w.dir, fmt.Sprintf("%016x%s", seq, segmentExt))}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(w.dir); err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.segments = append(w.segments, s)
+	return nil
+}
+
+// active gets the segment being appended to.
+// Callers must hold the lock.
+func (w *wal) active() *segment {
+	return w.segments[len(w.segments)-1]
+}
+
+// append adds a message to the log. It returns once the record is
+// written, and synced under SyncAlways, or ErrFull if the messages
+// waiting would add up to more than the maximum size.
+func (w *wal) append(op byte, channel string, data []byte) (*entry, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return nil, qp.ErrNotRunning
+	}
+	b := encodeRecord(op, w.next, channel, data)
+	if w.waiting+int64(len(b)) > w.options.maxSize() {
+		return nil, ErrFull
+	}
+	if err := w.rollFull(); err != nil {
+		return nil, err
+	}
+	s := w.active()
+	e := &entry{id: w.next, op: op, channel: channel, data: data, segment: s, size: int64(len(b))}
+	if err := w.write(b, w.options.Sync == SyncAlways); err != nil {
+		return nil, err
+	}
+	w.next++
+	w.entries[e.id] = e
+	s.live++
+	s.liveSize += e.size
+	w.waiting += e.size
+	return e, nil
+}
+
+// ack records that the message has been handled, and deletes the
+// segments that no longer hold messages that are waiting. Acks are only synced along with other records, so a crash
+// may leave a message to be handled again.
+func (w *wal) ack(e *entry) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return qp.ErrNotRunning
+	}
+	if _, ok := w.entries[e.id]; !ok {
+		return nil
+	}
+	if err := w.rollFull(); err != nil {
+		return err
+	}
+	if err := w.write(encodeRecord(recAck, e.id, "", nil), false); err != nil {
+		return err
+	}
+	delete(w.entries, e.id)
+	e.segment.live--
+	e.segment.liveSize -= e.size
+	w.waiting -= e.size
+	if e.segment != w.active() {
+		return w.collect()
+	}
+	return nil
+}
+
+// write appends the record to the active segment, cutting it off
+// again if it could not be written in full.
+// Callers must hold the lock.
+func (w *wal) write(b []byte, sync bool) error {
+	s := w.active()
+	_, err := w.file.Write(b)
+	if err == nil && sync {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		w.file.Truncate(s.size)
+		return err
+	}
+	s.size += int64(len(b))
+	w.dirty = !sync
+	return nil
+}
+
+// rollFull seals the active segment and starts a new one, if the
+// active segment has reached the segment size.
+// Callers must hold the lock.
+func (w *wal) rollFull() error {
+	if w.active().size < w.options.segmentSize() {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.dirty = false
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if err := w.create(w.active().seq + 1); err != nil {
+		return err
+	}
+	return w.collect()
+}
+
+// collect deletes the oldest segments while none of their messages
+// are waiting, then signals that the rest of the sealed segments are
+// due to be compacted if most of their bytes are for messages that
+// have been acked. Acks are always in the same or a later segment
+// than their messages, so deleting the oldest segments first never
+// brings an acked message back.
+// Callers must hold the lock.
+func (w *wal) collect() error {
+	for len(w.segments) > 1 && w.segments[0].live == 0 {
+		if err := os.Remove(w.segments[0].path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		w.segments = w.segments[1:]
+	}
+	if w.compactable() {
+		select {
+		case w.due <- qp.Signal{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// compactable gets whether most of the bytes of the sealed segments
+// are for messages that have been acked.
+// Callers must hold the lock.
+func (w *wal) compactable() bool {
+	sealed := w.segments[:len(w.segments)-1]
+	var size, live int64
+	for _, s := range sealed {
+		size += s.size
+		live += s.liveSize
+	}
+	return len(sealed) > 0 && live*2 < size
+}
+
+// compaction is a compacted segment being written, to replace the
+// segments that were sealed when it began.
+type compaction struct {
+	sealed    []*segment
+	waiting   []*entry
+	compacted *segment
+	tmp       string
+}
+
+// compact replaces the sealed segments with one that only holds
+// their messages that are waiting, if they are still compactable.
+// The new segment is written without holding the lock, so messages
+// can be sent and acked meanwhile, and then takes the place of the
+// first, and the others are deleted oldest first. If the process
+// stops part way through, replaying the log finds some messages
+// twice, which it ignores, but never finds an acked message without
+// its ack.
+func (w *wal) compact() error {
+	c := w.beginCompaction()
+	if c == nil {
+		return nil
+	}
+	if err := c.write(); err != nil {
+		os.Remove(c.tmp)
+		return err
+	}
+	return w.endCompaction(c)
+}
+
+// beginCompaction gets the messages to copy to the compacted
+// segment, or nil if the log is closed or not compactable.
+func (w *wal) beginCompaction() *compaction {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed || !w.compactable() {
+		return nil
+	}
+	c := &compaction{sealed: append([]*segment(nil), w.segments[:len(w.segments)-1]...)}
+	for _, e := range w.entries {
+		if e.segment != w.active() {
+			c.waiting = append(c.waiting, e)
+		}
+	}
+	sort.Slice(c.waiting, func(i, j int) bool { return c.waiting[i].id < c.waiting[j].id })
+	first := c.sealed[0]
+	c.compacted = &segment{seq: first.seq, path: first.path}
+	c.tmp = first.path + ".tmp"
+	return c
+}
+
+// write writes the messages to a temporary file, and syncs it. The
+// fields of entries it reads never change, so it does not need the
+// lock.
+func (c *compaction) write() error {
+	f, err := os.Create(c.tmp)
+	if err != nil {
+		return err
+	}
+	b := bufio.NewWriter(f)
+	for _, e := range c.waiting {
+		if _, err := b.Write(encodeRecord(e.op, e.id, e.channel, e.data)); err != nil {
+			f.Close()
+			return err
+		}
+		c.compacted.size += e.size
+	}
+	if err := b.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// endCompaction puts the compacted segment in place of the sealed
+// ones. Messages acked since the compaction began are copied
+// anyway, and their acks in later segments keep them acked. If the
+// first sealed segment has been deleted since, the compaction is
+// given up, and collect signals again if it is still due.
+func (w *wal) endCompaction(c *compaction) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed || len(w.segments) <= len(c.sealed) || w.segments[0] != c.sealed[0] {
+		os.Remove(c.tmp)
+		return nil
+	}
+	if err := os.Rename(c.tmp, c.compacted.path); err != nil {
+		return err
+	}
+	if err := syncDir(w.dir); err != nil {
+		return err
+	}
+	for _, s := range c.sealed[1:] {
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, e := range c.waiting {
+		if _, ok := w.entries[e.id]; ok {
+			e.segment = c.compacted
+			c.compacted.live++
+			c.compacted.liveSize += e.size
+		}
+	}
+	w.segments = append([]*segment{c.compacted}, w.segments[len(c.sealed):]...)
+	return nil
+}
+
+// sync syncs the records written since the last sync.
+func (w *wal) sync() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed || !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	return w.file.Sync()
+}
+
+// close syncs and closes the log.
+func (w *wal) close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// encodeRecord makes a record. The body is the op, the message ID
+// and, unless the record is an ack, the length of the channel name,
+// the channel name and the data.
+func encodeRecord(op byte, id uint64, channel string, data []byte) []byte {
+	n := 1 + 8
+	if op != recAck {
+		n += 4 + len(channel) + len(data)
+	}
+	b := make([]byte, headerSize+n)
+	body := b[headerSize:]
+	body[0] = op
+	binary.BigEndian.PutUint64(body[1:], id)
+	if op != recAck {
+		binary.BigEndian.PutUint32(body[9:], uint32(len(channel)))
+		copy(body[13:], channel)
+		copy(body[13+len(channel):], data)
+	}
+	binary.BigEndian.PutUint32(b, crc32.Checksum(body, crcTable))
+	binary.BigEndian.PutUint32(b[4:], uint32(n))
+	return b
+}
+
+// readRecord reads a record, returning its fields and its size.
+// It returns io.EOF at the end of the segment, and errRecord if the
+// record is incomplete or damaged.
+func readRecord(r *bufio.Reader) (op byte, id uint64, channel string, data []byte, size int64, err error) {
+	var header [headerSize]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errRecord
+		}
+		return
+	}
+	n := binary.BigEndian.Uint32(header[4:])
+	if n < 9 || n > maxRecord {
+		err = errRecord
+		return
+	}
+	body := make([]byte, n)
+	if _, err = io.ReadFull(r, body); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errRecord
+		}
+		return
+	}
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(header[:]) {
+		err = errRecord
+		return
+	}
+	op, id, size = body[0], binary.BigEndian.Uint64(body[1:]), int64(headerSize+n)
+	switch op {
+	case recAck:
+		if n != 9 {
+			err = errRecord
+		}
+	case recSend, recPublish:
+		if n < 13 || uint32(len(body)-13) < binary.BigEndian.Uint32(body[9:]) {
+			err = errRecord
+			return
+		}
+		end := 13 + int(binary.BigEndian.Uint32(body[9:]))
+		channel, data = string(body[13:end]), body[end:]
+	default:
+		err = errRecord
+	}
+	return
+}
+
+// syncDir syncs the directory, so that files created, renamed or
+// deleted in it stay that way after a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
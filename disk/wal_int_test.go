@@ -0,0 +1,268 @@
+package disk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// tempDir makes a directory for a log, and a func that removes it.
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "disk")
+	require.NoError(t, err)
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// messages gets the channels and data of the entries.
+func messages(entries []*entry) []string {
+	var messages []string
+	for _, e := range entries {
+		messages = append(messages, e.channel+":"+string(e.data))
+	}
+	return messages
+}
+
+func TestWALReplay(t *testing.T) {
+
+	dir, remove := tempDir(t)
+	defer remove()
+	w, waiting, err := openWAL(dir, Options{})
+	require.NoError(t, err)
+	require.Empty(t, waiting)
+	one, err := w.append(recSend, "a", []byte("one"))
+	require.NoError(t, err)
+	_, err = w.append(recPublish, "b", []byte("two"))
+	require.NoError(t, err)
+	_, err = w.append(recSend, "a", nil)
+	require.NoError(t, err)
+	require.NoError(t, w.ack(one))
+	require.NoError(t, w.close())
+
+	// a record cut short by a crash is cut off
+	path := w.active().path
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write(encodeRecord(recSend, 4, "a", []byte("four"))[:12])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	w, waiting, err = openWAL(dir, Options{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"b:two", "a:"}, messages(waiting))
+	require.Equal(t, recPublish, waiting[0].op)
+	require.Equal(t, recSend, waiting[1].op)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, w.active().size, info.Size())
+
+	// IDs carry on from those in the log
+	e, err := w.append(recSend, "a", []byte("five"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), e.id)
+	require.NoError(t, w.close())
+
+}
+
+func TestWALCorrupt(t *testing.T) {
+
+	dir, remove := tempDir(t)
+	defer remove()
+	w, _, err := openWAL(dir, Options{SegmentSize: 1})
+	require.NoError(t, err)
+	_, err = w.append(recSend, "a", []byte("one"))
+	require.NoError(t, err)
+	_, err = w.append(recSend, "a", []byte("two"))
+	require.NoError(t, err)
+	first := w.segments[0].path
+	require.NoError(t, w.close())
+
+	// damage is only expected at the end of the last segment
+	b, err := ioutil.ReadFile(first)
+	require.NoError(t, err)
+	b[len(b)-1] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(first, b, 0644))
+	_, _, err = openWAL(dir, Options{})
+	require.Equal(t, ErrCorrupt, err)
+
+}
+
+func TestWALSegments(t *testing.T) {
+
+	dir, remove := tempDir(t)
+	defer remove()
+	w, _, err := openWAL(dir, Options{SegmentSize: 100})
+	require.NoError(t, err)
+	var entries []*entry
+	for i := 0; i < 20; i++ {
+		e, err := w.append(recSend, "a", []byte("message"))
+		require.NoError(t, err)
+		entries = append(entries, e)
+	}
+	require.Len(t, w.segments, 5)
+
+	// segments whose messages have all been handled are deleted
+	for _, e := range entries[:10] {
+		require.NoError(t, w.ack(e))
+	}
+	require.Equal(t, entries[10].segment, w.segments[0])
+
+	// most of the sealed segments being handled makes them due to
+	// be compacted
+	for _, e := range entries[11:] {
+		require.NoError(t, w.ack(e))
+	}
+	require.Len(t, w.due, 1)
+	<-w.due
+	require.NoError(t, w.compact())
+	require.Len(t, w.segments, 2)
+	require.Equal(t, 1, w.segments[0].live)
+	require.True(t, w.segments[0].size <= 2*w.segments[0].liveSize)
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	require.NoError(t, err)
+	require.Len(t, names, 2)
+	require.NoError(t, w.close())
+
+	w, waiting, err := openWAL(dir, Options{SegmentSize: 100})
+	require.NoError(t, err)
+	require.Len(t, waiting, 1)
+	require.Equal(t, entries[10].id, waiting[0].id)
+	require.NoError(t, w.close())
+
+}
+
+func TestWALAckDuringCompaction(t *testing.T) {
+
+	dir, remove := tempDir(t)
+	defer remove()
+	w, _, err := openWAL(dir, Options{SegmentSize: 100})
+	require.NoError(t, err)
+	var entries []*entry
+	for i := 0; i < 20; i++ {
+		e, err := w.append(recSend, "a", []byte("message"))
+		require.NoError(t, err)
+		entries = append(entries, e)
+	}
+	for _, e := range entries[1:12] {
+		require.NoError(t, w.ack(e))
+	}
+	c := w.beginCompaction()
+	require.NotNil(t, c)
+	require.NoError(t, c.write())
+
+	// the log is not locked while the compacted segment is written
+	require.NoError(t, w.ack(entries[12]))
+	_, err = w.append(recSend, "a", []byte("message"))
+	require.NoError(t, err)
+	require.NoError(t, w.endCompaction(c))
+	require.Equal(t, c.compacted, w.segments[0])
+	require.Contains(t, c.waiting, entries[12])
+	require.Equal(t, len(c.waiting)-1, c.compacted.live)
+	require.Equal(t, c.compacted, entries[13].segment)
+	require.NoError(t, w.close())
+
+	// the message acked meanwhile stays acked
+	w, waiting, err := openWAL(dir, Options{SegmentSize: 100})
+	require.NoError(t, err)
+	require.Len(t, waiting, 9)
+	require.Equal(t, entries[0].id, waiting[0].id)
+	require.Equal(t, entries[13].id, waiting[1].id)
+	require.NoError(t, w.close())
+
+}
+
+func TestWALCompactionGivenUp(t *testing.T) {
+
+	dir, remove := tempDir(t)
+	defer remove()
+	w, _, err := openWAL(dir, Options{SegmentSize: 100})
+	require.NoError(t, err)
+	var entries []*entry
+	for i := 0; i < 20; i++ {
+		e, err := w.append(recSend, "a", []byte("message"))
+		require.NoError(t, err)
+		entries = append(entries, e)
+	}
+	for _, e := range entries[1:12] {
+		require.NoError(t, w.ack(e))
+	}
+	c := w.beginCompaction()
+	require.NotNil(t, c)
+	require.NoError(t, c.write())
+
+	// the first segment is deleted while the compacted one is
+	// written, so it is not put in its place
+	require.NoError(t, w.ack(entries[0]))
+	first := c.sealed[0]
+	require.NotEqual(t, first, w.segments[0])
+	require.NoError(t, w.endCompaction(c))
+	_, err = os.Stat(first.path)
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(c.tmp)
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, w.close())
+
+}
+
+func TestWALMaxSize(t *testing.T) {
+
+	dir, remove := tempDir(t)
+	defer remove()
+	size := int64(len(encodeRecord(recSend, 1, "a", []byte("message"))))
+	w, _, err := openWAL(dir, Options{MaxSize: 3 * size})
+	require.NoError(t, err)
+	var entries []*entry
+	for i := 0; i < 3; i++ {
+		e, err := w.append(recSend, "a", []byte("message"))
+		require.NoError(t, err)
+		entries = append(entries, e)
+	}
+	_, err = w.append(recSend, "a", []byte("message"))
+	require.Equal(t, ErrFull, err)
+
+	// acking a message makes room for another
+	require.NoError(t, w.ack(entries[0]))
+	_, err = w.append(recSend, "a", []byte("message"))
+	require.NoError(t, err)
+	_, err = w.append(recSend, "a", []byte("message"))
+	require.Equal(t, ErrFull, err)
+	require.NoError(t, w.close())
+
+	// the size of the messages waiting is counted on replay
+	w, waiting, err := openWAL(dir, Options{MaxSize: 3 * size})
+	require.NoError(t, err)
+	require.Len(t, waiting, 3)
+	_, err = w.append(recSend, "a", []byte("message"))
+	require.Equal(t, ErrFull, err)
+	require.NoError(t, w.close())
+
+}
+
+func TestWALInterruptedCompaction(t *testing.T) {
+
+	dir, remove := tempDir(t)
+	defer remove()
+
+	// the compacted segment was renamed into place, but the segment
+	// it copied the message from was not yet deleted
+	var first, second []byte
+	first = append(first, encodeRecord(recSend, 2, "a", []byte("two"))...)
+	second = append(second, encodeRecord(recSend, 2, "a", []byte("two"))...)
+	second = append(second, encodeRecord(recSend, 3, "a", []byte("three"))...)
+	second = append(second, encodeRecord(recAck, 3, "", nil)...)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "0000000000000001.wal"), first, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "0000000000000002.wal"), second, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "0000000000000001.wal.tmp"), first[:5], 0644))
+
+	w, waiting, err := openWAL(dir, Options{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a:two"}, messages(waiting))
+	require.Equal(t, w.segments[0], waiting[0].segment)
+	require.Equal(t, 0, w.segments[1].live)
+	_, err = os.Stat(filepath.Join(dir, "0000000000000001.wal.tmp"))
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, w.close())
+
+}
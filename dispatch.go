@@ -0,0 +1,222 @@
+package qp
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// ChannelOptions controls how a transport dispatches the messages
+// arriving on a channel to its Handler.
+type ChannelOptions struct {
+	// MaxInFlight is the maximum number of messages that may be
+	// handled at once. When the limit is reached, the transport
+	// stops taking new messages until a handler returns.
+	// Zero means no limit.
+	MaxInFlight int
+	// Workers is the number of long-lived goroutines that handle
+	// messages. When zero, a new goroutine is started for every
+	// message. When set, MaxInFlight is ignored since no more than
+	// Workers messages can be handled at once.
+	Workers int
+	// Key, when set, extracts a partition key from each message.
+	// Messages with the same key are handled strictly in the order
+	// they arrived, one at a time, while messages with different
+	// keys are still handled concurrently.
+	Key func(msg *Message) string
+}
+
+// Dispatcher hands messages to a Handler according to
+// ChannelOptions. Transports use one Dispatcher per channel.
+type Dispatcher struct {
+	handler Handler
+	key     func(msg *Message) string
+	slots   chan Signal
+	work    []chan *Message
+	quit    chan Signal
+	once    sync.Once
+	lock    sync.Mutex
+	queues  map[string][]*Message
+	// inFlight counts messages that have been accepted but
+	// not yet handled, and idle is closed when it reaches zero.
+	inFlight int
+	idle     chan Signal
+}
+
+// NewDispatcher makes a new Dispatcher that hands messages to
+// the specified handler.
+func NewDispatcher(handler Handler, options ChannelOptions) *Dispatcher {
+	d := &Dispatcher{
+		handler: handler,
+		key:     options.Key,
+		quit:    make(chan Signal),
+		queues:  make(map[string][]*Message),
+	}
+	if options.Workers > 0 {
+		d.work = make([]chan *Message, options.Workers)
+		for i := range d.work {
+			d.work[i] = make(chan *Message)
+			go d.worker(d.work[i])
+		}
+	} else if options.MaxInFlight > 0 {
+		d.slots = make(chan Signal, options.MaxInFlight)
+	}
+	return d
+}
+
+func (d *Dispatcher) worker(work chan *Message) {
+	for {
+		select {
+		case msg := <-work:
+			d.handle(msg)
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+// Dispatch hands the message to the handler, blocking while the
+// maximum number of messages are already being handled.
+// ErrNotRunning is returned if the Dispatcher is closed before the
+// message could be handed over.
+//
+// When using workers with a Key, messages with the same key always
+// go to the same worker, so Dispatch may block on a busy worker
+// even though others are idle.
+func (d *Dispatcher) Dispatch(msg *Message) error {
+	select {
+	case <-d.quit:
+		return ErrNotRunning
+	default:
+	}
+	if len(d.work) > 0 {
+		work := d.work[0]
+		if d.key != nil {
+			work = d.work[shard(d.key(msg), len(d.work))]
+		}
+		d.add(1)
+		select {
+		case work <- msg:
+			return nil
+		case <-d.quit:
+			d.add(-1)
+			return ErrNotRunning
+		}
+	}
+	if d.slots != nil {
+		select {
+		case d.slots <- Signal{}:
+		case <-d.quit:
+			return ErrNotRunning
+		}
+	}
+	d.add(1)
+	if d.key != nil {
+		d.enqueue(d.key(msg), msg)
+		return nil
+	}
+	go d.handle(msg)
+	return nil
+}
+
+// handle handles the message and frees its slot.
+func (d *Dispatcher) handle(msg *Message) {
+	d.handler.Handle(msg)
+	if d.slots != nil {
+		<-d.slots
+	}
+	d.add(-1)
+}
+
+// add adjusts the number of messages in flight.
+func (d *Dispatcher) add(delta int) {
+	d.lock.Lock()
+	d.inFlight += delta
+	if d.inFlight == 0 && d.idle != nil {
+		close(d.idle)
+		d.idle = nil
+	}
+	d.lock.Unlock()
+}
+
+// Wait waits for the messages in flight to be handled, giving
+// up after the timeout. It returns the number of messages that
+// were still being handled when it gave up.
+func (d *Dispatcher) Wait(timeout time.Duration) int {
+	d.lock.Lock()
+	if d.inFlight == 0 {
+		d.lock.Unlock()
+		return 0
+	}
+	if d.idle == nil {
+		d.idle = make(chan Signal)
+	}
+	idle := d.idle
+	d.lock.Unlock()
+	select {
+	case <-idle:
+		return 0
+	case <-time.After(timeout):
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		return d.inFlight
+	}
+}
+
+// Drain waits for the messages in flight on all of the
+// dispatchers to be handled, giving up once the grace period
+// has passed. It returns the number of messages that were
+// abandoned.
+func Drain(grace time.Duration, dispatchers ...*Dispatcher) int {
+	deadline := time.Now().Add(grace)
+	abandoned := 0
+	for _, d := range dispatchers {
+		abandoned += d.Wait(deadline.Sub(time.Now()))
+	}
+	return abandoned
+}
+
+// enqueue adds the message to the queue for the key, starting
+// a goroutine to drain the queue if there is not one already.
+func (d *Dispatcher) enqueue(key string, msg *Message) {
+	d.lock.Lock()
+	queue, busy := d.queues[key]
+	d.queues[key] = append(queue, msg)
+	d.lock.Unlock()
+	if !busy {
+		go d.drain(key)
+	}
+}
+
+// drain handles the messages queued for the key, in order,
+// until there are none left.
+func (d *Dispatcher) drain(key string) {
+	for {
+		d.lock.Lock()
+		queue := d.queues[key]
+		if len(queue) == 0 {
+			delete(d.queues, key)
+			d.lock.Unlock()
+			return
+		}
+		d.queues[key] = queue[1:]
+		d.lock.Unlock()
+		d.handle(queue[0])
+	}
+}
+
+// shard picks one of n shards for the key.
+func shard(key string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// Close stops the Dispatcher from accepting new messages and
+// lets the workers exit once they finish their current message.
+// It is safe to call Close more than once.
+func (d *Dispatcher) Close() {
+	d.once.Do(func() {
+		close(d.quit)
+	})
+}
@@ -0,0 +1,198 @@
+package qp_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDispatcherMaxInFlight(t *testing.T) {
+
+	var running, max int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	d := qp.NewDispatcher(qp.HandlerFunc(func(msg *qp.Message) {
+		n := atomic.AddInt32(&running, 1)
+		if n > atomic.LoadInt32(&max) {
+			atomic.StoreInt32(&max, n)
+		}
+		<-release
+		atomic.AddInt32(&running, -1)
+		wg.Done()
+	}), qp.ChannelOptions{MaxInFlight: 2})
+	defer d.Close()
+
+	wg.Add(3)
+	require.NoError(t, d.Dispatch(&qp.Message{}))
+	require.NoError(t, d.Dispatch(&qp.Message{}))
+
+	dispatched := make(chan error)
+	go func() {
+		dispatched <- d.Dispatch(&qp.Message{})
+	}()
+	select {
+	case <-dispatched:
+		require.FailNow(t, "Dispatch should block while at capacity")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release <- struct{}{}
+	select {
+	case err := <-dispatched:
+		require.NoError(t, err)
+	case <-time.After(100 * time.Millisecond):
+		require.FailNow(t, "Dispatch did not unblock")
+	}
+	close(release)
+	wg.Wait()
+	require.Equal(t, int32(2), max)
+
+}
+
+func TestDispatcherWorkers(t *testing.T) {
+
+	msgs := make(chan *qp.Message)
+	d := qp.NewDispatcher(qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	}), qp.ChannelOptions{Workers: 1})
+
+	require.NoError(t, d.Dispatch(&qp.Message{Source: "one"}))
+	dispatched := make(chan error)
+	go func() {
+		dispatched <- d.Dispatch(&qp.Message{Source: "two"})
+	}()
+	select {
+	case <-dispatched:
+		require.FailNow(t, "Dispatch should block while the worker is busy")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.Equal(t, "one", (<-msgs).Source)
+	require.Equal(t, "two", (<-msgs).Source)
+	require.NoError(t, <-dispatched)
+
+	d.Close()
+	d.Close()
+	require.Equal(t, qp.ErrNotRunning, d.Dispatch(&qp.Message{}))
+
+}
+
+func TestDispatcherKey(t *testing.T) {
+
+	release := make(chan struct{})
+	handled := make(chan string, 10)
+	d := qp.NewDispatcher(qp.HandlerFunc(func(msg *qp.Message) {
+		if string(msg.Data) == "a1" {
+			<-release
+		}
+		handled <- string(msg.Data)
+	}), qp.ChannelOptions{Key: func(msg *qp.Message) string {
+		return msg.Source
+	}})
+	defer d.Close()
+
+	for _, m := range []string{"a1", "a2", "a3"} {
+		require.NoError(t, d.Dispatch(&qp.Message{Source: "a", Data: []byte(m)}))
+	}
+	require.NoError(t, d.Dispatch(&qp.Message{Source: "b", Data: []byte("b1")}))
+
+	// b is not held up by a
+	select {
+	case m := <-handled:
+		require.Equal(t, "b1", m)
+	case <-time.After(100 * time.Millisecond):
+		require.FailNow(t, "b1 was not handled")
+	}
+
+	close(release)
+	for _, expected := range []string{"a1", "a2", "a3"} {
+		select {
+		case m := <-handled:
+			require.Equal(t, expected, m)
+		case <-time.After(100 * time.Millisecond):
+			require.FailNow(t, "no message handled")
+		}
+	}
+
+}
+
+func TestDispatcherKeyWorkers(t *testing.T) {
+
+	var lock sync.Mutex
+	handled := map[string][]int{}
+	var wg sync.WaitGroup
+	d := qp.NewDispatcher(qp.HandlerFunc(func(msg *qp.Message) {
+		lock.Lock()
+		handled[msg.Source] = append(handled[msg.Source], int(msg.Data[0]))
+		lock.Unlock()
+		wg.Done()
+	}), qp.ChannelOptions{Workers: 4, Key: func(msg *qp.Message) string {
+		return msg.Source
+	}})
+	defer d.Close()
+
+	keys := []string{"a", "b", "c", "d", "e"}
+	for i := 0; i < 50; i++ {
+		for _, k := range keys {
+			wg.Add(1)
+			require.NoError(t, d.Dispatch(&qp.Message{Source: k, Data: []byte{byte(i)}}))
+		}
+	}
+	wg.Wait()
+
+	for _, k := range keys {
+		require.Len(t, handled[k], 50)
+		for i, n := range handled[k] {
+			require.Equal(t, i, n)
+		}
+	}
+
+}
+
+func TestDispatcherWait(t *testing.T) {
+
+	release := make(chan struct{})
+	d := qp.NewDispatcher(qp.HandlerFunc(func(msg *qp.Message) {
+		<-release
+	}), qp.ChannelOptions{})
+	defer d.Close()
+
+	require.Equal(t, 0, d.Wait(stop.NoWait))
+	require.NoError(t, d.Dispatch(&qp.Message{}))
+	require.NoError(t, d.Dispatch(&qp.Message{}))
+	require.Equal(t, 2, d.Wait(10*time.Millisecond))
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+	}()
+	start := time.Now()
+	require.Equal(t, 0, qp.Drain(1*time.Second, d))
+	require.True(t, time.Since(start) < 500*time.Millisecond, "Drain should return as soon as handlers finish")
+
+}
+
+func TestDispatcherClosed(t *testing.T) {
+
+	for _, options := range []qp.ChannelOptions{
+		{},
+		{MaxInFlight: 1},
+		{Workers: 1},
+		{Key: func(msg *qp.Message) string { return msg.Source }},
+	} {
+		var handled int32
+		d := qp.NewDispatcher(qp.HandlerFunc(func(msg *qp.Message) {
+			atomic.AddInt32(&handled, 1)
+		}), options)
+		d.Close()
+		require.Equal(t, qp.ErrNotRunning, d.Dispatch(&qp.Message{}), "%+v", options)
+		require.Equal(t, 0, d.Wait(stop.NoWait))
+		require.Equal(t, int32(0), atomic.LoadInt32(&handled))
+	}
+
+}
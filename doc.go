@@ -20,6 +20,17 @@
 // Building services that respond to requests can be achieved by using
 // the Responder type, which exposes the Handle method.
 //
+// Channels and patterns
+//
+// Channel names are made up of tokens separated by dots, such as
+// "orders.eu.created". When subscribing, a channel may instead be a
+// pattern that matches many channels: "*" matches exactly one token,
+// as in "orders.*.created", and ">" as the last token matches one or
+// more remaining tokens, as in "orders.>". Wildcards only count when
+// they make up a whole token. Every PubSubTransport matches patterns
+// in the same way, and the Source of each Message is the concrete
+// channel it was published on.
+//
 // Name and instance ID
 //
 // Most types require a name and instance ID. The name describes the type
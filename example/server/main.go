@@ -1,13 +1,12 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
-	"net/http"
 	"time"
 
 	"github.com/qp/go"
+	"github.com/qp/go/gateway"
 	"github.com/qp/go/redis"
 	"github.com/stretchr/graceful"
 )
@@ -22,31 +21,15 @@ func main() {
 	}
 	t.Start()
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-		if req.URL.String() == "/favicon.ico" {
-			return
-		}
-		obj := map[string]interface{}{
-			"messages": []string{"Hello from the webserver at " + time.Now().String()},
-		}
-		f, err := r.Issue([]string{"first", "second", "third"}, obj)
-		if err != nil {
-			fmt.Fprintf(w, "error issuing request: %v\n", err)
-			return
-		}
-
-		msg, err := f.Response(1 * time.Second)
-		if err != nil {
-			fmt.Fprintf(w, "error getting response: %v\n", err)
-			return
-		}
-		json.NewEncoder(w).Encode(msg)
-	})
-
-	fmt.Println("Server started. Visit localhost:3001")
-
-	graceful.Run(":3001", 10*time.Second, mux)
+	// the gateway issues the body of requests to the pipeline, and
+	// writes the data of the response
+	g := gateway.New(qp.JSON, r, nil)
+	g.HandleRoute("/", gateway.Route{Pipeline: []string{"first", "second", "third"}, Timeout: 1 * time.Second})
+
+	fmt.Println("Server started. Try:")
+	fmt.Println(`  curl -d '{"messages":["Hello from curl"]}' localhost:3001`)
+
+	graceful.Run(":3001", 10*time.Second, g)
 	t.Stop(0)
 
 	fmt.Println("Server terminated.")
@@ -0,0 +1,28 @@
+// Package gateway exposes qp endpoints over HTTP.
+//
+// A Gateway is an http.Handler. Routes map paths to pipelines: the
+// request body is decoded with the Codec and issued to the pipeline
+// with a Requester, and the data of the response that comes back is
+// written to the client:
+//
+//	g := gateway.New(qp.JSON, requester, subscriber)
+//	g.Handle("/orders", "validate", "price", "store")
+//	g.HandleRoute("/reports", gateway.Route{Pipeline: []string{"report"}, Timeout: 30 * time.Second})
+//	g.Stream("/events", "orders.>")
+//	http.ListenAndServe(":3001", g)
+//
+// Requests that cannot be decoded get 400 Bad Request, requests that
+// cannot be sent get 502 Bad Gateway, or 503 Service Unavailable if
+// the transport is not running, and requests with no response
+// before the timeout get 504 Gateway Timeout. A response to a
+// transaction that a stage aborted is written with 502 Bad Gateway.
+//
+// Streams send the events a Subscriber gets on a channel to
+// browsers, over a WebSocket if the client asks to upgrade the
+// connection, or as Server-Sent Events otherwise. Each event is
+// encoded with the Codec, and sent in a text WebSocket message if
+// Options.ContentType is text, or a binary one if not; Server-Sent
+// Events need a Codec that encodes text. Events are dropped for
+// clients that fall too far behind. Pages from other sites may only
+// open WebSockets if their origin is in Options.AllowedOrigins.
+package gateway
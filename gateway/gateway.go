@@ -0,0 +1,191 @@
+package gateway
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+)
+
+// Route is a pipeline that requests to a path are issued to.
+type Route struct {
+	// Pipeline is the endpoints the request goes through, in order.
+	Pipeline []string
+	// Timeout is how long to wait for the response. Zero means the
+	// Timeout in the Gateway's Options.
+	Timeout time.Duration
+}
+
+// Gateway is an http.Handler that issues requests to routes'
+// pipelines, and streams events to clients.
+type Gateway struct {
+	codec      qp.Codec
+	requester  qp.Requester
+	subscriber qp.Subscriber
+	options    Options
+	lock       sync.RWMutex
+	routes     map[string]Route
+	streams    map[string]string
+	log        slog.Logger
+}
+
+// ensure the interface is satisfied
+var _ http.Handler = (*Gateway)(nil)
+
+// New makes a new Gateway that issues requests with the requester
+// and streams events from the subscriber, decoding request bodies
+// and encoding responses and events with the codec. The requester
+// may be nil if the Gateway has no routes, and the subscriber if it
+// has no streams.
+func New(codec qp.Codec, requester qp.Requester, subscriber qp.Subscriber) *Gateway {
+	return NewOptions(codec, requester, subscriber, Options{})
+}
+
+// NewOptions makes a new Gateway with the specified options.
+func NewOptions(codec qp.Codec, requester qp.Requester, subscriber qp.Subscriber, options Options) *Gateway {
+	return &Gateway{
+		codec:      codec,
+		requester:  requester,
+		subscriber: subscriber,
+		options:    options,
+		routes:     make(map[string]Route),
+		streams:    make(map[string]string),
+		log:        slog.NilLogger,
+	}
+}
+
+// SetLogger sets the Logger to log to.
+func (g *Gateway) SetLogger(log slog.Logger) {
+	g.log = log
+}
+
+// Handle issues GET and POST requests to the path to the pipeline.
+func (g *Gateway) Handle(path string, pipeline ...string) {
+	g.HandleRoute(path, Route{Pipeline: pipeline})
+}
+
+// HandleRoute issues GET and POST requests to the path to the
+// route's pipeline.
+//
+// The request body, if there is one, is decoded with the codec and
+// becomes the request's data. The data of the response that comes
+// back is encoded with the codec and written with status 200, or
+// 502 if a stage aborted the transaction before the end of the
+// pipeline. A body that cannot be decoded gets 400, a request that
+// cannot be issued gets 502, or 503 if the transport is not running,
+// and no response within the timeout gets 504.
+func (g *Gateway) HandleRoute(path string, route Route) {
+	g.lock.Lock()
+	g.routes[path] = route
+	g.lock.Unlock()
+}
+
+// Stream streams the events on the channel, which may be a
+// pattern, to clients that GET the path. Clients that ask to upgrade
+// the connection get each event in a WebSocket message, and others
+// get Server-Sent Events. Each event is encoded with the codec.
+func (g *Gateway) Stream(path, channel string) {
+	g.lock.Lock()
+	g.streams[path] = channel
+	g.lock.Unlock()
+}
+
+// Remove stops serving the path. Streams already open on the path
+// stay open.
+func (g *Gateway) Remove(path string) {
+	g.lock.Lock()
+	delete(g.routes, path)
+	delete(g.streams, path)
+	g.lock.Unlock()
+}
+
+// ServeHTTP serves the route or stream for the request's path,
+// or 404 if there is neither.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.lock.RLock()
+	route, isRoute := g.routes[r.URL.Path]
+	channel, isStream := g.streams[r.URL.Path]
+	g.lock.RUnlock()
+	switch {
+	case isRoute:
+		g.serveRoute(w, r, route)
+	case isStream:
+		g.serveStream(w, r, channel)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveRoute issues the request to the route's pipeline, and writes
+// the data of the response.
+func (g *Gateway) serveRoute(w http.ResponseWriter, r *http.Request, route Route) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, g.options.maxBody()))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "failed to read request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var data interface{}
+	if len(body) > 0 {
+		if err := g.codec.Unmarshal(body, &data); err != nil {
+			http.Error(w, "failed to decode request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if g.log.Info() {
+		g.log.Info("issuing", r.URL.Path, "to", route.Pipeline)
+	}
+	future, err := g.requester.Issue(route.Pipeline, data)
+	if err != nil {
+		if g.log.Err() {
+			g.log.Err("failed to issue request:", err)
+		}
+		status := http.StatusBadGateway
+		if err == qp.ErrNotRunning {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, "failed to issue request: "+err.Error(), status)
+		return
+	}
+	timeout := route.Timeout
+	if timeout == 0 {
+		timeout = g.options.timeout()
+	}
+	response, err := future.Response(timeout)
+	if err != nil {
+		if g.log.Warn() {
+			g.log.Warn("no response to", r.URL.Path+":", err)
+		}
+		http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+		return
+	}
+	out, err := g.codec.Marshal(response.Data)
+	if err != nil {
+		if g.log.Err() {
+			g.log.Err("failed to encode response:", err)
+		}
+		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", g.options.contentType())
+	if response.Aborted {
+		if g.log.Warn() {
+			g.log.Warn("transaction for", r.URL.Path, "was aborted")
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	w.Write(out)
+}
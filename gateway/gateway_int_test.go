@@ -0,0 +1,147 @@
+package gateway
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/qp/go/inproc"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+// fixture runs a Gateway on its own Bus, with responders that
+// append their names to the data they are given, and one that
+// aborts every transaction.
+type fixture struct {
+	bus       *inproc.Bus
+	direct    *inproc.Direct
+	pubSub    *inproc.PubSub
+	publisher qp.Publisher
+	gateway   *Gateway
+	server    *httptest.Server
+}
+
+func newFixture(t *testing.T, options Options) *fixture {
+	f := &fixture{bus: inproc.NewBus()}
+	f.direct = f.bus.NewDirect()
+	f.pubSub = f.bus.NewPubSub()
+	requester, err := qp.NewRequester("gateway", "test", qp.JSON, f.direct)
+	require.NoError(t, err)
+	responder := qp.NewResponder("service", "test", qp.JSON, f.direct)
+	for _, name := range []string{"first", "second"} {
+		name := name
+		require.NoError(t, responder.HandleFunc(name, func(tx *qp.Transaction) *qp.Transaction {
+			data := tx.Data.(map[string]interface{})
+			data["seen"] = append(data["seen"].([]interface{}), name)
+			return tx
+		}))
+	}
+	require.NoError(t, responder.HandleFunc("refuse", func(tx *qp.Transaction) *qp.Transaction {
+		tx.Abort()
+		tx.Data = map[string]interface{}{"error": "refused"}
+		return tx
+	}))
+	require.NoError(t, f.direct.Start())
+	require.NoError(t, f.pubSub.Start())
+	f.publisher = qp.NewPublisher("service", "test", qp.JSON, f.pubSub)
+	f.gateway = NewOptions(qp.JSON, requester, qp.NewSubscriber(qp.JSON, f.pubSub), options)
+	f.server = httptest.NewServer(f.gateway)
+	return f
+}
+
+func (f *fixture) close() {
+	f.server.Close()
+	f.direct.Stop(stop.NoWait)
+	f.pubSub.Stop(stop.NoWait)
+	f.bus.Close()
+}
+
+// post posts the body to the path, returning the status and body
+// of the response.
+func (f *fixture) post(t *testing.T, path, body string) (int, string) {
+	res, err := http.Post(f.server.URL+path, "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res.StatusCode, string(b)
+}
+
+func TestGatewayRoute(t *testing.T) {
+
+	f := newFixture(t, Options{})
+	defer f.close()
+	f.gateway.Handle("/pipeline", "first", "second")
+
+	status, body := f.post(t, "/pipeline", `{"seen":[]}`)
+	require.Equal(t, http.StatusOK, status)
+	require.JSONEq(t, `{"seen":["first","second"]}`, body)
+
+}
+
+func TestGatewayAborted(t *testing.T) {
+
+	f := newFixture(t, Options{})
+	defer f.close()
+	f.gateway.Handle("/pipeline", "first", "refuse", "second")
+
+	status, body := f.post(t, "/pipeline", `{"seen":[]}`)
+	require.Equal(t, http.StatusBadGateway, status)
+	require.JSONEq(t, `{"error":"refused"}`, body)
+
+	// aborted by the last stage
+	f.gateway.Handle("/last", "first", "refuse")
+	status, body = f.post(t, "/last", `{"seen":[]}`)
+	require.Equal(t, http.StatusBadGateway, status)
+	require.JSONEq(t, `{"error":"refused"}`, body)
+
+}
+
+func TestGatewayErrors(t *testing.T) {
+
+	f := newFixture(t, Options{MaxBody: 100})
+	defer f.close()
+	f.gateway.Handle("/pipeline", "first")
+	f.gateway.HandleRoute("/nowhere", Route{Pipeline: []string{"nowhere"}, Timeout: 50 * time.Millisecond})
+
+	status, _ := f.post(t, "/missing", `{}`)
+	require.Equal(t, http.StatusNotFound, status)
+	status, _ = f.post(t, "/pipeline", `{not json`)
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = f.post(t, "/pipeline", `{"seen":"`+strings.Repeat("x", 100)+`"}`)
+	require.Equal(t, http.StatusRequestEntityTooLarge, status)
+	status, _ = f.post(t, "/nowhere", `{}`)
+	require.Equal(t, http.StatusGatewayTimeout, status)
+
+	req, err := http.NewRequest("DELETE", f.server.URL+"/pipeline", nil)
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+	require.Equal(t, "GET, POST", res.Header.Get("Allow"))
+
+	// routes can be removed while serving
+	f.gateway.Remove("/pipeline")
+	status, _ = f.post(t, "/pipeline", `{"seen":[]}`)
+	require.Equal(t, http.StatusNotFound, status)
+
+}
+
+func TestGatewayNotRunning(t *testing.T) {
+
+	f := newFixture(t, Options{})
+	defer f.close()
+	f.gateway.Handle("/pipeline", "first")
+	f.direct.Stop(stop.NoWait)
+	<-f.direct.StopChan()
+
+	status, _ := f.post(t, "/pipeline", `{"seen":[]}`)
+	require.Equal(t, http.StatusServiceUnavailable, status)
+
+}
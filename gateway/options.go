@@ -0,0 +1,82 @@
+package gateway
+
+import "time"
+
+// Options controls how a Gateway serves requests and streams.
+type Options struct {
+	// Timeout is how long a route waits for the response from its
+	// pipeline, unless the Route sets its own. Zero means
+	// DefaultTimeout.
+	Timeout time.Duration
+	// ContentType is the Content-Type of what the Codec encodes.
+	// Empty means DefaultContentType.
+	ContentType string
+	// MaxBody is the largest request body, in bytes, a route
+	// accepts. Zero means DefaultMaxBody.
+	MaxBody int64
+	// Buffer is the number of events held for each stream while the
+	// client catches up. Events that arrive while the buffer is full
+	// are dropped. Zero means DefaultBuffer.
+	Buffer int
+	// KeepAlive is how often a stream sends something when no
+	// events arrive, so that proxies keep the connection open, and
+	// so that clients that have gone are noticed. Zero means
+	// DefaultKeepAlive.
+	KeepAlive time.Duration
+	// AllowedOrigins is the origins, such as "https://example.com",
+	// of pages on other sites that may open WebSocket streams, or
+	// "*" for any. Pages from other origins get 403, so that they
+	// cannot open streams with a visitor's cookies. The Gateway's
+	// own origin, and clients that send no Origin, are always
+	// allowed.
+	AllowedOrigins []string
+}
+
+// the defaults used when Options does not set a value
+const (
+	DefaultTimeout     = 10 * time.Second
+	DefaultContentType = "application/json"
+	DefaultMaxBody     = 1 << 20
+	DefaultBuffer      = 64
+	DefaultKeepAlive   = 15 * time.Second
+)
+
+// timeout gets how long routes wait for a response.
+func (o Options) timeout() time.Duration {
+	if o.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return o.Timeout
+}
+
+// contentType gets the Content-Type of what the Codec encodes.
+func (o Options) contentType() string {
+	if o.ContentType == "" {
+		return DefaultContentType
+	}
+	return o.ContentType
+}
+
+// maxBody gets the largest request body.
+func (o Options) maxBody() int64 {
+	if o.MaxBody == 0 {
+		return DefaultMaxBody
+	}
+	return o.MaxBody
+}
+
+// buffer gets the number of events held for each stream.
+func (o Options) buffer() int {
+	if o.Buffer == 0 {
+		return DefaultBuffer
+	}
+	return o.Buffer
+}
+
+// keepAlive gets how often idle streams send something.
+func (o Options) keepAlive() time.Duration {
+	if o.KeepAlive == 0 {
+		return DefaultKeepAlive
+	}
+	return o.KeepAlive
+}
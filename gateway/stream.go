@@ -0,0 +1,153 @@
+package gateway
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/qp/go"
+)
+
+// stream sends events to a client.
+type stream interface {
+	// send sends an encoded event.
+	send(data []byte) error
+	// keepAlive sends something that is not an event.
+	keepAlive() error
+	// done gets a channel that is closed once the client has gone.
+	done() <-chan struct{}
+	// close ends the stream.
+	close()
+}
+
+// serveStream streams the events on the channel to the client until
+// it goes away.
+func (g *Gateway) serveStream(w http.ResponseWriter, r *http.Request, channel string) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	events := make(chan []byte, g.options.buffer())
+	subscription, err := g.subscriber.Subscribe(channel, qp.EventHandlerFunc(func(event *qp.Event) {
+		data, err := g.codec.Marshal(event)
+		if err != nil {
+			if g.log.Err() {
+				g.log.Err("failed to encode event:", err)
+			}
+			return
+		}
+		select {
+		case events <- data:
+		default:
+			if g.log.Warn() {
+				g.log.Warn("dropped event on", channel, "for slow client", r.RemoteAddr)
+			}
+		}
+	}))
+	if err != nil {
+		if g.log.Err() {
+			g.log.Err("failed to subscribe:", err)
+		}
+		http.Error(w, "failed to subscribe: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer subscription.Unsubscribe()
+	var s stream
+	if isWebSocket(r) {
+		// upgrade writes the response if it fails
+		if s, err = upgrade(w, r, textual(g.options.contentType()), g.options.AllowedOrigins); err != nil {
+			return
+		}
+	} else if s, err = newEventStream(w, r); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer s.close()
+	if g.log.Info() {
+		g.log.Info("streaming", channel, "to", r.RemoteAddr)
+	}
+	keepAlive := time.NewTicker(g.options.keepAlive())
+	defer keepAlive.Stop()
+	for {
+		select {
+		case data := <-events:
+			err = s.send(data)
+		case <-keepAlive.C:
+			err = s.keepAlive()
+		case <-s.done():
+			return
+		}
+		if err != nil {
+			if g.log.Info() {
+				g.log.Info("stopped streaming", channel, "to", r.RemoteAddr+":", err)
+			}
+			return
+		}
+	}
+}
+
+// textual gets whether the content type is text, rather than binary.
+func textual(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") ||
+		strings.Contains(contentType, "json") ||
+		strings.Contains(contentType, "xml")
+}
+
+// eventStream sends Server-Sent Events.
+type eventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	gone    <-chan struct{}
+}
+
+// errNoFlush is returned when the ResponseWriter cannot send events
+// as they happen.
+var errNoFlush = errors.New("streaming is not supported")
+
+// newEventStream writes the response header for an event stream.
+func newEventStream(w http.ResponseWriter, r *http.Request) (*eventStream, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errNoFlush
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &eventStream{w: w, flusher: flusher, gone: r.Context().Done()}, nil
+}
+
+// send sends the event in data lines, one for each of its lines.
+func (e *eventStream) send(data []byte) error {
+	var b bytes.Buffer
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		b.WriteString("data: ")
+		b.Write(bytes.TrimSuffix(line, []byte("\r")))
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	return e.write(b.Bytes())
+}
+
+// keepAlive sends a comment, which clients ignore.
+func (e *eventStream) keepAlive() error {
+	return e.write([]byte(": keepalive\n\n"))
+}
+
+func (e *eventStream) write(b []byte) error {
+	if _, err := e.w.Write(b); err != nil {
+		return err
+	}
+	e.flusher.Flush()
+	return nil
+}
+
+func (e *eventStream) done() <-chan struct{} {
+	return e.gone
+}
+
+// close does nothing, as the response ends when the handler returns.
+func (e *eventStream) close() {}
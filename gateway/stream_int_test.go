@@ -0,0 +1,233 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// publishUntil publishes the data on the channel until the stream
+// has subscribed and gets it, as the client cannot tell when that
+// is.
+func (f *fixture) publishUntil(t *testing.T, channel string, data interface{}, got chan string) string {
+	for i := 0; i < 100; i++ {
+		require.NoError(t, f.publisher.Publish(channel, data))
+		select {
+		case event := <-got:
+			return event
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	require.FailNow(t, "no event received")
+	return ""
+}
+
+func TestGatewayServerSentEvents(t *testing.T) {
+
+	f := newFixture(t, Options{})
+	defer f.close()
+	f.gateway.Stream("/events", "orders.*")
+
+	res, err := http.Get(f.server.URL + "/events")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	got := make(chan string, 100)
+	go func() {
+		r := bufio.NewReader(res.Body)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(line, "data: ") {
+				got <- strings.TrimSpace(strings.TrimPrefix(line, "data: "))
+			}
+		}
+	}()
+	event := f.publishUntil(t, "orders.created", "order", got)
+	require.JSONEq(t, `{"from":"service.test","data":"order"}`, event)
+
+}
+
+// WebSocket opcodes
+const (
+	opText  byte = 0x1
+	opClose byte = 0x8
+	opPing  byte = 0x9
+	opPong  byte = 0xa
+)
+
+// dialWebSocket connects to the path, and completes the handshake.
+func dialWebSocket(t *testing.T, f *fixture, path string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(f.server.URL, "http://"))
+	require.NoError(t, err)
+	// the key and accept key from RFC 6455 section 1.3
+	io.WriteString(conn, "GET "+path+" HTTP/1.1\r\n"+
+		"Host: gateway\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	require.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", res.Header.Get("Sec-WebSocket-Accept"))
+	return conn, r
+}
+
+// readServerFrame reads an unmasked frame with a short payload.
+func readServerFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, header[1]&0x7f)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0] & 0x0f, payload, nil
+}
+
+// writeClientFrame writes a masked frame with a short payload.
+func writeClientFrame(conn net.Conn, opcode byte, payload []byte) {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	conn.Write(frame)
+}
+
+func TestGatewayWebSocket(t *testing.T) {
+
+	f := newFixture(t, Options{KeepAlive: 50 * time.Millisecond})
+	defer f.close()
+	f.gateway.Stream("/events", "orders.*")
+	conn, r := dialWebSocket(t, f, "/events")
+	defer conn.Close()
+
+	got := make(chan string, 100)
+	pings := make(chan []byte, 100)
+	closed := make(chan []byte, 1)
+	go func() {
+		for {
+			opcode, payload, err := readServerFrame(r)
+			if err != nil {
+				return
+			}
+			switch opcode {
+			case opText:
+				got <- string(payload)
+			case opPing:
+				pings <- payload
+			case opPong:
+				pings <- payload
+			case opClose:
+				closed <- payload
+				return
+			}
+		}
+	}()
+	event := f.publishUntil(t, "orders.created", "order", got)
+	require.JSONEq(t, `{"from":"service.test","data":"order"}`, event)
+
+	// idle streams are kept alive, and pings are answered
+	select {
+	case <-pings:
+	case <-time.After(1 * time.Second):
+		require.FailNow(t, "no keep alive sent")
+	}
+	writeClientFrame(conn, opPing, []byte("hello"))
+	deadline := time.After(1 * time.Second)
+	for pong := false; !pong; {
+		select {
+		case payload := <-pings:
+			pong = string(payload) == "hello"
+		case <-deadline:
+			require.FailNow(t, "ping not answered")
+		}
+	}
+
+	// closing is echoed
+	status := make([]byte, 2)
+	binary.BigEndian.PutUint16(status, 1000)
+	writeClientFrame(conn, opClose, status)
+	select {
+	case payload := <-closed:
+		require.Equal(t, status, payload)
+	case <-time.After(1 * time.Second):
+		require.FailNow(t, "close not echoed")
+	}
+
+}
+
+func TestGatewayWebSocketVersion(t *testing.T) {
+
+	f := newFixture(t, Options{})
+	defer f.close()
+	f.gateway.Stream("/events", "orders.*")
+	req, err := http.NewRequest("GET", f.server.URL+"/events", nil)
+	require.NoError(t, err)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "8")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusUpgradeRequired, res.StatusCode)
+	require.Equal(t, "13", res.Header.Get("Sec-WebSocket-Version"))
+
+}
+
+// upgradeStatus asks to upgrade a connection to the path to a
+// WebSocket, from a page with the origin, and gets the status of the
+// response.
+func upgradeStatus(t *testing.T, f *fixture, path, origin string) int {
+	req, err := http.NewRequest("GET", f.server.URL+path, nil)
+	require.NoError(t, err)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Origin", origin)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestGatewayWebSocketOrigin(t *testing.T) {
+
+	f := newFixture(t, Options{})
+	defer f.close()
+	f.gateway.Stream("/events", "orders.*")
+
+	require.Equal(t, http.StatusSwitchingProtocols, upgradeStatus(t, f, "/events", f.server.URL))
+	require.Equal(t, http.StatusForbidden, upgradeStatus(t, f, "/events", "https://evil.example"))
+
+}
+
+func TestGatewayWebSocketAllowedOrigins(t *testing.T) {
+
+	f := newFixture(t, Options{AllowedOrigins: []string{"https://app.example"}})
+	defer f.close()
+	f.gateway.Stream("/events", "orders.*")
+
+	require.Equal(t, http.StatusSwitchingProtocols, upgradeStatus(t, f, "/events", "https://app.example"))
+	require.Equal(t, http.StatusSwitchingProtocols, upgradeStatus(t, f, "/events", f.server.URL))
+	require.Equal(t, http.StatusForbidden, upgradeStatus(t, f, "/events", "https://evil.example"))
+
+}
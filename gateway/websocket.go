@@ -0,0 +1,115 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxClientMessage is the largest message a client may send.
+// Clients have nothing to send to a stream but control frames, which
+// are no more than 125 bytes.
+const maxClientMessage = 4096
+
+// writeTimeout is how long writing a frame may take before the
+// client is taken to have gone.
+const writeTimeout = 10 * time.Second
+
+// webSocket sends events in WebSocket messages.
+type webSocket struct {
+	conn        *websocket.Conn
+	messageType int
+	gone        chan struct{}
+}
+
+// isWebSocket gets whether the request asks to upgrade the
+// connection to a WebSocket.
+func isWebSocket(r *http.Request) bool {
+	return websocket.IsWebSocketUpgrade(r)
+}
+
+// upgrade completes the WebSocket handshake, and starts reading the
+// client's frames. Events are sent in text messages if text is true,
+// and in binary messages otherwise. Requests from origins that are
+// not allowed get 403. If the handshake fails, upgrade writes the
+// response and returns an error.
+func upgrade(w http.ResponseWriter, r *http.Request, text bool, allowed []string) (*webSocket, error) {
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported WebSocket version")
+	}
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return originAllowed(r, allowed)
+		},
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadLimit(maxClientMessage)
+	ws := &webSocket{conn: conn, messageType: websocket.BinaryMessage, gone: make(chan struct{})}
+	if text {
+		ws.messageType = websocket.TextMessage
+	}
+	go ws.read()
+	return ws, nil
+}
+
+// originAllowed gets whether a page from the request's origin may
+// open a WebSocket: its own origin, one of the allowed ones, or any
+// if "*" is allowed. Requests with no Origin are not from browsers,
+// and are allowed.
+func originAllowed(r *http.Request, allowed []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, a := range allowed {
+		if a == "*" || strings.EqualFold(strings.TrimSuffix(a, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// read reads the client's frames until the connection ends. Pings
+// and closes are answered while reading, and other messages are
+// ignored.
+func (ws *webSocket) read() {
+	defer close(ws.gone)
+	for {
+		if _, _, err := ws.conn.NextReader(); err != nil {
+			return
+		}
+	}
+}
+
+// send sends the event in a message.
+func (ws *webSocket) send(data []byte) error {
+	ws.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return ws.conn.WriteMessage(ws.messageType, data)
+}
+
+// keepAlive sends a ping.
+func (ws *webSocket) keepAlive() error {
+	return ws.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+}
+
+func (ws *webSocket) done() <-chan struct{} {
+	return ws.gone
+}
+
+// close sends a normal closure, and closes the connection.
+func (ws *webSocket) close() {
+	ws.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeTimeout))
+	ws.conn.Close()
+}
@@ -0,0 +1,92 @@
+package grpcbridge
+
+import (
+	"context"
+
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Client makes unary calls to a gRPC backend, so that pipeline
+// stages can be served by it.
+type Client struct {
+	conn    grpc.ClientConnInterface
+	codec   qp.Codec
+	options Options
+	log     slog.Logger
+}
+
+// NewClient makes a new Client that calls the backend on the
+// connection, such as a *grpc.ClientConn, encoding the messages it
+// sends and decoding the responses with the codec.
+func NewClient(conn grpc.ClientConnInterface, codec qp.Codec) *Client {
+	return NewClientOptions(conn, codec, Options{})
+}
+
+// NewClientOptions makes a new Client with the specified options.
+func NewClientOptions(conn grpc.ClientConnInterface, codec qp.Codec, options Options) *Client {
+	return &Client{
+		conn:    conn,
+		codec:   codec,
+		options: options,
+		log:     slog.NilLogger,
+	}
+}
+
+// SetLogger sets the Logger to log to.
+func (c *Client) SetLogger(log slog.Logger) {
+	c.log = log
+}
+
+// Invoke calls the method, such as "orders.Orders/Create", with the
+// message encoded from in, and decodes the response into out. A call
+// that fails returns an error with a gRPC status, which
+// status.Code gets the code of.
+func (c *Client) Invoke(ctx context.Context, method string, in, out interface{}) error {
+	message, err := c.codec.Marshal(in)
+	if err != nil {
+		return status.Error(codes.Internal, "failed to encode message: "+err.Error())
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.options.timeout())
+		defer cancel()
+	}
+	options := []grpc.CallOption{grpc.ForceCodecV2(rawCodec{})}
+	if c.options.ContentSubtype != "" {
+		options = append(options, grpc.CallContentSubtype(c.options.ContentSubtype))
+	}
+	var reply []byte
+	if err := c.conn.Invoke(ctx, methodPath(method), &message, &reply, options...); err != nil {
+		return err
+	}
+	if out != nil && len(reply) > 0 {
+		if err := c.codec.Unmarshal(reply, out); err != nil {
+			return status.Error(codes.Internal, "failed to decode response: "+err.Error())
+		}
+	}
+	return nil
+}
+
+// Handler makes a TransactionHandler that calls the method with the
+// transaction's data, and replaces the data with the response. If
+// the call fails, the transaction is aborted, so that it goes back
+// to the requester, with the status in its data under StatusKey.
+func (c *Client) Handler(method string) qp.TransactionHandler {
+	return qp.TransactionHandlerFunc(func(tx *qp.Transaction) *qp.Transaction {
+		var out interface{}
+		if err := c.Invoke(context.Background(), method, tx.Data, &out); err != nil {
+			if c.log.Warn() {
+				c.log.Warn("call to", method, "failed:", err)
+			}
+			tx.Abort()
+			tx.Data = failed(err)
+			return tx
+		}
+		tx.Data = out
+		return tx
+	})
+}
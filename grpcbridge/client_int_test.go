@@ -0,0 +1,138 @@
+package grpcbridge
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/qp/go"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/mem"
+	"google.golang.org/grpc/status"
+)
+
+// jsonCodec is the gRPC codec a JSON backend registers, which calls
+// with the content subtype "json" are decoded with.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) (mem.BufferSlice, error) {
+	b, err := json.Marshal(v)
+	return mem.BufferSlice{mem.SliceBuffer(b)}, err
+}
+
+func (jsonCodec) Unmarshal(data mem.BufferSlice, v interface{}) error {
+	return json.Unmarshal(data.Materialize(), v)
+}
+
+func (jsonCodec) Name() string { return "json" }
+
+func init() {
+	encoding.RegisterCodecV2(jsonCodec{})
+}
+
+// backend is a gRPC service, test.Backend, whose Upper method upper
+// cases the name it is given, and fails with NotFound when the name
+// is empty.
+var backend = grpc.ServiceDesc{
+	ServiceName: "test.Backend",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Upper",
+		Handler: func(_ interface{}, ctx context.Context, decode func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+			var in struct {
+				Name string `json:"name"`
+			}
+			if err := decode(&in); err != nil {
+				return nil, err
+			}
+			if in.Name == "" {
+				return nil, status.Error(codes.NotFound, "no name, 100% sure")
+			}
+			return map[string]string{"name": strings.ToUpper(in.Name)}, nil
+		},
+	}},
+}
+
+// dialBackend serves the backend, and returns a Client that calls it
+// with JSON.
+func dialBackend(t *testing.T) (*Client, func()) {
+	srv := grpc.NewServer()
+	srv.RegisterService(&backend, struct{}{})
+	conn, closeConn := dial(t, srv)
+	return NewClientOptions(conn, qp.JSON, Options{ContentSubtype: "json"}), closeConn
+}
+
+func TestClientInvoke(t *testing.T) {
+
+	client, closeClient := dialBackend(t)
+	defer closeClient()
+
+	var out map[string]interface{}
+	require.NoError(t, client.Invoke(context.Background(), "test.Backend/Upper", map[string]interface{}{"name": "qp"}, &out))
+	require.Equal(t, "QP", out["name"])
+
+	err := client.Invoke(context.Background(), "test.Backend/Upper", map[string]interface{}{}, &out)
+	requireCode(t, codes.NotFound, err)
+	require.Equal(t, "no name, 100% sure", status.Convert(err).Message())
+
+	err = client.Invoke(context.Background(), "test.Backend/Lower", map[string]interface{}{}, &out)
+	requireCode(t, codes.Unimplemented, err)
+
+}
+
+func TestClientHandler(t *testing.T) {
+
+	client, closeClient := dialBackend(t)
+	defer closeClient()
+
+	// a stage served by the backend, before one that must be skipped
+	// when the call fails
+	requester, _, stopStages := runStages(t, map[string]qp.TransactionHandlerFunc{
+		"upper": client.Handler("test.Backend/Upper").Handle,
+		"after": tag("after"),
+	})
+	defer stopStages()
+	s := NewServer(qp.JSON, requester)
+	s.Handle("test.Bridge/Upper", "upper", "after")
+	conn, closeConn := dial(t, s.GRPCServer())
+	defer closeConn()
+	bridge := NewClient(conn, qp.JSON)
+
+	var out map[string]interface{}
+	require.NoError(t, bridge.Invoke(context.Background(), "test.Bridge/Upper", map[string]interface{}{"name": "qp"}, &out))
+	require.Equal(t, map[string]interface{}{"name": "QP", "tags": []interface{}{"after"}}, out)
+
+	// the backend's status reaches the caller
+	err := bridge.Invoke(context.Background(), "test.Bridge/Upper", map[string]interface{}{}, &out)
+	requireCode(t, codes.NotFound, err)
+	require.Equal(t, "no name, 100% sure", status.Convert(err).Message())
+
+}
+
+func TestStatusData(t *testing.T) {
+
+	data := failed(status.Error(codes.NotFound, "gone"))
+	s, ok := statusFrom(data)
+	require.True(t, ok)
+	require.Equal(t, codes.NotFound, s.Code())
+
+	// as it comes back from the requester
+	b, err := qp.JSON.Marshal(data)
+	require.NoError(t, err)
+	var decoded interface{}
+	require.NoError(t, qp.JSON.Unmarshal(b, &decoded))
+	s, ok = statusFrom(decoded)
+	require.True(t, ok)
+	require.Equal(t, codes.NotFound, s.Code())
+	require.Equal(t, "gone", s.Message())
+
+	for _, data := range []interface{}{nil, "x", map[string]interface{}{StatusKey: "x"}, map[string]interface{}{StatusKey: map[string]interface{}{"code": float64(0)}}} {
+		_, ok := statusFrom(data)
+		require.False(t, ok, "%v", data)
+	}
+
+}
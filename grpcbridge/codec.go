@@ -0,0 +1,43 @@
+package grpcbridge
+
+import (
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/proto"
+	"google.golang.org/grpc/mem"
+)
+
+// rawCodec is a gRPC codec that passes the messages of the calls
+// the bridge serves and makes through as they are, so that the qp
+// Codec can decode and encode them. Messages of other types, such
+// as those of services registered on the same grpc.Server, are left
+// to the protocol buffers codec.
+type rawCodec struct{}
+
+// ensure the interface is satisfied
+var _ encoding.CodecV2 = rawCodec{}
+
+// Marshal gets the message, or encodes it with protocol buffers if
+// it is not a *[]byte.
+func (rawCodec) Marshal(v interface{}) (mem.BufferSlice, error) {
+	if b, ok := v.(*[]byte); ok {
+		return mem.BufferSlice{mem.SliceBuffer(*b)}, nil
+	}
+	return encoding.GetCodecV2(proto.Name).Marshal(v)
+}
+
+// Unmarshal copies the message into v, or decodes it with protocol
+// buffers if v is not a *[]byte.
+func (rawCodec) Unmarshal(data mem.BufferSlice, v interface{}) error {
+	if b, ok := v.(*[]byte); ok {
+		*b = data.Materialize()
+		return nil
+	}
+	return encoding.GetCodecV2(proto.Name).Unmarshal(data, v)
+}
+
+// Name gets the content subtype calls are made with when Options
+// does not set one. It is protocol buffers', so that calls are plain
+// application/grpc, as a generated client's are.
+func (rawCodec) Name() string {
+	return proto.Name
+}
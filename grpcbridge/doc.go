@@ -0,0 +1,34 @@
+// Package grpcbridge connects qp endpoints to gRPC services.
+//
+// A Server is a generic gRPC service: it serves unary calls to the
+// methods it routes by issuing the call's message to a pipeline
+// with a Requester, and returning the data of the response that
+// comes back. It is served by a grpc.Server, as the service for
+// methods that no other service is registered for:
+//
+//	s := grpcbridge.NewServer(qp.JSON, requester)
+//	s.Handle("orders.Orders/Create", "validate", "price", "store")
+//	s.HandleRoute("orders.Orders/Report", grpcbridge.Route{Pipeline: []string{"report"}, Timeout: 30 * time.Second})
+//	l, _ := net.Listen("tcp", ":50051")
+//	s.GRPCServer().Serve(l)
+//
+// A Client calls a gRPC backend on a grpc.ClientConn, and its
+// Handler serves a pipeline stage by calling a method with the
+// transaction's data:
+//
+//	conn, _ := grpc.NewClient("pricing:50051", grpc.WithTransportCredentials(insecure.NewCredentials()))
+//	c := grpcbridge.NewClientOptions(conn, qp.JSON, grpcbridge.Options{ContentSubtype: "json"})
+//	responder.Handle("price", c.Handler("pricing.Pricing/Quote"))
+//
+// Messages go between gRPC and the Codec as they are, whatever the
+// content subtype of the call, so the other side must encode them
+// the way the Codec does. A Codec that speaks protocol buffers
+// serves generated clients, and one for JSON serves clients that
+// call with a JSON codec. Streaming calls are not supported.
+//
+// When a call a stage makes fails, the transaction is aborted and
+// goes back to the requester with the call's status in its data,
+// under StatusKey. A Server that gets such a response fails its own
+// call with that status, so a backend's NotFound reaches the caller
+// as NotFound.
+package grpcbridge
@@ -0,0 +1,31 @@
+package grpcbridge
+
+import "time"
+
+// Options controls how a Server serves calls, and how a Client
+// makes them.
+type Options struct {
+	// Timeout is how long a Server waits for the response from a
+	// route's pipeline when neither the route nor the caller set a
+	// deadline, and how long a Client waits for a backend when the
+	// context it is given has no deadline. Zero means
+	// DefaultTimeout.
+	Timeout time.Duration
+	// ContentSubtype names the encoding of messages the Codec
+	// makes, as in application/grpc+json, that a Client calls
+	// backends with. Empty means plain application/grpc, which
+	// gRPC takes to mean protocol buffers. A Server answers in
+	// whatever the caller sent.
+	ContentSubtype string
+}
+
+// DefaultTimeout is the Timeout used when Options does not set one.
+const DefaultTimeout = 10 * time.Second
+
+// timeout gets how long to wait when no deadline is set.
+func (o Options) timeout() time.Duration {
+	if o.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return o.Timeout
+}
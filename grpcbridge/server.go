@@ -0,0 +1,163 @@
+package grpcbridge
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Route is a pipeline that calls to a method are issued to.
+type Route struct {
+	// Pipeline is the endpoints the request goes through, in order.
+	Pipeline []string
+	// Timeout is how long to wait for the response when the caller
+	// has not set a shorter deadline. Zero means the Timeout in the
+	// Server's Options.
+	Timeout time.Duration
+}
+
+// Server is a generic gRPC service that issues the unary calls it
+// gets to the pipelines of its routes. It is served by a grpc.Server
+// made with GRPCServer.
+type Server struct {
+	codec     qp.Codec
+	requester qp.Requester
+	options   Options
+	lock      sync.RWMutex
+	routes    map[string]Route
+	log       slog.Logger
+}
+
+// NewServer makes a new Server that issues requests with the
+// requester, decoding the messages of calls and encoding the
+// responses with the codec.
+func NewServer(codec qp.Codec, requester qp.Requester) *Server {
+	return NewServerOptions(codec, requester, Options{})
+}
+
+// NewServerOptions makes a new Server with the specified options.
+func NewServerOptions(codec qp.Codec, requester qp.Requester, options Options) *Server {
+	return &Server{
+		codec:     codec,
+		requester: requester,
+		options:   options,
+		routes:    make(map[string]Route),
+		log:       slog.NilLogger,
+	}
+}
+
+// SetLogger sets the Logger to log to.
+func (s *Server) SetLogger(log slog.Logger) {
+	s.log = log
+}
+
+// Handle issues calls to the method, such as "orders.Orders/Create",
+// to the pipeline.
+func (s *Server) Handle(method string, pipeline ...string) {
+	s.HandleRoute(method, Route{Pipeline: pipeline})
+}
+
+// HandleRoute issues calls to the method, such as
+// "orders.Orders/Create", to the route's pipeline.
+//
+// The call's message is decoded with the codec and becomes the
+// request's data, and the data of the response that comes back is
+// encoded with the codec and returned. A message that cannot be
+// decoded gets InvalidArgument, a request that cannot be issued gets
+// Unavailable, and no response before the deadline gets
+// DeadlineExceeded. A response whose data holds a status, from a
+// stage that a Client's Handler failed in, gets that status.
+func (s *Server) HandleRoute(method string, route Route) {
+	s.lock.Lock()
+	s.routes[methodPath(method)] = route
+	s.lock.Unlock()
+}
+
+// Remove stops serving the method, which then gets Unimplemented.
+func (s *Server) Remove(method string) {
+	s.lock.Lock()
+	delete(s.routes, methodPath(method))
+	s.lock.Unlock()
+}
+
+// GRPCServer makes a grpc.Server that serves the Server's routes
+// with the options. Services registered on it are served as usual,
+// and calls to any other method go to the Server.
+func (s *Server) GRPCServer(options ...grpc.ServerOption) *grpc.Server {
+	options = append(options,
+		grpc.ForceServerCodecV2(rawCodec{}),
+		grpc.UnknownServiceHandler(s.serve))
+	return grpc.NewServer(options...)
+}
+
+// serve serves a unary call to a method no service is registered
+// for.
+func (s *Server) serve(_ interface{}, stream grpc.ServerStream) error {
+	method, _ := grpc.MethodFromServerStream(stream)
+	s.lock.RLock()
+	route, ok := s.routes[method]
+	s.lock.RUnlock()
+	if !ok {
+		return s.fail(method, status.Error(codes.Unimplemented, "unknown method "+method))
+	}
+	var message []byte
+	if err := stream.RecvMsg(&message); err != nil {
+		return s.fail(method, err)
+	}
+	var data interface{}
+	if len(message) > 0 {
+		if err := s.codec.Unmarshal(message, &data); err != nil {
+			return s.fail(method, status.Error(codes.InvalidArgument, "failed to decode message: "+err.Error()))
+		}
+	}
+	timeout := route.Timeout
+	if timeout == 0 {
+		timeout = s.options.timeout()
+	}
+	if deadline, ok := stream.Context().Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	if s.log.Info() {
+		s.log.Info("issuing", method, "to", route.Pipeline)
+	}
+	future, err := s.requester.Issue(route.Pipeline, data)
+	if err != nil {
+		return s.fail(method, status.Error(codes.Unavailable, "failed to issue request: "+err.Error()))
+	}
+	response, err := future.Response(timeout)
+	if err != nil {
+		return s.fail(method, status.Error(codes.DeadlineExceeded, "no response: "+err.Error()))
+	}
+	if st, ok := statusFrom(response.Data); ok {
+		return s.fail(method, st.Err())
+	}
+	out, err := s.codec.Marshal(response.Data)
+	if err != nil {
+		return s.fail(method, status.Error(codes.Internal, "failed to encode response: "+err.Error()))
+	}
+	return stream.SendMsg(&out)
+}
+
+// fail logs the error the call to the method failed with, and
+// returns it.
+func (s *Server) fail(method string, err error) error {
+	if s.log.Warn() {
+		s.log.Warn("call to", method, "failed:", err)
+	}
+	return err
+}
+
+// methodPath gets the full name of the method, which calls are made
+// on.
+func methodPath(method string) string {
+	if strings.HasPrefix(method, "/") {
+		return method
+	}
+	return "/" + method
+}
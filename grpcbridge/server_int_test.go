@@ -0,0 +1,201 @@
+package grpcbridge
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/qp/go/inproc"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// dial serves the grpc.Server on a bufconn listener, and returns a
+// connection to it, and a func that closes both.
+func dial(t *testing.T, srv *grpc.Server) (*grpc.ClientConn, func()) {
+	l := bufconn.Listen(1 << 20)
+	go srv.Serve(l)
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return l.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	return conn, func() {
+		conn.Close()
+		srv.Stop()
+	}
+}
+
+// runStages serves the stages on a Bus of their own, and returns a
+// Requester that issues requests to them, the transport it uses,
+// and a func that stops them.
+func runStages(t *testing.T, stages map[string]qp.TransactionHandlerFunc) (qp.Requester, *inproc.Direct, func()) {
+	bus := inproc.NewBus()
+	direct := bus.NewDirect()
+	responder := qp.NewResponder("stages", "test", qp.JSON, direct)
+	for name, handler := range stages {
+		require.NoError(t, responder.HandleFunc(name, handler))
+	}
+	requester, err := qp.NewRequester("bridge", "test", qp.JSON, direct)
+	require.NoError(t, err)
+	require.NoError(t, direct.Start())
+	return requester, direct, func() {
+		direct.Stop(stop.NoWait)
+		bus.Close()
+	}
+}
+
+// tag is a stage that adds its name to the "tags" in the data.
+func tag(name string) qp.TransactionHandlerFunc {
+	return func(tx *qp.Transaction) *qp.Transaction {
+		data := tx.Data.(map[string]interface{})
+		tags, _ := data["tags"].([]interface{})
+		data["tags"] = append(tags, name)
+		return tx
+	}
+}
+
+// requireCode requires the error to have a gRPC status with the code.
+func requireCode(t *testing.T, code codes.Code, err error) {
+	require.Error(t, err)
+	s, ok := status.FromError(err)
+	require.True(t, ok, "%v has no gRPC status", err)
+	require.Equal(t, code, s.Code(), s.Message())
+}
+
+func TestServerRoute(t *testing.T) {
+
+	requester, _, stopStages := runStages(t, map[string]qp.TransactionHandlerFunc{"a": tag("a"), "b": tag("b")})
+	defer stopStages()
+	s := NewServer(qp.JSON, requester)
+	s.Handle("test.Test/Tags", "a", "b")
+	conn, closeConn := dial(t, s.GRPCServer())
+	defer closeConn()
+
+	var out map[string]interface{}
+	client := NewClientOptions(conn, qp.JSON, Options{ContentSubtype: "json"})
+	require.NoError(t, client.Invoke(context.Background(), "test.Test/Tags", map[string]interface{}{"id": 1}, &out))
+	require.Equal(t, map[string]interface{}{"id": float64(1), "tags": []interface{}{"a", "b"}}, out)
+
+	// a message that cannot be decoded
+	var reply []byte
+	message := []byte("{")
+	err := conn.Invoke(context.Background(), "/test.Test/Tags", &message, &reply, grpc.ForceCodecV2(rawCodec{}))
+	requireCode(t, codes.InvalidArgument, err)
+
+}
+
+// protoCodec encodes map data as protocol buffers Structs, as the
+// messages of a generated client would be.
+var protoCodec = qp.NewCodec(func(object interface{}) ([]byte, error) {
+	s, err := structpb.NewStruct(object.(map[string]interface{}))
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(s)
+}, func(data []byte, to interface{}) error {
+	var s structpb.Struct
+	if err := proto.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	*to.(*interface{}) = s.AsMap()
+	return nil
+})
+
+func TestServerProtobuf(t *testing.T) {
+
+	requester, _, stopStages := runStages(t, map[string]qp.TransactionHandlerFunc{"a": tag("a")})
+	defer stopStages()
+	s := NewServer(protoCodec, requester)
+	s.Handle("test.Test/Tags", "a")
+	srv := s.GRPCServer()
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(srv, healthServer)
+	conn, closeConn := dial(t, srv)
+	defer closeConn()
+
+	// called as a generated client would, with protocol buffers
+	in, err := structpb.NewStruct(map[string]interface{}{"id": "x"})
+	require.NoError(t, err)
+	out := new(structpb.Struct)
+	require.NoError(t, conn.Invoke(context.Background(), "/test.Test/Tags", in, out))
+	require.Equal(t, map[string]interface{}{"id": "x", "tags": []interface{}{"a"}}, out.AsMap())
+
+	// services registered on the grpc.Server are still served
+	check, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, check.Status)
+
+}
+
+func TestServerUnimplemented(t *testing.T) {
+
+	requester, _, stopStages := runStages(t, map[string]qp.TransactionHandlerFunc{"a": tag("a")})
+	defer stopStages()
+	s := NewServer(qp.JSON, requester)
+	s.Handle("test.Test/Tags", "a")
+	conn, closeConn := dial(t, s.GRPCServer())
+	defer closeConn()
+	client := NewClient(conn, qp.JSON)
+
+	err := client.Invoke(context.Background(), "test.Test/Missing", map[string]interface{}{}, nil)
+	requireCode(t, codes.Unimplemented, err)
+
+	s.Remove("test.Test/Tags")
+	err = client.Invoke(context.Background(), "test.Test/Tags", map[string]interface{}{}, nil)
+	requireCode(t, codes.Unimplemented, err)
+
+}
+
+func TestServerDeadline(t *testing.T) {
+
+	requester, _, stopStages := runStages(t, nil)
+	defer stopStages()
+	s := NewServer(qp.JSON, requester)
+	s.HandleRoute("test.Test/Route", Route{Pipeline: []string{"nobody"}, Timeout: 50 * time.Millisecond})
+	s.Handle("test.Test/Caller", "nobody")
+	conn, closeConn := dial(t, s.GRPCServer())
+	defer closeConn()
+	client := NewClient(conn, qp.JSON)
+
+	// the route's timeout
+	err := client.Invoke(context.Background(), "test.Test/Route", map[string]interface{}{}, nil)
+	requireCode(t, codes.DeadlineExceeded, err)
+
+	// the caller's deadline, which gRPC tells the server
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = client.Invoke(ctx, "test.Test/Caller", map[string]interface{}{}, nil)
+	requireCode(t, codes.DeadlineExceeded, err)
+	require.True(t, time.Since(start) < time.Second)
+
+}
+
+func TestServerNotRunning(t *testing.T) {
+
+	requester, direct, stopStages := runStages(t, map[string]qp.TransactionHandlerFunc{"a": tag("a")})
+	defer stopStages()
+	s := NewServer(qp.JSON, requester)
+	s.Handle("test.Test/Tags", "a")
+	conn, closeConn := dial(t, s.GRPCServer())
+	defer closeConn()
+	direct.Stop(stop.NoWait)
+	<-direct.StopChan()
+
+	err := NewClient(conn, qp.JSON).Invoke(context.Background(), "test.Test/Tags", map[string]interface{}{}, nil)
+	requireCode(t, codes.Unavailable, err)
+
+}
@@ -0,0 +1,49 @@
+package grpcbridge
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// StatusKey is the key of the status in the data of a transaction
+// that a gRPC call failed in. The status is a map with the call's
+// "code" and "message".
+const StatusKey = "grpcStatus"
+
+// failed makes the data of a transaction that the call failed in
+// with the error.
+func failed(err error) map[string]interface{} {
+	s := status.Convert(err)
+	return map[string]interface{}{StatusKey: map[string]interface{}{
+		"code":    int(s.Code()),
+		"message": s.Message(),
+	}}
+}
+
+// statusFrom gets the status in the data of a transaction that a
+// call failed in, as it is after being encoded and decoded on its
+// way back.
+func statusFrom(data interface{}) (*status.Status, bool) {
+	m, ok := data.(map[string]interface{})
+	if !ok || len(m) != 1 {
+		return nil, false
+	}
+	s, ok := m[StatusKey].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	var code codes.Code
+	switch c := s["code"].(type) {
+	case int:
+		code = codes.Code(c)
+	case float64:
+		code = codes.Code(c)
+	default:
+		return nil, false
+	}
+	if code == codes.OK {
+		return nil, false
+	}
+	message, _ := s["message"].(string)
+	return status.New(code, message), true
+}
@@ -0,0 +1,12 @@
+package qp
+
+// Hop is a relay an envelope went through, and the channel the
+// relay copied it to. Relays record their hops in the envelopes
+// they copy, so that relays that copy channels both ways between
+// two brokers do not copy messages back where they came from.
+type Hop struct {
+	// Relay is the ID of the relay.
+	Relay string `json:"relay"`
+	// Channel is the channel the relay copied the envelope to.
+	Channel string `json:"channel"`
+}
@@ -0,0 +1,363 @@
+package inproc
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/qp/go"
+)
+
+// Overflow is what a Bus does with a message sent while the
+// queue it belongs on is full.
+type Overflow int
+
+const (
+	// OverflowBlock makes the sender wait until there is room.
+	OverflowBlock Overflow = iota
+	// OverflowDropOldest discards the oldest message in the queue to
+	// make room for the new one. Channels share queues, so the
+	// message discarded may be on another channel.
+	OverflowDropOldest
+	// OverflowError makes the sender return ErrQueueFull.
+	OverflowError
+)
+
+// ErrQueueFull is returned when sending on a Bus whose queue is
+// full and whose Overflow is OverflowError.
+var ErrQueueFull = errors.New("queue is full")
+
+// BusOptions controls how a Bus queues messages.
+type BusOptions struct {
+	// Shards is the number of queues, each with its own goroutine
+	// handing messages to the transports. Messages on the same
+	// channel always use the same queue, so they keep their order.
+	// Values below one mean one.
+	Shards int
+	// QueueSize is the number of messages each queue buffers before
+	// Overflow applies. Zero means senders always wait for a
+	// message to be taken from the queue.
+	QueueSize int
+	// Overflow is what happens when a queue is full. Channels
+	// share queues, so OverflowDropOldest may drop a message on
+	// another channel than the one being sent on.
+	Overflow Overflow
+}
+
+// DefaultBusOptions are the options used by NewBus.
+var DefaultBusOptions = BusOptions{
+	Shards:    runtime.NumCPU(),
+	QueueSize: 1024,
+	Overflow:  OverflowBlock,
+}
+
+// Bus carries messages between the transports made from it.
+// Transports only see messages sent by transports on the same
+// Bus, so separate Buses (for example, one per test) cannot
+// interfere with each other.
+type Bus struct {
+	options      BusOptions
+	directQueues []chan *qp.Message
+	pubSubQueues []chan *qp.Message
+	quit         chan qp.Signal
+	closeOnce    sync.Once
+	dropped      uint64
+
+	directLock sync.RWMutex
+	// directInstances holds the running Direct instances in the
+	// order they started, and directNext holds the position after
+	// the instance that took the last message from each channel.
+	directInstances []*Direct
+	nextLock        sync.Mutex
+	directNext      map[string]int
+
+	pubSubLock      sync.RWMutex
+	pubSubInstances map[*PubSub]struct{}
+}
+
+// DefaultBus is the Bus used by the package level NewDirect and
+// NewPubSub functions.
+var DefaultBus = NewBus()
+
+var exists = struct{}{}
+
+// NewBus makes a new Bus with the DefaultBusOptions, ready to
+// carry messages until it is closed.
+func NewBus() *Bus {
+	return NewBusOptions(DefaultBusOptions)
+}
+
+// NewBusOptions makes a new Bus with the specified options, ready
+// to carry messages until it is closed.
+func NewBusOptions(options BusOptions) *Bus {
+	if options.Shards < 1 {
+		options.Shards = 1
+	}
+	b := &Bus{
+		options:         options,
+		directQueues:    make([]chan *qp.Message, options.Shards),
+		pubSubQueues:    make([]chan *qp.Message, options.Shards),
+		quit:            make(chan qp.Signal),
+		directNext:      make(map[string]int),
+		pubSubInstances: make(map[*PubSub]struct{}),
+	}
+	for i := 0; i < options.Shards; i++ {
+		b.directQueues[i] = make(chan *qp.Message, options.QueueSize)
+		b.pubSubQueues[i] = make(chan *qp.Message, options.QueueSize)
+		go b.processDirect(b.directQueues[i])
+		go b.processPubSub(b.pubSubQueues[i])
+	}
+	return b
+}
+
+// Close shuts the Bus down. Transports on a closed Bus cannot be
+// started, and sending on them returns qp.ErrNotRunning. Messages
+// still queued are discarded.
+// It is safe to call Close more than once.
+func (b *Bus) Close() {
+	b.closeOnce.Do(func() {
+		close(b.quit)
+	})
+}
+
+// Dropped gets the number of messages discarded to make room
+// for newer ones under OverflowDropOldest.
+func (b *Bus) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
+
+// closed gets whether the Bus has been closed.
+func (b *Bus) closed() bool {
+	select {
+	case <-b.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// send puts the message on the queue for its channel, applying
+// the Overflow policy if the queue is full.
+func (b *Bus) send(queues []chan *qp.Message, m *qp.Message) error {
+	if b.closed() {
+		return qp.ErrNotRunning
+	}
+	queue := queues[shard(m.Source, len(queues))]
+	switch b.options.Overflow {
+	case OverflowDropOldest:
+		for {
+			select {
+			case queue <- m:
+				return nil
+			case <-b.quit:
+				return qp.ErrNotRunning
+			default:
+			}
+			// make room by taking the oldest message, unless a
+			// dispatch goroutine got there first
+			select {
+			case <-queue:
+				atomic.AddUint64(&b.dropped, 1)
+			default:
+			}
+		}
+	case OverflowError:
+		select {
+		case queue <- m:
+			return nil
+		default:
+			return ErrQueueFull
+		}
+	}
+	select {
+	case queue <- m:
+		return nil
+	case <-b.quit:
+		return qp.ErrNotRunning
+	}
+}
+
+// shard picks one of n queues for the channel, by its 32-bit
+// FNV-1a hash.
+func shard(channel string, n int) int {
+	if n == 1 {
+		return 0
+	}
+	h := uint32(2166136261)
+	for i := 0; i < len(channel); i++ {
+		h ^= uint32(channel[i])
+		h *= 16777619
+	}
+	return int(h % uint32(n))
+}
+
+func (b *Bus) processDirect(queue chan *qp.Message) {
+	for {
+		select {
+		case m := <-queue:
+			b.dispatchDirect(m)
+		case <-b.quit:
+			return
+		}
+	}
+}
+
+// dispatchDirect hands the message to the next instance handling
+// its channel. A dispatcher that is replaced, removed or stopped
+// while the message waits for it refuses the message, which then
+// goes to whichever instance is next, so that it is only lost if
+// no instance handles the channel any more.
+func (b *Bus) dispatchDirect(m *qp.Message) {
+	var refused *Direct
+	for {
+		instance, dispatcher := b.nextDirect(m.Source)
+		if dispatcher == nil {
+			if refused != nil && refused.Logger.Warn() {
+				refused.Logger.Warn("dropping", m, "since no handler is bound to", m.Source)
+			}
+			return
+		}
+		// blocks the queue while the channel is at capacity
+		if dispatcher.Dispatch(m) == nil {
+			return
+		}
+		refused = instance
+	}
+}
+
+// nextDirect picks the instance that should take the next message
+// from the channel, and its dispatcher. Like a Redis list, each
+// message goes to exactly one instance, and the instances handling
+// a channel take turns, in the order they started.
+func (b *Bus) nextDirect(channel string) (*Direct, *qp.Dispatcher) {
+	b.directLock.RLock()
+	defer b.directLock.RUnlock()
+	b.nextLock.Lock()
+	defer b.nextLock.Unlock()
+	after := b.directNext[channel]
+	var first, next *Direct
+	var firstDispatcher, nextDispatcher *qp.Dispatcher
+	position := 0
+	for i, instance := range b.directInstances {
+		instance.lock.RLock()
+		d, ok := instance.dispatchers[channel]
+		instance.lock.RUnlock()
+		if !ok {
+			continue
+		}
+		if first == nil {
+			first, firstDispatcher, position = instance, d, i
+		}
+		if i >= after {
+			next, nextDispatcher, position = instance, d, i
+			break
+		}
+	}
+	if first == nil {
+		delete(b.directNext, channel)
+		return nil, nil
+	}
+	if next == nil {
+		// back round to the first
+		next, nextDispatcher = first, firstDispatcher
+	}
+	b.directNext[channel] = position + 1
+	return next, nextDispatcher
+}
+
+func (b *Bus) addDirect(d *Direct) {
+	b.directLock.Lock()
+	b.directInstances = append(b.directInstances, d)
+	b.directLock.Unlock()
+}
+
+func (b *Bus) removeDirect(d *Direct) {
+	b.directLock.Lock()
+	for i, instance := range b.directInstances {
+		if instance == d {
+			b.directInstances = append(b.directInstances[:i:i], b.directInstances[i+1:]...)
+			break
+		}
+	}
+	b.directLock.Unlock()
+}
+
+func (b *Bus) processPubSub(queue chan *qp.Message) {
+	// the targets of each message reuse those of the last, so that
+	// handing on a message allocates nothing
+	var targets []pubSubTarget
+	for {
+		select {
+		case m := <-queue:
+			targets = b.matchPubSub(m.Source, targets[:0])
+			for i, target := range targets {
+				target.dispatch(m)
+				targets[i] = pubSubTarget{}
+			}
+		case <-b.quit:
+			return
+		}
+	}
+}
+
+// pubSubTarget is a subscription that a message is to be handed to.
+type pubSubTarget struct {
+	instance     *PubSub
+	subscription *subscription
+}
+
+// dispatch hands the message to the subscription's dispatcher. If
+// the dispatcher is replaced by SetChannelOptions or Start while
+// the message waits for it, the message goes to the new one. It is
+// dropped if the subscription is removed or its instance stops.
+func (t pubSubTarget) dispatch(m *qp.Message) {
+	t.instance.lock.RLock()
+	dispatcher := t.subscription.dispatcher
+	t.instance.lock.RUnlock()
+	// blocks the queue while the channel is at capacity
+	for dispatcher.Dispatch(m) != nil {
+		t.instance.lock.RLock()
+		next := t.subscription.dispatcher
+		t.instance.lock.RUnlock()
+		if next == dispatcher {
+			if t.instance.Logger.Info() {
+				t.instance.Logger.Info("dropping", m, "for a subscription that has gone")
+			}
+			return
+		}
+		dispatcher = next
+	}
+}
+
+// matchPubSub appends every subscription, on every instance, whose
+// channel matches to the targets.
+func (b *Bus) matchPubSub(channel string, targets []pubSubTarget) []pubSubTarget {
+	b.pubSubLock.RLock()
+	defer b.pubSubLock.RUnlock()
+	for instance := range b.pubSubInstances {
+		instance.lock.RLock()
+		for pattern, subscriptions := range instance.subscriptions {
+			if !qp.MatchChannel(pattern, channel) {
+				continue
+			}
+			for _, s := range subscriptions {
+				targets = append(targets, pubSubTarget{instance: instance, subscription: s})
+			}
+		}
+		instance.lock.RUnlock()
+	}
+	return targets
+}
+
+func (b *Bus) addPubSub(p *PubSub) {
+	b.pubSubLock.Lock()
+	b.pubSubInstances[p] = exists
+	b.pubSubLock.Unlock()
+}
+
+func (b *Bus) removePubSub(p *PubSub) {
+	b.pubSubLock.Lock()
+	delete(b.pubSubInstances, p)
+	b.pubSubLock.Unlock()
+}
@@ -6,102 +6,138 @@ import (
 	"time"
 
 	"github.com/qp/go"
-	"github.com/stretchr/pat/stop"
 	"github.com/stretchr/slog"
 )
 
 // Direct represents a qp.DirectTransport.
 type Direct struct {
-	lock     sync.RWMutex
-	handlers map[string]qp.Handler
-	stopChan chan stop.Signal
-	Logger   slog.Logger
+	qp.Lifecycle
+	bus         *Bus
+	lock        sync.RWMutex
+	handlers    map[string]qp.Handler
+	options     map[string]qp.ChannelOptions
+	dispatchers map[string]*qp.Dispatcher
+	Logger      slog.Logger
 }
 
 // ensure the interface is satisfied
 var _ qp.DirectTransport = (*Direct)(nil)
 
-var directQueue = make(chan *qp.Message)
-var directInstances = make(map[*Direct]struct{})
-var directLock sync.RWMutex
-
-// NewDirect makes a new Direct.
+// NewDirect makes a new Direct on the DefaultBus.
 func NewDirect() *Direct {
-	p := &Direct{
-		handlers: make(map[string]qp.Handler),
-		Logger:   slog.NilLogger,
-	}
-	directLock.Lock()
-	directInstances[p] = exists
-	directLock.Unlock()
-	return p
+	return DefaultBus.NewDirect()
 }
 
-func processDirect() {
-	go func() {
-		for {
-			select {
-			case m, ok := <-directQueue:
-				if !ok {
-					return
-				}
-				directLock.Lock()
-				for instance := range directInstances {
-					instance.lock.RLock()
-					if h, ok := instance.handlers[m.Source]; ok {
-						go h.Handle(m)
-						instance.lock.RUnlock()
-						break
-					}
-					instance.lock.RUnlock()
-				}
-				directLock.Unlock()
-			}
-		}
-	}()
-}
-
-func init() {
-	processDirect()
+// NewDirect makes a new Direct on the Bus.
+func (b *Bus) NewDirect() *Direct {
+	return &Direct{
+		bus:         b,
+		handlers:    make(map[string]qp.Handler),
+		options:     make(map[string]qp.ChannelOptions),
+		dispatchers: make(map[string]*qp.Dispatcher),
+		Logger:      slog.NilLogger,
+	}
 }
 
 // Send sends a message to the given chanenl
+// What happens when the Bus queue is full depends on the Overflow
+// in its BusOptions.
 func (p *Direct) Send(channel string, data []byte) error {
+	if !p.Running() {
+		return qp.ErrNotRunning
+	}
 	m := &qp.Message{Source: channel, Data: data}
 	if p.Logger.Info() {
 		p.Logger.Info(fmt.Sprintf("send %v", m))
 	}
-	directQueue <- m
-	return nil
+	return p.bus.send(p.bus.directQueues, m)
 }
 
 // OnMessage binds the handler to the specified channel.
 func (p *Direct) OnMessage(channel string, handler qp.Handler) error {
 	p.lock.Lock()
 	p.handlers[channel] = handler
+	p.setDispatcher(channel)
 	p.lock.Unlock()
 	p.Logger.Info("OnMessage ", channel)
 	return nil
 }
 
+// RemoveHandler unbinds the handler from the specified channel.
+func (p *Direct) RemoveHandler(channel string) error {
+	p.lock.Lock()
+	delete(p.handlers, channel)
+	if d, ok := p.dispatchers[channel]; ok {
+		d.Close()
+		delete(p.dispatchers, channel)
+	}
+	p.lock.Unlock()
+	p.Logger.Info("RemoveHandler ", channel)
+	return nil
+}
+
+// SetChannelOptions sets the options that control how messages
+// on the specified channel are dispatched to its handler.
+func (p *Direct) SetChannelOptions(channel string, options qp.ChannelOptions) error {
+	p.lock.Lock()
+	p.options[channel] = options
+	if _, ok := p.handlers[channel]; ok {
+		p.setDispatcher(channel)
+	}
+	p.lock.Unlock()
+	return nil
+}
+
+// setDispatcher replaces the dispatcher for the channel.
+// Callers must hold the lock.
+func (p *Direct) setDispatcher(channel string) {
+	if d, ok := p.dispatchers[channel]; ok {
+		d.Close()
+	}
+	p.dispatchers[channel] = qp.NewDispatcher(p.handlers[channel], p.options[channel])
+}
+
 // Start starts the transport.
 func (p *Direct) Start() error {
-	p.stopChan = stop.Make()
+	if err := p.BeginStart(); err != nil {
+		return err
+	}
+	if p.bus.closed() {
+		return p.EndStart(qp.ErrNotRunning)
+	}
 	p.Logger.Info("start inproc direct")
-	return nil
+	p.lock.Lock()
+	for channel := range p.handlers {
+		p.setDispatcher(channel)
+	}
+	p.lock.Unlock()
+	p.bus.addDirect(p)
+	return p.EndStart(nil)
 }
 
 // Stop stops the transport and closes StopChan() when finished.
-func (p *Direct) Stop(time.Duration) {
+//
+// No new messages are taken once Stop is called, and messages
+// already being handled have the grace period to finish before
+// they are abandoned. It is safe to call Stop more than once.
+func (p *Direct) Stop(grace time.Duration) {
+	if !p.BeginStop() {
+		return
+	}
 	p.Logger.Info("stop inproc direct")
-	directLock.Lock()
-	delete(directInstances, p)
-	directLock.Unlock()
-	close(p.stopChan)
-}
-
-// StopChan gets the stop channel which will be closed when
-// this transport has successfully stopped.
-func (p *Direct) StopChan() <-chan stop.Signal {
-	return p.stopChan
+	p.bus.removeDirect(p)
+	p.lock.RLock()
+	dispatchers := make([]*qp.Dispatcher, 0, len(p.dispatchers))
+	for _, d := range p.dispatchers {
+		dispatchers = append(dispatchers, d)
+	}
+	p.lock.RUnlock()
+	abandoned := qp.Drain(grace, dispatchers...)
+	for _, d := range dispatchers {
+		d.Close()
+	}
+	if abandoned > 0 && p.Logger.Warn() {
+		p.Logger.Warn("abandoned", abandoned, "in-flight handlers")
+	}
+	p.EndStop(abandoned)
 }
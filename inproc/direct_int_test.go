@@ -9,16 +9,18 @@ import (
 
 func TestDirectStopping(t *testing.T) {
 
-	d := NewDirect()
+	bus := NewBus()
+	defer bus.Close()
+	d := bus.NewDirect()
 	d.Start()
 	require.NotNil(t, d)
 
-	require.NotNil(t, directInstances[d])
+	require.Contains(t, bus.directInstances, d)
 
 	d.Stop(1 * time.Millisecond)
 	select {
 	case <-d.StopChan():
-		require.Equal(t, len(directInstances), 0)
+		require.Equal(t, len(bus.directInstances), 0)
 	case <-time.After(10 * time.Millisecond):
 		require.FailNow(t, "transport did not stop")
 	}
@@ -1,11 +1,13 @@
 package inproc_test
 
 import (
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/qp/go"
 	"github.com/qp/go/inproc"
+	"github.com/qp/go/transporttest"
 	"github.com/stretchr/pat/stop"
 	"github.com/stretchr/testify/require"
 )
@@ -38,3 +40,211 @@ func TestDirect(t *testing.T) {
 	}
 
 }
+
+func TestDirectMaxInFlight(t *testing.T) {
+
+	// Send only feels the limit when the bus does not buffer
+	bus := inproc.NewBusOptions(inproc.BusOptions{})
+	defer bus.Close()
+	d := bus.NewDirect()
+	d.Start()
+	defer func() {
+		d.Stop(stop.NoWait)
+		<-d.StopChan()
+	}()
+
+	msgs := make(chan *qp.Message)
+	require.NoError(t, d.OnMessage("limited", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	})))
+	require.NoError(t, d.SetChannelOptions("limited", qp.ChannelOptions{MaxInFlight: 1}))
+
+	require.NoError(t, d.Send("limited", []byte("one")))
+	sent := make(chan error)
+	go func() {
+		d.Send("limited", []byte("two"))
+		sent <- d.Send("limited", []byte("three"))
+	}()
+	select {
+	case <-sent:
+		require.FailNow(t, "Send should block while the channel is at capacity")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for _, expected := range []string{"one", "two", "three"} {
+		select {
+		case msg := <-msgs:
+			require.Equal(t, expected, string(msg.Data))
+		case <-time.After(100 * time.Millisecond):
+			require.FailNow(t, "no message received")
+		}
+	}
+	require.NoError(t, <-sent)
+
+}
+
+func TestDirectRemoveHandler(t *testing.T) {
+
+	d := inproc.NewDirect()
+	d.Start()
+	defer func() {
+		d.Stop(stop.NoWait)
+		<-d.StopChan()
+	}()
+
+	msgs := make(chan *qp.Message, 1)
+	require.NoError(t, d.OnMessage("removed", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	})))
+	require.NoError(t, d.RemoveHandler("removed"))
+	require.NoError(t, d.Send("removed", []byte("testing")))
+
+	select {
+	case <-msgs:
+		require.FailNow(t, "message should not be received")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+}
+
+func TestDirectStopDrains(t *testing.T) {
+
+	d := inproc.NewDirect()
+	d.Start()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	require.NoError(t, d.OnMessage("draining", qp.HandlerFunc(func(msg *qp.Message) {
+		started <- struct{}{}
+		<-release
+	})))
+	require.NoError(t, d.Send("draining", []byte("one")))
+	require.NoError(t, d.Send("draining", []byte("two")))
+	<-started
+	<-started
+
+	// give up on both handlers
+	d.Stop(10 * time.Millisecond)
+	<-d.StopChan()
+	require.Equal(t, 2, d.Abandoned())
+	d.Stop(stop.NoWait)
+	close(release)
+
+	d = inproc.NewDirect()
+	d.Start()
+	require.NoError(t, d.OnMessage("draining", qp.HandlerFunc(func(msg *qp.Message) {
+		time.Sleep(10 * time.Millisecond)
+	})))
+	require.NoError(t, d.Send("draining", []byte("three")))
+
+	// wait for the handler, but no longer than it takes
+	start := time.Now()
+	d.Stop(1 * time.Second)
+	<-d.StopChan()
+	require.Equal(t, 0, d.Abandoned())
+	require.True(t, time.Since(start) < 500*time.Millisecond, "Stop should return once handlers finish")
+
+}
+
+func TestDirectRoundRobin(t *testing.T) {
+
+	bus := inproc.NewBus()
+	defer bus.Close()
+	sender := bus.NewDirect()
+	var consumers []*inproc.Direct
+	msgs := make(chan int, 100)
+	for i := 0; i < 3; i++ {
+		i := i
+		d := bus.NewDirect()
+		require.NoError(t, d.OnMessage("balanced", qp.HandlerFunc(func(msg *qp.Message) {
+			msgs <- i
+		})))
+		consumers = append(consumers, d)
+	}
+	for _, d := range append(consumers, sender) {
+		require.NoError(t, d.Start())
+	}
+	defer func() {
+		for _, d := range append(consumers, sender) {
+			d.Stop(stop.NoWait)
+			<-d.StopChan()
+		}
+	}()
+
+	for i := 0; i < 30; i++ {
+		require.NoError(t, sender.Send("balanced", []byte("testing")))
+	}
+	counts := make([]int, len(consumers))
+	for i := 0; i < 30; i++ {
+		select {
+		case consumer := <-msgs:
+			counts[consumer]++
+		case <-time.After(100 * time.Millisecond):
+			require.FailNow(t, "no message received")
+		}
+	}
+	require.Equal(t, []int{10, 10, 10}, counts)
+
+	select {
+	case <-msgs:
+		require.FailNow(t, "each message should be received once")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+}
+
+func TestDirectConformance(t *testing.T) {
+	bus := inproc.NewBus()
+	defer bus.Close()
+	transporttest.Direct(t, func() qp.DirectTransport {
+		return bus.NewDirect()
+	})
+}
+
+func TestDirectSetChannelOptionsLosesNothing(t *testing.T) {
+
+	bus := inproc.NewBus()
+	defer bus.Close()
+	d := bus.NewDirect()
+	received := make(chan string, 1000)
+	require.NoError(t, d.OnMessage("reconfigured", qp.HandlerFunc(func(msg *qp.Message) {
+		time.Sleep(100 * time.Microsecond)
+		received <- string(msg.Data)
+	})))
+	require.NoError(t, d.SetChannelOptions("reconfigured", qp.ChannelOptions{MaxInFlight: 1}))
+	d.Start()
+	defer func() {
+		d.Stop(stop.NoWait)
+		<-d.StopChan()
+	}()
+
+	// replace the dispatcher while messages wait for it
+	done := make(chan struct{})
+	go func() {
+		for n := 1; ; n++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			d.SetChannelOptions("reconfigured", qp.ChannelOptions{MaxInFlight: n%2 + 1})
+			time.Sleep(200 * time.Microsecond)
+		}
+	}()
+	const count = 500
+	for i := 0; i < count; i++ {
+		require.NoError(t, d.Send("reconfigured", []byte(strconv.Itoa(i))))
+	}
+	seen := make(map[string]bool)
+	for len(seen) < count {
+		select {
+		case data := <-received:
+			seen[data] = true
+		case <-time.After(time.Second):
+			close(done)
+			require.FailNow(t, "messages were lost", "received %d of %d", len(seen), count)
+		}
+	}
+	close(done)
+
+}
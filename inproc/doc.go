@@ -1,2 +1,19 @@
 // Package inproc provides transports for in-process operations.
+//
+// Transports only exchange messages with other transports on the
+// same Bus. NewDirect and NewPubSub use the DefaultBus; tests that
+// run in parallel should make their own Bus with NewBus, and Close
+// it when they are done.
+//
+// A Bus buffers messages in queues, sharded by channel, so Send
+// and Publish usually return without waiting for the message to
+// be taken. BusOptions controls the number and size of the queues,
+// and whether senders block, drop the oldest message in the queue,
+// whatever its channel, or get ErrQueueFull when a queue is full.
+// Messages on the same channel are always taken in the order they
+// were sent.
+//
+// Sharding pays off when some channels are slow: a queue waits
+// while the channel of the message at its head is at capacity, so
+// only the channels that share a queue with a slow one slow down.
 package inproc
@@ -6,102 +6,163 @@ import (
 	"time"
 
 	"github.com/qp/go"
-	"github.com/stretchr/pat/stop"
 	"github.com/stretchr/slog"
 )
 
-var exists = struct{}{}
-
 // PubSub represents a qp.PubSubTransport.
 type PubSub struct {
-	lock     sync.RWMutex
-	handlers map[string]qp.Handler
-	stopChan chan stop.Signal
-	Logger   slog.Logger
+	qp.Lifecycle
+	bus           *Bus
+	lock          sync.RWMutex
+	subscriptions map[string][]*subscription
+	options       map[string]qp.ChannelOptions
+	Logger        slog.Logger
+}
+
+// subscription is a single handler bound to a channel.
+type subscription struct {
+	handler    qp.Handler
+	dispatcher *qp.Dispatcher
 }
 
 // ensure the interface is satisfied
 var _ qp.PubSubTransport = (*PubSub)(nil)
 
-var pubSubQueue = make(chan *qp.Message)
-var pubSubInstances = make(map[*PubSub]struct{})
-var pubSubLock sync.RWMutex
-
-// NewPubSub makes a new PubSub.
+// NewPubSub makes a new PubSub on the DefaultBus.
 func NewPubSub() *PubSub {
-	p := &PubSub{
-		handlers: make(map[string]qp.Handler),
-		Logger:   slog.NilLogger,
-	}
-	pubSubLock.Lock()
-	pubSubInstances[p] = exists
-	pubSubLock.Unlock()
-	return p
+	return DefaultBus.NewPubSub()
 }
 
-func processPubSub() {
-	go func() {
-		for {
-			select {
-			case m, ok := <-pubSubQueue:
-				if !ok {
-					return
-				}
-				pubSubLock.Lock()
-				for instance := range pubSubInstances {
-					instance.lock.RLock()
-					if h, ok := instance.handlers[m.Source]; ok {
-						go h.Handle(m)
-					}
-					instance.lock.RUnlock()
-				}
-				pubSubLock.Unlock()
-			}
-		}
-	}()
-}
-
-func init() {
-	processPubSub()
+// NewPubSub makes a new PubSub on the Bus.
+func (b *Bus) NewPubSub() *PubSub {
+	return &PubSub{
+		bus:           b,
+		subscriptions: make(map[string][]*subscription),
+		options:       make(map[string]qp.ChannelOptions),
+		Logger:        slog.NilLogger,
+	}
 }
 
 // Publish publishes data on the specified channel.
+// What happens when the Bus queue is full depends on the Overflow
+// in its BusOptions.
 func (p *PubSub) Publish(channel string, data []byte) error {
+	if !p.Running() {
+		return qp.ErrNotRunning
+	}
 	m := &qp.Message{Source: channel, Data: data}
 	if p.Logger.Info() {
 		p.Logger.Info(fmt.Sprintf("publish %v", m))
 	}
-	pubSubQueue <- m
-	return nil
+	return p.bus.send(p.bus.pubSubQueues, m)
 }
 
 // Subscribe binds the handler to the specified channel.
-func (p *PubSub) Subscribe(channel string, handler qp.Handler) error {
+func (p *PubSub) Subscribe(channel string, handler qp.Handler) (qp.Subscription, error) {
 	p.lock.Lock()
-	p.handlers[channel] = handler
+	s := &subscription{
+		handler:    handler,
+		dispatcher: qp.NewDispatcher(handler, p.options[channel]),
+	}
+	p.subscriptions[channel] = append(p.subscriptions[channel], s)
 	p.lock.Unlock()
 	p.Logger.Info("subscribed to ", channel)
+	return qp.SubscriptionFunc(func() error {
+		p.remove(channel, s)
+		return nil
+	}), nil
+}
+
+// remove unbinds a single subscription from the channel.
+func (p *PubSub) remove(channel string, s *subscription) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	subscriptions := p.subscriptions[channel]
+	for i, existing := range subscriptions {
+		if existing == s {
+			s.dispatcher.Close()
+			subscriptions = append(subscriptions[:i:i], subscriptions[i+1:]...)
+			break
+		}
+	}
+	if len(subscriptions) == 0 {
+		delete(p.subscriptions, channel)
+	} else {
+		p.subscriptions[channel] = subscriptions
+	}
+}
+
+// Unsubscribe unbinds all handlers from the specified channel.
+func (p *PubSub) Unsubscribe(channel string) error {
+	p.lock.Lock()
+	for _, s := range p.subscriptions[channel] {
+		s.dispatcher.Close()
+	}
+	delete(p.subscriptions, channel)
+	p.lock.Unlock()
+	p.Logger.Info("unsubscribed from ", channel)
+	return nil
+}
+
+// SetChannelOptions sets the options that control how messages
+// on the specified channel are dispatched to its handlers.
+func (p *PubSub) SetChannelOptions(channel string, options qp.ChannelOptions) error {
+	p.lock.Lock()
+	p.options[channel] = options
+	for _, s := range p.subscriptions[channel] {
+		s.dispatcher.Close()
+		s.dispatcher = qp.NewDispatcher(s.handler, options)
+	}
+	p.lock.Unlock()
 	return nil
 }
 
 // Start starts the transport.
 func (p *PubSub) Start() error {
-	p.stopChan = stop.Make()
+	if err := p.BeginStart(); err != nil {
+		return err
+	}
+	if p.bus.closed() {
+		return p.EndStart(qp.ErrNotRunning)
+	}
 	p.Logger.Info("start inproc pubsub")
-	return nil
+	p.lock.Lock()
+	for channel, subscriptions := range p.subscriptions {
+		for _, s := range subscriptions {
+			s.dispatcher.Close()
+			s.dispatcher = qp.NewDispatcher(s.handler, p.options[channel])
+		}
+	}
+	p.lock.Unlock()
+	p.bus.addPubSub(p)
+	return p.EndStart(nil)
 }
 
 // Stop stops the transport and closes StopChan() when finished.
-func (p *PubSub) Stop(time.Duration) {
+//
+// No new messages are taken once Stop is called, and messages
+// already being handled have the grace period to finish before
+// they are abandoned. It is safe to call Stop more than once.
+func (p *PubSub) Stop(grace time.Duration) {
+	if !p.BeginStop() {
+		return
+	}
 	p.Logger.Info("stop inproc pubsub")
-	pubSubLock.Lock()
-	delete(pubSubInstances, p)
-	pubSubLock.Unlock()
-	close(p.stopChan)
-}
-
-// StopChan gets the stop channel which will be closed when
-// this transport has successfully stopped.
-func (p *PubSub) StopChan() <-chan stop.Signal {
-	return p.stopChan
+	p.bus.removePubSub(p)
+	var dispatchers []*qp.Dispatcher
+	p.lock.RLock()
+	for _, subscriptions := range p.subscriptions {
+		for _, s := range subscriptions {
+			dispatchers = append(dispatchers, s.dispatcher)
+		}
+	}
+	p.lock.RUnlock()
+	abandoned := qp.Drain(grace, dispatchers...)
+	for _, d := range dispatchers {
+		d.Close()
+	}
+	if abandoned > 0 && p.Logger.Warn() {
+		p.Logger.Warn("abandoned", abandoned, "in-flight handlers")
+	}
+	p.EndStop(abandoned)
 }
@@ -9,16 +9,18 @@ import (
 
 func TestPubSubStopping(t *testing.T) {
 
-	ps := NewPubSub()
+	bus := NewBus()
+	defer bus.Close()
+	ps := bus.NewPubSub()
 	ps.Start()
 	require.NotNil(t, ps)
 
-	require.NotNil(t, pubSubInstances[ps])
+	require.Contains(t, bus.pubSubInstances, ps)
 
 	ps.Stop(1 * time.Millisecond)
 	select {
 	case <-ps.StopChan():
-		require.Equal(t, len(pubSubInstances), 0)
+		require.Equal(t, len(bus.pubSubInstances), 0)
 	case <-time.After(10 * time.Millisecond):
 		require.FailNow(t, "transport did not stop")
 	}
@@ -1,12 +1,15 @@
 package inproc_test
 
 import (
+	"sort"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/qp/go"
 
 	"github.com/qp/go/inproc"
+	"github.com/qp/go/transporttest"
 	"github.com/stretchr/pat/stop"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -24,12 +27,14 @@ func TestPubSub(t *testing.T) {
 	msgs := make(chan *qp.Message)
 	data := []byte("testing")
 
-	require.NoError(t, ps.Subscribe("channel", qp.HandlerFunc(func(msg *qp.Message) {
+	_, err := ps.Subscribe("channel", qp.HandlerFunc(func(msg *qp.Message) {
 		msgs <- msg
-	})))
-	require.NoError(t, ps2.Subscribe("channel", qp.HandlerFunc(func(msg *qp.Message) {
+	}))
+	require.NoError(t, err)
+	_, err = ps2.Subscribe("channel", qp.HandlerFunc(func(msg *qp.Message) {
 		msgs <- msg
-	})))
+	}))
+	require.NoError(t, err)
 
 	require.NoError(t, ps.Publish("channel", data))
 
@@ -59,3 +64,212 @@ func TestPubSub(t *testing.T) {
 	<-ps2.StopChan()
 
 }
+
+func TestPubSubOrdered(t *testing.T) {
+
+	ps := inproc.NewPubSub()
+	ps.Start()
+	defer func() {
+		ps.Stop(stop.NoWait)
+		<-ps.StopChan()
+	}()
+
+	msgs := make(chan *qp.Message, 100)
+	_, err := ps.Subscribe("ordered", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	}))
+	require.NoError(t, err)
+	require.NoError(t, ps.SetChannelOptions("ordered", qp.ChannelOptions{Key: func(msg *qp.Message) string {
+		return "customer"
+	}}))
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, ps.Publish("ordered", []byte{byte(i)}))
+	}
+	for i := 0; i < 100; i++ {
+		select {
+		case msg := <-msgs:
+			require.Equal(t, byte(i), msg.Data[0])
+		case <-time.After(100 * time.Millisecond):
+			require.FailNow(t, "no message received")
+		}
+	}
+
+}
+
+func TestPubSubUnsubscribe(t *testing.T) {
+
+	ps := inproc.NewPubSub()
+	ps.Start()
+	defer func() {
+		ps.Stop(stop.NoWait)
+		<-ps.StopChan()
+	}()
+
+	msgs := make(chan *qp.Message, 1)
+	_, err := ps.Subscribe("unsubscribed", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	}))
+	require.NoError(t, err)
+	require.NoError(t, ps.Unsubscribe("unsubscribed"))
+	require.NoError(t, ps.Publish("unsubscribed", []byte("testing")))
+
+	select {
+	case <-msgs:
+		require.FailNow(t, "message should not be received")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+}
+
+func TestPubSubMultipleHandlers(t *testing.T) {
+
+	ps := inproc.NewPubSub()
+	ps.Start()
+	defer func() {
+		ps.Stop(stop.NoWait)
+		<-ps.StopChan()
+	}()
+
+	first := make(chan *qp.Message, 2)
+	second := make(chan *qp.Message, 2)
+	sub, err := ps.Subscribe("user.created", qp.HandlerFunc(func(msg *qp.Message) {
+		first <- msg
+	}))
+	require.NoError(t, err)
+	_, err = ps.Subscribe("user.created", qp.HandlerFunc(func(msg *qp.Message) {
+		second <- msg
+	}))
+	require.NoError(t, err)
+
+	require.NoError(t, ps.Publish("user.created", []byte("one")))
+	for _, msgs := range []chan *qp.Message{first, second} {
+		select {
+		case msg := <-msgs:
+			require.Equal(t, "one", string(msg.Data))
+		case <-time.After(100 * time.Millisecond):
+			require.FailNow(t, "no message received")
+		}
+	}
+
+	require.NoError(t, sub.Unsubscribe())
+	require.NoError(t, ps.Publish("user.created", []byte("two")))
+	select {
+	case msg := <-second:
+		require.Equal(t, "two", string(msg.Data))
+	case <-time.After(100 * time.Millisecond):
+		require.FailNow(t, "no message received")
+	}
+	select {
+	case <-first:
+		require.FailNow(t, "unsubscribed handler should not receive messages")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+}
+
+func TestPubSubPatterns(t *testing.T) {
+
+	ps := inproc.NewPubSub()
+	ps.Start()
+	defer func() {
+		ps.Stop(stop.NoWait)
+		<-ps.StopChan()
+	}()
+
+	created := make(chan *qp.Message, 10)
+	all := make(chan *qp.Message, 10)
+	_, err := ps.Subscribe("orders.*.created", qp.HandlerFunc(func(msg *qp.Message) {
+		created <- msg
+	}))
+	require.NoError(t, err)
+	_, err = ps.Subscribe("orders.>", qp.HandlerFunc(func(msg *qp.Message) {
+		all <- msg
+	}))
+	require.NoError(t, err)
+
+	require.NoError(t, ps.Publish("orders.eu.created", []byte("one")))
+	require.NoError(t, ps.Publish("orders.eu.west.created", []byte("two")))
+
+	select {
+	case msg := <-created:
+		require.Equal(t, "orders.eu.created", msg.Source)
+		require.Equal(t, "one", string(msg.Data))
+	case <-time.After(100 * time.Millisecond):
+		require.FailNow(t, "no message received")
+	}
+	var sources []string
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-all:
+			sources = append(sources, msg.Source)
+		case <-time.After(100 * time.Millisecond):
+			require.FailNow(t, "no message received")
+		}
+	}
+	sort.Strings(sources)
+	require.Equal(t, []string{"orders.eu.created", "orders.eu.west.created"}, sources)
+	select {
+	case <-created:
+		require.FailNow(t, "orders.*.created should not match orders.eu.west.created")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+}
+
+func TestPubSubConformance(t *testing.T) {
+	bus := inproc.NewBus()
+	defer bus.Close()
+	transporttest.PubSub(t, func() qp.PubSubTransport {
+		return bus.NewPubSub()
+	})
+}
+
+func TestPubSubSetChannelOptionsLosesNothing(t *testing.T) {
+
+	bus := inproc.NewBus()
+	defer bus.Close()
+	ps := bus.NewPubSub()
+	received := make(chan string, 1000)
+	_, err := ps.Subscribe("reconfigured", qp.HandlerFunc(func(msg *qp.Message) {
+		time.Sleep(100 * time.Microsecond)
+		received <- string(msg.Data)
+	}))
+	require.NoError(t, err)
+	require.NoError(t, ps.SetChannelOptions("reconfigured", qp.ChannelOptions{MaxInFlight: 1}))
+	ps.Start()
+	defer func() {
+		ps.Stop(stop.NoWait)
+		<-ps.StopChan()
+	}()
+
+	// replace the dispatcher while messages wait for it
+	done := make(chan struct{})
+	go func() {
+		for n := 1; ; n++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			ps.SetChannelOptions("reconfigured", qp.ChannelOptions{MaxInFlight: n%2 + 1})
+			time.Sleep(200 * time.Microsecond)
+		}
+	}()
+	const count = 500
+	for i := 0; i < count; i++ {
+		require.NoError(t, ps.Publish("reconfigured", []byte(strconv.Itoa(i))))
+	}
+	seen := make(map[string]bool)
+	for len(seen) < count {
+		select {
+		case data := <-received:
+			seen[data] = true
+		case <-time.After(time.Second):
+			close(done)
+			require.FailNow(t, "messages were lost", "received %d of %d", len(seen), count)
+		}
+	}
+	close(done)
+
+}
@@ -0,0 +1,135 @@
+package kafka
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned by requests on a connection that was
+// closed while they were waiting.
+var ErrClosed = errors.New("kafka connection closed")
+
+// maxResponseSize is the largest response the transports read.
+const maxResponseSize = 1 << 30
+
+// broker is a connection to a single broker. Requests are made one
+// at a time, and a failed connection is dialed again by the next
+// request.
+type broker struct {
+	addr     string
+	clientID string
+
+	// lock serializes requests
+	lock        sync.Mutex
+	correlation int32
+	r           *bufio.Reader
+
+	// connLock guards conn, so that close can interrupt a request
+	connLock sync.Mutex
+	conn     net.Conn
+	closed   bool
+}
+
+// newBroker makes a connection to the broker at the address. It is
+// dialed by the first request.
+func newBroker(addr, clientID string) *broker {
+	return &broker{addr: addr, clientID: clientID}
+}
+
+// request sends the request and reads the response, allowing wait
+// longer than Timeout for the broker to answer.
+func (b *broker) request(api int16, body []byte, wait time.Duration) (*decoder, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	conn, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	b.correlation++
+	e := &encoder{b: make([]byte, 0, 64+len(body))}
+	e.int32(0) // size, filled in below
+	e.int16(api)
+	e.int16(versions[api])
+	e.int32(b.correlation)
+	e.nullableString(b.clientID)
+	e.b = append(e.b, body...)
+	size := len(e.b) - 4
+	e.b[0], e.b[1], e.b[2], e.b[3] = byte(size>>24), byte(size>>16), byte(size>>8), byte(size)
+
+	conn.SetDeadline(time.Now().Add(Timeout + wait))
+	if _, err := conn.Write(e.b); err != nil {
+		return nil, b.fail(conn, err)
+	}
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(b.r, header); err != nil {
+		return nil, b.fail(conn, err)
+	}
+	d := &decoder{b: header}
+	size = int(d.int32())
+	if correlation := d.int32(); correlation != b.correlation || size < 4 || size > maxResponseSize {
+		return nil, b.fail(conn, errMalformed)
+	}
+	response := make([]byte, size-4)
+	if _, err := io.ReadFull(b.r, response); err != nil {
+		return nil, b.fail(conn, err)
+	}
+	return &decoder{b: response}, nil
+}
+
+// dial gets the connection, dialing it if there is none.
+// Callers must hold the lock.
+func (b *broker) dial() (net.Conn, error) {
+	b.connLock.Lock()
+	conn, closed := b.conn, b.closed
+	b.connLock.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	if conn != nil {
+		return conn, nil
+	}
+	conn, err := net.DialTimeout("tcp", b.addr, Timeout)
+	if err != nil {
+		return nil, err
+	}
+	b.connLock.Lock()
+	defer b.connLock.Unlock()
+	if b.closed {
+		conn.Close()
+		return nil, ErrClosed
+	}
+	b.conn = conn
+	b.r = bufio.NewReader(conn)
+	return conn, nil
+}
+
+// fail closes the connection after a failed request, so that the
+// next request dials again.
+// Callers must hold the lock.
+func (b *broker) fail(conn net.Conn, err error) error {
+	conn.Close()
+	b.connLock.Lock()
+	defer b.connLock.Unlock()
+	if b.conn == conn {
+		b.conn = nil
+	}
+	if b.closed {
+		return ErrClosed
+	}
+	return err
+}
+
+// close closes the connection, interrupting any request.
+func (b *broker) close() {
+	b.connLock.Lock()
+	defer b.connLock.Unlock()
+	b.closed = true
+	if b.conn != nil {
+		b.conn.Close()
+		b.conn = nil
+	}
+}
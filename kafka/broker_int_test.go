@@ -0,0 +1,801 @@
+package kafka
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/testify/require"
+)
+
+// testPartitions is how many partitions the test broker gives the
+// topics it creates.
+const testPartitions = 2
+
+// testBroker is an in-process stand-in for a single node Kafka
+// cluster, with just enough of the protocol for the transports:
+// topics it creates when asked about them, long-polling fetches,
+// offsets by time, and consumer groups that rebalance when members
+// join, leave or go quiet.
+type testBroker struct {
+	listener net.Listener
+	host     string
+	port     int32
+
+	lock    sync.Mutex
+	topics  map[string][][]record
+	codecs  map[topicPartition]map[int64]int16
+	groups  map[string]*testGroup
+	changed chan qp.Signal
+	conns   map[net.Conn]struct{}
+	closed  chan qp.Signal
+	wg      sync.WaitGroup
+}
+
+// testGroup is a consumer group, and its members in the current
+// generation.
+type testGroup struct {
+	generation  int32
+	members     map[string]*testMember
+	joining     map[string]*testMember
+	leader      string
+	rebalance   chan qp.Signal // closed once members have joined again
+	assignments map[string][]byte
+	synced      chan qp.Signal // closed once the leader has synced
+	offsets     map[topicPartition]int64
+	next        int
+}
+
+type testMember struct {
+	metadata  []byte
+	session   time.Duration
+	rebalance time.Duration
+	seen      time.Time
+}
+
+// startBroker starts a broker on the address, which may be
+// "127.0.0.1:0" for any free port.
+func startBroker(t *testing.T, addr string) *testBroker {
+	l, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	host, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+	p, err := strconv.Atoi(port)
+	require.NoError(t, err)
+	b := &testBroker{
+		listener: l,
+		host:     host,
+		port:     int32(p),
+		topics:   make(map[string][][]record),
+		codecs:   make(map[topicPartition]map[int64]int16),
+		groups:   make(map[string]*testGroup),
+		changed:  make(chan qp.Signal),
+		conns:    make(map[net.Conn]struct{}),
+		closed:   make(chan qp.Signal),
+	}
+	b.wg.Add(2)
+	go b.accept()
+	go b.reap()
+	return b
+}
+
+// addrs gets the addresses to find the broker through.
+func (b *testBroker) addrs() []string {
+	return []string{b.listener.Addr().String()}
+}
+
+// close stops the broker and disconnects every client.
+func (b *testBroker) close() {
+	b.listener.Close()
+	close(b.closed)
+	b.lock.Lock()
+	for conn := range b.conns {
+		conn.Close()
+	}
+	b.lock.Unlock()
+	b.wg.Wait()
+}
+
+// create creates the topic with the number of partitions.
+func (b *testBroker) create(topic string, partitions int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ok := b.topics[topic]; !ok {
+		b.topics[topic] = make([][]record, partitions)
+	}
+}
+
+// compress has the record at the offset fetched in a batch that
+// says it is compressed with the codec, though it is not.
+func (b *testBroker) compress(tp topicPartition, offset int64, codec int16) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.codecs[tp] == nil {
+		b.codecs[tp] = make(map[int64]int16)
+	}
+	b.codecs[tp][offset] = codec
+}
+
+// committed gets the offset the group committed for the partition,
+// or -1.
+func (b *testBroker) committed(group string, tp topicPartition) int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if g, ok := b.groups[group]; ok {
+		if offset, ok := g.offsets[tp]; ok {
+			return offset
+		}
+	}
+	return -1
+}
+
+func (b *testBroker) accept() {
+	defer b.wg.Done()
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		b.lock.Lock()
+		b.conns[conn] = struct{}{}
+		b.lock.Unlock()
+		b.wg.Add(1)
+		go b.serve(conn)
+	}
+}
+
+// serve answers the requests on the connection in turn.
+func (b *testBroker) serve(conn net.Conn) {
+	defer b.wg.Done()
+	defer func() {
+		conn.Close()
+		b.lock.Lock()
+		delete(b.conns, conn)
+		b.lock.Unlock()
+	}()
+	r := bufio.NewReader(conn)
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return
+		}
+		body := make([]byte, (&decoder{b: header}).int32())
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+		d := &decoder{b: body}
+		api := d.int16()
+		d.int16() // version
+		correlation := d.int32()
+		d.string() // client ID
+		if d.err != nil {
+			return
+		}
+		response := b.handle(api, d)
+		if response == nil {
+			return
+		}
+		e := &encoder{}
+		e.int32(int32(4 + len(response)))
+		e.int32(correlation)
+		e.b = append(e.b, response...)
+		if _, err := conn.Write(e.b); err != nil {
+			return
+		}
+	}
+}
+
+// handle answers a request, returning nil to drop the connection.
+func (b *testBroker) handle(api int16, d *decoder) []byte {
+	switch api {
+	case apiMetadata:
+		return b.metadata(d)
+	case apiProduce:
+		return b.produce(d)
+	case apiFetch:
+		return b.fetch(d)
+	case apiListOffsets:
+		return b.listOffsets(d)
+	case apiFindCoordinator:
+		e := &encoder{}
+		e.int16(0)
+		e.int32(0)
+		e.string(b.host)
+		e.int32(b.port)
+		return e.b
+	case apiJoinGroup:
+		return b.join(d)
+	case apiSyncGroup:
+		return b.sync(d)
+	case apiHeartbeat:
+		return b.heartbeat(d)
+	case apiLeaveGroup:
+		return b.leave(d)
+	case apiOffsetCommit:
+		return b.commit(d)
+	case apiOffsetFetch:
+		return b.offsetFetch(d)
+	}
+	return nil
+}
+
+func (b *testBroker) metadata(d *decoder) []byte {
+	n := int(d.int32())
+	var topics []string
+	for i := 0; i < n; i++ {
+		topics = append(topics, d.string())
+	}
+	create := d.bool()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if n < 0 {
+		for topic := range b.topics {
+			topics = append(topics, topic)
+		}
+		sort.Strings(topics)
+	}
+	e := &encoder{}
+	e.int32(0) // throttle time
+	e.array(1)
+	e.int32(0)
+	e.string(b.host)
+	e.int32(b.port)
+	e.nullableString("") // rack
+	e.nullableString("") // cluster ID
+	e.int32(0)           // controller ID
+	e.array(len(topics))
+	for _, topic := range topics {
+		partitions, ok := b.topics[topic]
+		if !ok && create {
+			partitions = make([][]record, testPartitions)
+			b.topics[topic] = partitions
+		}
+		if !ok && !create {
+			e.int16(int16(errUnknownTopic))
+		} else {
+			e.int16(0)
+		}
+		e.string(topic)
+		e.bool(false) // internal
+		e.array(len(partitions))
+		for p := range partitions {
+			e.int16(0)
+			e.int32(int32(p))
+			e.int32(0) // leader
+			for replicas := 0; replicas < 2; replicas++ {
+				e.array(1)
+				e.int32(0)
+			}
+		}
+	}
+	return e.b
+}
+
+func (b *testBroker) produce(d *decoder) []byte {
+	d.string() // transactional ID
+	d.int16()  // acks
+	d.int32()  // timeout
+	e := &encoder{}
+	n := d.array(6)
+	e.array(n)
+	b.lock.Lock()
+	for i := 0; i < n; i++ {
+		topic := d.string()
+		e.string(topic)
+		m := d.array(8)
+		e.array(m)
+		for j := 0; j < m; j++ {
+			p := d.int32()
+			records, err := decodeBatches(d.bytes())
+			e.int32(p)
+			partitions := b.topics[topic]
+			if err != nil || int(p) >= len(partitions) {
+				e.int16(int16(errUnknownTopic))
+				e.int64(-1)
+				e.int64(-1)
+				continue
+			}
+			base := int64(len(partitions[p]))
+			for k, r := range records {
+				r.offset = base + int64(k)
+				partitions[p] = append(partitions[p], r)
+			}
+			e.int16(0)
+			e.int64(base)
+			e.int64(-1) // log append time
+		}
+	}
+	close(b.changed)
+	b.changed = make(chan qp.Signal)
+	b.lock.Unlock()
+	e.int32(0) // throttle time
+	return e.b
+}
+
+// fetchPartition is a partition a fetch asks for.
+type fetchPartition struct {
+	tp     topicPartition
+	offset int64
+	max    int32
+}
+
+func (b *testBroker) fetch(d *decoder) []byte {
+	d.int32() // replica ID
+	wait := time.Duration(d.int32()) * time.Millisecond
+	d.int32() // min bytes
+	d.int32() // max bytes
+	d.int8()  // isolation level
+	var wanted []fetchPartition
+	for i, n := 0, d.array(6); i < n; i++ {
+		topic := d.string()
+		for j, m := 0, d.array(16); j < m; j++ {
+			tp := topicPartition{topic, d.int32()}
+			wanted = append(wanted, fetchPartition{tp, d.int64(), d.int32()})
+		}
+	}
+	timeout := time.After(wait)
+	for {
+		b.lock.Lock()
+		changed := b.changed
+		available := false
+		for _, f := range wanted {
+			if partitions := b.topics[f.tp.topic]; int(f.tp.partition) < len(partitions) {
+				if f.offset != int64(len(partitions[f.tp.partition])) {
+					available = true
+				}
+			}
+		}
+		b.lock.Unlock()
+		if available {
+			break
+		}
+		select {
+		case <-changed:
+			continue
+		case <-timeout:
+		case <-b.closed:
+			return nil
+		}
+		break
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	e := &encoder{}
+	e.int32(0) // throttle time
+	e.array(len(wanted))
+	for _, f := range wanted {
+		e.string(f.tp.topic)
+		e.array(1)
+		e.int32(f.tp.partition)
+		partitions := b.topics[f.tp.topic]
+		if int(f.tp.partition) >= len(partitions) {
+			e.int16(int16(errUnknownTopic))
+			e.int64(-1)
+			e.int64(-1)
+			e.array(-1)
+			e.bytes(nil)
+			continue
+		}
+		log := partitions[f.tp.partition]
+		if f.offset < 0 || f.offset > int64(len(log)) {
+			e.int16(int16(errOffsetOutOfRange))
+			e.int64(int64(len(log)))
+			e.int64(int64(len(log)))
+			e.array(-1)
+			e.bytes(nil)
+			continue
+		}
+		e.int16(0)
+		e.int64(int64(len(log))) // high watermark
+		e.int64(int64(len(log))) // last stable offset
+		e.array(-1)              // aborted transactions
+		var batches []byte
+		for _, r := range log[f.offset:] {
+			// a batch for each record, as they were produced
+			batch := encodeBatch([]record{r})
+			if codec, ok := b.codecs[f.tp][r.offset]; ok {
+				batch = compressBatch(batch, codec, func(b []byte) []byte { return b })
+			}
+			batches = append(batches, batch...)
+			if len(batches) >= int(f.max) {
+				break
+			}
+		}
+		e.bytes(batches)
+	}
+	return e.b
+}
+
+func (b *testBroker) listOffsets(d *decoder) []byte {
+	d.int32() // replica ID
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	e := &encoder{}
+	n := d.array(6)
+	e.array(n)
+	for i := 0; i < n; i++ {
+		topic := d.string()
+		e.string(topic)
+		m := d.array(12)
+		e.array(m)
+		for j := 0; j < m; j++ {
+			p := d.int32()
+			t := d.int64()
+			e.int32(p)
+			partitions := b.topics[topic]
+			if int(p) >= len(partitions) {
+				e.int16(int16(errUnknownTopic))
+				e.int64(-1)
+				e.int64(-1)
+				continue
+			}
+			log := partitions[p]
+			offset := int64(-1)
+			switch t {
+			case OffsetNewest:
+				offset = int64(len(log))
+			case OffsetOldest:
+				offset = 0
+			default:
+				for _, r := range log {
+					if r.timestamp >= t {
+						offset = r.offset
+						break
+					}
+				}
+			}
+			e.int16(0)
+			e.int64(-1) // timestamp
+			e.int64(offset)
+		}
+	}
+	return e.b
+}
+
+// group gets the group, making it if it is new.
+// Callers must hold the lock.
+func (b *testBroker) group(id string) *testGroup {
+	g, ok := b.groups[id]
+	if !ok {
+		g = &testGroup{
+			members: make(map[string]*testMember),
+			offsets: make(map[topicPartition]int64),
+		}
+		b.groups[id] = g
+	}
+	return g
+}
+
+// prepare starts a rebalance, unless one is already waiting for
+// members to join again, which ends once they all have or after
+// the longest rebalance timeout of the members.
+// Callers must hold the lock.
+func (b *testBroker) prepare(g *testGroup, timeout time.Duration) {
+	if g.rebalance != nil {
+		return
+	}
+	for _, m := range g.members {
+		if m.rebalance > timeout {
+			timeout = m.rebalance
+		}
+	}
+	if g.synced != nil {
+		// members waiting for the leader to sync join again
+		close(g.synced)
+		g.synced = nil
+	}
+	rebalance := make(chan qp.Signal)
+	g.rebalance = rebalance
+	g.joining = make(map[string]*testMember)
+	time.AfterFunc(timeout, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if g.rebalance == rebalance {
+			b.complete(g)
+		}
+	})
+}
+
+// complete ends the rebalance with the members that have joined.
+// Callers must hold the lock.
+func (b *testBroker) complete(g *testGroup) {
+	g.generation++
+	g.members = g.joining
+	g.joining = nil
+	ids := make([]string, 0, len(g.members))
+	for id, m := range g.members {
+		ids = append(ids, id)
+		m.seen = time.Now()
+	}
+	sort.Strings(ids)
+	if _, ok := g.members[g.leader]; !ok && len(ids) > 0 {
+		g.leader = ids[0]
+	}
+	g.assignments = nil
+	g.synced = make(chan qp.Signal)
+	close(g.rebalance)
+	g.rebalance = nil
+}
+
+// joined reports whether every member has joined the rebalance.
+// Callers must hold the lock.
+func (g *testGroup) joined() bool {
+	for id := range g.members {
+		if _, ok := g.joining[id]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *testBroker) join(d *decoder) []byte {
+	id := d.string()
+	session := time.Duration(d.int32()) * time.Millisecond
+	rebalance := time.Duration(d.int32()) * time.Millisecond
+	member := d.string()
+	d.string() // protocol type
+	var metadata []byte
+	for i, n := 0, d.array(6); i < n; i++ {
+		d.string() // protocol
+		metadata = d.bytes()
+	}
+	b.lock.Lock()
+	g := b.group(id)
+	e := &encoder{}
+	e.int32(0) // throttle time
+	if member == "" {
+		g.next++
+		member = fmt.Sprint("member-", g.next)
+	} else if _, ok := g.members[member]; !ok {
+		if _, ok := g.joining[member]; !ok {
+			b.lock.Unlock()
+			e.int16(int16(errUnknownMember))
+			e.int32(-1)
+			e.string("")
+			e.string("")
+			e.string("")
+			e.array(0)
+			return e.b
+		}
+	}
+	b.prepare(g, rebalance)
+	g.joining[member] = &testMember{metadata: metadata, session: session, rebalance: rebalance}
+	wait := g.rebalance
+	if g.joined() {
+		b.complete(g)
+	}
+	b.lock.Unlock()
+	select {
+	case <-wait:
+	case <-b.closed:
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ok := g.members[member]; !ok {
+		e.int16(int16(errUnknownMember))
+		e.int32(-1)
+		e.string("")
+		e.string("")
+		e.string(member)
+		e.array(0)
+		return e.b
+	}
+	e.int16(0)
+	e.int32(g.generation)
+	e.string(assignor)
+	e.string(g.leader)
+	e.string(member)
+	if member != g.leader {
+		e.array(0)
+		return e.b
+	}
+	e.array(len(g.members))
+	for id, m := range g.members {
+		e.string(id)
+		e.bytes(m.metadata)
+	}
+	return e.b
+}
+
+// check checks the member is in the generation of the group,
+// returning the error code if it is not.
+// Callers must hold the lock.
+func (g *testGroup) check(generation int32, member string) int16 {
+	m, ok := g.members[member]
+	if !ok {
+		return int16(errUnknownMember)
+	}
+	if generation != g.generation {
+		return int16(errIllegalGeneration)
+	}
+	m.seen = time.Now()
+	return 0
+}
+
+func (b *testBroker) sync(d *decoder) []byte {
+	id := d.string()
+	generation := d.int32()
+	member := d.string()
+	assignments := make(map[string][]byte)
+	for i, n := 0, d.array(6); i < n; i++ {
+		assignments[d.string()] = d.bytes()
+	}
+	b.lock.Lock()
+	g := b.group(id)
+	e := &encoder{}
+	e.int32(0) // throttle time
+	code := g.check(generation, member)
+	if code == 0 && g.rebalance != nil {
+		code = int16(errRebalanceInProgress)
+	}
+	if code != 0 {
+		b.lock.Unlock()
+		e.int16(code)
+		e.bytes(nil)
+		return e.b
+	}
+	if member == g.leader && g.synced != nil {
+		g.assignments = assignments
+		close(g.synced)
+		g.synced = nil
+	}
+	synced := g.synced
+	b.lock.Unlock()
+	if synced != nil {
+		select {
+		case <-synced:
+		case <-b.closed:
+			return nil
+		}
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if g.generation != generation || g.assignments == nil {
+		e.int16(int16(errRebalanceInProgress))
+		e.bytes(nil)
+		return e.b
+	}
+	e.int16(0)
+	e.bytes(g.assignments[member])
+	return e.b
+}
+
+func (b *testBroker) heartbeat(d *decoder) []byte {
+	id := d.string()
+	generation := d.int32()
+	member := d.string()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	g := b.group(id)
+	code := g.check(generation, member)
+	if code == 0 && g.rebalance != nil {
+		code = int16(errRebalanceInProgress)
+	}
+	e := &encoder{}
+	e.int32(0) // throttle time
+	e.int16(code)
+	return e.b
+}
+
+func (b *testBroker) leave(d *decoder) []byte {
+	id := d.string()
+	member := d.string()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	g := b.group(id)
+	e := &encoder{}
+	e.int32(0) // throttle time
+	if _, ok := g.members[member]; !ok {
+		e.int16(int16(errUnknownMember))
+		return e.b
+	}
+	b.evict(g, member)
+	e.int16(0)
+	return e.b
+}
+
+// evict removes the member from the group, and has the others join
+// again.
+// Callers must hold the lock.
+func (b *testBroker) evict(g *testGroup, member string) {
+	timeout := g.members[member].rebalance
+	delete(g.members, member)
+	if len(g.members) == 0 && g.rebalance == nil {
+		g.generation++
+		return
+	}
+	b.prepare(g, timeout)
+	delete(g.joining, member)
+	if g.joined() && len(g.joining) > 0 {
+		b.complete(g)
+	}
+}
+
+// reap evicts members that have not been heard from for longer
+// than their session timeout.
+func (b *testBroker) reap() {
+	defer b.wg.Done()
+	for {
+		select {
+		case <-b.closed:
+			return
+		case <-time.After(20 * time.Millisecond):
+		}
+		b.lock.Lock()
+		for _, g := range b.groups {
+			for id, m := range g.members {
+				if _, joining := g.joining[id]; !joining && time.Since(m.seen) > m.session {
+					b.evict(g, id)
+				}
+			}
+		}
+		b.lock.Unlock()
+	}
+}
+
+func (b *testBroker) commit(d *decoder) []byte {
+	id := d.string()
+	generation := d.int32()
+	member := d.string()
+	d.int64() // retention time
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	g := b.group(id)
+	code := g.check(generation, member)
+	e := &encoder{}
+	n := d.array(6)
+	e.array(n)
+	for i := 0; i < n; i++ {
+		topic := d.string()
+		e.string(topic)
+		m := d.array(14)
+		e.array(m)
+		for j := 0; j < m; j++ {
+			tp := topicPartition{topic, d.int32()}
+			offset := d.int64()
+			d.string() // metadata
+			if code == 0 {
+				g.offsets[tp] = offset
+			}
+			e.int32(tp.partition)
+			e.int16(code)
+		}
+	}
+	return e.b
+}
+
+func (b *testBroker) offsetFetch(d *decoder) []byte {
+	id := d.string()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	g := b.group(id)
+	e := &encoder{}
+	n := d.array(6)
+	e.array(n)
+	for i := 0; i < n; i++ {
+		topic := d.string()
+		e.string(topic)
+		m := d.array(4)
+		e.array(m)
+		for j := 0; j < m; j++ {
+			tp := topicPartition{topic, d.int32()}
+			offset, ok := g.offsets[tp]
+			if !ok {
+				offset = -1
+			}
+			e.int32(tp.partition)
+			e.int64(offset)
+			e.string("") // metadata
+			e.int16(0)
+		}
+	}
+	return e.b
+}
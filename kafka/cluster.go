@@ -0,0 +1,347 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/stretchr/slog"
+)
+
+// ErrNoBrokers is returned when none of the brokers can be reached.
+var ErrNoBrokers = errors.New("no Kafka broker could be reached")
+
+// Timeout is how long to wait when connecting to a broker, and for
+// it to answer a request.
+var Timeout = 5 * time.Second
+
+// cluster keeps track of the brokers and which of them leads each
+// partition, and the connections used to produce and to ask the
+// cluster about itself.
+type cluster struct {
+	bootstrap []string
+	clientID  string
+	log       slog.Logger
+
+	lock       sync.Mutex
+	brokers    map[int32]string
+	partitions map[string][]partition
+	conns      map[string]*broker
+}
+
+// partition is a partition of a topic, and the broker that leads
+// it.
+type partition struct {
+	id     int32
+	leader int32
+}
+
+// topicPartition identifies a partition.
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+func (tp topicPartition) String() string {
+	return tp.topic + "/" + strconv.Itoa(int(tp.partition))
+}
+
+// newCluster makes a cluster that is first found through the
+// bootstrap brokers.
+func newCluster(bootstrap []string, clientID string) *cluster {
+	return &cluster{
+		bootstrap:  bootstrap,
+		clientID:   clientID,
+		log:        slog.NilLogger,
+		brokers:    make(map[int32]string),
+		partitions: make(map[string][]partition),
+		conns:      make(map[string]*broker),
+	}
+}
+
+// broker gets the shared connection to the broker at the address.
+func (c *cluster) broker(addr string) *broker {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	b, ok := c.conns[addr]
+	if !ok {
+		b = newBroker(addr, c.clientID)
+		c.conns[addr] = b
+	}
+	return b
+}
+
+// addrs gets the addresses of every known broker, followed by the
+// bootstrap brokers.
+func (c *cluster) addrs() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	addrs := make([]string, 0, len(c.brokers)+len(c.bootstrap))
+	for _, addr := range c.brokers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return append(addrs, c.bootstrap...)
+}
+
+// any makes the request of the first broker that answers it.
+func (c *cluster) any(api int16, body []byte) (*decoder, error) {
+	err := ErrNoBrokers
+	for _, addr := range c.addrs() {
+		var d *decoder
+		if d, err = c.broker(addr).request(api, body, 0); err == nil {
+			return d, nil
+		}
+		if c.log.Warn() {
+			c.log.Warn("failed to reach Kafka broker", addr+":", err)
+		}
+	}
+	return nil, err
+}
+
+// refresh asks the cluster about the topics, or every topic if
+// there are none, and creates the named topics that do not exist
+// if create is true and the brokers allow it. It returns the topics
+// the cluster knows, other than its internal ones.
+func (c *cluster) refresh(topics []string, create bool) ([]string, error) {
+	e := &encoder{}
+	if len(topics) == 0 {
+		e.array(-1)
+	} else {
+		e.array(len(topics))
+		for _, topic := range topics {
+			e.string(topic)
+		}
+	}
+	e.bool(create)
+	d, err := c.any(apiMetadata, e.b)
+	if err != nil {
+		return nil, err
+	}
+	d.int32() // throttle time
+	brokers := make(map[int32]string)
+	for i, n := 0, d.array(12); i < n; i++ {
+		node := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // rack
+		brokers[node] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.string() // cluster ID
+	d.int32()  // controller ID
+	found := make(map[string][]partition)
+	var names []string
+	for i, n := 0, d.array(7); i < n; i++ {
+		code := d.int16()
+		topic := d.string()
+		internal := d.bool()
+		var partitions []partition
+		for j, m := 0, d.array(18); j < m; j++ {
+			d.int16() // error code, with a leader of -1
+			p := partition{id: d.int32(), leader: d.int32()}
+			for replicas := 0; replicas < 2; replicas++ {
+				// the replicas, then those in sync
+				for k, l := 0, d.array(4); k < l; k++ {
+					d.int32()
+				}
+			}
+			partitions = append(partitions, p)
+		}
+		if code != 0 && c.log.Info() {
+			c.log.Info("topic", topic+":", Error(code))
+		}
+		if internal {
+			continue
+		}
+		sort.Slice(partitions, func(i, j int) bool { return partitions[i].id < partitions[j].id })
+		found[topic] = partitions
+		names = append(names, topic)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	c.lock.Lock()
+	for node, addr := range brokers {
+		c.brokers[node] = addr
+	}
+	for topic, partitions := range found {
+		if len(partitions) == 0 {
+			delete(c.partitions, topic)
+		} else {
+			c.partitions[topic] = partitions
+		}
+	}
+	c.lock.Unlock()
+	sort.Strings(names)
+	return names, nil
+}
+
+// topic gets the partitions of the topic, asking the cluster if it
+// does not know them and creating the topic if create is true.
+func (c *cluster) topic(topic string, create bool) ([]partition, error) {
+	c.lock.Lock()
+	partitions := c.partitions[topic]
+	c.lock.Unlock()
+	if len(partitions) > 0 {
+		return partitions, nil
+	}
+	if _, err := c.refresh([]string{topic}, create); err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	partitions = c.partitions[topic]
+	c.lock.Unlock()
+	if len(partitions) == 0 {
+		return nil, errLeaderNotAvailable
+	}
+	return partitions, nil
+}
+
+// ensure makes sure the topics exist, creating them if the brokers
+// allow it, and waits up to Timeout for them to have leaders.
+func (c *cluster) ensure(topics []string) error {
+	deadline := time.Now().Add(Timeout)
+	for _, topic := range topics {
+		for {
+			_, err := c.topic(topic, true)
+			if err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("kafka topic %s: %v", topic, err)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// leader gets the address of the broker that leads the partition.
+func (c *cluster) leader(tp topicPartition) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, p := range c.partitions[tp.topic] {
+		if p.id != tp.partition {
+			continue
+		}
+		if addr, ok := c.brokers[p.leader]; ok {
+			return addr, nil
+		}
+	}
+	return "", errLeaderNotAvailable
+}
+
+// forget drops what is known about the topic, so that it is asked
+// about again, such as when its leaders have moved.
+func (c *cluster) forget(topic string) {
+	c.lock.Lock()
+	delete(c.partitions, topic)
+	c.lock.Unlock()
+}
+
+// coordinator finds the broker that coordinates the group.
+func (c *cluster) coordinator(group string) (string, error) {
+	e := &encoder{}
+	e.string(group)
+	d, err := c.any(apiFindCoordinator, e.b)
+	if err != nil {
+		return "", err
+	}
+	code := d.int16()
+	d.int32() // node ID
+	host := d.string()
+	port := d.int32()
+	if d.err != nil {
+		return "", d.err
+	}
+	if err := check(code); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// offsets asks the leaders of the partitions for the offset of the
+// first message at or after each timestamp, where OffsetOldest and
+// OffsetNewest ask for the first offset and the offset after the
+// last. Partitions with no such message get OffsetNewest's offset.
+func (c *cluster) offsets(times map[topicPartition]int64) (map[topicPartition]int64, error) {
+	byLeader := make(map[string][]topicPartition)
+	for tp := range times {
+		addr, err := c.leader(tp)
+		if err != nil {
+			return nil, err
+		}
+		byLeader[addr] = append(byLeader[addr], tp)
+	}
+	offsets := make(map[topicPartition]int64)
+	var later map[topicPartition]int64
+	for addr, tps := range byLeader {
+		byTopic := make(map[string][]topicPartition)
+		for _, tp := range tps {
+			byTopic[tp.topic] = append(byTopic[tp.topic], tp)
+		}
+		e := &encoder{}
+		e.int32(-1) // replica ID
+		e.array(len(byTopic))
+		for topic, tps := range byTopic {
+			e.string(topic)
+			e.array(len(tps))
+			for _, tp := range tps {
+				e.int32(tp.partition)
+				e.int64(times[tp])
+			}
+		}
+		d, err := c.broker(addr).request(apiListOffsets, e.b, 0)
+		if err != nil {
+			return nil, err
+		}
+		for i, n := 0, d.array(6); i < n; i++ {
+			topic := d.string()
+			for j, m := 0, d.array(22); j < m; j++ {
+				tp := topicPartition{topic, d.int32()}
+				code := d.int16()
+				d.int64() // timestamp
+				offset := d.int64()
+				if err := check(code); err != nil {
+					return nil, fmt.Errorf("%s: %v", tp, err)
+				}
+				if offset < 0 && times[tp] != OffsetNewest {
+					// nothing that late, so start at the end
+					if later == nil {
+						later = make(map[topicPartition]int64)
+					}
+					later[tp] = OffsetNewest
+					continue
+				}
+				offsets[tp] = offset
+			}
+		}
+		if d.err != nil {
+			return nil, d.err
+		}
+	}
+	if len(later) > 0 {
+		newest, err := c.offsets(later)
+		if err != nil {
+			return nil, err
+		}
+		for tp, offset := range newest {
+			offsets[tp] = offset
+		}
+	}
+	return offsets, nil
+}
+
+// close closes the shared connections.
+func (c *cluster) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for addr, b := range c.conns {
+		b.close()
+		delete(c.conns, addr)
+	}
+}
@@ -0,0 +1,813 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+)
+
+// errRestart ends a session so that the consumer joins its group
+// again, such as when what it consumes has changed.
+var errRestart = errors.New("kafka consumer joining its group again")
+
+// consumer consumes topics as a member of a consumer group, handing
+// each message to the handlers bound to its topic and committing
+// the offsets of the messages they have handled.
+//
+// Each time the group's members change, every member joins the
+// group again and is assigned partitions: a session. Within a
+// session, a goroutine for each broker fetches the partitions it
+// leads.
+type consumer struct {
+	cluster *cluster
+	group   string
+	options Options
+	initial int64
+	log     slog.Logger
+	// subscription gets the topics to consume, and the patterns
+	// whose matching topics are consumed too.
+	subscription func() (topics, patterns []string)
+	// dispatchers gets the dispatchers to hand a message on the
+	// topic to.
+	dispatchers func(topic string) []*qp.Dispatcher
+	// skip is whether messages on a topic with no handlers are
+	// passed over, or left for another member of the group.
+	skip bool
+	// fault reports records that had to be skipped.
+	fault   func(err error)
+	tracker *tracker
+
+	lock    sync.Mutex
+	member  string
+	seen    map[string]map[string]bool
+	fresh   map[string]bool
+	seeks   map[topicPartition]int64
+	ready   chan qp.Signal
+	restart chan qp.Signal
+	quit    chan qp.Signal
+	paused  chan qp.Signal
+	closing chan qp.Signal
+	done    chan qp.Signal
+	pause   sync.Once
+}
+
+// session is the partitions assigned to the consumer until the
+// group changes, and the goroutines fetching them.
+type session struct {
+	coordinator *coordinator
+	topics      string
+	progress    map[topicPartition]*progress
+	quit        chan qp.Signal
+	errs        chan error
+	wg          sync.WaitGroup
+
+	lock  sync.Mutex
+	conns []*broker
+}
+
+func newConsumer(c *cluster, group string, options Options, initial int64) *consumer {
+	return &consumer{
+		cluster: c,
+		group:   group,
+		options: options,
+		initial: initial,
+		log:     slog.NilLogger,
+		tracker: newTracker(),
+		seeks:   make(map[topicPartition]int64),
+	}
+}
+
+// start starts consuming, and returns once the first session has
+// started or the group has taken too long to assign partitions.
+func (c *consumer) start() {
+	c.lock.Lock()
+	c.seen = make(map[string]map[string]bool)
+	c.fresh = make(map[string]bool)
+	c.ready = make(chan qp.Signal)
+	ready := c.ready
+	c.lock.Unlock()
+	c.restart = make(chan qp.Signal, 1)
+	c.quit = make(chan qp.Signal)
+	c.paused = make(chan qp.Signal)
+	c.closing = make(chan qp.Signal)
+	c.done = make(chan qp.Signal)
+	c.pause = sync.Once{}
+	go c.run()
+	c.await(ready)
+}
+
+// update has the consumer join its group again, so that a change
+// to what it consumes takes effect, and waits for it to have done
+// so.
+func (c *consumer) update() {
+	c.lock.Lock()
+	select {
+	case <-c.ready:
+		c.ready = make(chan qp.Signal)
+	default:
+	}
+	ready := c.ready
+	c.lock.Unlock()
+	c.rejoin()
+	c.await(ready)
+}
+
+// await waits for the ready channel to be closed, giving up once
+// the group could have given the partitions to other members.
+func (c *consumer) await(ready chan qp.Signal) {
+	select {
+	case <-ready:
+	case <-c.quit:
+	case <-time.After(c.options.sessionTimeout()):
+		if c.log.Warn() {
+			c.log.Warn("still waiting for partitions from group", c.group)
+		}
+	}
+}
+
+// rejoin has the consumer end its session and join its group
+// again.
+func (c *consumer) rejoin() {
+	select {
+	case c.restart <- qp.Signal{}:
+	default:
+	}
+}
+
+// seek has the partition consumed from the offset, or from
+// OffsetOldest or OffsetNewest, next time the consumer is assigned
+// it.
+func (c *consumer) seek(tp topicPartition, offset int64) {
+	c.lock.Lock()
+	c.seeks[tp] = offset
+	c.lock.Unlock()
+}
+
+// seekTime has each partition of the topic consumed from the first
+// message at or after the time, next time the consumer is assigned
+// it.
+func (c *consumer) seekTime(topic string, t time.Time) error {
+	partitions, err := c.cluster.topic(topic, false)
+	if err != nil {
+		return err
+	}
+	times := make(map[topicPartition]int64, len(partitions))
+	for _, p := range partitions {
+		times[topicPartition{topic, p.id}] = t.UnixNano() / int64(time.Millisecond)
+	}
+	offsets, err := c.cluster.offsets(times)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	for tp, offset := range offsets {
+		c.seeks[tp] = offset
+	}
+	c.lock.Unlock()
+	return nil
+}
+
+// stop stops fetching, and waits up to the timeout for the
+// goroutines fetching to have handed on what they had.
+func (c *consumer) stop(timeout time.Duration) {
+	close(c.quit)
+	select {
+	case <-c.paused:
+	case <-time.After(timeout):
+	}
+}
+
+// close commits the offsets of the messages that were handled, and
+// leaves the group. Handlers must have returned or been abandoned,
+// and their dispatchers closed.
+func (c *consumer) close() {
+	close(c.closing)
+	<-c.done
+}
+
+// run runs sessions until the consumer stops.
+func (c *consumer) run() {
+	defer close(c.done)
+	delay := 100 * time.Millisecond
+	for {
+		err := c.session()
+		if err == nil {
+			return
+		}
+		select {
+		case <-c.quit:
+			c.finish(nil)
+			return
+		default:
+		}
+		if err == errRestart {
+			delay = 100 * time.Millisecond
+			continue
+		}
+		if c.log.Warn() {
+			c.log.Warn("consuming for group", c.group, "failed:", err)
+		}
+		select {
+		case <-c.quit:
+			c.finish(nil)
+			return
+		case <-c.restart:
+		case <-time.After(delay):
+		}
+		if delay < 5*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// finish waits for the transport to have finished with the
+// handlers, then commits what the session handled and leaves the
+// group.
+func (c *consumer) finish(s *session) {
+	c.pause.Do(func() { close(c.paused) })
+	<-c.closing
+	if s != nil {
+		c.commit(s)
+	}
+	c.leave(s)
+}
+
+// leave leaves the group, if the consumer is a member.
+func (c *consumer) leave(s *session) {
+	c.lock.Lock()
+	member := c.member
+	c.member = ""
+	c.lock.Unlock()
+	if member == "" {
+		return
+	}
+	var coord *coordinator
+	if s != nil {
+		coord = s.coordinator
+	} else {
+		addr, err := c.cluster.coordinator(c.group)
+		if err != nil {
+			return
+		}
+		coord = &coordinator{conn: newBroker(addr, c.options.clientID()), group: c.group}
+		defer coord.conn.close()
+	}
+	coord.member = member
+	if err := coord.leave(); err != nil && c.log.Warn() {
+		c.log.Warn("failed to leave group", c.group+":", err)
+	}
+}
+
+// session joins the group and consumes the partitions it assigns,
+// until the group changes or the consumer stops. It returns nil
+// once the consumer has stopped.
+func (c *consumer) session() error {
+	topics, err := c.resolve()
+	if err != nil {
+		return err
+	}
+	if len(topics) == 0 {
+		// nothing to consume, so no need to be in the group
+		c.leave(nil)
+		c.signalReady()
+		select {
+		case <-c.quit:
+			c.finish(nil)
+			return nil
+		case <-c.restart:
+		case <-time.After(c.options.refresh()):
+		}
+		return errRestart
+	}
+	addr, err := c.cluster.coordinator(c.group)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	coord := &coordinator{conn: newBroker(addr, c.options.clientID()), group: c.group, member: c.member}
+	c.lock.Unlock()
+	defer coord.conn.close()
+
+	// joining waits for the other members, so give up on quit
+	joined, quit := make(chan qp.Signal), c.quit
+	go func() {
+		select {
+		case <-quit:
+			coord.conn.close()
+		case <-joined:
+		}
+	}()
+	assigned, err := c.join(coord, topics)
+	close(joined)
+	c.lock.Lock()
+	c.member = coord.member
+	c.lock.Unlock()
+	if err != nil {
+		if rejoinable(err) {
+			return errRestart
+		}
+		return err
+	}
+	s := &session{
+		coordinator: coord,
+		topics:      signature(topics, c.cluster),
+		progress:    make(map[topicPartition]*progress),
+		quit:        make(chan qp.Signal),
+		errs:        make(chan error, 1),
+	}
+	if err := c.begin(s, assigned); err != nil {
+		c.end(s)
+		return err
+	}
+	c.signalReady()
+
+	heartbeat := time.NewTicker(c.options.heartbeat())
+	defer heartbeat.Stop()
+	refresh := time.NewTicker(c.options.refresh())
+	defer refresh.Stop()
+	for {
+		select {
+		case <-c.quit:
+			s.stop()
+			fetched := s.stopped()
+			select {
+			case <-fetched:
+			case <-c.closing:
+			}
+			c.pause.Do(func() { close(c.paused) })
+			<-c.closing
+			<-fetched
+			c.finish(s)
+			return nil
+		case <-c.restart:
+			c.end(s)
+			return errRestart
+		case err := <-s.errs:
+			c.end(s)
+			return err
+		case <-heartbeat.C:
+			c.commit(s)
+			if err := coord.heartbeat(); err != nil {
+				c.end(s)
+				if rejoinable(err) {
+					return errRestart
+				}
+				return err
+			}
+		case <-refresh.C:
+			topics, err := c.resolve()
+			if err == nil && signature(topics, c.cluster) != s.topics {
+				c.end(s)
+				return errRestart
+			}
+		}
+	}
+}
+
+// rejoinable reports whether the error means the member should
+// join its group again, rather than that something went wrong.
+func rejoinable(err error) bool {
+	switch err {
+	case errRebalanceInProgress, errIllegalGeneration, errUnknownMember:
+		return true
+	}
+	return false
+}
+
+// resolve gets the topics to consume, creating those named by the
+// subscription and finding those that match its patterns.
+func (c *consumer) resolve() ([]string, error) {
+	topics, patterns := c.subscription()
+	if err := c.cluster.ensure(topics); err != nil {
+		return nil, err
+	}
+	if len(patterns) == 0 {
+		return topics, nil
+	}
+	all, err := c.cluster.refresh(nil, false)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool)
+	for _, topic := range topics {
+		set[topic] = true
+	}
+	c.lock.Lock()
+	for _, pattern := range patterns {
+		seen, known := c.seen[pattern]
+		if !known {
+			seen = make(map[string]bool)
+			c.seen[pattern] = seen
+		}
+		for _, topic := range all {
+			if !qp.MatchChannel(pattern, topic) {
+				continue
+			}
+			set[topic] = true
+			if !seen[topic] {
+				seen[topic] = true
+				// topics made since the pattern was first
+				// resolved are consumed from the start
+				if known {
+					c.fresh[topic] = true
+				}
+			}
+		}
+	}
+	c.lock.Unlock()
+	topics = make([]string, 0, len(set))
+	for topic := range set {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// signature describes the topics and how many partitions each has,
+// so that changes to either can be noticed.
+func signature(topics []string, c *cluster) string {
+	parts := make([]string, len(topics))
+	for i, topic := range topics {
+		c.lock.Lock()
+		parts[i] = fmt.Sprint(topic, ":", len(c.partitions[topic]))
+		c.lock.Unlock()
+	}
+	return strings.Join(parts, ",")
+}
+
+// join joins the group, assigning the partitions if this member is
+// the leader, and returns those assigned to this member.
+func (c *consumer) join(coord *coordinator, topics []string) (map[string][]int32, error) {
+	leader, members, err := coord.join(topics, c.options.sessionTimeout(), c.options.rebalanceTimeout())
+	if err != nil {
+		return nil, err
+	}
+	var assignments map[string]map[string][]int32
+	if leader {
+		all := make(map[string]bool)
+		for _, topics := range members {
+			for _, topic := range topics {
+				all[topic] = true
+			}
+		}
+		names := make([]string, 0, len(all))
+		for topic := range all {
+			names = append(names, topic)
+		}
+		if _, err := c.cluster.refresh(names, false); err != nil {
+			return nil, err
+		}
+		partitions := make(map[string][]int32)
+		c.cluster.lock.Lock()
+		for _, topic := range names {
+			for _, p := range c.cluster.partitions[topic] {
+				partitions[topic] = append(partitions[topic], p.id)
+			}
+		}
+		c.cluster.lock.Unlock()
+		assignments = assign(members, partitions)
+	}
+	return coord.sync(assignments, c.options.rebalanceTimeout())
+}
+
+// begin works out where to start consuming each assigned partition,
+// and starts fetching them.
+func (c *consumer) begin(s *session, assigned map[string][]int32) error {
+	var tps []topicPartition
+	for topic, partitions := range assigned {
+		for _, p := range partitions {
+			tps = append(tps, topicPartition{topic, p})
+		}
+	}
+	if len(tps) == 0 {
+		return nil
+	}
+	committed, err := s.coordinator.committed(tps)
+	if err != nil {
+		return err
+	}
+	starts := make(map[topicPartition]int64)
+	times := make(map[topicPartition]int64)
+	c.lock.Lock()
+	for _, tp := range tps {
+		if offset, ok := c.seeks[tp]; ok {
+			delete(c.seeks, tp)
+			if offset < 0 {
+				times[tp] = offset
+			} else {
+				starts[tp] = offset
+			}
+		} else if offset, ok := committed[tp]; ok {
+			starts[tp] = offset
+		} else if c.fresh[tp.topic] {
+			times[tp] = OffsetOldest
+		} else {
+			times[tp] = c.initial
+		}
+	}
+	c.lock.Unlock()
+	if len(times) > 0 {
+		offsets, err := c.cluster.offsets(times)
+		if err != nil {
+			return err
+		}
+		for tp, offset := range offsets {
+			starts[tp] = offset
+		}
+	}
+	byLeader := make(map[string]map[topicPartition]*progress)
+	for _, tp := range tps {
+		committedOffset, ok := committed[tp]
+		if !ok || committedOffset != starts[tp] {
+			// commit where it starts, so that the group
+			// starts there too if this member goes away
+			committedOffset = -1
+		}
+		p := &progress{next: starts[tp], committed: committedOffset}
+		s.progress[tp] = p
+		addr, err := c.cluster.leader(tp)
+		if err != nil {
+			return err
+		}
+		if byLeader[addr] == nil {
+			byLeader[addr] = make(map[topicPartition]*progress)
+		}
+		byLeader[addr][tp] = p
+	}
+	c.commit(s)
+	if c.log.Info() {
+		c.log.Info("consuming", len(tps), "partitions for group", c.group)
+	}
+	for addr, partitions := range byLeader {
+		s.wg.Add(1)
+		go c.fetch(s, addr, partitions)
+	}
+	return nil
+}
+
+// end stops fetching, and waits for the handlers to finish with
+// what was fetched before committing it, so that the partitions'
+// next owners carry on from there.
+func (c *consumer) end(s *session) {
+	s.stop()
+	timeout := time.After(c.options.rebalanceTimeout())
+	select {
+	case <-s.stopped():
+	case <-timeout:
+	case <-c.quit:
+	}
+	select {
+	case <-c.tracker.idle():
+	case <-timeout:
+	case <-c.quit:
+	}
+	c.commit(s)
+}
+
+// commit commits the offset of each partition's first message that
+// has not been handled, where it has moved on.
+func (c *consumer) commit(s *session) {
+	offsets := make(map[topicPartition]int64)
+	for tp, p := range s.progress {
+		if position := c.tracker.position(p); position != p.committed {
+			offsets[tp] = position
+		}
+	}
+	if len(offsets) == 0 {
+		return
+	}
+	if err := s.coordinator.commit(offsets); err != nil {
+		if c.log.Warn() {
+			c.log.Warn("failed to commit offsets for group", c.group+":", err)
+		}
+		return
+	}
+	for tp, offset := range offsets {
+		c.tracker.committed(s.progress[tp], offset)
+	}
+}
+
+// signalReady tells those waiting that a session has started.
+func (c *consumer) signalReady() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	select {
+	case <-c.ready:
+	default:
+		close(c.ready)
+	}
+}
+
+// fetch fetches the partitions from their leader, and hands their
+// messages on, until the session stops.
+func (c *consumer) fetch(s *session, addr string, partitions map[topicPartition]*progress) {
+	defer s.wg.Done()
+	conn := newBroker(addr, c.options.clientID())
+	if !s.track(conn) {
+		return
+	}
+	defer conn.close()
+	parked := make(map[topicPartition]bool)
+	for {
+		e := &encoder{}
+		e.int32(-1) // replica ID
+		e.int32(int32(c.options.maxWait() / time.Millisecond))
+		e.int32(1)  // min bytes
+		e.int32(-1) // max bytes: as many as the partitions allow
+		e.int8(0)   // isolation level: read uncommitted
+		byTopic := make(map[string][]topicPartition)
+		for tp := range partitions {
+			if !parked[tp] {
+				byTopic[tp.topic] = append(byTopic[tp.topic], tp)
+			}
+		}
+		if len(byTopic) == 0 {
+			<-s.quit
+			return
+		}
+		e.array(len(byTopic))
+		for topic, tps := range byTopic {
+			e.string(topic)
+			e.array(len(tps))
+			for _, tp := range tps {
+				e.int32(tp.partition)
+				e.int64(c.tracker.next(partitions[tp]))
+				e.int32(c.options.fetchSize())
+			}
+		}
+		d, err := conn.request(apiFetch, e.b, c.options.maxWait())
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		d.int32() // throttle time
+		for i, n := 0, d.array(6); i < n; i++ {
+			topic := d.string()
+			for j, m := 0, d.array(34); j < m; j++ {
+				tp := topicPartition{topic, d.int32()}
+				code := d.int16()
+				d.int64() // high watermark
+				d.int64() // last stable offset
+				for k, l := 0, d.array(16); k < l; k++ {
+					d.int64() // aborted producer ID
+					d.int64() // first aborted offset
+				}
+				batches := d.bytes()
+				p, ok := partitions[tp]
+				if !ok || d.err != nil {
+					continue
+				}
+				if Error(code) == errOffsetOutOfRange {
+					if err := c.reset(tp, p); err != nil {
+						s.fail(err)
+						return
+					}
+					continue
+				}
+				if err := check(code); err != nil {
+					s.fail(fmt.Errorf("fetching %s: %v", tp, err))
+					return
+				}
+				records, err := decodeBatches(batches)
+				var skipped *unreadable
+				if err != nil && !errors.As(err, &skipped) {
+					s.fail(fmt.Errorf("fetching %s: %v", tp, err))
+					return
+				}
+				for _, r := range records {
+					if r.offset < c.tracker.next(p) {
+						continue
+					}
+					select {
+					case <-s.quit:
+						return
+					default:
+					}
+					if !c.deliver(tp, p, r) {
+						// leave it for another member
+						parked[tp] = true
+						c.rejoin()
+						break
+					}
+				}
+				if skipped != nil && !parked[tp] {
+					c.pass(tp, p, skipped)
+				}
+			}
+		}
+		if d.err != nil {
+			s.fail(d.err)
+			return
+		}
+	}
+}
+
+// reset moves a partition whose offset the broker no longer has to
+// where partitions without a committed offset start.
+func (c *consumer) reset(tp topicPartition, p *progress) error {
+	if c.log.Warn() {
+		c.log.Warn("offset", c.tracker.next(p), "out of range for", tp)
+	}
+	offsets, err := c.cluster.offsets(map[topicPartition]int64{tp: c.initial})
+	if err != nil {
+		return err
+	}
+	c.tracker.skip(p, offsets[tp])
+	return nil
+}
+
+// pass moves the partition on past a batch that cannot be read,
+// which fetching again would never get past, and reports the
+// records lost with the fault func.
+func (c *consumer) pass(tp topicPartition, p *progress, batch *unreadable) {
+	if batch.next <= c.tracker.next(p) {
+		return
+	}
+	err := fmt.Errorf("skipped %s: %v", tp, batch)
+	if c.log.Err() {
+		c.log.Err(err)
+	}
+	c.tracker.skip(p, batch.next)
+	if c.fault != nil {
+		c.fault(err)
+	}
+}
+
+// deliver hands the record to the handlers of its topic. It
+// returns false if there are none and the consumer should leave
+// the partition for another member.
+func (c *consumer) deliver(tp topicPartition, p *progress, r record) bool {
+	dispatchers := c.dispatchers(tp.topic)
+	if len(dispatchers) == 0 && !c.skip {
+		return false
+	}
+	msg := &qp.Message{Source: tp.topic, Data: r.value}
+	c.tracker.take(p, r.offset, msg, len(dispatchers))
+	for _, dispatcher := range dispatchers {
+		// blocks while the channel is at capacity, and a
+		// message that cannot be handed over is consumed
+		// again unless it would be skipped anyway
+		if err := dispatcher.Dispatch(msg); err != nil {
+			c.tracker.handled(msg, c.skip)
+			if !c.skip {
+				c.rejoin()
+			}
+		}
+	}
+	return true
+}
+
+// track keeps the connection to close when the session stops. It
+// returns false if the session has already stopped.
+func (s *session) track(conn *broker) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	select {
+	case <-s.quit:
+		return false
+	default:
+	}
+	s.conns = append(s.conns, conn)
+	return true
+}
+
+// stop stops the goroutines fetching, interrupting their fetches.
+func (s *session) stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	select {
+	case <-s.quit:
+		return
+	default:
+	}
+	close(s.quit)
+	for _, conn := range s.conns {
+		conn.close()
+	}
+}
+
+// stopped gets a channel that is closed once the goroutines
+// fetching have returned.
+func (s *session) stopped() chan qp.Signal {
+	stopped := make(chan qp.Signal)
+	go func() {
+		s.wg.Wait()
+		close(stopped)
+	}()
+	return stopped
+}
+
+// fail ends the session because of the error.
+func (s *session) fail(err error) {
+	select {
+	case <-s.quit:
+	case s.errs <- err:
+	default:
+	}
+}
@@ -0,0 +1,277 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+)
+
+// Direct represents a qp.DirectTransport. Each channel is a topic
+// that every Direct consumes in the same group, so that each
+// message goes to one of them. Messages wait in the topic until a
+// handler takes them, and a Direct that stops carries on from the
+// group's committed offsets when it starts again.
+type Direct struct {
+	qp.Lifecycle
+	cluster     *cluster
+	producer    *producer
+	consumer    *consumer
+	options     Options
+	handlers    map[string]qp.Handler
+	channels    map[string]qp.ChannelOptions
+	dispatchers map[string]*qp.Dispatcher
+	lock        sync.Mutex
+	log         slog.Logger
+}
+
+// ensure the interface is satisfied
+var _ qp.DirectTransport = (*Direct)(nil)
+
+// NewDirect makes a new Direct Kafka transport that finds the
+// cluster through the brokers, such as "localhost:9092".
+func NewDirect(brokers []string) *Direct {
+	return NewDirectOptions(brokers, Options{})
+}
+
+// NewDirectOptions makes a new Direct Kafka transport with the
+// specified options.
+func NewDirectOptions(brokers []string, options Options) *Direct {
+	c := newCluster(brokers, options.clientID())
+	group := options.Group
+	if group == "" {
+		group = DefaultGroup
+	}
+	d := &Direct{
+		cluster:     c,
+		producer:    newProducer(c, options.acks()),
+		consumer:    newConsumer(c, group, options, options.initial(OffsetOldest)),
+		options:     options,
+		handlers:    make(map[string]qp.Handler),
+		channels:    make(map[string]qp.ChannelOptions),
+		dispatchers: make(map[string]*qp.Dispatcher),
+		log:         slog.NilLogger,
+	}
+	d.consumer.subscription = d.subscription
+	d.consumer.fault = d.Fault
+	d.consumer.dispatchers = d.dispatchersFor
+	return d
+}
+
+// SetLogger sets the Logger to log to.
+func (d *Direct) SetLogger(log slog.Logger) {
+	d.log = log
+	d.cluster.log = log
+	d.consumer.log = log
+}
+
+// Send sends data on the channel, to the partition the Key option
+// picks. It returns once the brokers the Acks option names have
+// the message.
+func (d *Direct) Send(channel string, data []byte) error {
+	if !d.Running() {
+		return qp.ErrNotRunning
+	}
+	if d.log.Info() {
+		d.log.Info("sending to", channel, string(data))
+	}
+	err := d.producer.produce(channel, d.options.key(channel, data), data)
+	if err != nil && d.log.Err() {
+		d.log.Err("send failed", err)
+	}
+	return err
+}
+
+// OnMessage binds the handler to the specified channel.
+// If the transport is running, it returns once the group has
+// assigned it the channel's partitions it is to consume.
+func (d *Direct) OnMessage(channel string, handler qp.Handler) error {
+	if d.log.Info() {
+		d.log.Info("listening to", channel)
+	}
+	d.lock.Lock()
+	_, replaced := d.handlers[channel]
+	d.handlers[channel] = handler
+	running := d.State() == qp.StateRunning
+	if running {
+		d.listen(channel)
+	}
+	d.lock.Unlock()
+	if running && !replaced {
+		if err := d.cluster.ensure([]string{channel}); err != nil {
+			return err
+		}
+		d.consumer.update()
+	}
+	return nil
+}
+
+// RemoveHandler unbinds the handler from the specified channel.
+// If the transport is running, it stops consuming the channel once
+// the handlers already running have finished, so that its messages
+// go to another member of the group.
+func (d *Direct) RemoveHandler(channel string) error {
+	if d.log.Info() {
+		d.log.Info("no longer listening to", channel)
+	}
+	d.lock.Lock()
+	delete(d.handlers, channel)
+	d.unlisten(channel)
+	running := d.State() == qp.StateRunning
+	d.lock.Unlock()
+	if running {
+		d.consumer.update()
+	}
+	return nil
+}
+
+// SetChannelOptions sets the options that control how messages
+// on the specified channel are dispatched to its handler.
+func (d *Direct) SetChannelOptions(channel string, options qp.ChannelOptions) error {
+	d.lock.Lock()
+	d.channels[channel] = options
+	if _, ok := d.handlers[channel]; ok && d.State() == qp.StateRunning {
+		d.listen(channel)
+	}
+	d.lock.Unlock()
+	return nil
+}
+
+// Seek has the channel's partition consumed from the offset, or
+// from OffsetOldest or OffsetNewest, in place of its committed
+// offset. The seek takes effect when the group next assigns the
+// partition to this transport, which is straight away if it is
+// running and has been assigned it.
+func (d *Direct) Seek(channel string, partition int32, offset int64) error {
+	d.consumer.seek(topicPartition{channel, partition}, offset)
+	if d.Running() {
+		d.consumer.update()
+	}
+	return nil
+}
+
+// SeekTime has the channel consumed from the first message
+// published at or after the time, in place of its committed
+// offsets, as Seek does for each of its partitions.
+func (d *Direct) SeekTime(channel string, t time.Time) error {
+	if err := d.consumer.seekTime(channel, t); err != nil {
+		return err
+	}
+	if d.Running() {
+		d.consumer.update()
+	}
+	return nil
+}
+
+// subscription gets the channels that have handlers.
+func (d *Direct) subscription() ([]string, []string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	channels := make([]string, 0, len(d.handlers))
+	for channel := range d.handlers {
+		channels = append(channels, channel)
+	}
+	return channels, nil
+}
+
+// dispatchersFor gets the dispatcher of the channel's handler.
+func (d *Direct) dispatchersFor(channel string) []*qp.Dispatcher {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if dispatcher, ok := d.dispatchers[channel]; ok {
+		return []*qp.Dispatcher{dispatcher}
+	}
+	return nil
+}
+
+// listen makes the dispatcher for the channel's handler, replacing
+// any existing one.
+// Callers must hold the lock.
+func (d *Direct) listen(channel string) {
+	d.unlisten(channel)
+	handler := d.consumer.tracker.wrap(d.handlers[channel])
+	d.dispatchers[channel] = qp.NewDispatcher(handler, d.channels[channel])
+}
+
+// unlisten closes the dispatcher for the channel.
+// Callers must hold the lock.
+func (d *Direct) unlisten(channel string) {
+	if dispatcher, ok := d.dispatchers[channel]; ok {
+		// anything fetched from now on is consumed again
+		dispatcher.Close()
+		delete(d.dispatchers, channel)
+	}
+}
+
+// Start connects to the cluster, creates the topics for the
+// channels with handlers, and returns once the group has assigned
+// the transport the partitions it is to consume.
+// A stopped transport may be started again.
+func (d *Direct) Start() error {
+	if err := d.BeginStart(); err != nil {
+		return err
+	}
+	if d.log.Info() {
+		d.log.Info("starting")
+	}
+	channels, _ := d.subscription()
+	if _, err := d.cluster.refresh(nil, false); err != nil {
+		d.cluster.close()
+		return d.EndStart(err)
+	}
+	if err := d.cluster.ensure(channels); err != nil {
+		d.cluster.close()
+		return d.EndStart(err)
+	}
+	d.lock.Lock()
+	for channel := range d.handlers {
+		d.listen(channel)
+	}
+	d.lock.Unlock()
+	d.consumer.start()
+	return d.EndStart(nil)
+}
+
+// Stop instructs the transport to gracefully stop and close the
+// StopChan when stopping has completed.
+//
+// No new messages are fetched once Stop is called, and in-flight
+// requests have the grace period to complete before being
+// abandoned. The group's offsets are committed up to the first
+// message that was not handled, so the group consumes abandoned
+// messages again. Sends are still allowed until then, so that
+// handlers can pass their results on. It is safe to call Stop more
+// than once.
+func (d *Direct) Stop(grace time.Duration) {
+	if !d.BeginStop() {
+		return
+	}
+	if d.log.Info() {
+		d.log.Info("stopping...")
+	}
+	d.consumer.stop(grace)
+	d.lock.Lock()
+	dispatchers := make([]*qp.Dispatcher, 0, len(d.dispatchers))
+	for _, dispatcher := range d.dispatchers {
+		dispatchers = append(dispatchers, dispatcher)
+	}
+	d.lock.Unlock()
+	// wait for in-flight requests to finish
+	abandoned := qp.Drain(grace, dispatchers...)
+	d.lock.Lock()
+	for channel := range d.dispatchers {
+		d.unlisten(channel)
+	}
+	d.lock.Unlock()
+	d.consumer.close()
+	d.cluster.close()
+	if abandoned > 0 && d.log.Warn() {
+		d.log.Warn("abandoned", abandoned, "in-flight requests")
+	}
+	// inform caller of stop complete
+	d.EndStop(abandoned)
+	if d.log.Info() {
+		d.log.Info("stopped")
+	}
+}
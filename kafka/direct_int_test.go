@@ -0,0 +1,148 @@
+package kafka
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/qp/go/transporttest"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+// testOptions has the transports notice changes quickly.
+var testOptions = Options{
+	SessionTimeout:   1 * time.Second,
+	Heartbeat:        50 * time.Millisecond,
+	RebalanceTimeout: 2 * time.Second,
+	Refresh:          100 * time.Millisecond,
+	MaxWait:          100 * time.Millisecond,
+}
+
+func TestDirectConformance(t *testing.T) {
+	b := startBroker(t, "127.0.0.1:0")
+	defer b.close()
+	transporttest.Direct(t, func() qp.DirectTransport {
+		return NewDirectOptions(b.addrs(), testOptions)
+	})
+}
+
+func TestDirectWaits(t *testing.T) {
+
+	b := startBroker(t, "127.0.0.1:0")
+	defer b.close()
+	sender := NewDirectOptions(b.addrs(), testOptions)
+	require.NoError(t, sender.Start())
+	defer sender.Stop(stop.NoWait)
+	require.NoError(t, sender.Send("waits", []byte("one")))
+
+	// messages wait in the topic for a handler
+	d := NewDirectOptions(b.addrs(), testOptions)
+	msgs := make(chan *qp.Message, 10)
+	require.NoError(t, d.OnMessage("waits", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	})))
+	require.NoError(t, d.Start())
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "one", string(msg.Data))
+	case <-time.After(2 * time.Second):
+		require.FailNow(t, "waiting message not received")
+	}
+	d.Stop(stop.NoWait)
+	<-d.StopChan()
+
+	// the group carries on from where it committed
+	require.NoError(t, sender.Send("waits", []byte("two")))
+	d = NewDirectOptions(b.addrs(), testOptions)
+	require.NoError(t, d.OnMessage("waits", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	})))
+	require.NoError(t, d.Start())
+	defer d.Stop(stop.NoWait)
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "two", string(msg.Data))
+	case <-time.After(2 * time.Second):
+		require.FailNow(t, "message sent while stopped not received")
+	}
+	select {
+	case msg := <-msgs:
+		require.FailNow(t, "handled message received again", string(msg.Data))
+	case <-time.After(100 * time.Millisecond):
+	}
+
+}
+
+func TestDirectSkipsUnreadable(t *testing.T) {
+
+	b := startBroker(t, "127.0.0.1:0")
+	defer b.close()
+	b.create("unreadable", 1)
+	b.compress(topicPartition{"unreadable", 0}, 1, compressionLZ4)
+	sender := NewDirectOptions(b.addrs(), testOptions)
+	require.NoError(t, sender.Start())
+	defer sender.Stop(stop.NoWait)
+	for _, data := range []string{"one", "two", "three"} {
+		require.NoError(t, sender.Send("unreadable", []byte(data)))
+	}
+
+	// the batch that cannot be read is skipped, rather than fetched
+	// again forever, and reported
+	d := NewDirectOptions(b.addrs(), testOptions)
+	msgs := make(chan string, 10)
+	require.NoError(t, d.OnMessage("unreadable", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- string(msg.Data)
+	})))
+	require.NoError(t, d.Start())
+	defer d.Stop(stop.NoWait)
+	for _, expected := range []string{"one", "three"} {
+		select {
+		case data := <-msgs:
+			require.Equal(t, expected, data)
+		case <-time.After(2 * time.Second):
+			require.FailNow(t, "message not received", expected)
+		}
+	}
+	require.Error(t, d.Err())
+	require.Contains(t, d.Err().Error(), "unreadable/0")
+
+}
+
+func TestDirectKey(t *testing.T) {
+
+	b := startBroker(t, "127.0.0.1:0")
+	defer b.close()
+	options := testOptions
+	options.Key = func(channel string, data []byte) []byte {
+		return data[:1]
+	}
+	d := NewDirectOptions(b.addrs(), options)
+	require.NoError(t, d.Start())
+	defer d.Stop(stop.NoWait)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, d.Send("keys", []byte(fmt.Sprint("a", i))))
+		require.NoError(t, d.Send("keys", []byte(fmt.Sprint("b", i))))
+	}
+
+	// each key's messages are in a single partition, in order
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	partitions := b.topics["keys"]
+	require.Len(t, partitions, testPartitions)
+	for _, key := range []string{"a", "b"} {
+		p := int(murmur2([]byte(key))&0x7fffffff) % testPartitions
+		var values []string
+		for _, r := range partitions[p] {
+			if string(r.key) == key {
+				values = append(values, string(r.value))
+			}
+		}
+		require.Len(t, values, 10)
+		for i, value := range values {
+			require.Equal(t, fmt.Sprint(key, i), value)
+		}
+	}
+
+}
@@ -0,0 +1,28 @@
+// Package kafka implements the qp transports on a Kafka cluster, or
+// anything else that speaks Kafka's wire protocol.
+//
+// The transports speak the protocol themselves. Each channel is a
+// topic, and the transports create topics as they need them, which
+// needs the brokers' auto.create.topics.enable setting. Publish and
+// Send produce to the partition the message's key hashes to, as
+// Kafka's own clients do, so that messages with the same key are
+// consumed in order; Options.Key picks the key, and
+// PubSub.PublishKey takes one.
+//
+// Both transports consume in consumer groups that Kafka's own
+// consumers can join too, and commit the offsets of the messages
+// their handlers have finished with. Direct transports share a
+// group, so each message goes to one of them, and messages wait in
+// their topic until a handler takes them. Each PubSub has a group
+// of its own unless Options.Group names one. Seek and SeekTime
+// replay a channel from an offset or from a time.
+//
+// Messages are handled at least once: those that were fetched but
+// not handled when a transport stops, or when the group changes,
+// are consumed again from the last committed offset.
+//
+// Batches compressed with gzip, snappy or zstd are read; the
+// transports produce uncompressed batches. A batch they cannot read,
+// such as one compressed with lz4, is skipped, so that it does not
+// hold up its partition, and the error is kept for Err.
+package kafka
@@ -0,0 +1,304 @@
+package kafka
+
+import (
+	"sort"
+	"time"
+)
+
+// protocolType and assignor are what members of the groups the
+// transports make say they are, so that Kafka's own consumers can
+// join the same groups.
+const (
+	protocolType = "consumer"
+	assignor     = "roundrobin"
+)
+
+// coordinator is a connection to the broker that coordinates a
+// group, on behalf of one of its members.
+type coordinator struct {
+	conn       *broker
+	group      string
+	member     string
+	generation int32
+}
+
+// join joins the group, or joins it again, to consume the topics.
+// It waits for the group's other members to join too, and returns
+// whether this member leads the group and, if it does, the topics
+// each member consumes.
+func (c *coordinator) join(topics []string, session, rebalance time.Duration) (bool, map[string][]string, error) {
+	metadata := &encoder{}
+	metadata.int16(0) // version
+	metadata.array(len(topics))
+	for _, topic := range topics {
+		metadata.string(topic)
+	}
+	metadata.bytes(nil) // user data
+
+	e := &encoder{}
+	e.string(c.group)
+	e.int32(int32(session / time.Millisecond))
+	e.int32(int32(rebalance / time.Millisecond))
+	e.string(c.member)
+	e.string(protocolType)
+	e.array(1)
+	e.string(assignor)
+	e.bytes(metadata.b)
+	d, err := c.conn.request(apiJoinGroup, e.b, rebalance)
+	if err != nil {
+		return false, nil, err
+	}
+	d.int32() // throttle time
+	code := d.int16()
+	generation := d.int32()
+	d.string() // protocol
+	leader := d.string()
+	member := d.string()
+	members := make(map[string][]string)
+	for i, n := 0, d.array(6); i < n; i++ {
+		id := d.string()
+		md := &decoder{b: d.bytes()}
+		md.int16() // version
+		var topics []string
+		for j, m := 0, md.array(2); j < m; j++ {
+			topics = append(topics, md.string())
+		}
+		if md.err != nil {
+			return false, nil, md.err
+		}
+		members[id] = topics
+	}
+	if d.err != nil {
+		return false, nil, d.err
+	}
+	if err := check(code); err != nil {
+		if err == errUnknownMember {
+			c.member = ""
+		}
+		return false, nil, err
+	}
+	c.member = member
+	c.generation = generation
+	return leader == member, members, nil
+}
+
+// sync hands the leader's assignments to the group, and gets the
+// partitions assigned to this member. Members other than the leader
+// pass no assignments, and wait for the leader's.
+func (c *coordinator) sync(assignments map[string]map[string][]int32, rebalance time.Duration) (map[string][]int32, error) {
+	e := &encoder{}
+	e.string(c.group)
+	e.int32(c.generation)
+	e.string(c.member)
+	e.array(len(assignments))
+	for member, topics := range assignments {
+		e.string(member)
+		e.bytes(encodeAssignment(topics))
+	}
+	d, err := c.conn.request(apiSyncGroup, e.b, rebalance)
+	if err != nil {
+		return nil, err
+	}
+	d.int32() // throttle time
+	code := d.int16()
+	assignment := d.bytes()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if err := check(code); err != nil {
+		return nil, err
+	}
+	return decodeAssignment(assignment)
+}
+
+// heartbeat tells the group the member is still there. It returns
+// errRebalanceInProgress when the member should join again.
+func (c *coordinator) heartbeat() error {
+	e := &encoder{}
+	e.string(c.group)
+	e.int32(c.generation)
+	e.string(c.member)
+	d, err := c.conn.request(apiHeartbeat, e.b, 0)
+	if err != nil {
+		return err
+	}
+	d.int32() // throttle time
+	code := d.int16()
+	if d.err != nil {
+		return d.err
+	}
+	return check(code)
+}
+
+// leave leaves the group, so that its other members take over the
+// partitions straight away.
+func (c *coordinator) leave() error {
+	e := &encoder{}
+	e.string(c.group)
+	e.string(c.member)
+	d, err := c.conn.request(apiLeaveGroup, e.b, 0)
+	if err != nil {
+		return err
+	}
+	d.int32() // throttle time
+	code := d.int16()
+	if d.err != nil {
+		return d.err
+	}
+	return check(code)
+}
+
+// commit commits the offsets as those to consume each partition
+// from next.
+func (c *coordinator) commit(offsets map[topicPartition]int64) error {
+	byTopic := make(map[string][]topicPartition)
+	for tp := range offsets {
+		byTopic[tp.topic] = append(byTopic[tp.topic], tp)
+	}
+	e := &encoder{}
+	e.string(c.group)
+	e.int32(c.generation)
+	e.string(c.member)
+	e.int64(-1) // retention time: the broker's own
+	e.array(len(byTopic))
+	for topic, tps := range byTopic {
+		e.string(topic)
+		e.array(len(tps))
+		for _, tp := range tps {
+			e.int32(tp.partition)
+			e.int64(offsets[tp])
+			e.nullableString("") // metadata
+		}
+	}
+	d, err := c.conn.request(apiOffsetCommit, e.b, 0)
+	if err != nil {
+		return err
+	}
+	for i, n := 0, d.array(6); i < n; i++ {
+		d.string() // topic
+		for j, m := 0, d.array(6); j < m; j++ {
+			d.int32() // partition
+			if err := check(d.int16()); err != nil && d.err == nil {
+				return err
+			}
+		}
+	}
+	return d.err
+}
+
+// committed gets the offsets the group last committed for the
+// partitions. Partitions with no committed offset are left out.
+func (c *coordinator) committed(tps []topicPartition) (map[topicPartition]int64, error) {
+	byTopic := make(map[string][]int32)
+	for _, tp := range tps {
+		byTopic[tp.topic] = append(byTopic[tp.topic], tp.partition)
+	}
+	e := &encoder{}
+	e.string(c.group)
+	e.array(len(byTopic))
+	for topic, partitions := range byTopic {
+		e.string(topic)
+		e.array(len(partitions))
+		for _, p := range partitions {
+			e.int32(p)
+		}
+	}
+	d, err := c.conn.request(apiOffsetFetch, e.b, 0)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[topicPartition]int64)
+	for i, n := 0, d.array(6); i < n; i++ {
+		topic := d.string()
+		for j, m := 0, d.array(16); j < m; j++ {
+			tp := topicPartition{topic, d.int32()}
+			offset := d.int64()
+			d.string() // metadata
+			if err := check(d.int16()); err != nil && d.err == nil {
+				return nil, err
+			}
+			if offset >= 0 {
+				offsets[tp] = offset
+			}
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return offsets, nil
+}
+
+// assign shares the partitions of each topic among the members that
+// consume it, going round the members in turn so that each has
+// about the same number in all.
+func assign(members map[string][]string, partitions map[string][]int32) map[string]map[string][]int32 {
+	ids := make([]string, 0, len(members))
+	consumers := make(map[string][]string)
+	for id, topics := range members {
+		ids = append(ids, id)
+		for _, topic := range topics {
+			consumers[topic] = append(consumers[topic], id)
+		}
+	}
+	sort.Strings(ids)
+	topics := make([]string, 0, len(consumers))
+	for topic := range consumers {
+		topics = append(topics, topic)
+		sort.Strings(consumers[topic])
+	}
+	sort.Strings(topics)
+	assignments := make(map[string]map[string][]int32, len(ids))
+	for _, id := range ids {
+		assignments[id] = make(map[string][]int32)
+	}
+	turn := 0
+	for _, topic := range topics {
+		ids := consumers[topic]
+		for _, p := range partitions[topic] {
+			id := ids[turn%len(ids)]
+			assignments[id][topic] = append(assignments[id][topic], p)
+			turn++
+		}
+	}
+	return assignments
+}
+
+// encodeAssignment encodes the partitions assigned to a member as
+// Kafka's own consumers do.
+func encodeAssignment(topics map[string][]int32) []byte {
+	names := make([]string, 0, len(topics))
+	for topic := range topics {
+		names = append(names, topic)
+	}
+	sort.Strings(names)
+	e := &encoder{}
+	e.int16(0) // version
+	e.array(len(names))
+	for _, topic := range names {
+		e.string(topic)
+		e.array(len(topics[topic]))
+		for _, p := range topics[topic] {
+			e.int32(p)
+		}
+	}
+	e.bytes(nil) // user data
+	return e.b
+}
+
+// decodeAssignment decodes the partitions assigned to a member.
+func decodeAssignment(b []byte) (map[string][]int32, error) {
+	topics := make(map[string][]int32)
+	if len(b) == 0 {
+		// not assigned anything
+		return topics, nil
+	}
+	d := &decoder{b: b}
+	d.int16() // version
+	for i, n := 0, d.array(6); i < n; i++ {
+		topic := d.string()
+		for j, m := 0, d.array(4); j < m; j++ {
+			topics[topic] = append(topics[topic], d.int32())
+		}
+	}
+	return topics, d.err
+}
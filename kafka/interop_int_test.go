@@ -0,0 +1,45 @@
+package kafka
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/qp/go/transporttest"
+)
+
+// ensureCluster gets the addresses of a real Kafka cluster to check
+// the transports against, from QP_KAFKA_BROKERS, separated by
+// commas, or the default port on this machine, and skips the test
+// if the first is not running. The cluster must create topics when
+// they are first used.
+func ensureCluster(t *testing.T) []string {
+	brokers := os.Getenv("QP_KAFKA_BROKERS")
+	if brokers == "" {
+		brokers = "127.0.0.1:9092"
+	}
+	addrs := strings.Split(brokers, ",")
+	conn, err := net.DialTimeout("tcp", addrs[0], time.Second)
+	if err != nil {
+		t.Skip("skipping because no Kafka broker is running at", addrs[0])
+	}
+	conn.Close()
+	return addrs
+}
+
+func TestInteropDirect(t *testing.T) {
+	addrs := ensureCluster(t)
+	transporttest.Direct(t, func() qp.DirectTransport {
+		return NewDirectOptions(addrs, testOptions)
+	})
+}
+
+func TestInteropPubSub(t *testing.T) {
+	addrs := ensureCluster(t)
+	transporttest.PubSub(t, func() qp.PubSubTransport {
+		return NewPubSubOptions(addrs, testOptions)
+	})
+}
@@ -0,0 +1,166 @@
+package kafka
+
+import "time"
+
+// the offsets to start consuming a partition at, other than the
+// offset of a particular message
+const (
+	// OffsetNewest is the offset after the last message, so that
+	// only messages published later are consumed.
+	OffsetNewest int64 = -1
+	// OffsetOldest is the offset of the oldest message the
+	// partition still keeps.
+	OffsetOldest int64 = -2
+)
+
+// the acknowledgements producers can wait for
+const (
+	// WaitForLocal waits for the partition's leader to have the
+	// message.
+	WaitForLocal int16 = 1
+	// WaitForAll waits for every in-sync replica of the partition
+	// to have the message.
+	WaitForAll int16 = -1
+)
+
+// Options controls how a transport uses the cluster.
+type Options struct {
+	// ClientID identifies the transport to the brokers, in their
+	// logs and quotas. Empty means DefaultClientID.
+	ClientID string
+	// Group is the consumer group the transport consumes in, whose
+	// members share the partitions of each topic and whose
+	// committed offsets are where consuming starts again. Empty
+	// means DefaultGroup for Direct, and for PubSub a group of the
+	// transport's own, so that it gets every message.
+	Group string
+	// Initial is where the group starts consuming a partition it
+	// has no committed offset for: OffsetNewest or OffsetOldest.
+	// Zero means OffsetNewest for PubSub, and OffsetOldest for
+	// Direct so that messages wait for a handler.
+	Initial int64
+	// Key gets the key to publish a message with. Messages with the
+	// same key go to the same partition, and so are consumed in
+	// order. Nil, or a nil key, spreads messages over the
+	// partitions in turn.
+	Key func(channel string, data []byte) []byte
+	// Acks is which replicas must have a message before it counts
+	// as sent: WaitForLocal or WaitForAll. Zero means WaitForAll.
+	Acks int16
+	// SessionTimeout is how long the group waits to hear from the
+	// transport before giving its partitions to other members.
+	// Zero means DefaultSessionTimeout.
+	SessionTimeout time.Duration
+	// Heartbeat is how often the transport tells the group it is
+	// still there, and commits the offsets it has handled. Zero
+	// means DefaultHeartbeat.
+	Heartbeat time.Duration
+	// RebalanceTimeout is how long the group waits for its members
+	// to join again when they change. Zero means
+	// DefaultRebalanceTimeout.
+	RebalanceTimeout time.Duration
+	// Refresh is how often the transport looks for new topics that
+	// match its patterns, and new partitions. Zero means
+	// DefaultRefresh.
+	Refresh time.Duration
+	// MaxWait is how long a broker may hold a fetch while it waits
+	// for messages. Zero means DefaultMaxWait.
+	MaxWait time.Duration
+	// FetchSize is the most each fetch takes from a partition,
+	// though a larger message is still taken whole. Zero means
+	// DefaultFetchSize.
+	FetchSize int32
+}
+
+// the defaults used when Options does not set a value
+const (
+	DefaultClientID         = "qp"
+	DefaultGroup            = "qp"
+	DefaultSessionTimeout   = 10 * time.Second
+	DefaultHeartbeat        = 3 * time.Second
+	DefaultRebalanceTimeout = 30 * time.Second
+	DefaultRefresh          = 10 * time.Second
+	DefaultMaxWait          = 500 * time.Millisecond
+	DefaultFetchSize        = 1 << 20
+)
+
+// clientID gets the client ID to give the brokers.
+func (o Options) clientID() string {
+	if o.ClientID == "" {
+		return DefaultClientID
+	}
+	return o.ClientID
+}
+
+// acks gets which replicas must have a message.
+func (o Options) acks() int16 {
+	if o.Acks == 0 {
+		return WaitForAll
+	}
+	return o.Acks
+}
+
+// sessionTimeout gets how long the group waits to hear from the transport.
+func (o Options) sessionTimeout() time.Duration {
+	if o.SessionTimeout == 0 {
+		return DefaultSessionTimeout
+	}
+	return o.SessionTimeout
+}
+
+// heartbeat gets how often to tell the group the transport is there.
+func (o Options) heartbeat() time.Duration {
+	if o.Heartbeat == 0 {
+		return DefaultHeartbeat
+	}
+	return o.Heartbeat
+}
+
+// rebalanceTimeout gets how long the group waits for members to join again.
+func (o Options) rebalanceTimeout() time.Duration {
+	if o.RebalanceTimeout == 0 {
+		return DefaultRebalanceTimeout
+	}
+	return o.RebalanceTimeout
+}
+
+// refresh gets how often to look for new topics and partitions.
+func (o Options) refresh() time.Duration {
+	if o.Refresh == 0 {
+		return DefaultRefresh
+	}
+	return o.Refresh
+}
+
+// maxWait gets how long a broker may hold a fetch.
+func (o Options) maxWait() time.Duration {
+	if o.MaxWait == 0 {
+		return DefaultMaxWait
+	}
+	return o.MaxWait
+}
+
+// fetchSize gets the most to take from a partition in each fetch.
+func (o Options) fetchSize() int32 {
+	if o.FetchSize == 0 {
+		return DefaultFetchSize
+	}
+	return o.FetchSize
+}
+
+// initial gets where to start consuming partitions without a
+// committed offset, given the transport's default.
+func (o Options) initial(fallback int64) int64 {
+	if o.Initial == 0 {
+		return fallback
+	}
+	return o.Initial
+}
+
+// key gets the key to publish the message with.
+func (o Options) key(channel string, data []byte) []byte {
+	if o.Key == nil {
+		return nil
+	}
+	return o.Key(channel, data)
+}
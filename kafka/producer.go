@@ -0,0 +1,139 @@
+package kafka
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// produceRetries is how many more times a message is produced when
+// the cluster says it may succeed later, such as while a new topic
+// is being created or a partition's leader moves.
+const produceRetries = 5
+
+// producer produces messages to the partitions' leaders.
+type producer struct {
+	cluster *cluster
+	acks    int16
+
+	lock sync.Mutex
+	next map[string]int
+}
+
+func newProducer(c *cluster, acks int16) *producer {
+	return &producer{cluster: c, acks: acks, next: make(map[string]int)}
+}
+
+// produce produces the message to the topic, creating the topic if
+// the brokers allow it. Messages with a key go to the partition
+// the key hashes to, the same one Kafka's own clients pick, and
+// those without one go to each partition in turn.
+func (p *producer) produce(topic string, key, value []byte) error {
+	delay := 50 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := p.try(topic, key, value)
+		if err == nil {
+			return nil
+		}
+		if kerr, ok := err.(Error); ok && !kerr.retriable() {
+			return err
+		}
+		if attempt == produceRetries {
+			return err
+		}
+		p.cluster.forget(topic)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// try produces the message once.
+func (p *producer) try(topic string, key, value []byte) error {
+	partitions, err := p.cluster.topic(topic, true)
+	if err != nil {
+		return err
+	}
+	var index int
+	if key != nil {
+		index = int(murmur2(key)&0x7fffffff) % len(partitions)
+	} else {
+		p.lock.Lock()
+		index = p.next[topic] % len(partitions)
+		p.next[topic]++
+		p.lock.Unlock()
+	}
+	tp := topicPartition{topic, partitions[index].id}
+	addr, err := p.cluster.leader(tp)
+	if err != nil {
+		return err
+	}
+	batch := encodeBatch([]record{{
+		timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		key:       key,
+		value:     value,
+	}})
+	e := &encoder{b: make([]byte, 0, 64+len(topic)+len(batch))}
+	e.nullableString("") // transactional ID
+	e.int16(p.acks)
+	e.int32(int32(Timeout / time.Millisecond))
+	e.array(1)
+	e.string(topic)
+	e.array(1)
+	e.int32(tp.partition)
+	e.bytes(batch)
+	d, err := p.cluster.broker(addr).request(apiProduce, e.b, Timeout)
+	if err != nil {
+		return err
+	}
+	for i, n := 0, d.array(6); i < n; i++ {
+		d.string() // topic
+		for j, m := 0, d.array(22); j < m; j++ {
+			d.int32() // partition
+			code := d.int16()
+			d.int64() // base offset
+			d.int64() // log append time
+			if err := check(code); err != nil {
+				return err
+			}
+		}
+	}
+	if d.err != nil {
+		return fmt.Errorf("producing to %s: %v", tp, d.err)
+	}
+	return nil
+}
+
+// murmur2 is the hash Kafka's own clients partition keys with.
+func murmur2(data []byte) int32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := length &^ 3
+	switch length % 4 {
+	case 3:
+		h ^= uint32(data[tail+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[tail+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[tail])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
@@ -0,0 +1,292 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// the requests the transports make, with the versions they use
+const (
+	apiProduce         = 0
+	apiFetch           = 1
+	apiListOffsets     = 2
+	apiMetadata        = 3
+	apiOffsetCommit    = 8
+	apiOffsetFetch     = 9
+	apiFindCoordinator = 10
+	apiJoinGroup       = 11
+	apiHeartbeat       = 12
+	apiLeaveGroup      = 13
+	apiSyncGroup       = 14
+)
+
+// versions gets the version of each request the transports make.
+// They are the oldest versions that every broker from Kafka 1.0 on
+// understands and that have everything the transports need.
+var versions = map[int16]int16{
+	apiProduce:         3,
+	apiFetch:           4,
+	apiListOffsets:     1,
+	apiMetadata:        4,
+	apiOffsetCommit:    2,
+	apiOffsetFetch:     1,
+	apiFindCoordinator: 0,
+	apiJoinGroup:       2,
+	apiHeartbeat:       1,
+	apiLeaveGroup:      1,
+	apiSyncGroup:       1,
+}
+
+// Error is an error code returned by a broker.
+type Error int16
+
+// the error codes the transports act on
+const (
+	errOffsetOutOfRange      Error = 1
+	errUnknownTopic          Error = 3
+	errLeaderNotAvailable    Error = 5
+	errNotLeader             Error = 6
+	errRequestTimedOut       Error = 7
+	errCoordinatorLoading    Error = 14
+	errCoordinatorNotAvail   Error = 15
+	errNotCoordinator        Error = 16
+	errNotEnoughReplicas     Error = 19
+	errNotEnoughReplicasSent Error = 20
+	errIllegalGeneration     Error = 22
+	errUnknownMember         Error = 25
+	errRebalanceInProgress   Error = 27
+	errTopicAuthorization    Error = 29
+	errGroupAuthorization    Error = 30
+)
+
+// errorMessages describes the error codes.
+var errorMessages = map[Error]string{
+	errOffsetOutOfRange:      "offset out of range",
+	errUnknownTopic:          "unknown topic or partition",
+	errLeaderNotAvailable:    "leader not available",
+	errNotLeader:             "not leader for partition",
+	errRequestTimedOut:       "request timed out",
+	errCoordinatorLoading:    "coordinator loading",
+	errCoordinatorNotAvail:   "coordinator not available",
+	errNotCoordinator:        "not coordinator",
+	errNotEnoughReplicas:     "not enough replicas",
+	errNotEnoughReplicasSent: "not enough replicas after append",
+	errIllegalGeneration:     "illegal generation",
+	errUnknownMember:         "unknown member",
+	errRebalanceInProgress:   "rebalance in progress",
+	errTopicAuthorization:    "topic authorization failed",
+	errGroupAuthorization:    "group authorization failed",
+}
+
+func (e Error) Error() string {
+	if msg, ok := errorMessages[e]; ok {
+		return "kafka: " + msg
+	}
+	return fmt.Sprintf("kafka: error code %d", int16(e))
+}
+
+// retriable gets whether the request may succeed if it is made
+// again once the metadata has been refreshed.
+func (e Error) retriable() bool {
+	switch e {
+	case errUnknownTopic, errLeaderNotAvailable, errNotLeader, errRequestTimedOut,
+		errNotEnoughReplicas, errNotEnoughReplicasSent,
+		errCoordinatorLoading, errCoordinatorNotAvail, errNotCoordinator:
+		return true
+	}
+	return false
+}
+
+// check gets the error for the code, or nil if there is none.
+func check(code int16) error {
+	if code == 0 {
+		return nil
+	}
+	return Error(code)
+}
+
+// errMalformed is returned when a response cannot be decoded.
+var errMalformed = errors.New("malformed Kafka response")
+
+// encoder builds the body of a request.
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) int8(v int8) {
+	e.b = append(e.b, byte(v))
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.int8(1)
+	} else {
+		e.int8(0)
+	}
+}
+
+func (e *encoder) int16(v int16) {
+	e.b = append(e.b, byte(v>>8), byte(v))
+}
+
+func (e *encoder) int32(v int32) {
+	e.b = append(e.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *encoder) int64(v int64) {
+	e.int32(int32(v >> 32))
+	e.int32(int32(v))
+}
+
+func (e *encoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+// nullableString writes an empty string as null.
+func (e *encoder) nullableString(s string) {
+	if s == "" {
+		e.int16(-1)
+		return
+	}
+	e.string(s)
+}
+
+// bytes writes nil as null.
+func (e *encoder) bytes(b []byte) {
+	if b == nil {
+		e.int32(-1)
+		return
+	}
+	e.int32(int32(len(b)))
+	e.b = append(e.b, b...)
+}
+
+// array writes the length of an array, whose items follow.
+func (e *encoder) array(n int) {
+	e.int32(int32(n))
+}
+
+// varint writes a zigzag encoded variable length integer, as
+// records use.
+func (e *encoder) varint(v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	e.b = append(e.b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+// varbytes writes the length as a varint, and nil as -1.
+func (e *encoder) varbytes(b []byte) {
+	if b == nil {
+		e.varint(-1)
+		return
+	}
+	e.varint(int64(len(b)))
+	e.b = append(e.b, b...)
+}
+
+// decoder reads the fields of a response in turn. Once a field is
+// missing, err is set and every later field is empty.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+// take takes the next n bytes.
+func (d *decoder) take(n int) []byte {
+	if n < 0 || len(d.b) < n {
+		d.err = errMalformed
+		d.b = nil
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *decoder) bool() bool {
+	return d.int8() != 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// string reads a string, or a null string as empty.
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+// bytes reads bytes, or null as nil.
+func (d *decoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+// array reads the length of an array, treating null as empty. The
+// length is checked against the bytes left, each item being at
+// least size bytes, so that a corrupt length cannot make the caller
+// loop for long.
+func (d *decoder) array(size int) int {
+	n := int(d.int32())
+	if n < 0 {
+		return 0
+	}
+	if n*size > len(d.b) {
+		d.err = errMalformed
+		d.b = nil
+		return 0
+	}
+	return n
+}
+
+func (d *decoder) varint() int64 {
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errMalformed
+		d.b = nil
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+// varbytes reads bytes with a varint length, or -1 as nil.
+func (d *decoder) varbytes() []byte {
+	n := d.varint()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
@@ -0,0 +1,322 @@
+package kafka
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+)
+
+// PubSub represents a qp.PubSubTransport. Each channel is a topic,
+// and patterns match the names of the cluster's topics, which are
+// looked for again every Refresh.
+//
+// Each PubSub consumes in a group of its own unless the Group
+// option names one, so that every PubSub gets every message.
+// PubSubs that share a group share the messages instead, and carry
+// on from the group's committed offsets.
+type PubSub struct {
+	qp.Lifecycle
+	cluster       *cluster
+	producer      *producer
+	consumer      *consumer
+	options       Options
+	subscriptions map[string][]*subscription
+	channels      map[string]qp.ChannelOptions
+	lock          sync.Mutex
+	log           slog.Logger
+}
+
+// subscription is a single handler bound to a channel.
+type subscription struct {
+	handler    qp.Handler
+	dispatcher *qp.Dispatcher
+}
+
+// ensure the interface is satisfied
+var _ qp.PubSubTransport = (*PubSub)(nil)
+
+// NewPubSub makes a new PubSub Kafka transport that finds the
+// cluster through the brokers, such as "localhost:9092".
+func NewPubSub(brokers []string) *PubSub {
+	return NewPubSubOptions(brokers, Options{})
+}
+
+// NewPubSubOptions makes a new PubSub Kafka transport with the
+// specified options.
+func NewPubSubOptions(brokers []string, options Options) *PubSub {
+	c := newCluster(brokers, options.clientID())
+	group := options.Group
+	if group == "" {
+		b := make([]byte, 8)
+		rand.Read(b)
+		group = "qp-" + hex.EncodeToString(b)
+	}
+	p := &PubSub{
+		cluster:       c,
+		producer:      newProducer(c, options.acks()),
+		consumer:      newConsumer(c, group, options, options.initial(OffsetNewest)),
+		options:       options,
+		subscriptions: make(map[string][]*subscription),
+		channels:      make(map[string]qp.ChannelOptions),
+		log:           slog.NilLogger,
+	}
+	p.consumer.subscription = p.subscription
+	p.consumer.fault = p.Fault
+	p.consumer.dispatchers = p.dispatchers
+	p.consumer.skip = true
+	return p
+}
+
+// SetLogger sets the Logger to log to.
+func (p *PubSub) SetLogger(log slog.Logger) {
+	p.log = log
+	p.cluster.log = log
+	p.consumer.log = log
+}
+
+// Publish publishes data on the specified channel, to the
+// partition the Key option picks. It returns once the brokers the
+// Acks option names have the message.
+func (p *PubSub) Publish(channel string, data []byte) error {
+	return p.PublishKey(channel, p.options.key(channel, data), data)
+}
+
+// PublishKey publishes data on the specified channel like Publish,
+// with the key in place of the one the Key option picks. Messages
+// with the same key go to the same partition, and so are consumed
+// in the order they were published.
+func (p *PubSub) PublishKey(channel string, key, data []byte) error {
+	if !p.Running() {
+		return qp.ErrNotRunning
+	}
+	if p.log.Info() {
+		p.log.Info("publish to", channel, string(data))
+	}
+	err := p.producer.produce(channel, key, data)
+	if err != nil && p.log.Err() {
+		p.log.Err("publish failed", err)
+	}
+	return err
+}
+
+// Subscribe binds the handler to the specified channel.
+// If the transport is running, it returns once the group has
+// assigned it the partitions it is to consume.
+func (p *PubSub) Subscribe(channel string, handler qp.Handler) (qp.Subscription, error) {
+	if p.log.Info() {
+		p.log.Info("subscribing to", channel)
+	}
+	p.lock.Lock()
+	s := &subscription{
+		handler:    handler,
+		dispatcher: qp.NewDispatcher(p.consumer.tracker.wrap(handler), p.channels[channel]),
+	}
+	p.subscriptions[channel] = append(p.subscriptions[channel], s)
+	added := len(p.subscriptions[channel]) == 1
+	running := p.State() == qp.StateRunning
+	p.lock.Unlock()
+	if running && added {
+		if !qp.IsPattern(channel) {
+			if err := p.cluster.ensure([]string{channel}); err != nil {
+				return nil, err
+			}
+		}
+		p.consumer.update()
+	}
+	return qp.SubscriptionFunc(func() error {
+		p.remove(channel, s)
+		return nil
+	}), nil
+}
+
+// remove unbinds a single subscription from the channel, and stops
+// consuming the channel if it was the last one.
+func (p *PubSub) remove(channel string, s *subscription) {
+	p.lock.Lock()
+	subscriptions := p.subscriptions[channel]
+	for i, existing := range subscriptions {
+		if existing == s {
+			s.dispatcher.Close()
+			subscriptions = append(subscriptions[:i:i], subscriptions[i+1:]...)
+			break
+		}
+	}
+	removed := len(subscriptions) == 0
+	if removed {
+		delete(p.subscriptions, channel)
+	} else {
+		p.subscriptions[channel] = subscriptions
+	}
+	running := p.State() == qp.StateRunning
+	p.lock.Unlock()
+	if running && removed {
+		p.consumer.update()
+	}
+}
+
+// Unsubscribe unbinds all handlers from the specified channel.
+// If the transport is running, it stops consuming the channel.
+func (p *PubSub) Unsubscribe(channel string) error {
+	if p.log.Info() {
+		p.log.Info("unsubscribing from", channel)
+	}
+	p.lock.Lock()
+	for _, s := range p.subscriptions[channel] {
+		s.dispatcher.Close()
+	}
+	delete(p.subscriptions, channel)
+	running := p.State() == qp.StateRunning
+	p.lock.Unlock()
+	if running {
+		p.consumer.update()
+	}
+	return nil
+}
+
+// SetChannelOptions sets the options that control how messages
+// on the specified channel are dispatched to its handlers.
+func (p *PubSub) SetChannelOptions(channel string, options qp.ChannelOptions) error {
+	p.lock.Lock()
+	p.channels[channel] = options
+	for _, s := range p.subscriptions[channel] {
+		s.dispatcher.Close()
+		s.dispatcher = qp.NewDispatcher(p.consumer.tracker.wrap(s.handler), options)
+	}
+	p.lock.Unlock()
+	return nil
+}
+
+// Seek has the channel's partition consumed from the offset, or
+// from OffsetOldest or OffsetNewest, in place of its committed
+// offset, so that messages can be handled again. The seek takes
+// effect when the group next assigns the partition to this
+// transport, which is straight away if it is running and has been
+// assigned it.
+func (p *PubSub) Seek(channel string, partition int32, offset int64) error {
+	p.consumer.seek(topicPartition{channel, partition}, offset)
+	if p.Running() {
+		p.consumer.update()
+	}
+	return nil
+}
+
+// SeekTime has the channel consumed from the first message
+// published at or after the time, in place of its committed
+// offsets, as Seek does for each of its partitions.
+func (p *PubSub) SeekTime(channel string, t time.Time) error {
+	if err := p.consumer.seekTime(channel, t); err != nil {
+		return err
+	}
+	if p.Running() {
+		p.consumer.update()
+	}
+	return nil
+}
+
+// subscription gets the channels and the patterns that have
+// handlers.
+func (p *PubSub) subscription() ([]string, []string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var channels, patterns []string
+	for channel := range p.subscriptions {
+		if qp.IsPattern(channel) {
+			patterns = append(patterns, channel)
+		} else {
+			channels = append(channels, channel)
+		}
+	}
+	return channels, patterns
+}
+
+// dispatchers gets the dispatchers of every handler bound to the
+// topic, or to a pattern that matches it.
+func (p *PubSub) dispatchers(topic string) []*qp.Dispatcher {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var dispatchers []*qp.Dispatcher
+	for channel, subscriptions := range p.subscriptions {
+		if channel != topic && !qp.MatchChannel(channel, topic) {
+			continue
+		}
+		for _, s := range subscriptions {
+			dispatchers = append(dispatchers, s.dispatcher)
+		}
+	}
+	return dispatchers
+}
+
+// Start connects to the cluster, creates the topics for the
+// channels with handlers, and returns once the group has assigned
+// the transport the partitions it is to consume.
+// A stopped transport may be started again.
+func (p *PubSub) Start() error {
+	if err := p.BeginStart(); err != nil {
+		return err
+	}
+	if p.log.Info() {
+		p.log.Info("starting")
+	}
+	channels, _ := p.subscription()
+	if _, err := p.cluster.refresh(nil, false); err != nil {
+		p.cluster.close()
+		return p.EndStart(err)
+	}
+	if err := p.cluster.ensure(channels); err != nil {
+		p.cluster.close()
+		return p.EndStart(err)
+	}
+	p.lock.Lock()
+	for channel, subscriptions := range p.subscriptions {
+		for _, s := range subscriptions {
+			s.dispatcher.Close()
+			s.dispatcher = qp.NewDispatcher(p.consumer.tracker.wrap(s.handler), p.channels[channel])
+		}
+	}
+	p.lock.Unlock()
+	p.consumer.start()
+	return p.EndStart(nil)
+}
+
+// Stop stops the transport and closes StopChan() when finished.
+//
+// No new messages are fetched once Stop is called, and the
+// messages already being handled have the grace period to finish
+// before they are abandoned. The group's offsets are committed up
+// to the first message that was not handled. It is safe to call
+// Stop more than once.
+func (p *PubSub) Stop(grace time.Duration) {
+	if !p.BeginStop() {
+		return
+	}
+	if p.log.Info() {
+		p.log.Info("stopping...")
+	}
+	p.consumer.stop(grace)
+	var dispatchers []*qp.Dispatcher
+	p.lock.Lock()
+	for _, subscriptions := range p.subscriptions {
+		for _, s := range subscriptions {
+			dispatchers = append(dispatchers, s.dispatcher)
+		}
+	}
+	p.lock.Unlock()
+	abandoned := qp.Drain(grace, dispatchers...)
+	for _, dispatcher := range dispatchers {
+		dispatcher.Close()
+	}
+	p.consumer.close()
+	p.cluster.close()
+	if abandoned > 0 && p.log.Warn() {
+		p.log.Warn("abandoned", abandoned, "in-flight handlers")
+	}
+	// inform caller of stop complete
+	p.EndStop(abandoned)
+	if p.log.Info() {
+		p.log.Info("stopped")
+	}
+}
@@ -0,0 +1,129 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/qp/go/transporttest"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPubSubConformance(t *testing.T) {
+	b := startBroker(t, "127.0.0.1:0")
+	defer b.close()
+	transporttest.PubSub(t, func() qp.PubSubTransport {
+		return NewPubSubOptions(b.addrs(), testOptions)
+	})
+}
+
+// receiveData gets the data of the next n messages.
+func receiveData(t *testing.T, msgs chan *qp.Message, n int) []string {
+	var data []string
+	for len(data) < n {
+		select {
+		case msg := <-msgs:
+			data = append(data, string(msg.Data))
+		case <-time.After(2 * time.Second):
+			require.FailNow(t, "messages not received", "got %v", data)
+		}
+	}
+	return data
+}
+
+func TestPubSubSeek(t *testing.T) {
+
+	b := startBroker(t, "127.0.0.1:0")
+	defer b.close()
+	b.create("replay", 1)
+	p := NewPubSubOptions(b.addrs(), testOptions)
+	require.NoError(t, p.SetChannelOptions("replay", qp.ChannelOptions{Workers: 1}))
+	msgs := make(chan *qp.Message, 10)
+	_, err := p.Subscribe("replay", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	}))
+	require.NoError(t, err)
+	require.NoError(t, p.Start())
+	defer p.Stop(stop.NoWait)
+
+	require.NoError(t, p.Publish("replay", []byte("one")))
+	require.NoError(t, p.Publish("replay", []byte("two")))
+	time.Sleep(20 * time.Millisecond)
+	middle := time.Now()
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, p.Publish("replay", []byte("three")))
+	require.Equal(t, []string{"one", "two", "three"}, receiveData(t, msgs, 3))
+
+	// replay from an offset
+	require.NoError(t, p.Seek("replay", 0, 1))
+	require.Equal(t, []string{"two", "three"}, receiveData(t, msgs, 2))
+
+	// replay from a time
+	require.NoError(t, p.SeekTime("replay", middle))
+	require.Equal(t, []string{"three"}, receiveData(t, msgs, 1))
+
+	// replay everything
+	require.NoError(t, p.Seek("replay", 0, OffsetOldest))
+	require.Equal(t, []string{"one", "two", "three"}, receiveData(t, msgs, 3))
+
+}
+
+func TestPubSubGroup(t *testing.T) {
+
+	b := startBroker(t, "127.0.0.1:0")
+	defer b.close()
+	b.create("grouped", 1)
+	options := testOptions
+	options.Group = "grouped"
+	publisher := NewPubSubOptions(b.addrs(), testOptions)
+	require.NoError(t, publisher.Start())
+	defer publisher.Stop(stop.NoWait)
+
+	p := NewPubSubOptions(b.addrs(), options)
+	msgs := make(chan *qp.Message, 10)
+	handler := qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	})
+	_, err := p.Subscribe("grouped", handler)
+	require.NoError(t, err)
+	require.NoError(t, p.Start())
+	require.NoError(t, publisher.Publish("grouped", []byte("one")))
+	require.Equal(t, []string{"one"}, receiveData(t, msgs, 1))
+	p.Stop(stop.NoWait)
+	<-p.StopChan()
+	require.Equal(t, int64(1), b.committed("grouped", topicPartition{"grouped", 0}))
+
+	// another transport in the group carries on where it stopped
+	require.NoError(t, publisher.Publish("grouped", []byte("two")))
+	p = NewPubSubOptions(b.addrs(), options)
+	_, err = p.Subscribe("grouped", handler)
+	require.NoError(t, err)
+	require.NoError(t, p.Start())
+	defer p.Stop(stop.NoWait)
+	require.Equal(t, []string{"two"}, receiveData(t, msgs, 1))
+
+}
+
+func TestPubSubPublishKey(t *testing.T) {
+
+	b := startBroker(t, "127.0.0.1:0")
+	defer b.close()
+	p := NewPubSubOptions(b.addrs(), testOptions)
+	require.NoError(t, p.SetChannelOptions("ordered", qp.ChannelOptions{Workers: 1}))
+	msgs := make(chan *qp.Message, 100)
+	_, err := p.Subscribe("ordered", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	}))
+	require.NoError(t, err)
+	require.NoError(t, p.Start())
+	defer p.Stop(stop.NoWait)
+
+	// messages with the same key are consumed in order
+	want := []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}
+	for _, data := range want {
+		require.NoError(t, p.PublishKey("ordered", []byte("key"), []byte(data)))
+	}
+	require.Equal(t, want, receiveData(t, msgs, len(want)))
+
+}
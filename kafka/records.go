@@ -0,0 +1,208 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"strconv"
+
+	snappy "github.com/eapache/go-xerial-snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// castagnoli is the CRC table record batches are checked with.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorrupt is returned when a record batch fails its check.
+var errCorrupt = errors.New("corrupt Kafka record batch")
+
+// errFormat is returned for messages in the formats older than
+// record batches, which Kafka wrote before version 0.11.
+var errFormat = errors.New("unsupported Kafka message format")
+
+// the compression codecs in the attributes of a record batch
+const (
+	compressionNone   = 0
+	compressionGzip   = 1
+	compressionSnappy = 2
+	compressionLZ4    = 3
+	compressionZstd   = 4
+)
+
+// zstdDecoder decompresses zstd batches. DecodeAll may be called
+// from many goroutines at once.
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+
+// unreadable is returned for a record batch compressed in a way the
+// transports cannot read, so that the consumer can move on to the
+// offset after it rather than fetching it again.
+type unreadable struct {
+	// base is the offset of the batch's first record.
+	base int64
+	// next is the offset after the batch's last record.
+	next int64
+	// compression is the batch's codec.
+	compression int16
+}
+
+// Error gets a string that describes the error.
+func (u *unreadable) Error() string {
+	return "unsupported Kafka compression " + strconv.Itoa(int(u.compression)) +
+		" in the records from offset " + strconv.FormatInt(u.base, 10) +
+		" to " + strconv.FormatInt(u.next-1, 10)
+}
+
+// record is a single message in a partition.
+type record struct {
+	offset    int64
+	timestamp int64
+	key       []byte
+	value     []byte
+}
+
+// the record batch header sizes
+const (
+	// batchOverhead is the size of the offset and length before
+	// the part of the batch its length counts.
+	batchOverhead = 12
+	// batchHeader is the size of a whole batch header.
+	batchHeader = 61
+)
+
+// encodeBatch makes a version 2 record batch of the records, with
+// offsets counted from the first record's, which producers leave
+// at zero.
+func encodeBatch(records []record) []byte {
+	first, last := records[0].timestamp, records[0].timestamp
+	for _, r := range records {
+		if r.timestamp > last {
+			last = r.timestamp
+		}
+	}
+	body := &encoder{}
+	for i, r := range records {
+		rec := &encoder{}
+		rec.int8(0) // attributes
+		rec.varint(r.timestamp - first)
+		rec.varint(int64(i))
+		rec.varbytes(r.key)
+		rec.varbytes(r.value)
+		rec.varint(0) // headers
+		body.varint(int64(len(rec.b)))
+		body.b = append(body.b, rec.b...)
+	}
+	// the part of the header the CRC covers
+	e := &encoder{}
+	e.int16(0) // attributes: no compression
+	e.int32(int32(len(records) - 1))
+	e.int64(first)
+	e.int64(last)
+	e.int64(-1) // producer ID
+	e.int16(-1) // producer epoch
+	e.int32(-1) // base sequence
+	e.array(len(records))
+	e.b = append(e.b, body.b...)
+
+	batch := &encoder{}
+	batch.int64(records[0].offset)
+	batch.int32(int32(9 + len(e.b))) // leader epoch, magic and CRC
+	batch.int32(-1)                  // partition leader epoch
+	batch.int8(2)                    // magic
+	batch.int32(int32(crc32.Checksum(e.b, castagnoli)))
+	batch.b = append(batch.b, e.b...)
+	return batch.b
+}
+
+// decodeBatches reads the records in the record batches, skipping
+// control batches and any partial batch at the end, which brokers
+// send when a batch does not fit in what was asked for. A batch
+// that cannot be decompressed ends the records with an
+// *unreadable error.
+func decodeBatches(b []byte) ([]record, error) {
+	var records []record
+	for len(b) >= batchOverhead {
+		d := &decoder{b: b}
+		base := d.int64()
+		size := int(d.int32())
+		if size < batchHeader-batchOverhead {
+			return records, errCorrupt
+		}
+		if len(d.b) < size {
+			break
+		}
+		b = d.b[size:]
+		d.b = d.b[:size]
+		d.int32() // partition leader epoch
+		if magic := d.int8(); magic != 2 {
+			return records, errFormat
+		}
+		crc := uint32(d.int32())
+		if crc32.Checksum(d.b, castagnoli) != crc {
+			return records, errCorrupt
+		}
+		attributes := d.int16()
+		lastDelta := d.int32()
+		first := d.int64()
+		d.int64() // max timestamp
+		d.int64() // producer ID
+		d.int16() // producer epoch
+		d.int32() // base sequence
+		n := int(d.int32())
+		if attributes&32 != 0 {
+			// control batches mark transactions
+			continue
+		}
+		var err error
+		if d.b, err = decompress(attributes&7, d.b); err == errUnsupported {
+			return records, &unreadable{base: base, next: base + int64(lastDelta) + 1, compression: attributes & 7}
+		} else if err != nil {
+			return records, err
+		}
+		if n < 0 || n > len(d.b) {
+			// each record takes at least a byte
+			return records, errCorrupt
+		}
+		for i := 0; i < n && d.err == nil; i++ {
+			rd := &decoder{b: d.take(int(d.varint()))}
+			rd.int8() // attributes
+			r := record{timestamp: first + rd.varint(), offset: base + rd.varint()}
+			r.key = rd.varbytes()
+			r.value = rd.varbytes()
+			if rd.err != nil {
+				return records, rd.err
+			}
+			records = append(records, r)
+		}
+		if d.err != nil {
+			return records, d.err
+		}
+	}
+	return records, nil
+}
+
+// errUnsupported is returned for a codec that decompress cannot
+// read.
+var errUnsupported = errors.New("unsupported compression")
+
+// decompress decompresses the records of a batch compressed with
+// the codec. Snappy batches may be in the framing Kafka's Java
+// clients write, or plain.
+func decompress(compression int16, b []byte) ([]byte, error) {
+	switch compression {
+	case compressionNone:
+		return b, nil
+	case compressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	case compressionSnappy:
+		return snappy.Decode(b)
+	case compressionZstd:
+		return zstdDecoder.DecodeAll(b, nil)
+	}
+	return nil, errUnsupported
+}
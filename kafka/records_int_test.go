@@ -0,0 +1,146 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"hash/crc32"
+	"testing"
+
+	snappy "github.com/eapache/go-xerial-snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatch(t *testing.T) {
+
+	records := []record{
+		{offset: 10, timestamp: 1000, key: []byte("key"), value: []byte("one")},
+		{offset: 11, timestamp: 1005, value: []byte("two")},
+		{offset: 12, timestamp: 999, key: []byte{}, value: nil},
+	}
+	batch := encodeBatch(records)
+	decoded, err := decodeBatches(append(batch, encodeBatch(records[:1])...))
+	require.NoError(t, err)
+	require.Equal(t, append(records, records[0]), decoded)
+
+	// a partial batch at the end is left for the next fetch
+	decoded, err = decodeBatches(append(batch, batch[:len(batch)-1]...))
+	require.NoError(t, err)
+	require.Equal(t, records, decoded)
+
+}
+
+func TestBatchMalformed(t *testing.T) {
+
+	batch := encodeBatch([]record{{value: []byte("data")}})
+
+	corrupt := append([]byte{}, batch...)
+	corrupt[len(corrupt)-1] ^= 1
+	_, err := decodeBatches(corrupt)
+	require.Equal(t, errCorrupt, err)
+
+	old := append([]byte{}, batch...)
+	old[16] = 1 // magic
+	_, err = decodeBatches(old)
+	require.Equal(t, errFormat, err)
+
+	// the length is shorter than a batch header
+	short := append([]byte{}, batch...)
+	short[8], short[9], short[10], short[11] = 0, 0, 0, 10
+	_, err = decodeBatches(short)
+	require.Equal(t, errCorrupt, err)
+
+}
+
+// compressBatch makes the batch one compressed with the codec, by
+// compressing the records after its header, and fixing up the
+// header to match.
+func compressBatch(batch []byte, codec int16, compress func([]byte) []byte) []byte {
+	compressed := append(append([]byte{}, batch[:batchHeader]...), compress(batch[batchHeader:])...)
+	compressed[22] = byte(codec) // attributes
+	size := len(compressed) - batchOverhead
+	compressed[8], compressed[9], compressed[10], compressed[11] = byte(size>>24), byte(size>>16), byte(size>>8), byte(size)
+	crc := crc32.Checksum(compressed[21:], castagnoli)
+	compressed[17], compressed[18], compressed[19], compressed[20] = byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc)
+	return compressed
+}
+
+func TestBatchCompressed(t *testing.T) {
+
+	batch := encodeBatch([]record{{offset: 3, value: []byte("one")}, {offset: 4, value: []byte("two")}})
+	zstdEncoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	for name, compressed := range map[string][]byte{
+		"gzip": compressBatch(batch, compressionGzip, func(b []byte) []byte {
+			var buf bytes.Buffer
+			w := gzip.NewWriter(&buf)
+			w.Write(b)
+			w.Close()
+			return buf.Bytes()
+		}),
+		// in the framing Kafka's Java clients write, and plain
+		"snappy":        compressBatch(batch, compressionSnappy, func(b []byte) []byte { return snappy.EncodeStream(nil, b) }),
+		"snappy, plain": compressBatch(batch, compressionSnappy, snappy.Encode),
+		"zstd":          compressBatch(batch, compressionZstd, func(b []byte) []byte { return zstdEncoder.EncodeAll(b, nil) }),
+	} {
+		records, err := decodeBatches(compressed)
+		require.NoError(t, err, name)
+		require.Len(t, records, 2, name)
+		require.Equal(t, int64(4), records[1].offset, name)
+		require.Equal(t, "two", string(records[1].value), name)
+	}
+
+}
+
+func TestBatchUnreadable(t *testing.T) {
+
+	first := encodeBatch([]record{{offset: 3, value: []byte("one")}})
+	lz4 := compressBatch(encodeBatch([]record{{offset: 4, value: []byte("two")}, {offset: 5, value: []byte("three")}}), compressionLZ4, func(b []byte) []byte { return b })
+	last := encodeBatch([]record{{offset: 6, value: []byte("four")}})
+
+	// the records before the batch are read, and the error says
+	// where to carry on from
+	records, err := decodeBatches(append(append(first, lz4...), last...))
+	require.Len(t, records, 1)
+	require.Equal(t, "one", string(records[0].value))
+	require.Equal(t, &unreadable{base: 4, next: 6, compression: compressionLZ4}, err)
+
+}
+
+func TestMurmur2(t *testing.T) {
+
+	// the hashes Kafka's own clients get
+	for key, hash := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		require.Equal(t, hash, murmur2([]byte(key)), key)
+	}
+
+}
+
+func TestAssign(t *testing.T) {
+
+	assignments := assign(map[string][]string{
+		"a": {"one", "two"},
+		"b": {"one"},
+	}, map[string][]int32{
+		"one": {0, 1, 2},
+		"two": {0, 1},
+	})
+	require.Equal(t, map[string]map[string][]int32{
+		"a": {"one": {0, 2}, "two": {0, 1}},
+		"b": {"one": {1}},
+	}, assignments)
+
+	for _, topics := range assignments {
+		decoded, err := decodeAssignment(encodeAssignment(topics))
+		require.NoError(t, err)
+		require.Equal(t, topics, decoded)
+	}
+
+}
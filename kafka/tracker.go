@@ -0,0 +1,141 @@
+package kafka
+
+import (
+	"sync"
+
+	"github.com/qp/go"
+)
+
+// tracker keeps track of the messages being handled, so that each
+// partition's committed offset never passes a message that has not
+// been.
+type tracker struct {
+	lock     sync.Mutex
+	pending  map[*qp.Message]*entry
+	inflight int
+	waiters  []chan qp.Signal
+}
+
+// progress is how far a partition has been consumed in a session.
+type progress struct {
+	// next is the offset of the next message to fetch.
+	next int64
+	// entries are the messages taken, oldest first, back to the
+	// oldest that has not been handled.
+	entries []*entry
+	// committed is the offset last committed, or -1.
+	committed int64
+}
+
+// entry is a message taken from a partition.
+type entry struct {
+	offset   int64
+	handlers int
+	done     bool
+	failed   bool
+}
+
+func newTracker() *tracker {
+	return &tracker{pending: make(map[*qp.Message]*entry)}
+}
+
+// wrap makes a handler that tells the tracker when the handler has
+// returned.
+func (t *tracker) wrap(handler qp.Handler) qp.Handler {
+	return qp.HandlerFunc(func(msg *qp.Message) {
+		handler.Handle(msg)
+		t.handled(msg, true)
+	})
+}
+
+// take records that the message at the offset was taken from the
+// partition, to be handed to the number of handlers.
+func (t *tracker) take(p *progress, offset int64, msg *qp.Message, handlers int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	p.next = offset + 1
+	if handlers == 0 {
+		return
+	}
+	e := &entry{offset: offset, handlers: handlers}
+	p.entries = append(p.entries, e)
+	t.pending[msg] = e
+	t.inflight++
+}
+
+// handled records that one handler of the message has returned, or
+// could not be given it. A message that any handler could not be
+// given holds its partition's position until the session ends, so
+// that it is consumed again.
+func (t *tracker) handled(msg *qp.Message, ok bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	e, found := t.pending[msg]
+	if !found {
+		return
+	}
+	e.handlers--
+	e.failed = e.failed || !ok
+	if e.handlers > 0 {
+		return
+	}
+	e.done = true
+	delete(t.pending, msg)
+	t.inflight--
+	if t.inflight == 0 {
+		for _, waiter := range t.waiters {
+			close(waiter)
+		}
+		t.waiters = nil
+	}
+}
+
+// position gets the offset to commit for the partition: that of
+// its oldest message not handled, or the next to fetch.
+func (t *tracker) position(p *progress) int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for len(p.entries) > 0 && p.entries[0].done && !p.entries[0].failed {
+		p.entries = p.entries[1:]
+	}
+	if len(p.entries) > 0 {
+		return p.entries[0].offset
+	}
+	return p.next
+}
+
+// next gets the offset of the partition's next message to fetch.
+func (t *tracker) next(p *progress) int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return p.next
+}
+
+// skip moves the partition on to fetch from the offset.
+func (t *tracker) skip(p *progress, offset int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	p.next = offset
+}
+
+// committed records that the offset was committed for the
+// partition.
+func (t *tracker) committed(p *progress, offset int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	p.committed = offset
+}
+
+// idle gets a channel that is closed once no message is being
+// handled.
+func (t *tracker) idle() chan qp.Signal {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	idle := make(chan qp.Signal)
+	if t.inflight == 0 {
+		close(idle)
+	} else {
+		t.waiters = append(t.waiters, idle)
+	}
+	return idle
+}
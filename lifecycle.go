@@ -0,0 +1,164 @@
+package qp
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/stretchr/pat/stop"
+)
+
+// State describes where a transport is in its lifecycle.
+type State uint32
+
+const (
+	// StateNew is the state of a transport that has never been
+	// started.
+	StateNew State = iota
+	// StateStarting is the state of a transport while Start is
+	// running.
+	StateStarting
+	// StateRunning is the state of a transport that has started
+	// successfully.
+	StateRunning
+	// StateStopping is the state of a transport that is waiting
+	// for in-flight messages to be handled after Stop was called.
+	StateStopping
+	// StateStopped is the state of a transport that has stopped.
+	// It may be started again.
+	StateStopped
+)
+
+var stateNames = []string{"new", "starting", "running", "stopping", "stopped"}
+
+func (s State) String() string {
+	if int(s) < len(stateNames) {
+		return stateNames[s]
+	}
+	return "unknown"
+}
+
+// Lifecycle tracks the state of a transport and provides its
+// StopChan. Transports embed a Lifecycle and wrap the work they
+// do in Start and Stop with calls to BeginStart and EndStart, and
+// BeginStop and EndStop.
+//
+// The zero value is a new, stopped transport whose StopChan is
+// already closed.
+type Lifecycle struct {
+	lock      sync.Mutex
+	state     uint32
+	stopChan  chan stop.Signal
+	abandoned int
+	fault     error
+}
+
+// State gets the current state.
+func (l *Lifecycle) State() State {
+	return State(atomic.LoadUint32(&l.state))
+}
+
+// Running gets whether the transport has started and has not yet
+// finished stopping. Transports keep sending while they are
+// stopping, so that in-flight handlers can pass their results on.
+func (l *Lifecycle) Running() bool {
+	s := l.State()
+	return s == StateRunning || s == StateStopping
+}
+
+// BeginStart moves the lifecycle into StateStarting and makes a
+// new StopChan. ErrRunning is returned if the transport has
+// already been started and has not stopped.
+func (l *Lifecycle) BeginStart() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	switch l.State() {
+	case StateNew, StateStopped:
+	default:
+		return ErrRunning
+	}
+	l.stopChan = stop.Make()
+	l.abandoned = 0
+	l.fault = nil
+	l.set(StateStarting)
+	return nil
+}
+
+// EndStart moves the lifecycle into StateRunning. If the transport
+// failed to start, err is not nil and the lifecycle moves back to
+// StateStopped instead. EndStart returns err.
+func (l *Lifecycle) EndStart(err error) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err != nil {
+		close(l.stopChan)
+		l.set(StateStopped)
+		return err
+	}
+	l.set(StateRunning)
+	return nil
+}
+
+// BeginStop moves the lifecycle into StateStopping. It returns
+// false if the transport is not running, in which case there is
+// nothing for the caller to stop.
+func (l *Lifecycle) BeginStop() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.State() != StateRunning {
+		return false
+	}
+	l.set(StateStopping)
+	return true
+}
+
+// EndStop moves the lifecycle into StateStopped and closes the
+// StopChan, recording how many in-flight handlers were abandoned.
+func (l *Lifecycle) EndStop(abandoned int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.abandoned = abandoned
+	l.set(StateStopped)
+	close(l.stopChan)
+}
+
+// StopChan gets the stop channel which will be closed when the
+// transport has stopped. If the transport is not running, the
+// channel is already closed. Each Start makes a new channel.
+func (l *Lifecycle) StopChan() <-chan stop.Signal {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.stopChan == nil {
+		return stop.Stopped()
+	}
+	return l.stopChan
+}
+
+// Abandoned gets the number of in-flight handlers that were still
+// running when the last Stop gave up waiting for them.
+func (l *Lifecycle) Abandoned() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.abandoned
+}
+
+// Fault records an error the transport ran into while running, but
+// could not return to a caller and kept running past, such as a
+// message it could not read and had to skip.
+func (l *Lifecycle) Fault(err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.fault = err
+}
+
+// Err gets the last error recorded with Fault since the transport
+// was last started, or nil if there was none.
+func (l *Lifecycle) Err() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.fault
+}
+
+// set changes the state. Callers must hold the lock.
+func (l *Lifecycle) set(s State) {
+	atomic.StoreUint32(&l.state, uint32(s))
+}
@@ -0,0 +1,90 @@
+package qp_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/qp/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func isClosed(l *qp.Lifecycle) bool {
+	select {
+	case <-l.StopChan():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+
+	var l qp.Lifecycle
+	assert.Equal(t, qp.StateNew, l.State())
+	assert.False(t, l.Running())
+	assert.True(t, isClosed(&l))
+	assert.False(t, l.BeginStop())
+
+	require.NoError(t, l.BeginStart())
+	assert.Equal(t, qp.StateStarting, l.State())
+	assert.False(t, l.Running())
+	assert.False(t, isClosed(&l))
+	assert.Equal(t, qp.ErrRunning, l.BeginStart())
+
+	require.NoError(t, l.EndStart(nil))
+	assert.Equal(t, qp.StateRunning, l.State())
+	assert.True(t, l.Running())
+	assert.Equal(t, qp.ErrRunning, l.BeginStart())
+
+	require.True(t, l.BeginStop())
+	assert.Equal(t, qp.StateStopping, l.State())
+	assert.True(t, l.Running())
+	assert.False(t, isClosed(&l))
+	assert.False(t, l.BeginStop())
+
+	l.EndStop(2)
+	assert.Equal(t, qp.StateStopped, l.State())
+	assert.False(t, l.Running())
+	assert.True(t, isClosed(&l))
+	assert.Equal(t, 2, l.Abandoned())
+
+	// faults are kept until the next start
+	fault := errors.New("skipped a message")
+	assert.NoError(t, l.Err())
+	l.Fault(fault)
+	assert.Equal(t, fault, l.Err())
+
+	// restart
+	require.NoError(t, l.BeginStart())
+	assert.False(t, isClosed(&l))
+	assert.Equal(t, 0, l.Abandoned())
+	assert.NoError(t, l.Err())
+	require.NoError(t, l.EndStart(nil))
+	assert.True(t, l.Running())
+
+}
+
+func TestLifecycleStartFailed(t *testing.T) {
+
+	var l qp.Lifecycle
+	err := errors.New("cannot connect")
+	require.NoError(t, l.BeginStart())
+	assert.Equal(t, err, l.EndStart(err))
+	assert.Equal(t, qp.StateStopped, l.State())
+	assert.True(t, isClosed(&l))
+	assert.False(t, l.BeginStop())
+
+	// may try again
+	require.NoError(t, l.BeginStart())
+
+}
+
+func TestStateString(t *testing.T) {
+
+	assert.Equal(t, "new", qp.StateNew.String())
+	assert.Equal(t, "running", qp.StateRunning.String())
+	assert.Equal(t, "stopped", qp.StateStopped.String())
+	assert.Equal(t, "unknown", qp.State(99).String())
+
+}
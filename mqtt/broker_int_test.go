@@ -0,0 +1,323 @@
+package mqtt
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testBroker is an in-process stand-in for an MQTT broker, with
+// just enough of the protocol for the transports: the three QoS
+// levels, retained messages, wills and shared subscriptions.
+type testBroker struct {
+	listener net.Listener
+
+	lock     sync.Mutex
+	conns    map[*brokerConn]struct{}
+	retained map[string]publish
+	next     map[string]int
+	wg       sync.WaitGroup
+}
+
+type brokerConn struct {
+	net.Conn
+	subs     map[string]QoS // guarded by the broker's lock
+	will     *publish
+	received map[uint16]bool
+
+	lock    sync.Mutex
+	w       *bufio.Writer
+	next    uint16
+	unacked map[uint16]bool
+}
+
+// startBroker starts a broker on the address, which may be
+// "127.0.0.1:0" for any free port.
+func startBroker(t *testing.T, addr string) *testBroker {
+	l, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	b := &testBroker{
+		listener: l,
+		conns:    make(map[*brokerConn]struct{}),
+		retained: make(map[string]publish),
+		next:     make(map[string]int),
+	}
+	b.wg.Add(1)
+	go b.accept()
+	return b
+}
+
+// url gets the URL to connect to the broker.
+func (b *testBroker) url() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+// close stops the broker and disconnects every client.
+func (b *testBroker) close() {
+	b.listener.Close()
+	b.lock.Lock()
+	for c := range b.conns {
+		c.Close()
+	}
+	b.lock.Unlock()
+	b.wg.Wait()
+}
+
+func (b *testBroker) accept() {
+	defer b.wg.Done()
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &brokerConn{
+			Conn:     conn,
+			w:        bufio.NewWriter(conn),
+			subs:     make(map[string]QoS),
+			received: make(map[uint16]bool),
+			unacked:  make(map[uint16]bool),
+		}
+		b.wg.Add(1)
+		go b.serve(c)
+	}
+}
+
+func (b *testBroker) serve(c *brokerConn) {
+	defer b.wg.Done()
+	defer c.Close()
+	r := bufio.NewReader(c)
+	p, err := readPacket(r)
+	if err != nil || p.kind != pktConnect || !c.connect(p) {
+		return
+	}
+	b.lock.Lock()
+	b.conns[c] = struct{}{}
+	b.lock.Unlock()
+	defer func() {
+		b.lock.Lock()
+		delete(b.conns, c)
+		b.lock.Unlock()
+		// the client went away without disconnecting
+		if c.will != nil {
+			b.route(*c.will)
+		}
+	}()
+	c.send(pktConnack, 0, []byte{0, 0})
+	for {
+		p, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		d := &decoder{b: p.body}
+		switch p.kind {
+		case pktPublish:
+			m, err := decodePublish(p)
+			if err != nil {
+				return
+			}
+			if m.qos == ExactlyOnce && c.received[m.id] {
+				c.send(pktPubrec, 0, idBody(m.id))
+				continue
+			}
+			if m.retain {
+				b.lock.Lock()
+				if len(m.data) == 0 {
+					delete(b.retained, m.topic)
+				} else {
+					b.retained[m.topic] = m
+				}
+				b.lock.Unlock()
+			}
+			b.route(m)
+			switch m.qos {
+			case AtLeastOnce:
+				c.send(pktPuback, 0, idBody(m.id))
+			case ExactlyOnce:
+				c.received[m.id] = true
+				c.send(pktPubrec, 0, idBody(m.id))
+			}
+		case pktPubrel:
+			id := d.uint16()
+			delete(c.received, id)
+			c.send(pktPubcomp, 0, idBody(id))
+		case pktPubrec:
+			c.send(pktPubrel, 2, idBody(d.uint16()))
+		case pktPuback, pktPubcomp:
+			c.lock.Lock()
+			delete(c.unacked, d.uint16())
+			c.lock.Unlock()
+		case pktSubscribe:
+			id := d.uint16()
+			var filters []string
+			codes := idBody(id)
+			b.lock.Lock()
+			for len(d.b) > 0 && d.err == nil {
+				filter, qos := d.string(), QoS(d.byte())
+				if strings.Contains(filter, "refused") {
+					codes = append(codes, 0x80)
+					continue
+				}
+				c.subs[filter] = qos
+				filters = append(filters, filter)
+				codes = append(codes, byte(qos))
+			}
+			retained := make(map[string]QoS)
+			for topic := range b.retained {
+				for _, filter := range filters {
+					if !strings.HasPrefix(filter, "$share/") && matchTopic(filter, topic) {
+						retained[topic] = c.subs[filter]
+						break
+					}
+				}
+			}
+			messages := make([]publish, 0, len(retained))
+			for topic := range retained {
+				messages = append(messages, b.retained[topic])
+			}
+			b.lock.Unlock()
+			c.send(pktSuback, 0, codes)
+			for _, m := range messages {
+				c.publish(m, retained[m.topic], true)
+			}
+		case pktUnsubscribe:
+			id := d.uint16()
+			b.lock.Lock()
+			for len(d.b) > 0 && d.err == nil {
+				delete(c.subs, d.string())
+			}
+			b.lock.Unlock()
+			c.send(pktUnsuback, 0, idBody(id))
+		case pktPingreq:
+			c.send(pktPingresp, 0, nil)
+		case pktDisconnect:
+			c.will = nil
+			return
+		default:
+			return
+		}
+	}
+}
+
+// unacked gets the number of messages sent AtLeastOnce to clients
+// that they have not acknowledged.
+func (b *testBroker) unacked() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	n := 0
+	for c := range b.conns {
+		c.lock.Lock()
+		n += len(c.unacked)
+		c.lock.Unlock()
+	}
+	return n
+}
+
+// route sends the message to every client with a matching
+// subscription, once each, and to one member of each matching
+// shared subscription group.
+func (b *testBroker) route(m publish) {
+	type target struct {
+		conn *brokerConn
+		qos  QoS
+	}
+	b.lock.Lock()
+	var targets []target
+	clients := make(map[*brokerConn]QoS)
+	groups := make(map[string][]target)
+	for c := range b.conns {
+		for filter, qos := range c.subs {
+			if strings.HasPrefix(filter, "$share/") {
+				parts := strings.SplitN(filter, "/", 3)
+				if len(parts) == 3 && matchTopic(parts[2], m.topic) {
+					groups[filter] = append(groups[filter], target{c, qos})
+				}
+			} else if matchTopic(filter, m.topic) {
+				if most, ok := clients[c]; !ok || qos > most {
+					clients[c] = qos
+				}
+			}
+		}
+	}
+	for c, qos := range clients {
+		targets = append(targets, target{c, qos})
+	}
+	for filter, members := range groups {
+		targets = append(targets, members[b.next[filter]%len(members)])
+		b.next[filter]++
+	}
+	b.lock.Unlock()
+	for _, t := range targets {
+		t.conn.publish(m, t.qos, false)
+	}
+}
+
+// connect reads the CONNECT packet, keeping the will.
+func (c *brokerConn) connect(p packet) bool {
+	d := &decoder{b: p.body}
+	if d.string() != "MQTT" || d.byte() != 4 {
+		return false
+	}
+	flags := d.byte()
+	d.uint16() // keep alive
+	d.string() // client identifier
+	if flags&4 != 0 {
+		c.will = &publish{
+			topic:  d.string(),
+			qos:    QoS(flags >> 3 & 3),
+			retain: flags&32 != 0,
+		}
+		c.will.data = []byte(d.string())
+	}
+	return d.err == nil
+}
+
+// publish sends the message at the lower of its QoS and the
+// subscription's.
+func (c *brokerConn) publish(m publish, qos QoS, retain bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if qos > m.qos {
+		qos = m.qos
+	}
+	m.qos, m.retain, m.dup = qos, retain, false
+	if qos > AtMostOnce {
+		if c.next++; c.next == 0 {
+			c.next++
+		}
+		m.id = c.next
+		if qos == AtLeastOnce {
+			c.unacked[m.id] = true
+		}
+	}
+	flags, body := m.encode()
+	writePacket(c.w, pktPublish, flags, body)
+	c.w.Flush()
+}
+
+// send writes the packet.
+func (c *brokerConn) send(kind, flags byte, body []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	writePacket(c.w, kind, flags, body)
+	c.w.Flush()
+}
+
+// matchTopic gets whether the topic matches the MQTT topic filter,
+// where "+" matches one level and a final "#" matches the rest,
+// including none at all.
+func matchTopic(filter, topic string) bool {
+	levels := strings.Split(topic, "/")
+	for i, level := range strings.Split(filter, "/") {
+		if level == "#" {
+			return true
+		}
+		if i >= len(levels) || (level != "+" && level != levels[i]) {
+			return false
+		}
+	}
+	return len(strings.Split(filter, "/")) == len(levels)
+}
@@ -0,0 +1,78 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/qp/go/transporttest"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectConformance(t *testing.T) {
+	b := startBroker(t, "127.0.0.1:0")
+	defer b.close()
+	transporttest.Direct(t, func() qp.DirectTransport {
+		return NewDirectOptions(b.url(), Options{QoS: AtLeastOnce})
+	})
+}
+
+func TestDirectDevice(t *testing.T) {
+
+	b := startBroker(t, "127.0.0.1:0")
+	defer b.close()
+	d := NewDirect(b.url())
+	msgs := make(chan *qp.Message, 10)
+	require.NoError(t, d.OnMessage("devices.requests", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	})))
+	require.NoError(t, d.Start())
+	defer d.Stop(stop.NoWait)
+
+	// a device publishes on the topic
+	device := newClient(b.url(), Options{})
+	require.NoError(t, device.start())
+	defer device.stop()
+	require.NoError(t, device.publish("devices/requests", []byte("hello"), AtLeastOnce, false))
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "devices.requests", msg.Source)
+		require.Equal(t, "hello", string(msg.Data))
+	case <-time.After(1 * time.Second):
+		require.FailNow(t, "no message received from the device")
+	}
+
+}
+
+func TestDirectReconnect(t *testing.T) {
+
+	b := startBroker(t, "127.0.0.1:0")
+	addr := b.listener.Addr().String()
+	d := NewDirect(b.url())
+	msgs := make(chan *qp.Message, 10)
+	require.NoError(t, d.OnMessage("reconnect", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	})))
+	require.NoError(t, d.Start())
+	defer d.Stop(stop.NoWait)
+
+	b.close()
+	b = startBroker(t, addr)
+	defer b.close()
+
+	// the transport subscribes again once it reconnects
+	deadline := time.Now().Add(2 * time.Second)
+	for d.client.flush() != nil {
+		require.True(t, time.Now().Before(deadline), "did not reconnect")
+		time.Sleep(20 * time.Millisecond)
+	}
+	require.NoError(t, d.Send("reconnect", []byte("found")))
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "found", string(msg.Data))
+	case <-time.After(1 * time.Second):
+		require.FailNow(t, "no message received after reconnecting")
+	}
+
+}
@@ -0,0 +1,20 @@
+// Package mqtt implements the qp transports on an MQTT broker, so
+// that devices which only speak MQTT can take part.
+//
+// The transports speak MQTT 3.1.1 themselves. Channels are topics
+// with their tokens as topic levels, so "sensors.kitchen" is the
+// topic "sensors/kitchen", and qp patterns are MQTT wildcards.
+// Channels with "/", "+" or "#" in them would mean something else
+// to the broker, so they get ErrChannel.
+// Direct channels use shared subscriptions ("$share/<group>/...")
+// which give each message to one of the group, as Service needs.
+// Options sets the QoS messages are sent and received with, and a
+// will for the broker to publish if a transport goes away without
+// stopping. PubSub.PublishRetained has the broker keep a message
+// for later subscribers.
+//
+// The transports start a clean session whenever they connect, and
+// subscribe again, so messages sent while they are disconnected are
+// lost. The broker should send a single copy of a message that
+// matches more than one subscription, as MQTT 3.1.1 brokers do.
+package mqtt
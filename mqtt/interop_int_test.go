@@ -0,0 +1,86 @@
+package mqtt
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/qp/go/transporttest"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+// ensureBroker gets the URL of a real MQTT broker to check the
+// transports against, from QP_MQTT_URL or the default port on this
+// machine, and skips the test if none is running there. The broker
+// must support shared subscriptions.
+func ensureBroker(t *testing.T) string {
+	addr := os.Getenv("QP_MQTT_URL")
+	if addr == "" {
+		addr = "tcp://127.0.0.1:1883"
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		t.Fatal("bad QP_MQTT_URL:", err)
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, time.Second)
+	if err != nil {
+		t.Skip("skipping because no MQTT broker is running at", addr)
+	}
+	conn.Close()
+	return addr
+}
+
+func TestInteropDirect(t *testing.T) {
+	addr := ensureBroker(t)
+	for name, qos := range map[string]QoS{"AtMostOnce": AtMostOnce, "ExactlyOnce": ExactlyOnce} {
+		qos := qos
+		t.Run(name, func(t *testing.T) {
+			transporttest.Direct(t, func() qp.DirectTransport {
+				return NewDirectOptions(addr, Options{QoS: qos})
+			})
+		})
+	}
+}
+
+func TestInteropPubSub(t *testing.T) {
+	addr := ensureBroker(t)
+	for name, qos := range map[string]QoS{"AtMostOnce": AtMostOnce, "ExactlyOnce": ExactlyOnce} {
+		qos := qos
+		t.Run(name, func(t *testing.T) {
+			transporttest.PubSub(t, func() qp.PubSubTransport {
+				return NewPubSubOptions(addr, Options{QoS: qos})
+			})
+		})
+	}
+}
+
+func TestInteropRetained(t *testing.T) {
+
+	addr := ensureBroker(t)
+	publisher := NewPubSubOptions(addr, Options{QoS: AtLeastOnce})
+	require.NoError(t, publisher.Start())
+	defer publisher.Stop(stop.NoWait)
+	require.NoError(t, publisher.PublishRetained("qp.interop.retained", []byte("kept")))
+	defer publisher.PublishRetained("qp.interop.retained", nil)
+
+	msgs := make(chan *qp.Message, 1)
+	subscriber := NewPubSubOptions(addr, Options{QoS: AtLeastOnce})
+	_, err := subscriber.Subscribe("qp.interop.*", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	}))
+	require.NoError(t, err)
+	require.NoError(t, subscriber.Start())
+	defer subscriber.Stop(stop.NoWait)
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "qp.interop.retained", msg.Source)
+		require.Equal(t, "kept", string(msg.Data))
+	case <-time.After(2 * time.Second):
+		require.FailNow(t, "retained message not received")
+	}
+
+}
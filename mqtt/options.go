@@ -0,0 +1,95 @@
+package mqtt
+
+import "time"
+
+// QoS is an MQTT quality of service level.
+type QoS byte
+
+const (
+	// AtMostOnce sends each message once, and it is lost if the
+	// connection fails on the way.
+	AtMostOnce QoS = iota
+	// AtLeastOnce has the broker acknowledge each message, so it
+	// may arrive more than once but is not lost while connected.
+	AtLeastOnce
+	// ExactlyOnce has the broker and the client agree on each
+	// message in two steps, so that it arrives once.
+	ExactlyOnce
+)
+
+// Will is the message the broker publishes for a transport that
+// disconnects without stopping, such as a device losing power.
+type Will struct {
+	// Channel is the channel to publish on.
+	Channel string
+	// Data is the message.
+	Data []byte
+	// QoS is the quality of service to publish with.
+	QoS QoS
+	// Retain has the broker keep the message for later
+	// subscribers.
+	Retain bool
+}
+
+// Options controls how a transport uses the broker.
+type Options struct {
+	// ClientID identifies the transport to the broker, which
+	// disconnects any other client with the same ID. Empty means
+	// a random ID.
+	ClientID string
+	// Group is the shared subscription group Direct transports
+	// join on each channel, so that each message goes to one of
+	// them. Empty means DefaultGroup.
+	Group string
+	// QoS is the quality of service messages are sent with, and
+	// the most that subscriptions ask for. The zero value is
+	// AtMostOnce.
+	QoS QoS
+	// Will is published by the broker if the transport loses its
+	// connection. Nil means no will.
+	Will *Will
+	// KeepAlive is how often the transport pings the broker when
+	// idle. Zero means DefaultKeepAlive.
+	KeepAlive time.Duration
+	// PendingLimit is the number of messages that may wait to be
+	// handed to the handlers of a channel. Past it, messages
+	// received AtMostOnce are dropped, and others are not
+	// acknowledged until the handlers catch up, which stops the
+	// broker sending more. Zero means DefaultPendingLimit.
+	PendingLimit int
+}
+
+// DefaultGroup is the Group used when Options does not set one.
+const DefaultGroup = "qp"
+
+// DefaultKeepAlive is the KeepAlive used when Options does not set
+// one.
+const DefaultKeepAlive = 30 * time.Second
+
+// DefaultPendingLimit is the PendingLimit used when Options does
+// not set one.
+const DefaultPendingLimit = 65536
+
+// group gets the shared subscription group to join.
+func (o Options) group() string {
+	if o.Group == "" {
+		return DefaultGroup
+	}
+	return o.Group
+}
+
+// keepAlive gets how often to ping the broker.
+func (o Options) keepAlive() time.Duration {
+	if o.KeepAlive == 0 {
+		return DefaultKeepAlive
+	}
+	return o.KeepAlive
+}
+
+// pendingLimit gets the number of messages that may wait.
+func (o Options) pendingLimit() int {
+	if o.PendingLimit == 0 {
+		return DefaultPendingLimit
+	}
+	return o.PendingLimit
+}
@@ -0,0 +1,190 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// the MQTT 3.1.1 control packet types
+const (
+	pktConnect     = 1
+	pktConnack     = 2
+	pktPublish     = 3
+	pktPuback      = 4
+	pktPubrec      = 5
+	pktPubrel      = 6
+	pktPubcomp     = 7
+	pktSubscribe   = 8
+	pktSuback      = 9
+	pktUnsubscribe = 10
+	pktUnsuback    = 11
+	pktPingreq     = 12
+	pktPingresp    = 13
+	pktDisconnect  = 14
+)
+
+// MaxPacketSize is the largest packet MQTT can carry.
+const MaxPacketSize = 268435455
+
+// errMalformed is returned when a packet cannot be read.
+var errMalformed = errors.New("malformed MQTT packet")
+
+// packet is a control packet: its type, the flags in the low
+// nibble of its first byte, and the rest of it.
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+// readPacket reads the next packet.
+func readPacket(r *bufio.Reader) (packet, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+	size, shift := 0, uint(0)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+		size |= int(b&127) << shift
+		if b&128 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return packet{}, errMalformed
+		}
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return packet{}, err
+	}
+	return packet{kind: first >> 4, flags: first & 15, body: body}, nil
+}
+
+// writePacket writes the packet, without flushing it.
+func writePacket(w *bufio.Writer, kind, flags byte, body []byte) error {
+	if len(body) > MaxPacketSize {
+		return ErrTooLarge
+	}
+	w.WriteByte(kind<<4 | flags)
+	size := len(body)
+	for {
+		b := byte(size & 127)
+		if size >>= 7; size > 0 {
+			b |= 128
+		}
+		w.WriteByte(b)
+		if size == 0 {
+			break
+		}
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// appendUint16 appends the big-endian value.
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// appendString appends the string, or bytes, after its length.
+func appendString(b []byte, s string) []byte {
+	return append(appendUint16(b, uint16(len(s))), s...)
+}
+
+// idBody makes the body of a packet that carries only a packet
+// identifier, such as PUBACK.
+func idBody(id uint16) []byte {
+	return appendUint16(nil, id)
+}
+
+// decoder reads the fields of a packet body in turn. Once a field
+// is missing, err is set and every later field is empty.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) byte() byte {
+	if len(d.b) < 1 {
+		d.err = errMalformed
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *decoder) uint16() uint16 {
+	if len(d.b) < 2 {
+		d.err = errMalformed
+		d.b = nil
+		return 0
+	}
+	v := binary.BigEndian.Uint16(d.b)
+	d.b = d.b[2:]
+	return v
+}
+
+func (d *decoder) string() string {
+	n := int(d.uint16())
+	if len(d.b) < n {
+		d.err = errMalformed
+		d.b = nil
+		return ""
+	}
+	v := string(d.b[:n])
+	d.b = d.b[n:]
+	return v
+}
+
+// publish is a decoded PUBLISH packet.
+type publish struct {
+	topic  string
+	id     uint16
+	qos    QoS
+	retain bool
+	dup    bool
+	data   []byte
+}
+
+// encode gets the flags and body of the PUBLISH packet.
+func (p publish) encode() (byte, []byte) {
+	flags := byte(p.qos) << 1
+	if p.retain {
+		flags |= 1
+	}
+	if p.dup {
+		flags |= 8
+	}
+	body := make([]byte, 0, 4+len(p.topic)+len(p.data))
+	body = appendString(body, p.topic)
+	if p.qos > AtMostOnce {
+		body = appendUint16(body, p.id)
+	}
+	return flags, append(body, p.data...)
+}
+
+// decodePublish decodes a PUBLISH packet.
+func decodePublish(p packet) (publish, error) {
+	m := publish{
+		qos:    QoS(p.flags >> 1 & 3),
+		retain: p.flags&1 != 0,
+		dup:    p.flags&8 != 0,
+	}
+	if m.qos > ExactlyOnce {
+		return m, errMalformed
+	}
+	d := &decoder{b: p.body}
+	m.topic = d.string()
+	if m.qos > AtMostOnce {
+		m.id = d.uint16()
+	}
+	m.data = d.b
+	return m, d.err
+}
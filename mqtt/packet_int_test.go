@@ -0,0 +1,57 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPacket(t *testing.T) {
+
+	for _, size := range []int{0, 127, 128, 16383, 16384, 1 << 21} {
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		body := bytes.Repeat([]byte{'x'}, size)
+		require.NoError(t, writePacket(w, pktPublish, 3, body))
+		require.NoError(t, w.Flush())
+		p, err := readPacket(bufio.NewReader(&buf))
+		require.NoError(t, err)
+		require.Equal(t, byte(pktPublish), p.kind)
+		require.Equal(t, byte(3), p.flags)
+		require.Equal(t, size, len(p.body))
+	}
+
+}
+
+func TestPacketMalformed(t *testing.T) {
+
+	// the remaining length has more than four bytes
+	_, err := readPacket(bufio.NewReader(bytes.NewReader([]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01})))
+	require.Equal(t, errMalformed, err)
+
+	// the topic is longer than the packet
+	_, err = decodePublish(packet{kind: pktPublish, body: []byte{0, 10, 'a'}})
+	require.Equal(t, errMalformed, err)
+
+	// QoS 3 does not exist
+	_, err = decodePublish(packet{kind: pktPublish, flags: 6, body: []byte{0, 1, 'a'}})
+	require.Equal(t, errMalformed, err)
+
+}
+
+func TestPublish(t *testing.T) {
+
+	for _, m := range []publish{
+		{topic: "a/b", data: []byte("data")},
+		{topic: "a/b", id: 7, qos: AtLeastOnce, retain: true, data: []byte("data")},
+		{topic: "a", id: 65535, qos: ExactlyOnce, dup: true, data: []byte{}},
+	} {
+		flags, body := m.encode()
+		decoded, err := decodePublish(packet{kind: pktPublish, flags: flags, body: body})
+		require.NoError(t, err)
+		require.Equal(t, m, decoded)
+	}
+
+}
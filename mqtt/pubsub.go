@@ -0,0 +1,316 @@
+package mqtt
+
+import (
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+)
+
+// PubSub represents a qp.PubSubTransport. Channels are topics with
+// their tokens as topic levels, so "sensors.kitchen" is the topic
+// "sensors/kitchen", and qp patterns are MQTT wildcards: "*" is "+"
+// and ">" is "#".
+type PubSub struct {
+	qp.Lifecycle
+	client        *client
+	options       Options
+	subscriptions map[string][]*subscription
+	channels      map[string]qp.ChannelOptions
+	listeners     map[string]*sub
+	lock          sync.Mutex
+	log           slog.Logger
+}
+
+// subscription is a single handler bound to a channel.
+type subscription struct {
+	handler    qp.Handler
+	dispatcher *qp.Dispatcher
+}
+
+// ensure the interface is satisfied
+var _ qp.PubSubTransport = (*PubSub)(nil)
+
+// NewPubSub makes a new PubSub MQTT transport that connects to the
+// broker at the URL, such as "tcp://localhost:1883".
+func NewPubSub(url string) *PubSub {
+	return NewPubSubOptions(url, Options{})
+}
+
+// NewPubSubOptions makes a new PubSub MQTT transport with the
+// specified options. The shared subscription group is not used.
+func NewPubSubOptions(url string, options Options) *PubSub {
+	return &PubSub{
+		client:        newClient(url, options),
+		options:       options,
+		subscriptions: make(map[string][]*subscription),
+		channels:      make(map[string]qp.ChannelOptions),
+		listeners:     make(map[string]*sub),
+		log:           slog.NilLogger,
+	}
+}
+
+// SetLogger sets the Logger to log to.
+func (p *PubSub) SetLogger(log slog.Logger) {
+	p.log = log
+	p.client.log = log
+}
+
+// Publish publishes data on the specified channel with the QoS in
+// the options, waiting for the broker to acknowledge it if the QoS
+// needs it to.
+func (p *PubSub) Publish(channel string, data []byte) error {
+	return p.publish(channel, data, false)
+}
+
+// PublishRetained publishes data on the specified channel like
+// Publish, and has the broker keep it to send to every later
+// subscriber to the channel, in place of any message it kept
+// before. Publishing empty data removes the kept message.
+func (p *PubSub) PublishRetained(channel string, data []byte) error {
+	return p.publish(channel, data, true)
+}
+
+// publish publishes data on the channel.
+func (p *PubSub) publish(channel string, data []byte, retain bool) error {
+	if !p.Running() {
+		return qp.ErrNotRunning
+	}
+	if p.log.Info() {
+		p.log.Info("publish to", channel, string(data))
+	}
+	t, err := topic(channel)
+	if err == nil {
+		err = p.client.publish(t, data, p.options.QoS, retain)
+	}
+	if err != nil && p.log.Err() {
+		p.log.Err("publish failed", err)
+	}
+	return err
+}
+
+// Subscribe binds the handler to the specified channel.
+// If the transport is running, it subscribes to the channel
+// straight away, and returns once the broker has the subscription.
+// If the broker refuses it, the handler is unbound and ErrRefused is
+// returned. All handlers on a channel share a single MQTT subscription, so
+// retained messages go to the handlers bound when the transport
+// first subscribes to the channel.
+func (p *PubSub) Subscribe(channel string, handler qp.Handler) (qp.Subscription, error) {
+	if p.log.Info() {
+		p.log.Info("subscribing to", channel)
+	}
+	if _, err := filter(channel); err != nil {
+		return nil, err
+	}
+	p.lock.Lock()
+	s := &subscription{
+		handler:    handler,
+		dispatcher: qp.NewDispatcher(handler, p.channels[channel]),
+	}
+	p.subscriptions[channel] = append(p.subscriptions[channel], s)
+	var l *sub
+	if p.State() == qp.StateRunning {
+		l = p.listen(channel)
+	}
+	p.lock.Unlock()
+	if l != nil {
+		p.flush()
+		if err := p.client.confirm(l); err != nil {
+			p.lock.Lock()
+			if p.listeners[channel] == l {
+				p.unlisten(channel)
+			}
+			p.lock.Unlock()
+			p.remove(channel, s)
+			return nil, err
+		}
+	}
+	return qp.SubscriptionFunc(func() error {
+		p.remove(channel, s)
+		return nil
+	}), nil
+}
+
+// remove unbinds a single subscription from the channel,
+// unsubscribing if it was the last one.
+func (p *PubSub) remove(channel string, s *subscription) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	subscriptions := p.subscriptions[channel]
+	for i, existing := range subscriptions {
+		if existing == s {
+			s.dispatcher.Close()
+			subscriptions = append(subscriptions[:i:i], subscriptions[i+1:]...)
+			break
+		}
+	}
+	if len(subscriptions) == 0 {
+		delete(p.subscriptions, channel)
+		p.unlisten(channel)
+	} else {
+		p.subscriptions[channel] = subscriptions
+	}
+}
+
+// Unsubscribe unbinds all handlers from the specified channel.
+// If the transport is running, it unsubscribes from the channel.
+func (p *PubSub) Unsubscribe(channel string) error {
+	if p.log.Info() {
+		p.log.Info("unsubscribing from", channel)
+	}
+	p.lock.Lock()
+	for _, s := range p.subscriptions[channel] {
+		s.dispatcher.Close()
+	}
+	delete(p.subscriptions, channel)
+	p.unlisten(channel)
+	p.lock.Unlock()
+	return nil
+}
+
+// SetChannelOptions sets the options that control how messages
+// on the specified channel are dispatched to its handlers.
+func (p *PubSub) SetChannelOptions(channel string, options qp.ChannelOptions) error {
+	p.lock.Lock()
+	p.channels[channel] = options
+	for _, s := range p.subscriptions[channel] {
+		s.dispatcher.Close()
+		s.dispatcher = qp.NewDispatcher(s.handler, options)
+	}
+	p.lock.Unlock()
+	return nil
+}
+
+// dispatchers gets the dispatchers of every handler
+// bound to the channel.
+func (p *PubSub) dispatchers(channel string) []*qp.Dispatcher {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	dispatchers := make([]*qp.Dispatcher, 0, len(p.subscriptions[channel]))
+	for _, s := range p.subscriptions[channel] {
+		dispatchers = append(dispatchers, s.dispatcher)
+	}
+	return dispatchers
+}
+
+// listen subscribes to the channel, unless there is already a
+// subscription for it, and returns the new subscription, or nil if
+// there already was one.
+// Callers must hold the lock.
+func (p *PubSub) listen(channel string) *sub {
+	if _, ok := p.listeners[channel]; ok {
+		return nil
+	}
+	// Subscribe has checked the channel
+	f, _ := filter(channel)
+	s, err := p.client.subscribe(channel, f, p.options.QoS, func(msg *qp.Message) {
+		if p.log.Info() {
+			p.log.Info("handling message from", msg.Source+":", string(msg.Data))
+		}
+		for _, dispatcher := range p.dispatchers(channel) {
+			dispatcher.Dispatch(msg)
+		}
+	})
+	if err != nil && p.log.Warn() {
+		p.log.Warn("failed to subscribe to", channel+":", err)
+	}
+	p.listeners[channel] = s
+	return s
+}
+
+// unlisten unsubscribes from the channel.
+// Callers must hold the lock.
+func (p *PubSub) unlisten(channel string) {
+	if s, ok := p.listeners[channel]; ok {
+		if err := p.client.unsubscribe(s); err != nil && p.log.Warn() {
+			p.log.Warn("failed to unsubscribe from", channel+":", err)
+		}
+		delete(p.listeners, channel)
+	}
+}
+
+// flush waits for the broker to have the subscriptions.
+func (p *PubSub) flush() {
+	if err := p.client.flush(); err != nil && p.log.Warn() {
+		p.log.Warn("failed to flush subscriptions:", err)
+	}
+}
+
+// Start connects to the broker and subscribes to the channels.
+// A stopped transport may be started again.
+func (p *PubSub) Start() error {
+	if err := p.BeginStart(); err != nil {
+		return err
+	}
+	if p.log.Info() {
+		p.log.Info("starting")
+	}
+	if err := p.client.start(); err != nil {
+		return p.EndStart(err)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	listeners := make(map[string]*sub, len(p.subscriptions))
+	for channel, subscriptions := range p.subscriptions {
+		for _, s := range subscriptions {
+			s.dispatcher.Close()
+			s.dispatcher = qp.NewDispatcher(s.handler, p.channels[channel])
+		}
+		listeners[channel] = p.listen(channel)
+	}
+	p.flush()
+	for channel, s := range listeners {
+		if s == nil {
+			continue
+		}
+		if err := p.client.confirm(s); err != nil {
+			if p.log.Err() {
+				p.log.Err("failed to subscribe to", channel+":", err)
+			}
+			p.Fault(err)
+			p.unlisten(channel)
+		}
+	}
+	return p.EndStart(nil)
+}
+
+// Stop stops the transport and closes StopChan() when finished.
+//
+// Stop unsubscribes from every channel, then hands on the messages
+// that had already arrived.
+// Those and the messages already being handled have the grace
+// period to finish before they are abandoned. It is safe to call
+// Stop more than once.
+func (p *PubSub) Stop(grace time.Duration) {
+	if !p.BeginStop() {
+		return
+	}
+	if p.log.Info() {
+		p.log.Info("stopping...")
+	}
+	var subs []*sub
+	var dispatchers []*qp.Dispatcher
+	p.lock.Lock()
+	for channel, s := range p.listeners {
+		subs = append(subs, s)
+		delete(p.listeners, channel)
+	}
+	for _, subscriptions := range p.subscriptions {
+		for _, s := range subscriptions {
+			dispatchers = append(dispatchers, s.dispatcher)
+		}
+	}
+	p.lock.Unlock()
+	abandoned := drain(p.client, grace, subs, dispatchers, p.log)
+	p.client.stop()
+	if abandoned > 0 && p.log.Warn() {
+		p.log.Warn("abandoned", abandoned, "in-flight handlers")
+	}
+	// inform caller of stop complete
+	p.EndStop(abandoned)
+	if p.log.Info() {
+		p.log.Info("stopped")
+	}
+}
@@ -0,0 +1,235 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/qp/go/transporttest"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPubSubConformance(t *testing.T) {
+	b := startBroker(t, "127.0.0.1:0")
+	defer b.close()
+	for name, qos := range map[string]QoS{"AtMostOnce": AtMostOnce, "ExactlyOnce": ExactlyOnce} {
+		qos := qos
+		t.Run(name, func(t *testing.T) {
+			transporttest.PubSub(t, func() qp.PubSubTransport {
+				return NewPubSubOptions(b.url(), Options{QoS: qos})
+			})
+		})
+	}
+}
+
+func TestPubSubRetained(t *testing.T) {
+
+	b := startBroker(t, "127.0.0.1:0")
+	defer b.close()
+	publisher := NewPubSubOptions(b.url(), Options{QoS: AtLeastOnce})
+	require.NoError(t, publisher.Start())
+	defer publisher.Stop(stop.NoWait)
+	require.NoError(t, publisher.PublishRetained("retained.status", []byte("online")))
+
+	// later subscribers get the kept message
+	msgs := make(chan *qp.Message, 10)
+	p := NewPubSubOptions(b.url(), Options{QoS: AtLeastOnce})
+	_, err := p.Subscribe("retained.*", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	}))
+	require.NoError(t, err)
+	require.NoError(t, p.Start())
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "retained.status", msg.Source)
+		require.Equal(t, "online", string(msg.Data))
+	case <-time.After(1 * time.Second):
+		require.FailNow(t, "retained message not received")
+	}
+	p.Stop(stop.NoWait)
+
+	// publishing empty data removes it
+	require.NoError(t, publisher.PublishRetained("retained.status", nil))
+	require.NoError(t, p.Start())
+	defer p.Stop(stop.NoWait)
+	select {
+	case msg := <-msgs:
+		require.FailNow(t, "removed retained message received", string(msg.Data))
+	case <-time.After(100 * time.Millisecond):
+	}
+
+}
+
+func TestPubSubWill(t *testing.T) {
+
+	b := startBroker(t, "127.0.0.1:0")
+	defer b.close()
+	msgs := make(chan *qp.Message, 10)
+	watcher := NewPubSub(b.url())
+	_, err := watcher.Subscribe("devices.>", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	}))
+	require.NoError(t, err)
+	require.NoError(t, watcher.Start())
+	defer watcher.Stop(stop.NoWait)
+
+	will := &Will{Channel: "devices.sensor.gone", Data: []byte("sensor"), QoS: AtLeastOnce}
+	device := NewPubSubOptions(b.url(), Options{Will: will})
+	require.NoError(t, device.Start())
+
+	// stopping cleanly does not publish the will
+	device.Stop(stop.NoWait)
+	select {
+	case msg := <-msgs:
+		require.FailNow(t, "will published after stopping", string(msg.Data))
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// losing the connection does
+	require.NoError(t, device.Start())
+	defer device.Stop(stop.NoWait)
+	device.client.lock.Lock()
+	device.client.conn.Close()
+	device.client.lock.Unlock()
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "devices.sensor.gone", msg.Source)
+		require.Equal(t, "sensor", string(msg.Data))
+	case <-time.After(1 * time.Second):
+		require.FailNow(t, "will not published")
+	}
+
+}
+
+// requireUnacked requires the broker to have the number of messages
+// that clients have not acknowledged, soon.
+func requireUnacked(t *testing.T, b *testBroker, n int) {
+	deadline := time.Now().Add(1 * time.Second)
+	for b.unacked() != n {
+		if time.Now().After(deadline) {
+			require.FailNow(t, "unexpected unacknowledged messages", "%d, not %d", b.unacked(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPubSubPendingLimit(t *testing.T) {
+
+	b := startBroker(t, "127.0.0.1:0")
+	defer b.close()
+	publisher := NewPubSubOptions(b.url(), Options{QoS: AtLeastOnce})
+	require.NoError(t, publisher.Start())
+	defer publisher.Stop(stop.NoWait)
+
+	// the handler holds the first message, the next waits to be
+	// dispatched, and one more may wait in the queue
+	p := NewPubSubOptions(b.url(), Options{QoS: AtLeastOnce, PendingLimit: 1})
+	release := make(chan qp.Signal)
+	msgs := make(chan string, 10)
+	_, err := p.Subscribe("slow", qp.HandlerFunc(func(msg *qp.Message) {
+		<-release
+		msgs <- string(msg.Data)
+	}))
+	require.NoError(t, err)
+	require.NoError(t, p.SetChannelOptions("slow", qp.ChannelOptions{MaxInFlight: 1}))
+	require.NoError(t, p.Start())
+	defer p.Stop(stop.NoWait)
+	sent := []string{"one", "two", "three", "four"}
+	for _, data := range sent {
+		require.NoError(t, publisher.Publish("slow", []byte(data)))
+	}
+
+	// the message past the limit is kept, but not acknowledged
+	// until the handler catches up
+	requireUnacked(t, b, 1)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 1, b.unacked())
+	close(release)
+	for _, expected := range sent {
+		select {
+		case data := <-msgs:
+			require.Equal(t, expected, data)
+		case <-time.After(1 * time.Second):
+			require.FailNow(t, "message not received", expected)
+		}
+	}
+	requireUnacked(t, b, 0)
+
+}
+
+func TestTopic(t *testing.T) {
+
+	for channel, expected := range map[string]string{
+		"sensors.kitchen": "sensors/kitchen",
+		"sensors.k*":      "sensors/k*",
+	} {
+		actual, err := topic(channel)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	}
+	for pattern, expected := range map[string]string{
+		"sensors.*.temperature": "sensors/+/temperature",
+		"sensors.>":             "sensors/#",
+	} {
+		actual, err := filter(pattern)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+		// patterns cannot be sent or published to
+		_, err = topic(pattern)
+		require.Equal(t, ErrChannel, err)
+	}
+	// characters MQTT gives meanings of its own are not passed on
+	for _, channel := range []string{"sensors/kitchen", "sensors.+", "sensors.#", "a+b", "a#", "a\x00"} {
+		_, err := filter(channel)
+		require.Equal(t, ErrChannel, err, channel)
+	}
+	require.Equal(t, "sensors.kitchen", channel("sensors/kitchen"))
+
+}
+
+func TestChannelRejected(t *testing.T) {
+
+	b := startBroker(t, "127.0.0.1:0")
+	defer b.close()
+	p := NewPubSub(b.url())
+	require.NoError(t, p.Start())
+	defer p.Stop(stop.NoWait)
+	require.Equal(t, ErrChannel, p.Publish("sensors/kitchen", []byte("data")))
+	require.Equal(t, ErrChannel, p.Publish("sensors.*", []byte("data")))
+	_, err := p.Subscribe("sensors.#", qp.HandlerFunc(func(*qp.Message) {}))
+	require.Equal(t, ErrChannel, err)
+	d := NewDirect(b.url())
+	require.Equal(t, ErrChannel, d.OnMessage("jobs/one", qp.HandlerFunc(func(*qp.Message) {})))
+
+}
+
+func TestSubscriptionRefused(t *testing.T) {
+
+	// the broker refuses filters containing "refused"
+	b := startBroker(t, "127.0.0.1:0")
+	defer b.close()
+	handler := qp.HandlerFunc(func(*qp.Message) {})
+
+	p := NewPubSub(b.url())
+	require.NoError(t, p.Start())
+	defer p.Stop(stop.NoWait)
+	_, err := p.Subscribe("sensors.refused", handler)
+	require.Equal(t, ErrRefused, err)
+	_, err = p.Subscribe("sensors.kitchen", handler)
+	require.NoError(t, err)
+
+	d := NewDirect(b.url())
+	require.NoError(t, d.Start())
+	defer d.Stop(stop.NoWait)
+	require.Equal(t, ErrRefused, d.OnMessage("jobs.refused", handler))
+	require.NoError(t, d.OnMessage("jobs.one", handler))
+
+	// refused when starting
+	d = NewDirect(b.url())
+	require.NoError(t, d.OnMessage("jobs.refused", handler))
+	require.NoError(t, d.Start())
+	defer d.Stop(stop.NoWait)
+	require.Equal(t, ErrRefused, d.Err())
+
+}
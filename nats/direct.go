@@ -0,0 +1,242 @@
+package nats
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+)
+
+// Direct represents a qp.DirectTransport. Each channel is a subject
+// that every Direct subscribes to in the same queue group, so that
+// each message goes to one of them.
+//
+// NATS does not keep messages: one sent on a channel that nothing
+// is handling is lost.
+type Direct struct {
+	qp.Lifecycle
+	client    *client
+	options   Options
+	handlers  map[string]qp.Handler
+	channels  map[string]qp.ChannelOptions
+	listeners map[string]*listener
+	lock      sync.Mutex
+	log       slog.Logger
+}
+
+// listener takes messages from a single channel.
+type listener struct {
+	sub        *nats.Subscription
+	dispatcher *qp.Dispatcher
+}
+
+// ensure the interface is satisfied
+var _ qp.DirectTransport = (*Direct)(nil)
+
+// NewDirect makes a new Direct NATS transport that connects to the
+// server at the URL, such as "nats://localhost:4222".
+func NewDirect(url string) *Direct {
+	return NewDirectOptions(url, Options{})
+}
+
+// NewDirectOptions makes a new Direct NATS transport with the
+// specified options.
+func NewDirectOptions(url string, options Options) *Direct {
+	return &Direct{
+		client:    newClient(url, options.pendingLimit()),
+		options:   options,
+		handlers:  make(map[string]qp.Handler),
+		channels:  make(map[string]qp.ChannelOptions),
+		listeners: make(map[string]*listener),
+		log:       slog.NilLogger,
+	}
+}
+
+// SetLogger sets the Logger to log to.
+func (d *Direct) SetLogger(log slog.Logger) {
+	d.log = log
+	d.client.log = log
+}
+
+// Send sends data on the channel.
+func (d *Direct) Send(channel string, data []byte) error {
+	if !d.Running() {
+		return qp.ErrNotRunning
+	}
+	if d.log.Info() {
+		d.log.Info("sending to", channel, string(data))
+	}
+	err := d.client.publish(channel, data)
+	if err != nil && d.log.Err() {
+		d.log.Err("send failed", err)
+	}
+	return err
+}
+
+// OnMessage binds the handler to the specified channel.
+// If the transport is running, it subscribes to the channel, and
+// returns once the server has the subscription.
+func (d *Direct) OnMessage(channel string, handler qp.Handler) error {
+	if d.log.Info() {
+		d.log.Info("listening to", channel)
+	}
+	d.lock.Lock()
+	d.handlers[channel] = handler
+	running := d.State() == qp.StateRunning
+	if running {
+		d.listen(channel)
+	}
+	d.lock.Unlock()
+	if running {
+		d.flush()
+	}
+	return nil
+}
+
+// RemoveHandler unbinds the handler from the specified channel.
+// If the transport is running, it unsubscribes from the channel.
+// Handlers that are already running are left to finish, and
+// messages waiting to be handled are dropped.
+func (d *Direct) RemoveHandler(channel string) error {
+	if d.log.Info() {
+		d.log.Info("no longer listening to", channel)
+	}
+	d.lock.Lock()
+	delete(d.handlers, channel)
+	d.unlisten(channel)
+	d.lock.Unlock()
+	return nil
+}
+
+// SetChannelOptions sets the options that control how messages
+// on the specified channel are dispatched to its handler.
+func (d *Direct) SetChannelOptions(channel string, options qp.ChannelOptions) error {
+	d.lock.Lock()
+	d.channels[channel] = options
+	if _, ok := d.handlers[channel]; ok && d.State() == qp.StateRunning {
+		d.listen(channel)
+	}
+	d.lock.Unlock()
+	return nil
+}
+
+// listen subscribes to the channel, replacing any existing
+// listener.
+// Callers must hold the lock.
+func (d *Direct) listen(channel string) {
+	d.unlisten(channel)
+	dispatcher := qp.NewDispatcher(d.handlers[channel], d.channels[channel])
+	s, err := d.client.subscribe(channel, d.options.queue(), func(msg *qp.Message) {
+		if d.log.Info() {
+			d.log.Info("handling message on", channel+":", string(msg.Data))
+		}
+		// blocks while the channel is at capacity
+		if err := dispatcher.Dispatch(msg); err != nil && d.log.Warn() {
+			d.log.Warn("dropped message on", channel, "while stopping")
+		}
+	})
+	if err != nil {
+		if d.log.Warn() {
+			d.log.Warn("failed to subscribe to", channel+":", err)
+		}
+		dispatcher.Close()
+		return
+	}
+	d.listeners[channel] = &listener{sub: s, dispatcher: dispatcher}
+}
+
+// unlisten unsubscribes from the channel.
+// Callers must hold the lock.
+func (d *Direct) unlisten(channel string) {
+	if l, ok := d.listeners[channel]; ok {
+		if err := d.client.unsubscribe(l.sub); err != nil && d.log.Warn() {
+			d.log.Warn("failed to unsubscribe from", channel+":", err)
+		}
+		l.dispatcher.Close()
+		delete(d.listeners, channel)
+	}
+}
+
+// flush waits for the server to have the subscriptions.
+func (d *Direct) flush() {
+	if err := d.client.flush(); err != nil && d.log.Warn() {
+		d.log.Warn("failed to flush subscriptions:", err)
+	}
+}
+
+// Start connects to the server and subscribes to the channels.
+// A stopped transport may be started again.
+func (d *Direct) Start() error {
+	if err := d.BeginStart(); err != nil {
+		return err
+	}
+	if d.log.Info() {
+		d.log.Info("starting")
+	}
+	if err := d.client.start(); err != nil {
+		return d.EndStart(err)
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for channel := range d.handlers {
+		d.listen(channel)
+	}
+	d.flush()
+	return d.EndStart(nil)
+}
+
+// Stop instructs the transport to gracefully stop and close the
+// StopChan when stopping has completed.
+//
+// Like draining a NATS connection, Stop unsubscribes from every
+// channel, then hands on the messages that had already arrived.
+// Those and the in-flight requests have the grace period to
+// complete before being abandoned. Sends are still allowed until
+// then, so that handlers can pass their results on. It is safe to
+// call Stop more than once.
+func (d *Direct) Stop(grace time.Duration) {
+	if !d.BeginStop() {
+		return
+	}
+	if d.log.Info() {
+		d.log.Info("stopping...")
+	}
+	d.lock.Lock()
+	subs := make([]*nats.Subscription, 0, len(d.listeners))
+	dispatchers := make([]*qp.Dispatcher, 0, len(d.listeners))
+	for channel, l := range d.listeners {
+		subs = append(subs, l.sub)
+		dispatchers = append(dispatchers, l.dispatcher)
+		delete(d.listeners, channel)
+	}
+	d.lock.Unlock()
+	abandoned := drain(d.client, grace, subs, dispatchers, d.log)
+	d.client.stop()
+	if abandoned > 0 && d.log.Warn() {
+		d.log.Warn("abandoned", abandoned, "in-flight requests")
+	}
+	// inform caller of stop complete
+	d.EndStop(abandoned)
+	if d.log.Info() {
+		d.log.Info("stopped")
+	}
+}
+
+// drain unsubscribes, and waits for the messages that had already
+// arrived to be handled, giving up once the grace period has
+// passed. It closes the dispatchers, and returns the number of
+// messages that were abandoned. Anything still waiting is dropped
+// by the closed dispatchers.
+func drain(c *client, grace time.Duration, subs []*nats.Subscription, dispatchers []*qp.Dispatcher, log slog.Logger) int {
+	deadline := time.Now().Add(grace)
+	if err := c.drain(subs, grace); err != nil && log.Warn() {
+		log.Warn("failed to drain subscriptions:", err)
+	}
+	abandoned := qp.Drain(deadline.Sub(time.Now()), dispatchers...)
+	for _, dispatcher := range dispatchers {
+		dispatcher.Close()
+	}
+	return abandoned
+}
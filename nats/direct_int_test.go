@@ -0,0 +1,94 @@
+package nats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/qp/go/transporttest"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectConformance(t *testing.T) {
+	s := startServer(t, "127.0.0.1:0")
+	defer s.close()
+	transporttest.Direct(t, func() qp.DirectTransport {
+		return NewDirect(s.url())
+	})
+}
+
+func TestDirectMaxPayload(t *testing.T) {
+
+	s := startServer(t, "127.0.0.1:0")
+	defer s.close()
+	s.lock.Lock()
+	s.maxPayload = 10
+	s.lock.Unlock()
+	d := NewDirect(s.url())
+	require.NoError(t, d.Start())
+	defer d.Stop(stop.NoWait)
+	require.Equal(t, ErrMaxPayload, d.Send("large", make([]byte, 11)))
+	require.NoError(t, d.Send("large", make([]byte, 10)))
+
+}
+
+func TestDirectStopHandlesArrived(t *testing.T) {
+
+	s := startServer(t, "127.0.0.1:0")
+	defer s.close()
+	d := NewDirect(s.url())
+	release := make(chan struct{})
+	msgs := make(chan *qp.Message, 10)
+	require.NoError(t, d.SetChannelOptions("drain", qp.ChannelOptions{Workers: 1}))
+	require.NoError(t, d.OnMessage("drain", qp.HandlerFunc(func(msg *qp.Message) {
+		<-release
+		msgs <- msg
+	})))
+	require.NoError(t, d.Start())
+	for _, data := range []string{"one", "two", "three"} {
+		require.NoError(t, d.Send("drain", []byte(data)))
+	}
+	require.NoError(t, d.client.flush())
+
+	// messages that arrived before Stop are still handled
+	go d.Stop(1 * time.Second)
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	<-d.StopChan()
+	require.Equal(t, 0, d.Abandoned())
+	require.Len(t, msgs, 3)
+
+}
+
+func TestDirectReconnect(t *testing.T) {
+
+	s := startServer(t, "127.0.0.1:0")
+	addr := s.listener.Addr().String()
+	d := NewDirect(s.url())
+	msgs := make(chan *qp.Message, 10)
+	require.NoError(t, d.OnMessage("reconnect", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	})))
+	require.NoError(t, d.Start())
+	defer d.Stop(stop.NoWait)
+
+	s.close()
+	s = startServer(t, addr)
+	defer s.close()
+
+	// the transport subscribes again once it reconnects
+	deadline := time.Now().Add(2 * time.Second)
+	for d.client.flush() != nil {
+		require.True(t, time.Now().Before(deadline), "did not reconnect")
+		time.Sleep(20 * time.Millisecond)
+	}
+	require.NoError(t, d.Send("reconnect", []byte("found")))
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "found", string(msg.Data))
+	case <-time.After(1 * time.Second):
+		require.FailNow(t, "no message received after reconnecting")
+	}
+
+}
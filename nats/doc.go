@@ -0,0 +1,13 @@
+// Package nats implements the qp transports on a NATS server.
+//
+// The transports are built on the nats.go client. Direct
+// channels are subjects that every Direct subscribes to in the same
+// queue group, which gives each message to one of them, as Service
+// needs. PubSub channels are subjects, and qp patterns are the same
+// as NATS wildcards.
+//
+// NATS does not keep messages, so those sent while nothing handles
+// the channel are lost. The client reconnects and subscribes again
+// whenever the connection is lost, and Stop drains the
+// subscriptions, handing on the messages that had already arrived.
+package nats
@@ -0,0 +1,46 @@
+package nats
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/qp/go/transporttest"
+)
+
+// ensureServer gets the URL of a real NATS server to check the
+// transports against, from QP_NATS_URL or the default port on this
+// machine, and skips the test if none is running there.
+func ensureServer(t *testing.T) string {
+	addr := os.Getenv("QP_NATS_URL")
+	if addr == "" {
+		addr = "nats://127.0.0.1:4222"
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		t.Fatal("bad QP_NATS_URL:", err)
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, time.Second)
+	if err != nil {
+		t.Skip("skipping because no NATS server is running at", addr)
+	}
+	conn.Close()
+	return addr
+}
+
+func TestInteropDirect(t *testing.T) {
+	addr := ensureServer(t)
+	transporttest.Direct(t, func() qp.DirectTransport {
+		return NewDirect(addr)
+	})
+}
+
+func TestInteropPubSub(t *testing.T) {
+	addr := ensureServer(t)
+	transporttest.PubSub(t, func() qp.PubSubTransport {
+		return NewPubSub(addr)
+	})
+}
@@ -0,0 +1,36 @@
+package nats
+
+// Options controls how a transport uses the server.
+type Options struct {
+	// Queue is the queue group Direct transports join on each
+	// channel, so that each message goes to one of them. Empty
+	// means DefaultQueue.
+	Queue string
+	// PendingLimit is the number of messages that may wait to be
+	// handed to the handlers of a channel before more are dropped.
+	// Zero means DefaultPendingLimit.
+	PendingLimit int
+}
+
+// DefaultQueue is the Queue used when Options does not set one.
+const DefaultQueue = "qp"
+
+// DefaultPendingLimit is the PendingLimit used when Options does
+// not set one.
+const DefaultPendingLimit = 65536
+
+// queue gets the queue group to join.
+func (o Options) queue() string {
+	if o.Queue == "" {
+		return DefaultQueue
+	}
+	return o.Queue
+}
+
+// pendingLimit gets the number of messages that may wait.
+func (o Options) pendingLimit() int {
+	if o.PendingLimit == 0 {
+		return DefaultPendingLimit
+	}
+	return o.PendingLimit
+}
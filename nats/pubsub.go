@@ -0,0 +1,267 @@
+package nats
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+)
+
+// PubSub represents a qp.PubSubTransport. Channels are subjects,
+// and qp patterns are NATS wildcards: "*" matches one token and
+// ">" matches the rest.
+type PubSub struct {
+	qp.Lifecycle
+	client        *client
+	subscriptions map[string][]*subscription
+	channels      map[string]qp.ChannelOptions
+	listeners     map[string]*nats.Subscription
+	lock          sync.Mutex
+	log           slog.Logger
+}
+
+// subscription is a single handler bound to a channel.
+type subscription struct {
+	handler    qp.Handler
+	dispatcher *qp.Dispatcher
+}
+
+// ensure the interface is satisfied
+var _ qp.PubSubTransport = (*PubSub)(nil)
+
+// NewPubSub makes a new PubSub NATS transport that connects to the
+// server at the URL, such as "nats://localhost:4222".
+func NewPubSub(url string) *PubSub {
+	return NewPubSubOptions(url, Options{})
+}
+
+// NewPubSubOptions makes a new PubSub NATS transport with the
+// specified options. The queue group is not used.
+func NewPubSubOptions(url string, options Options) *PubSub {
+	return &PubSub{
+		client:        newClient(url, options.pendingLimit()),
+		subscriptions: make(map[string][]*subscription),
+		channels:      make(map[string]qp.ChannelOptions),
+		listeners:     make(map[string]*nats.Subscription),
+		log:           slog.NilLogger,
+	}
+}
+
+// SetLogger sets the Logger to log to.
+func (p *PubSub) SetLogger(log slog.Logger) {
+	p.log = log
+	p.client.log = log
+}
+
+// Publish publishes data on the specified channel.
+func (p *PubSub) Publish(channel string, data []byte) error {
+	if !p.Running() {
+		return qp.ErrNotRunning
+	}
+	if p.log.Info() {
+		p.log.Info("publish to", channel, string(data))
+	}
+	err := p.client.publish(channel, data)
+	if err != nil && p.log.Err() {
+		p.log.Err("publish failed", err)
+	}
+	return err
+}
+
+// Subscribe binds the handler to the specified channel.
+// If the transport is running, it subscribes to the channel
+// straight away, and returns once the server has the subscription.
+// All handlers on a channel share a single NATS subscription.
+func (p *PubSub) Subscribe(channel string, handler qp.Handler) (qp.Subscription, error) {
+	if p.log.Info() {
+		p.log.Info("subscribing to", channel)
+	}
+	p.lock.Lock()
+	s := &subscription{
+		handler:    handler,
+		dispatcher: qp.NewDispatcher(handler, p.channels[channel]),
+	}
+	p.subscriptions[channel] = append(p.subscriptions[channel], s)
+	running := p.State() == qp.StateRunning
+	if running {
+		p.listen(channel)
+	}
+	p.lock.Unlock()
+	if running {
+		p.flush()
+	}
+	return qp.SubscriptionFunc(func() error {
+		p.remove(channel, s)
+		return nil
+	}), nil
+}
+
+// remove unbinds a single subscription from the channel,
+// unsubscribing if it was the last one.
+func (p *PubSub) remove(channel string, s *subscription) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	subscriptions := p.subscriptions[channel]
+	for i, existing := range subscriptions {
+		if existing == s {
+			s.dispatcher.Close()
+			subscriptions = append(subscriptions[:i:i], subscriptions[i+1:]...)
+			break
+		}
+	}
+	if len(subscriptions) == 0 {
+		delete(p.subscriptions, channel)
+		p.unlisten(channel)
+	} else {
+		p.subscriptions[channel] = subscriptions
+	}
+}
+
+// Unsubscribe unbinds all handlers from the specified channel.
+// If the transport is running, it unsubscribes from the channel.
+func (p *PubSub) Unsubscribe(channel string) error {
+	if p.log.Info() {
+		p.log.Info("unsubscribing from", channel)
+	}
+	p.lock.Lock()
+	for _, s := range p.subscriptions[channel] {
+		s.dispatcher.Close()
+	}
+	delete(p.subscriptions, channel)
+	p.unlisten(channel)
+	p.lock.Unlock()
+	return nil
+}
+
+// SetChannelOptions sets the options that control how messages
+// on the specified channel are dispatched to its handlers.
+func (p *PubSub) SetChannelOptions(channel string, options qp.ChannelOptions) error {
+	p.lock.Lock()
+	p.channels[channel] = options
+	for _, s := range p.subscriptions[channel] {
+		s.dispatcher.Close()
+		s.dispatcher = qp.NewDispatcher(s.handler, options)
+	}
+	p.lock.Unlock()
+	return nil
+}
+
+// dispatchers gets the dispatchers of every handler
+// bound to the channel.
+func (p *PubSub) dispatchers(channel string) []*qp.Dispatcher {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	dispatchers := make([]*qp.Dispatcher, 0, len(p.subscriptions[channel]))
+	for _, s := range p.subscriptions[channel] {
+		dispatchers = append(dispatchers, s.dispatcher)
+	}
+	return dispatchers
+}
+
+// listen subscribes to the channel, unless there is already a
+// subscription for it.
+// Callers must hold the lock.
+func (p *PubSub) listen(channel string) {
+	if _, ok := p.listeners[channel]; ok {
+		return
+	}
+	s, err := p.client.subscribe(channel, "", func(msg *qp.Message) {
+		if p.log.Info() {
+			p.log.Info("handling message from", msg.Source+":", string(msg.Data))
+		}
+		for _, dispatcher := range p.dispatchers(channel) {
+			dispatcher.Dispatch(msg)
+		}
+	})
+	if err != nil {
+		if p.log.Warn() {
+			p.log.Warn("failed to subscribe to", channel+":", err)
+		}
+		return
+	}
+	p.listeners[channel] = s
+}
+
+// unlisten unsubscribes from the channel.
+// Callers must hold the lock.
+func (p *PubSub) unlisten(channel string) {
+	if s, ok := p.listeners[channel]; ok {
+		if err := p.client.unsubscribe(s); err != nil && p.log.Warn() {
+			p.log.Warn("failed to unsubscribe from", channel+":", err)
+		}
+		delete(p.listeners, channel)
+	}
+}
+
+// flush waits for the server to have the subscriptions.
+func (p *PubSub) flush() {
+	if err := p.client.flush(); err != nil && p.log.Warn() {
+		p.log.Warn("failed to flush subscriptions:", err)
+	}
+}
+
+// Start connects to the server and subscribes to the channels.
+// A stopped transport may be started again.
+func (p *PubSub) Start() error {
+	if err := p.BeginStart(); err != nil {
+		return err
+	}
+	if p.log.Info() {
+		p.log.Info("starting")
+	}
+	if err := p.client.start(); err != nil {
+		return p.EndStart(err)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for channel, subscriptions := range p.subscriptions {
+		for _, s := range subscriptions {
+			s.dispatcher.Close()
+			s.dispatcher = qp.NewDispatcher(s.handler, p.channels[channel])
+		}
+		p.listen(channel)
+	}
+	p.flush()
+	return p.EndStart(nil)
+}
+
+// Stop stops the transport and closes StopChan() when finished.
+//
+// Like draining a NATS connection, Stop unsubscribes from every
+// channel, then hands on the messages that had already arrived.
+// Those and the messages already being handled have the grace
+// period to finish before they are abandoned. It is safe to call
+// Stop more than once.
+func (p *PubSub) Stop(grace time.Duration) {
+	if !p.BeginStop() {
+		return
+	}
+	if p.log.Info() {
+		p.log.Info("stopping...")
+	}
+	var subs []*nats.Subscription
+	var dispatchers []*qp.Dispatcher
+	p.lock.Lock()
+	for channel, s := range p.listeners {
+		subs = append(subs, s)
+		delete(p.listeners, channel)
+	}
+	for _, subscriptions := range p.subscriptions {
+		for _, s := range subscriptions {
+			dispatchers = append(dispatchers, s.dispatcher)
+		}
+	}
+	p.lock.Unlock()
+	abandoned := drain(p.client, grace, subs, dispatchers, p.log)
+	p.client.stop()
+	if abandoned > 0 && p.log.Warn() {
+		p.log.Warn("abandoned", abandoned, "in-flight handlers")
+	}
+	// inform caller of stop complete
+	p.EndStop(abandoned)
+	if p.log.Info() {
+		p.log.Info("stopped")
+	}
+}
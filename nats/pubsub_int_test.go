@@ -0,0 +1,16 @@
+package nats
+
+import (
+	"testing"
+
+	"github.com/qp/go"
+	"github.com/qp/go/transporttest"
+)
+
+func TestPubSubConformance(t *testing.T) {
+	s := startServer(t, "127.0.0.1:0")
+	defer s.close()
+	transporttest.PubSub(t, func() qp.PubSubTransport {
+		return NewPubSub(s.url())
+	})
+}
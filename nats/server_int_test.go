@@ -0,0 +1,199 @@
+package nats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/qp/go"
+	"github.com/stretchr/testify/require"
+)
+
+// testServer is an in-process stand-in for a NATS server, with
+// just enough of the protocol for the transports: subjects with
+// wildcards, queue groups, and pings.
+type testServer struct {
+	listener   net.Listener
+	maxPayload int
+
+	lock  sync.Mutex
+	conns map[*testConn]struct{}
+	next  map[string]int
+	wg    sync.WaitGroup
+}
+
+type testConn struct {
+	net.Conn
+	lock sync.Mutex
+	w    *bufio.Writer
+	subs map[string]*testSub
+}
+
+type testSub struct {
+	conn    *testConn
+	sid     string
+	subject string
+	queue   string
+}
+
+// startServer starts a server on the address, which may be
+// "127.0.0.1:0" for any free port.
+func startServer(t *testing.T, addr string) *testServer {
+	l, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	s := &testServer{
+		listener:   l,
+		maxPayload: 1 << 20,
+		conns:      make(map[*testConn]struct{}),
+		next:       make(map[string]int),
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s
+}
+
+// url gets the URL to connect to the server.
+func (s *testServer) url() string {
+	return "nats://" + s.listener.Addr().String()
+}
+
+// close stops the server and disconnects every client.
+func (s *testServer) close() {
+	s.listener.Close()
+	s.lock.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.lock.Unlock()
+	s.wg.Wait()
+}
+
+func (s *testServer) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &testConn{Conn: conn, w: bufio.NewWriter(conn), subs: make(map[string]*testSub)}
+		s.lock.Lock()
+		s.conns[c] = struct{}{}
+		s.lock.Unlock()
+		s.wg.Add(1)
+		go s.serve(c)
+	}
+}
+
+func (s *testServer) serve(c *testConn) {
+	defer s.wg.Done()
+	defer func() {
+		c.Close()
+		s.lock.Lock()
+		delete(s.conns, c)
+		s.lock.Unlock()
+	}()
+	s.lock.Lock()
+	maxPayload := s.maxPayload
+	s.lock.Unlock()
+	c.send(fmt.Sprintf("INFO {\"server_id\":\"test\",\"max_payload\":%d}\r\n", maxPayload), nil)
+	r := bufio.NewReader(c)
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		switch strings.ToUpper(args[0]) {
+		case "CONNECT":
+		case "PING":
+			c.send("PONG\r\n", nil)
+		case "PONG":
+		case "SUB":
+			// SUB <subject> [queue group] <sid>
+			sub := &testSub{conn: c, subject: args[1], sid: args[len(args)-1]}
+			if len(args) == 4 {
+				sub.queue = args[2]
+			}
+			s.lock.Lock()
+			c.subs[sub.sid] = sub
+			s.lock.Unlock()
+		case "UNSUB":
+			s.lock.Lock()
+			delete(c.subs, args[1])
+			s.lock.Unlock()
+		case "PUB":
+			// PUB <subject> [reply-to] <size>
+			size, err := strconv.Atoi(args[len(args)-1])
+			if err != nil || size > maxPayload {
+				c.send("-ERR 'Maximum Payload Violation'\r\n", nil)
+				return
+			}
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			s.publish(args[1], data[:size])
+		default:
+			c.send("-ERR 'Unknown Protocol Operation'\r\n", nil)
+			return
+		}
+	}
+}
+
+// publish sends the message to every matching subscription without
+// a queue group, and to one member of each matching queue group.
+func (s *testServer) publish(subject string, data []byte) {
+	s.lock.Lock()
+	var targets []*testSub
+	groups := make(map[string][]*testSub)
+	for c := range s.conns {
+		for _, sub := range c.subs {
+			if !qp.MatchChannel(sub.subject, subject) {
+				continue
+			}
+			if sub.queue == "" {
+				targets = append(targets, sub)
+			} else {
+				key := sub.subject + " " + sub.queue
+				groups[key] = append(groups[key], sub)
+			}
+		}
+	}
+	for key, members := range groups {
+		targets = append(targets, members[s.next[key]%len(members)])
+		s.next[key]++
+	}
+	s.lock.Unlock()
+	for _, sub := range targets {
+		sub.conn.send(fmt.Sprintf("MSG %s %s %d\r\n", subject, sub.sid, len(data)), data)
+	}
+}
+
+// send writes the line, and the data if there is any.
+func (c *testConn) send(line string, data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.w.WriteString(line)
+	if data != nil {
+		c.w.Write(data)
+		c.w.WriteString("\r\n")
+	}
+	c.w.Flush()
+}
+
+// readLine reads a line, without its "\r\n".
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
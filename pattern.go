@@ -0,0 +1,53 @@
+package qp
+
+import "strings"
+
+// IsPattern gets whether the channel contains wildcards.
+func IsPattern(channel string) bool {
+	tokens := strings.Split(channel, ".")
+	for i, token := range tokens {
+		if token == "*" || (token == ">" && i == len(tokens)-1) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchChannel gets whether the channel matches the pattern.
+// A pattern without wildcards only matches itself.
+func MatchChannel(pattern, channel string) bool {
+	if pattern == channel {
+		return true
+	}
+	// the channel's tokens are taken one at a time, rather than
+	// split, since transports match every message they carry
+	exhausted := false
+	for {
+		p, patternRest, morePattern := cutToken(pattern)
+		if p == ">" && !morePattern {
+			return !exhausted
+		}
+		if exhausted {
+			return false
+		}
+		token, rest, more := cutToken(channel)
+		if p != "*" && p != token {
+			return false
+		}
+		if !morePattern {
+			return !more
+		}
+		exhausted = !more
+		pattern, channel = patternRest, rest
+	}
+}
+
+// cutToken gets the first token of the channel, the rest after
+// the dot that ends it, and whether there was such a dot.
+func cutToken(channel string) (string, string, bool) {
+	i := strings.IndexByte(channel, '.')
+	if i < 0 {
+		return channel, "", false
+	}
+	return channel[:i], channel[i+1:], true
+}
@@ -0,0 +1,56 @@
+package qp_test
+
+import (
+	"testing"
+
+	"github.com/qp/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsPattern(t *testing.T) {
+
+	assert.True(t, qp.IsPattern("orders.*.created"))
+	assert.True(t, qp.IsPattern("orders.>"))
+	assert.True(t, qp.IsPattern("*"))
+	assert.False(t, qp.IsPattern("orders.eu.created"))
+	assert.False(t, qp.IsPattern("orders.eu*"))
+	assert.False(t, qp.IsPattern("orders.>.created"))
+	assert.False(t, qp.IsPattern("orders?"))
+
+}
+
+func TestMatchChannel(t *testing.T) {
+
+	for _, test := range []struct {
+		pattern string
+		channel string
+		match   bool
+	}{
+		{"orders.eu.created", "orders.eu.created", true},
+		{"orders.eu.created", "orders.us.created", false},
+		{"orders.*.created", "orders.eu.created", true},
+		{"orders.*.created", "orders.eu.west.created", false},
+		{"orders.*.created", "orders.created", false},
+		{"orders.*", "orders.eu", true},
+		{"orders.*", "orders.eu.created", false},
+		{"orders.>", "orders.eu", true},
+		{"orders.>", "orders.eu.created", true},
+		{"orders.>", "orders", false},
+		{"*.>", "orders.eu", true},
+		{"*", "orders", true},
+		{"*", "orders.eu", false},
+		{">", "orders.eu", true},
+		{"orders.eu*", "orders.eu1", false},
+		{"orders.eu*", "orders.eu*", true},
+		{"orders?", "orders1", false},
+		{"orders.*", "orders", false},
+		{"orders.*.>", "orders.eu", false},
+		{"orders.*.>", "orders.eu.created", true},
+		{"orders.>.created", "orders.eu.created", false},
+		{"orders..created", "orders..created", true},
+		{"orders.*.created", "orders..created", true},
+	} {
+		assert.Equal(t, test.match, qp.MatchChannel(test.pattern, test.channel), "%s %s", test.pattern, test.channel)
+	}
+
+}
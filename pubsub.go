@@ -11,6 +11,8 @@ type Event struct {
 	From string `json:"from"`
 	// Data is the payload of the event.
 	Data interface{} `json:"data"`
+	// Hops are the relays the event went through, in order.
+	Hops []Hop `json:"hops,omitempty"`
 }
 
 // Publisher represents types capable of publishing events.
@@ -72,9 +74,10 @@ func (f EventHandlerFunc) Handle(r *Event) {
 // events.
 type Subscriber interface {
 	// Subscribe binds the handler to the specified channel.
-	Subscribe(channel string, handler EventHandler) error
+	// The returned Subscription unbinds the handler.
+	Subscribe(channel string, handler EventHandler) (Subscription, error)
 	// SubscribeFunc binds the EventHandlerFunc to the specified channel.
-	SubscribeFunc(channel string, fn EventHandlerFunc) error
+	SubscribeFunc(channel string, fn EventHandlerFunc) (Subscription, error)
 }
 
 // subscriber allows events to be subscribed to.
@@ -96,7 +99,7 @@ func NewSubscriberLogger(codec Codec, transport PubSubTransport, logger slog.Log
 	return &subscriber{codec: codec, transport: transport, log: logger}
 }
 
-func (s *subscriber) Subscribe(channel string, handler EventHandler) error {
+func (s *subscriber) Subscribe(channel string, handler EventHandler) (Subscription, error) {
 	return s.transport.Subscribe(channel, HandlerFunc(func(msg *Message) {
 
 		var event Event
@@ -112,6 +115,6 @@ func (s *subscriber) Subscribe(channel string, handler EventHandler) error {
 	}))
 }
 
-func (s *subscriber) SubscribeFunc(channel string, fn EventHandlerFunc) error {
+func (s *subscriber) SubscribeFunc(channel string, fn EventHandlerFunc) (Subscription, error) {
 	return s.Subscribe(channel, fn)
 }
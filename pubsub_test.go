@@ -30,9 +30,11 @@ func TestSubscriber(t *testing.T) {
 
 	s := qp.NewSubscriber(qp.JSON, tp)
 	var events []*qp.Event
-	s.SubscribeFunc("channel", func(e *qp.Event) {
+	sub, err := s.SubscribeFunc("channel", func(e *qp.Event) {
 		events = append(events, e)
 	})
+	require.NoError(t, err)
+	require.NotNil(t, sub)
 
 	event := &qp.Event{From: "place.id", Data: map[string]interface{}{"key": "value"}}
 	message := &qp.Message{Source: "somewhere", Data: json(event)}
@@ -43,4 +45,7 @@ func TestSubscriber(t *testing.T) {
 	require.Equal(t, "place.id", events[0].From)
 	require.Equal(t, "value", events[0].Data.(map[string]interface{})["key"])
 
+	require.NoError(t, sub.Unsubscribe())
+	require.Nil(t, tp.Subscribed["channel"])
+
 }
@@ -0,0 +1,217 @@
+package qpd
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+)
+
+// ErrDisconnected is returned when the client is not connected to
+// the server, or loses its connection while waiting for a reply.
+var ErrDisconnected = errors.New("not connected to the qpd server")
+
+// DialTimeout is how long clients wait when connecting to the
+// server.
+var DialTimeout = 1 * time.Second
+
+// client is a connection to the server that transports share the
+// work of talking to it through. It reconnects whenever the
+// connection is lost.
+type client struct {
+	network string
+	addr    string
+	log     slog.Logger
+	// receive handles the frames the server sends that are not
+	// replies. It is called by the reading goroutine, so must not
+	// block.
+	receive func(op byte, fields [][]byte)
+	// connected is called in its own goroutine each time the
+	// client reconnects, to remake whatever the server forgot.
+	connected func()
+
+	lock     sync.Mutex
+	conn     net.Conn
+	w        *bufio.Writer
+	waiting  []chan error
+	shutdown chan qp.Signal
+	done     chan qp.Signal
+}
+
+func newClient(network, addr string) *client {
+	return &client{
+		network: network,
+		addr:    addr,
+		log:     slog.NilLogger,
+	}
+}
+
+// start connects to the server, and keeps reading from it until
+// stop is called.
+func (c *client) start() error {
+	conn, err := net.DialTimeout(c.network, c.addr, DialTimeout)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	c.conn = conn
+	c.w = bufio.NewWriter(conn)
+	c.shutdown = make(chan qp.Signal)
+	c.done = make(chan qp.Signal)
+	c.lock.Unlock()
+	go c.run(conn)
+	return nil
+}
+
+// stop disconnects from the server.
+func (c *client) stop() {
+	c.lock.Lock()
+	close(c.shutdown)
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.lock.Unlock()
+	<-c.done
+}
+
+// run reads from the connection, reconnecting whenever it fails.
+func (c *client) run(conn net.Conn) {
+	defer close(c.done)
+	for {
+		err := c.read(conn)
+		c.disconnect()
+		select {
+		case <-c.shutdown:
+			return
+		default:
+		}
+		if c.log.Warn() {
+			c.log.Warn("lost connection to", c.addr+":", err)
+		}
+		if conn = c.reconnect(); conn == nil {
+			return
+		}
+		if c.log.Warn() {
+			c.log.Warn("reconnected to", c.addr)
+		}
+		go c.connected()
+	}
+}
+
+// reconnect keeps trying to connect to the server, with a growing
+// delay between attempts. It returns nil if the client stops first.
+func (c *client) reconnect() net.Conn {
+	delay := 50 * time.Millisecond
+	for {
+		select {
+		case <-c.shutdown:
+			return nil
+		case <-time.After(delay):
+		}
+		conn, err := net.DialTimeout(c.network, c.addr, DialTimeout)
+		if err != nil {
+			if delay < 5*time.Second {
+				delay *= 2
+			}
+			continue
+		}
+		c.lock.Lock()
+		select {
+		case <-c.shutdown:
+			c.lock.Unlock()
+			conn.Close()
+			return nil
+		default:
+		}
+		c.conn = conn
+		c.w = bufio.NewWriter(conn)
+		c.lock.Unlock()
+		return conn
+	}
+}
+
+// disconnect closes the connection and fails the operations waiting
+// for a reply on it.
+func (c *client) disconnect() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.conn = nil
+	for _, reply := range c.waiting {
+		reply <- ErrDisconnected
+	}
+	c.waiting = nil
+}
+
+// read handles the frames the server sends until the connection
+// fails.
+func (c *client) read(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	for {
+		op, fields, err := readFrame(r)
+		if err != nil {
+			return err
+		}
+		switch op {
+		case opOK, opError:
+			var reply error
+			if op == opError && len(fields) == 1 {
+				reply = errors.New(string(fields[0]))
+			} else if op == opError {
+				reply = errFrameFormat
+			}
+			c.lock.Lock()
+			if len(c.waiting) > 0 {
+				c.waiting[0] <- reply
+				c.waiting = c.waiting[1:]
+			}
+			c.lock.Unlock()
+		default:
+			c.receive(op, fields)
+		}
+	}
+}
+
+// do sends the operation and waits for the server to reply.
+func (c *client) do(op byte, fields ...[]byte) error {
+	reply := make(chan error, 1)
+	c.lock.Lock()
+	if err := c.write(op, fields...); err != nil {
+		c.lock.Unlock()
+		return err
+	}
+	c.waiting = append(c.waiting, reply)
+	c.lock.Unlock()
+	return <-reply
+}
+
+// send sends the operation without waiting.
+func (c *client) send(op byte, fields ...[]byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.write(op, fields...)
+}
+
+// write writes the frame to the connection.
+// Callers must hold the lock.
+func (c *client) write(op byte, fields ...[]byte) error {
+	if c.conn == nil {
+		return ErrDisconnected
+	}
+	_, err := c.w.Write(encodeFrame(op, fields...))
+	if err == nil {
+		err = c.w.Flush()
+	}
+	if err != nil {
+		// the frame may be half written, so the reading goroutine
+		// must start again on a new connection
+		c.conn.Close()
+	}
+	return err
+}
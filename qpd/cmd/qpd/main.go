@@ -0,0 +1,46 @@
+// Command qpd runs a qpd broker.
+//
+//	qpd -addr :7411 -dir /var/lib/qpd
+//
+// It stops when interrupted.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/qp/go/qpd"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/slog"
+)
+
+func main() {
+
+	network := flag.String("network", "tcp", "network to listen on: tcp or unix")
+	addr := flag.String("addr", ":7411", "address to listen on")
+	dir := flag.String("dir", "", "directory to store queues in (memory only when empty)")
+	sync := flag.Bool("sync", false, "write each message to disk before acknowledging it")
+	verbose := flag.Bool("v", false, "log everything")
+	flag.Parse()
+
+	s := qpd.NewServerOptions(*network, *addr, qpd.Options{Dir: *dir, Sync: *sync})
+	if *verbose {
+		s.SetLogger(slog.New("qpd", slog.Everything))
+	}
+	if err := s.Start(); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("qpd listening on", *network, s.Addr())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	s.Stop(stop.NoWait)
+	<-s.StopChan()
+	log.Println("qpd stopped")
+
+}
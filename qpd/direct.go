@@ -0,0 +1,300 @@
+package qpd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+)
+
+// Direct represents a qp.DirectTransport.
+type Direct struct {
+	qp.Lifecycle
+	client    *client
+	handlers  map[string]qp.Handler
+	options   map[string]qp.ChannelOptions
+	listeners map[string]*listener
+	lock      sync.Mutex
+	listening sync.WaitGroup
+	log       slog.Logger
+}
+
+// listener takes messages from a single queue, one at a time.
+type listener struct {
+	messages   chan []byte
+	quit       chan qp.Signal
+	dispatcher *qp.Dispatcher
+}
+
+// ensure the interface is satisfied
+var _ qp.DirectTransport = (*Direct)(nil)
+
+// NewDirect makes a new Direct qpd transport. The network is "tcp"
+// or "unix".
+func NewDirect(network, addr string) *Direct {
+	d := &Direct{
+		client:    newClient(network, addr),
+		handlers:  make(map[string]qp.Handler),
+		options:   make(map[string]qp.ChannelOptions),
+		listeners: make(map[string]*listener),
+		log:       slog.NilLogger,
+	}
+	d.client.receive = d.receive
+	d.client.connected = d.connected
+	return d
+}
+
+// SetLogger sets the Logger to log to.
+func (d *Direct) SetLogger(log slog.Logger) {
+	d.log = log
+	d.client.log = log
+}
+
+// Send sends data on the channel. It returns once the server has
+// stored the message.
+func (d *Direct) Send(channel string, data []byte) error {
+	if !d.Running() {
+		return qp.ErrNotRunning
+	}
+	if d.log.Info() {
+		d.log.Info("sending to", channel, string(data))
+	}
+	err := d.client.do(opSend, []byte(channel), data)
+	if err != nil && d.log.Err() {
+		d.log.Err("send failed", err)
+	}
+	return err
+}
+
+// OnMessage binds the handler to the specified channel.
+// If the transport is running, it starts taking messages from the
+// channel straight away.
+func (d *Direct) OnMessage(channel string, handler qp.Handler) error {
+	if d.log.Info() {
+		d.log.Info("listening to", channel)
+	}
+	d.lock.Lock()
+	d.handlers[channel] = handler
+	if d.State() == qp.StateRunning {
+		d.listen(channel)
+	}
+	d.lock.Unlock()
+	return nil
+}
+
+// RemoveHandler unbinds the handler from the specified channel.
+// If the transport is running, it stops taking messages from the
+// channel. Handlers that are already running are left to finish,
+// and a message the server sent after the handler was removed is
+// put back on the queue.
+func (d *Direct) RemoveHandler(channel string) error {
+	if d.log.Info() {
+		d.log.Info("no longer listening to", channel)
+	}
+	d.lock.Lock()
+	delete(d.handlers, channel)
+	_, listening := d.listeners[channel]
+	d.unlisten(channel)
+	d.lock.Unlock()
+	if listening {
+		d.cancel(channel)
+	}
+	return nil
+}
+
+// SetChannelOptions sets the options that control how messages
+// on the specified channel are dispatched to its handler.
+// When the channel is at capacity, no more messages are taken
+// from the server until a handler returns.
+func (d *Direct) SetChannelOptions(channel string, options qp.ChannelOptions) error {
+	d.lock.Lock()
+	d.options[channel] = options
+	if _, ok := d.handlers[channel]; ok && d.State() == qp.StateRunning {
+		d.listen(channel)
+	}
+	d.lock.Unlock()
+	return nil
+}
+
+// listen starts taking messages from the channel, replacing any
+// existing listener.
+// Callers must hold the lock.
+func (d *Direct) listen(channel string) {
+	d.unlisten(channel)
+	l := &listener{
+		messages:   make(chan []byte, 1),
+		quit:       make(chan qp.Signal),
+		dispatcher: qp.NewDispatcher(d.handlers[channel], d.options[channel]),
+	}
+	d.listeners[channel] = l
+	d.listening.Add(1)
+	go d.take(channel, l)
+}
+
+// take asks the server for messages from the channel one at a time,
+// and dispatches them to the handler.
+func (d *Direct) take(channel string, l *listener) {
+	defer d.listening.Done()
+	for {
+		// asking under the lock means a cancel always follows the
+		// last take, and while disconnected, connected asks again
+		// once the client reconnects
+		d.lock.Lock()
+		select {
+		case <-l.quit:
+			d.lock.Unlock()
+			return
+		default:
+		}
+		d.client.send(opTake, []byte(channel))
+		d.lock.Unlock()
+		select {
+		case <-l.quit:
+			return
+		case data := <-l.messages:
+			if d.log.Info() {
+				d.log.Info("handling message on", channel+":", string(data))
+			}
+			// blocks while the channel is at capacity
+			if err := l.dispatcher.Dispatch(&qp.Message{Source: channel, Data: data}); err != nil {
+				d.giveBack(channel, data)
+			}
+		}
+	}
+}
+
+// unlisten stops taking messages from the channel.
+// Callers must hold the lock.
+func (d *Direct) unlisten(channel string) {
+	if l, ok := d.listeners[channel]; ok {
+		close(l.quit)
+		// anything taken from now on goes back on the queue
+		l.dispatcher.Close()
+		select {
+		case data := <-l.messages:
+			d.giveBack(channel, data)
+		default:
+		}
+		delete(d.listeners, channel)
+	}
+}
+
+// cancel tells the server to stop sending messages from the
+// channel. Once it returns, any message already sent has arrived
+// and been put back.
+func (d *Direct) cancel(channel string) {
+	if err := d.client.do(opCancel, []byte(channel)); err != nil && d.log.Warn() {
+		d.log.Warn("failed to stop taking from", channel+":", err)
+	}
+}
+
+// giveBack puts a message that was not handled back at the front
+// of its queue.
+func (d *Direct) giveBack(channel string, data []byte) {
+	if d.log.Info() {
+		d.log.Info("returning message to", channel)
+	}
+	if err := d.client.send(opReturn, []byte(channel), data); err != nil && d.log.Err() {
+		d.log.Err("lost message on", channel+":", err)
+	}
+}
+
+// receive handles a message the server sent.
+func (d *Direct) receive(op byte, fields [][]byte) {
+	if op != opMessage || len(fields) != 2 {
+		return
+	}
+	channel := string(fields[0])
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if l, ok := d.listeners[channel]; ok {
+		select {
+		case l.messages <- fields[1]:
+			return
+		default:
+		}
+	}
+	d.giveBack(channel, fields[1])
+}
+
+// connected asks for messages again after reconnecting.
+func (d *Direct) connected() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for channel := range d.listeners {
+		d.client.send(opTake, []byte(channel))
+	}
+}
+
+// Start connects to the server and starts taking messages.
+// A stopped transport may be started again.
+func (d *Direct) Start() error {
+	if err := d.BeginStart(); err != nil {
+		return err
+	}
+	if d.log.Info() {
+		d.log.Info("starting")
+	}
+	if err := d.client.start(); err != nil {
+		return d.EndStart(err)
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for channel := range d.handlers {
+		d.listen(channel)
+	}
+	return d.EndStart(nil)
+}
+
+// Stop instructs the transport to gracefully stop and close the
+// StopChan when stopping has completed.
+//
+// No new messages are taken from the server once Stop is called,
+// and in-flight requests have the grace period to complete before
+// being abandoned. Sends are still allowed until then, so that
+// handlers can pass their results on. It is safe to call Stop
+// more than once.
+func (d *Direct) Stop(grace time.Duration) {
+	if !d.BeginStop() {
+		return
+	}
+	if d.log.Info() {
+		d.log.Info("stopping...")
+	}
+	d.lock.Lock()
+	listeners := make(map[string]*listener, len(d.listeners))
+	dispatchers := make([]*qp.Dispatcher, 0, len(d.listeners))
+	for channel, l := range d.listeners {
+		listeners[channel] = l
+		dispatchers = append(dispatchers, l.dispatcher)
+		close(l.quit)
+		delete(d.listeners, channel)
+	}
+	d.lock.Unlock()
+	for channel := range listeners {
+		d.cancel(channel)
+	}
+	// wait for in-flight requests to finish
+	abandoned := qp.Drain(grace, dispatchers...)
+	for _, dispatcher := range dispatchers {
+		dispatcher.Close()
+	}
+	d.listening.Wait()
+	for channel, l := range listeners {
+		select {
+		case data := <-l.messages:
+			d.giveBack(channel, data)
+		default:
+		}
+	}
+	d.client.stop()
+	if abandoned > 0 && d.log.Warn() {
+		d.log.Warn("abandoned", abandoned, "in-flight requests")
+	}
+	// inform caller of stop complete
+	d.EndStop(abandoned)
+	if d.log.Info() {
+		d.log.Info("stopped")
+	}
+}
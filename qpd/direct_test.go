@@ -0,0 +1,124 @@
+package qpd_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/qp/go/qpd"
+	"github.com/qp/go/transporttest"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectConformance(t *testing.T) {
+	s := server(t, qpd.Options{})
+	defer s.Stop(stop.NoWait)
+	transporttest.Direct(t, func() qp.DirectTransport {
+		return qpd.NewDirect("tcp", s.Addr())
+	})
+}
+
+func TestDirectUnix(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "qpd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s := qpd.NewServer("unix", filepath.Join(dir, "qpd.sock"))
+	require.NoError(t, s.Start())
+	defer s.Stop(stop.NoWait)
+
+	d := qpd.NewDirect("unix", s.Addr())
+	msgs := make(chan *qp.Message, 10)
+	require.NoError(t, d.OnMessage("unix", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	})))
+	require.NoError(t, d.Start())
+	defer d.Stop(stop.NoWait)
+	require.NoError(t, d.Send("unix", []byte("hello")))
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "hello", string(msg.Data))
+	case <-time.After(1 * time.Second):
+		require.FailNow(t, "no message received")
+	}
+
+}
+
+func TestDirectPersistence(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "qpd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s := server(t, qpd.Options{Dir: dir, Sync: true})
+	addr := s.Addr()
+
+	sender := qpd.NewDirect("tcp", addr)
+	require.NoError(t, sender.Start())
+	for _, data := range []string{"one", "two", "three"} {
+		require.NoError(t, sender.Send("persisted", []byte(data)))
+	}
+	sender.Stop(stop.NoWait)
+
+	// the queue survives the server restarting
+	s.Stop(stop.NoWait)
+	<-s.StopChan()
+	s = qpd.NewServerOptions("tcp", addr, qpd.Options{Dir: dir})
+	require.NoError(t, s.Start())
+	defer s.Stop(stop.NoWait)
+
+	receiver := qpd.NewDirect("tcp", addr)
+	msgs := make(chan *qp.Message, 10)
+	require.NoError(t, receiver.OnMessage("persisted", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	})))
+	require.NoError(t, receiver.Start())
+	defer receiver.Stop(stop.NoWait)
+	for _, data := range []string{"one", "two", "three"} {
+		select {
+		case msg := <-msgs:
+			require.Equal(t, data, string(msg.Data))
+		case <-time.After(1 * time.Second):
+			require.FailNow(t, "no message received")
+		}
+	}
+
+}
+
+func TestDirectReconnect(t *testing.T) {
+
+	s := server(t, qpd.Options{})
+	addr := s.Addr()
+	d := qpd.NewDirect("tcp", addr)
+	msgs := make(chan *qp.Message, 10)
+	require.NoError(t, d.OnMessage("reconnect", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	})))
+	require.NoError(t, d.Start())
+	defer d.Stop(stop.NoWait)
+
+	s.Stop(stop.NoWait)
+	<-s.StopChan()
+	// sending fails until the client reconnects
+	require.Error(t, d.Send("reconnect", []byte("lost")))
+	s = qpd.NewServer("tcp", addr)
+	require.NoError(t, s.Start())
+	defer s.Stop(stop.NoWait)
+
+	// the client asks for messages again once it reconnects
+	deadline := time.Now().Add(2 * time.Second)
+	for d.Send("reconnect", []byte("found")) != nil {
+		require.True(t, time.Now().Before(deadline), "did not reconnect")
+		time.Sleep(20 * time.Millisecond)
+	}
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "found", string(msg.Data))
+	case <-time.After(1 * time.Second):
+		require.FailNow(t, "no message received after reconnecting")
+	}
+
+}
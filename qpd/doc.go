@@ -0,0 +1,23 @@
+// Package qpd provides a small standalone broker, and transports
+// that use it in the way the redis transports use Redis.
+//
+// The broker holds queues, for Send and OnMessage, and topics, for
+// Publish and Subscribe. It listens on TCP or a Unix socket, and
+// can store its queues on disk so that they survive a restart:
+//
+//	s := qpd.NewServerOptions("unix", "/tmp/qpd.sock", qpd.Options{Dir: "/var/lib/qpd"})
+//	s.Start()
+//	defer s.Stop(stop.NoWait)
+//
+//	d := qpd.NewDirect("unix", "/tmp/qpd.sock")
+//
+// The qpd command in cmd/qpd runs a broker on its own.
+//
+// Clients and the broker exchange frames: a big endian uint32
+// length, an operation byte, and length-prefixed fields. Each
+// message on a queue goes to exactly one client, which takes one
+// message at a time for each channel it handles. Published messages
+// go to every matching subscription, and are dropped for clients
+// that fall too far behind. Clients reconnect when the connection
+// is lost; messages being written at the time may be lost.
+package qpd
@@ -0,0 +1,15 @@
+package qpd_test
+
+import (
+	"testing"
+
+	"github.com/qp/go/qpd"
+	"github.com/stretchr/testify/require"
+)
+
+// server starts a server on a free local port.
+func server(t *testing.T, options qpd.Options) *qpd.Server {
+	s := qpd.NewServerOptions("tcp", "127.0.0.1:0", options)
+	require.NoError(t, s.Start())
+	return s
+}
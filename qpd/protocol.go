@@ -0,0 +1,124 @@
+package qpd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// operations sent by clients
+const (
+	// opSend adds a message to the back of a queue. The server
+	// replies once the message is stored.
+	opSend byte = iota + 1
+	// opReturn puts back a message that a client was given but did
+	// not handle, at the front of its queue.
+	opReturn
+	// opTake asks for the next message from a queue. The server
+	// sends it with opMessage when there is one. A connection has
+	// at most one take waiting on each queue.
+	opTake
+	// opCancel withdraws a take. The server replies once it has
+	// been withdrawn, so any message sent for it has already
+	// arrived.
+	opCancel
+	// opPublish sends a message to every subscription that matches
+	// its channel. The server replies once it has been sent.
+	opPublish
+	// opSubscribe and opUnsubscribe add and remove a pattern that
+	// the connection receives published messages on. The server
+	// replies once the change has been made.
+	opSubscribe
+	opUnsubscribe
+)
+
+// operations sent by the server
+const (
+	// opOK and opError reply to the operations that have replies,
+	// in the order they were sent.
+	opOK byte = iota + 64
+	opError
+	// opMessage carries a message taken from a queue.
+	opMessage
+	// opEvent carries a published message, and the pattern of the
+	// subscription it matched.
+	opEvent
+)
+
+// replies gets whether the server replies to the operation.
+func replies(op byte) bool {
+	switch op {
+	case opSend, opCancel, opPublish, opSubscribe, opUnsubscribe:
+		return true
+	}
+	return false
+}
+
+// MaxFrameSize is the largest frame the server and clients will
+// read. Larger frames close the connection.
+var MaxFrameSize = 64 << 20
+
+// errFrameSize is returned when reading a frame larger than
+// MaxFrameSize.
+var errFrameSize = errors.New("frame is too large")
+
+// errFrameFormat is returned when reading a frame whose fields
+// do not add up.
+var errFrameFormat = errors.New("malformed frame")
+
+// encodeFrame makes a frame of the operation with the fields.
+//
+// Frames start with their length as a big endian uint32, followed
+// by the operation byte and then each field, itself prefixed with
+// its length as a big endian uint32.
+func encodeFrame(op byte, fields ...[]byte) []byte {
+	size := 1
+	for _, f := range fields {
+		size += 4 + len(f)
+	}
+	b := make([]byte, 4+size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	b[4] = op
+	i := 5
+	for _, f := range fields {
+		binary.BigEndian.PutUint32(b[i:], uint32(len(f)))
+		i += 4
+		i += copy(b[i:], f)
+	}
+	return b
+}
+
+// readFrame reads the next frame, returning its operation and
+// fields.
+func readFrame(r *bufio.Reader) (byte, [][]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := int(binary.BigEndian.Uint32(header[:]))
+	if size < 1 {
+		return 0, nil, errFrameFormat
+	}
+	if size > MaxFrameSize {
+		return 0, nil, errFrameSize
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+	var fields [][]byte
+	for i := 1; i < len(b); {
+		if i+4 > len(b) {
+			return 0, nil, errFrameFormat
+		}
+		n := int(binary.BigEndian.Uint32(b[i:]))
+		i += 4
+		if n > len(b)-i {
+			return 0, nil, errFrameFormat
+		}
+		fields = append(fields, b[i:i+n])
+		i += n
+	}
+	return b[0], fields, nil
+}
@@ -0,0 +1,288 @@
+package qpd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+)
+
+// PubSub represents a qp.PubSubTransport.
+type PubSub struct {
+	qp.Lifecycle
+	client        *client
+	subscriptions map[string][]*subscription
+	options       map[string]qp.ChannelOptions
+	lock          sync.Mutex
+	events        chan *event
+	shutdown      chan qp.Signal
+	delivering    sync.WaitGroup
+	log           slog.Logger
+}
+
+// subscription is a single handler bound to a channel.
+type subscription struct {
+	handler    qp.Handler
+	dispatcher *qp.Dispatcher
+}
+
+// event is a published message, and the pattern of the
+// subscription it matched.
+type event struct {
+	pattern string
+	msg     *qp.Message
+}
+
+// ensure the interface is satisfied
+var _ qp.PubSubTransport = (*PubSub)(nil)
+
+// NewPubSub makes a new PubSub qpd transport. The network is "tcp"
+// or "unix".
+func NewPubSub(network, addr string) *PubSub {
+	p := &PubSub{
+		client:        newClient(network, addr),
+		subscriptions: make(map[string][]*subscription),
+		options:       make(map[string]qp.ChannelOptions),
+		log:           slog.NilLogger,
+	}
+	p.client.receive = p.receive
+	p.client.connected = p.connected
+	return p
+}
+
+// SetLogger sets the Logger to log to.
+func (p *PubSub) SetLogger(log slog.Logger) {
+	p.log = log
+	p.client.log = log
+}
+
+// Publish publishes data on the specified channel. It returns once
+// the server has passed the message on.
+func (p *PubSub) Publish(channel string, data []byte) error {
+	if !p.Running() {
+		return qp.ErrNotRunning
+	}
+	if p.log.Info() {
+		p.log.Info("publish to", channel, string(data))
+	}
+	err := p.client.do(opPublish, []byte(channel), data)
+	if err != nil && p.log.Err() {
+		p.log.Err("publish failed", err)
+	}
+	return err
+}
+
+// Subscribe binds the handler to the specified channel.
+// If the transport is running, it subscribes to the channel
+// straight away, and returns once the server has the subscription.
+// All handlers on a channel share a single server subscription.
+func (p *PubSub) Subscribe(channel string, handler qp.Handler) (qp.Subscription, error) {
+	if p.log.Info() {
+		p.log.Info("subscribing to", channel)
+	}
+	p.lock.Lock()
+	s := &subscription{
+		handler:    handler,
+		dispatcher: qp.NewDispatcher(handler, p.options[channel]),
+	}
+	p.subscriptions[channel] = append(p.subscriptions[channel], s)
+	if len(p.subscriptions[channel]) == 1 && p.State() == qp.StateRunning {
+		p.change(opSubscribe, channel)
+	}
+	p.lock.Unlock()
+	return qp.SubscriptionFunc(func() error {
+		p.remove(channel, s)
+		return nil
+	}), nil
+}
+
+// remove unbinds a single subscription from the channel,
+// unsubscribing from the server if it was the last one.
+func (p *PubSub) remove(channel string, s *subscription) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	subscriptions := p.subscriptions[channel]
+	for i, existing := range subscriptions {
+		if existing == s {
+			s.dispatcher.Close()
+			subscriptions = append(subscriptions[:i:i], subscriptions[i+1:]...)
+			break
+		}
+	}
+	if len(subscriptions) == 0 {
+		if _, ok := p.subscriptions[channel]; ok && p.State() == qp.StateRunning {
+			p.change(opUnsubscribe, channel)
+		}
+		delete(p.subscriptions, channel)
+	} else {
+		p.subscriptions[channel] = subscriptions
+	}
+}
+
+// Unsubscribe unbinds all handlers from the specified channel.
+// If the transport is running, it unsubscribes from the channel.
+func (p *PubSub) Unsubscribe(channel string) error {
+	if p.log.Info() {
+		p.log.Info("unsubscribing from", channel)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	subscriptions, ok := p.subscriptions[channel]
+	for _, s := range subscriptions {
+		s.dispatcher.Close()
+	}
+	delete(p.subscriptions, channel)
+	if ok && p.State() == qp.StateRunning {
+		p.change(opUnsubscribe, channel)
+	}
+	return nil
+}
+
+// change subscribes to or unsubscribes from the channel on the
+// server. Failures are logged, since the subscriptions are made
+// again whenever the client reconnects.
+// Callers must hold the lock.
+func (p *PubSub) change(op byte, channel string) {
+	if err := p.client.do(op, []byte(channel)); err != nil && p.log.Warn() {
+		p.log.Warn("failed to change subscription to", channel+":", err)
+	}
+}
+
+// SetChannelOptions sets the options that control how messages
+// on the specified channel are dispatched to its handlers.
+func (p *PubSub) SetChannelOptions(channel string, options qp.ChannelOptions) error {
+	p.lock.Lock()
+	p.options[channel] = options
+	for _, s := range p.subscriptions[channel] {
+		s.dispatcher.Close()
+		s.dispatcher = qp.NewDispatcher(s.handler, options)
+	}
+	p.lock.Unlock()
+	return nil
+}
+
+// dispatchers gets the dispatchers of every handler
+// bound to the channel.
+func (p *PubSub) dispatchers(channel string) []*qp.Dispatcher {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	dispatchers := make([]*qp.Dispatcher, 0, len(p.subscriptions[channel]))
+	for _, s := range p.subscriptions[channel] {
+		dispatchers = append(dispatchers, s.dispatcher)
+	}
+	return dispatchers
+}
+
+// receive queues a published message to be dispatched. Messages
+// are dropped if too many are already waiting.
+func (p *PubSub) receive(op byte, fields [][]byte) {
+	if op != opEvent || len(fields) != 3 {
+		return
+	}
+	e := &event{
+		pattern: string(fields[0]),
+		msg:     &qp.Message{Source: string(fields[1]), Data: fields[2]},
+	}
+	select {
+	case p.events <- e:
+	default:
+		if p.log.Warn() {
+			p.log.Warn("dropped message from", e.msg.Source, "- too many waiting")
+		}
+	}
+}
+
+// deliver dispatches published messages to the handlers until the
+// transport stops.
+func (p *PubSub) deliver(events chan *event, shutdown chan qp.Signal) {
+	defer p.delivering.Done()
+	for {
+		select {
+		case <-shutdown:
+			return
+		case e := <-events:
+			if p.log.Info() {
+				p.log.Info("handling message from", e.msg.Source+":", string(e.msg.Data))
+			}
+			for _, dispatcher := range p.dispatchers(e.pattern) {
+				dispatcher.Dispatch(e.msg)
+			}
+		}
+	}
+}
+
+// connected subscribes again after reconnecting.
+func (p *PubSub) connected() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for channel := range p.subscriptions {
+		p.change(opSubscribe, channel)
+	}
+}
+
+// Start connects to the server and subscribes to the channels.
+// A stopped transport may be started again.
+func (p *PubSub) Start() error {
+	if err := p.BeginStart(); err != nil {
+		return err
+	}
+	if p.log.Info() {
+		p.log.Info("starting")
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.events = make(chan *event, DefaultQueueSize)
+	p.shutdown = make(chan qp.Signal)
+	if err := p.client.start(); err != nil {
+		return p.EndStart(err)
+	}
+	p.delivering.Add(1)
+	go p.deliver(p.events, p.shutdown)
+	for channel, subscriptions := range p.subscriptions {
+		for _, s := range subscriptions {
+			s.dispatcher.Close()
+			s.dispatcher = qp.NewDispatcher(s.handler, p.options[channel])
+		}
+		p.change(opSubscribe, channel)
+	}
+	return p.EndStart(nil)
+}
+
+// Stop stops the transport and closes StopChan() when finished.
+//
+// No new messages are received once Stop is called, and messages
+// already being handled have the grace period to finish before
+// they are abandoned. It is safe to call Stop more than once.
+func (p *PubSub) Stop(grace time.Duration) {
+	if !p.BeginStop() {
+		return
+	}
+	if p.log.Info() {
+		p.log.Info("stopping...")
+	}
+	var dispatchers []*qp.Dispatcher
+	p.lock.Lock()
+	close(p.shutdown)
+	for _, subscriptions := range p.subscriptions {
+		for _, s := range subscriptions {
+			dispatchers = append(dispatchers, s.dispatcher)
+		}
+	}
+	p.lock.Unlock()
+	// wait for in-flight messages to finish
+	abandoned := qp.Drain(grace, dispatchers...)
+	for _, d := range dispatchers {
+		d.Close()
+	}
+	p.delivering.Wait()
+	p.client.stop()
+	if abandoned > 0 && p.log.Warn() {
+		p.log.Warn("abandoned", abandoned, "in-flight handlers")
+	}
+	// inform caller of stop complete
+	p.EndStop(abandoned)
+	if p.log.Info() {
+		p.log.Info("stopped")
+	}
+}
@@ -0,0 +1,18 @@
+package qpd_test
+
+import (
+	"testing"
+
+	"github.com/qp/go"
+	"github.com/qp/go/qpd"
+	"github.com/qp/go/transporttest"
+	"github.com/stretchr/pat/stop"
+)
+
+func TestPubSubConformance(t *testing.T) {
+	s := server(t, qpd.Options{})
+	defer s.Stop(stop.NoWait)
+	transporttest.PubSub(t, func() qp.PubSubTransport {
+		return qpd.NewPubSub("tcp", s.Addr())
+	})
+}
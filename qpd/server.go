@@ -0,0 +1,488 @@
+package qpd
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+)
+
+// Options controls how a Server stores messages and treats its
+// clients.
+type Options struct {
+	// Dir is the directory queues are stored in, so that they
+	// survive the server restarting. When empty, queues are only
+	// kept in memory.
+	Dir string
+	// Sync, when true, makes sure each message is on disk before
+	// Send returns. It only applies when Dir is set.
+	Sync bool
+	// QueueSize is the number of frames that may wait to be
+	// written to a client before published messages for it are
+	// dropped. Zero means DefaultQueueSize.
+	QueueSize int
+}
+
+// DefaultQueueSize is the QueueSize used when Options does not
+// set one.
+const DefaultQueueSize = 1024
+
+// errOperation is returned to clients that send an operation the
+// server does not know.
+var errOperation = errors.New("unknown operation")
+
+// Server is a qpd broker. It holds queues, which each message sent
+// with Send waits on until a client takes it, and topics, which
+// pass each published message to every matching subscription.
+type Server struct {
+	qp.Lifecycle
+	network string
+	addr    string
+	options Options
+	log     slog.Logger
+
+	lock     sync.Mutex
+	listener net.Listener
+	store    *store
+	queues   map[string]*queue
+	stored   int
+	conns    map[*conn]struct{}
+	wg       sync.WaitGroup
+}
+
+// queue holds the messages sent on a channel, and the connections
+// waiting to take them.
+type queue struct {
+	messages [][]byte
+	takers   []*conn
+}
+
+// NewServer makes a new Server that listens on the network address.
+// The network is "tcp" or "unix".
+func NewServer(network, addr string) *Server {
+	return NewServerOptions(network, addr, Options{})
+}
+
+// NewServerOptions makes a new Server that listens on the network
+// address, and stores messages as the options describe.
+func NewServerOptions(network, addr string, options Options) *Server {
+	if options.QueueSize == 0 {
+		options.QueueSize = DefaultQueueSize
+	}
+	return &Server{
+		network: network,
+		addr:    addr,
+		options: options,
+		log:     slog.NilLogger,
+	}
+}
+
+// SetLogger sets the Logger to log to.
+func (s *Server) SetLogger(log slog.Logger) {
+	s.log = log
+}
+
+// Addr gets the address the server is listening on. It is only
+// known once the server has started.
+func (s *Server) Addr() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
+
+// Start loads any stored queues and starts listening for clients.
+// A stopped server may be started again.
+func (s *Server) Start() error {
+	if err := s.BeginStart(); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.queues = make(map[string]*queue)
+	s.conns = make(map[*conn]struct{})
+	s.stored = 0
+	s.store = nil
+	if s.options.Dir != "" {
+		store, queues, err := openStore(s.options.Dir, s.options.Sync)
+		if err != nil {
+			return s.EndStart(err)
+		}
+		s.store = store
+		for name, messages := range queues {
+			s.queues[name] = &queue{messages: messages}
+			s.stored += len(messages)
+		}
+	}
+	listener, err := net.Listen(s.network, s.addr)
+	if err != nil {
+		if s.store != nil {
+			s.store.close()
+		}
+		return s.EndStart(err)
+	}
+	s.listener = listener
+	s.wg.Add(1)
+	go s.accept(listener)
+	if s.log.Info() {
+		s.log.Info("listening on", s.network, listener.Addr().String())
+	}
+	return s.EndStart(nil)
+}
+
+// Stop disconnects every client and closes StopChan() when
+// finished. Stored queues are kept for the next Start. The server
+// runs no handlers, so the grace period is not used. It is safe to
+// call Stop more than once.
+func (s *Server) Stop(grace time.Duration) {
+	if !s.BeginStop() {
+		return
+	}
+	if s.log.Info() {
+		s.log.Info("stopping...")
+	}
+	s.lock.Lock()
+	s.listener.Close()
+	for c := range s.conns {
+		c.close()
+	}
+	s.lock.Unlock()
+	s.wg.Wait()
+	s.lock.Lock()
+	if s.store != nil {
+		if err := s.store.close(); err != nil && s.log.Err() {
+			s.log.Err("failed to close store:", err)
+		}
+	}
+	s.lock.Unlock()
+	s.EndStop(0)
+	if s.log.Info() {
+		s.log.Info("stopped")
+	}
+}
+
+// accept takes connections from clients until the listener is
+// closed.
+func (s *Server) accept(listener net.Listener) {
+	defer s.wg.Done()
+	for {
+		nc, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		c := newConn(nc, s.options.QueueSize)
+		s.lock.Lock()
+		if state := s.State(); state == qp.StateStopping || state == qp.StateStopped {
+			s.lock.Unlock()
+			nc.Close()
+			return
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(2)
+		s.lock.Unlock()
+		go func() {
+			defer s.wg.Done()
+			c.write()
+		}()
+		go s.serve(c)
+	}
+}
+
+// serve handles the operations a client sends on the connection.
+func (s *Server) serve(c *conn) {
+	defer s.wg.Done()
+	defer s.disconnect(c)
+	r := bufio.NewReader(c.Conn)
+	for {
+		op, fields, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		err = s.handle(c, op, fields)
+		if err == errOperation || err == errFrameFormat {
+			if s.log.Warn() {
+				s.log.Warn("closing connection from", c.RemoteAddr(), "-", err)
+			}
+			return
+		}
+		if !replies(op) {
+			continue
+		}
+		if err != nil {
+			c.push(encodeFrame(opError, []byte(err.Error())), false)
+		} else {
+			c.push(encodeFrame(opOK), false)
+		}
+	}
+}
+
+// handle carries out a single operation.
+func (s *Server) handle(c *conn, op byte, fields [][]byte) error {
+	switch {
+	case op == opSend && len(fields) == 2:
+		return s.push(string(fields[0]), fields[1], false)
+	case op == opReturn && len(fields) == 2:
+		return s.push(string(fields[0]), fields[1], true)
+	case op == opTake && len(fields) == 1:
+		return s.take(c, string(fields[0]))
+	case op == opCancel && len(fields) == 1:
+		s.cancel(c, string(fields[0]))
+		return nil
+	case op == opPublish && len(fields) == 2:
+		s.publish(string(fields[0]), fields[1])
+		return nil
+	case op == opSubscribe && len(fields) == 1:
+		s.lock.Lock()
+		c.patterns[string(fields[0])] = struct{}{}
+		s.lock.Unlock()
+		return nil
+	case op == opUnsubscribe && len(fields) == 1:
+		s.lock.Lock()
+		delete(c.patterns, string(fields[0]))
+		s.lock.Unlock()
+		return nil
+	case op >= opSend && op <= opUnsubscribe:
+		return errFrameFormat
+	}
+	return errOperation
+}
+
+// push hands the message to the first connection waiting on the
+// queue, or stores it until one takes it.
+func (s *Server) push(name string, data []byte, front bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	q := s.queue(name)
+	for len(q.takers) > 0 {
+		c := q.takers[0]
+		q.takers = q.takers[1:]
+		if c.push(encodeFrame(opMessage, []byte(name), data), false) {
+			s.release(name)
+			return nil
+		}
+	}
+	if s.store != nil {
+		rec := recPush
+		if front {
+			rec = recPushFront
+		}
+		if err := s.store.append(rec, []byte(name), data); err != nil {
+			if s.log.Err() {
+				s.log.Err("failed to store message on", name+":", err)
+			}
+			s.release(name)
+			return err
+		}
+	}
+	if front {
+		q.messages = append([][]byte{data}, q.messages...)
+	} else {
+		q.messages = append(q.messages, data)
+	}
+	s.stored++
+	return nil
+}
+
+// take sends the connection the next message on the queue, or
+// waits for one if the queue is empty.
+func (s *Server) take(c *conn, name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	q := s.queue(name)
+	for _, taker := range q.takers {
+		if taker == c {
+			return nil
+		}
+	}
+	if len(q.messages) == 0 {
+		q.takers = append(q.takers, c)
+		return nil
+	}
+	if !c.push(encodeFrame(opMessage, []byte(name), q.messages[0]), false) {
+		return nil
+	}
+	q.messages = q.messages[1:]
+	s.stored--
+	s.release(name)
+	if s.store == nil {
+		return nil
+	}
+	if err := s.store.append(recPop, []byte(name)); err != nil {
+		if s.log.Err() {
+			s.log.Err("failed to store take from", name+":", err)
+		}
+		return err
+	}
+	if s.store.compacting(s.stored) {
+		queues := make(map[string][][]byte, len(s.queues))
+		for name, q := range s.queues {
+			if len(q.messages) > 0 {
+				queues[name] = q.messages
+			}
+		}
+		if err := s.store.compact(queues); err != nil && s.log.Err() {
+			s.log.Err("failed to compact store:", err)
+		}
+	}
+	return nil
+}
+
+// cancel stops the connection waiting on the queue.
+func (s *Server) cancel(c *conn, name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	q, ok := s.queues[name]
+	if !ok {
+		return
+	}
+	for i, taker := range q.takers {
+		if taker == c {
+			q.takers = append(q.takers[:i:i], q.takers[i+1:]...)
+			break
+		}
+	}
+	s.release(name)
+}
+
+// publish sends the message to every connection subscribed to a
+// pattern that matches the channel, once for each pattern.
+// Connections that are too far behind miss the message.
+func (s *Server) publish(channel string, data []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for c := range s.conns {
+		for pattern := range c.patterns {
+			if !qp.MatchChannel(pattern, channel) {
+				continue
+			}
+			if !c.push(encodeFrame(opEvent, []byte(pattern), []byte(channel), data), true) && s.log.Warn() {
+				s.log.Warn("dropped message on", channel, "for", c.RemoteAddr())
+			}
+		}
+	}
+}
+
+// queue gets the named queue, making it if it does not exist.
+// Callers must hold the lock.
+func (s *Server) queue(name string) *queue {
+	q, ok := s.queues[name]
+	if !ok {
+		q = &queue{}
+		s.queues[name] = q
+	}
+	return q
+}
+
+// release forgets the named queue if it is empty and nobody is
+// waiting on it.
+// Callers must hold the lock.
+func (s *Server) release(name string) {
+	if q, ok := s.queues[name]; ok && len(q.messages) == 0 && len(q.takers) == 0 {
+		delete(s.queues, name)
+	}
+}
+
+// disconnect closes the connection and forgets what it was
+// waiting for.
+func (s *Server) disconnect(c *conn) {
+	c.close()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.conns, c)
+	for name := range s.queues {
+		q := s.queues[name]
+		for i, taker := range q.takers {
+			if taker == c {
+				q.takers = append(q.takers[:i:i], q.takers[i+1:]...)
+				break
+			}
+		}
+		s.release(name)
+	}
+}
+
+// conn is a connection from a client. Frames pushed to it are
+// written in order by its own goroutine.
+type conn struct {
+	net.Conn
+	limit    int
+	lock     sync.Mutex
+	frames   [][]byte
+	ready    chan qp.Signal
+	closed   chan qp.Signal
+	done     bool
+	patterns map[string]struct{}
+}
+
+func newConn(nc net.Conn, limit int) *conn {
+	return &conn{
+		Conn:     nc,
+		limit:    limit,
+		ready:    make(chan qp.Signal, 1),
+		closed:   make(chan qp.Signal),
+		patterns: make(map[string]struct{}),
+	}
+}
+
+// push queues the frame to be written, returning false if the
+// connection is closed. Frames that may be dropped are also
+// refused when too many frames are already waiting.
+func (c *conn) push(frame []byte, droppable bool) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.done || (droppable && len(c.frames) >= c.limit) {
+		return false
+	}
+	c.frames = append(c.frames, frame)
+	select {
+	case c.ready <- qp.Signal{}:
+	default:
+	}
+	return true
+}
+
+// write writes the frames pushed to the connection until it is
+// closed.
+func (c *conn) write() {
+	w := bufio.NewWriter(c.Conn)
+	for {
+		select {
+		case <-c.ready:
+		case <-c.closed:
+			return
+		}
+		c.lock.Lock()
+		frames := c.frames
+		c.frames = nil
+		c.lock.Unlock()
+		for _, frame := range frames {
+			if _, err := w.Write(frame); err != nil {
+				c.close()
+				return
+			}
+		}
+		if err := w.Flush(); err != nil {
+			c.close()
+			return
+		}
+	}
+}
+
+// close closes the connection. It is safe to call more than once.
+func (c *conn) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.done {
+		return
+	}
+	c.done = true
+	c.frames = nil
+	close(c.closed)
+	c.Conn.Close()
+}
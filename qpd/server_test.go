@@ -0,0 +1,15 @@
+package qpd_test
+
+import (
+	"testing"
+
+	"github.com/qp/go/qpd"
+	"github.com/qp/go/transporttest"
+	"github.com/stretchr/pat/start"
+)
+
+func TestServerLifecycle(t *testing.T) {
+	transporttest.Lifecycle(t, func() start.StartStopper {
+		return qpd.NewServer("tcp", "127.0.0.1:0")
+	})
+}
@@ -0,0 +1,167 @@
+package qpd
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// store records
+const (
+	// recPush adds a message to the back of a queue.
+	recPush byte = iota + 1
+	// recPushFront adds a message to the front of a queue.
+	recPushFront
+	// recPop removes the message at the front of a queue.
+	recPop
+)
+
+// compactRecords is the number of records the log may hold before
+// it is compacted, as long as it is also more than twice the size
+// it would be after compacting.
+const compactRecords = 4096
+
+// store keeps the queues in an append-only log, so that they
+// survive the server restarting. Topics are not stored.
+//
+// The log is compacted when it is opened, and whenever most of
+// its records are for messages that have since been taken.
+type store struct {
+	path    string
+	sync    bool
+	file    *os.File
+	w       *bufio.Writer
+	records int
+}
+
+// openStore opens the log in the directory, creating it if it does
+// not exist, and returns the queues it holds.
+func openStore(dir string, sync bool) (*store, map[string][][]byte, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+	s := &store{path: filepath.Join(dir, "queues.log"), sync: sync}
+	queues, err := s.replay()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.compact(queues); err != nil {
+		return nil, nil, err
+	}
+	return s, queues, nil
+}
+
+// replay reads the queues from the log.
+func (s *store) replay() (map[string][][]byte, error) {
+	queues := make(map[string][][]byte)
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return queues, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		op, fields, err := readFrame(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// a partly written record is from a crash, and is
+			// dropped when the log is compacted
+			return queues, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) < 1 {
+			return nil, errFrameFormat
+		}
+		name := string(fields[0])
+		switch {
+		case op == recPush && len(fields) == 2:
+			queues[name] = append(queues[name], fields[1])
+		case op == recPushFront && len(fields) == 2:
+			queues[name] = append([][]byte{fields[1]}, queues[name]...)
+		case op == recPop && len(fields) == 1:
+			if len(queues[name]) > 0 {
+				queues[name] = queues[name][1:]
+			}
+			if len(queues[name]) == 0 {
+				delete(queues, name)
+			}
+		default:
+			return nil, errFrameFormat
+		}
+	}
+}
+
+// append adds a record to the log.
+func (s *store) append(op byte, fields ...[]byte) error {
+	if _, err := s.w.Write(encodeFrame(op, fields...)); err != nil {
+		return err
+	}
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	s.records++
+	if s.sync {
+		return s.file.Sync()
+	}
+	return nil
+}
+
+// compacting gets whether the log should be compacted now that the
+// queues hold the number of messages.
+func (s *store) compacting(messages int) bool {
+	return s.records > compactRecords && s.records > 2*messages
+}
+
+// compact replaces the log with one that only holds the messages
+// still in the queues.
+func (s *store) compact(queues map[string][][]byte) error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	records := 0
+	for name, messages := range queues {
+		for _, data := range messages {
+			if _, err := w.Write(encodeFrame(recPush, []byte(name), data)); err != nil {
+				f.Close()
+				return err
+			}
+			records++
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return err
+	}
+	s.w = bufio.NewWriter(s.file)
+	s.records = records
+	return nil
+}
+
+// close closes the log.
+func (s *store) close() error {
+	return s.file.Close()
+}
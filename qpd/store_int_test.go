@@ -0,0 +1,55 @@
+package qpd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "qpd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, queues, err := openStore(dir, false)
+	require.NoError(t, err)
+	require.Empty(t, queues)
+	require.NoError(t, s.append(recPush, []byte("a"), []byte("one")))
+	require.NoError(t, s.append(recPush, []byte("a"), []byte("two")))
+	require.NoError(t, s.append(recPush, []byte("b"), []byte("three")))
+	require.NoError(t, s.append(recPop, []byte("a")))
+	require.NoError(t, s.append(recPushFront, []byte("b"), []byte("four")))
+	require.NoError(t, s.append(recPop, []byte("c")))
+	require.NoError(t, s.close())
+
+	// a record cut short by a crash is ignored
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write(encodeFrame(recPush, []byte("a"), []byte("five"))[:10])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s, queues, err = openStore(dir, false)
+	require.NoError(t, err)
+	require.Equal(t, map[string][][]byte{
+		"a": {[]byte("two")},
+		"b": {[]byte("four"), []byte("three")},
+	}, queues)
+	// opening compacts the log down to the messages left
+	require.Equal(t, 3, s.records)
+	require.NoError(t, s.close())
+
+}
+
+func TestStoreCompacting(t *testing.T) {
+
+	s := &store{records: compactRecords}
+	require.False(t, s.compacting(0))
+	s.records = compactRecords + 1
+	require.True(t, s.compacting(0))
+	require.False(t, s.compacting(compactRecords))
+
+}
@@ -0,0 +1,79 @@
+package qptest
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is a virtual clock that only moves when it is told to.
+type Clock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*timer
+}
+
+// timer is a channel waiting for the clock to reach a time.
+type timer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+// NewClock makes a new Clock that starts at the specified time.
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+// Now gets the current virtual time.
+func (c *Clock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// After waits for the virtual duration to elapse and then sends
+// the virtual time on the returned channel, like time.After.
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t := &timer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+		return t.c
+	}
+	c.timers = append(c.timers, t)
+	sort.SliceStable(c.timers, func(i, j int) bool {
+		return c.timers[i].at.Before(c.timers[j].at)
+	})
+	return t.c
+}
+
+// Advance moves the clock forward by the duration, firing any
+// timers that are due on the way.
+func (c *Clock) Advance(d time.Duration) {
+	c.advanceTo(c.Now().Add(d))
+}
+
+// advanceTo moves the clock to the time, firing any timers that
+// are due. The clock never moves backwards.
+func (c *Clock) advanceTo(t time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if t.After(c.now) {
+		c.now = t
+	}
+	for len(c.timers) > 0 && !c.timers[0].at.After(c.now) {
+		c.timers[0].c <- c.timers[0].at
+		c.timers = c.timers[1:]
+	}
+}
+
+// next gets the time of the next timer, if there is one.
+func (c *Clock) next() (time.Time, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.timers) == 0 {
+		return time.Time{}, false
+	}
+	return c.timers[0].at, true
+}
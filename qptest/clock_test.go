@@ -0,0 +1,33 @@
+package qptest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qp/go/qptest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClock(t *testing.T) {
+
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := qptest.NewClock(start)
+	require.Equal(t, start, clock.Now())
+
+	later := clock.After(2 * time.Second)
+	sooner := clock.After(1 * time.Second)
+	require.Len(t, clock.After(0), 1)
+
+	clock.Advance(500 * time.Millisecond)
+	require.Len(t, sooner, 0)
+	require.Len(t, later, 0)
+
+	clock.Advance(500 * time.Millisecond)
+	require.Equal(t, start.Add(1*time.Second), <-sooner)
+	require.Len(t, later, 0)
+
+	clock.Advance(5 * time.Second)
+	require.Equal(t, start.Add(2*time.Second), <-later)
+	require.Equal(t, start.Add(6*time.Second), clock.Now())
+
+}
@@ -0,0 +1,73 @@
+package qptest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+)
+
+// Direct is a qp.DirectTransport on a simulated Network.
+type Direct struct {
+	qp.Lifecycle
+	network  *Network
+	lock     sync.RWMutex
+	handlers map[string]qp.Handler
+}
+
+// ensure the interface is satisfied
+var _ qp.DirectTransport = (*Direct)(nil)
+
+// Send sends data on the channel.
+func (d *Direct) Send(channel string, data []byte) error {
+	if !d.Running() {
+		return qp.ErrNotRunning
+	}
+	d.network.send(&qp.Message{Source: channel, Data: data}, true)
+	return nil
+}
+
+// OnMessage binds the handler to the specified channel.
+func (d *Direct) OnMessage(channel string, handler qp.Handler) error {
+	d.lock.Lock()
+	d.handlers[channel] = handler
+	d.lock.Unlock()
+	return nil
+}
+
+// RemoveHandler unbinds the handler from the specified channel.
+func (d *Direct) RemoveHandler(channel string) error {
+	d.lock.Lock()
+	delete(d.handlers, channel)
+	d.lock.Unlock()
+	return nil
+}
+
+// handler gets the handler for the channel, or nil if there is
+// none or the transport is not running.
+func (d *Direct) handler(channel string) qp.Handler {
+	if d.State() != qp.StateRunning {
+		return nil
+	}
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.handlers[channel]
+}
+
+// Start starts the transport.
+func (d *Direct) Start() error {
+	if err := d.BeginStart(); err != nil {
+		return err
+	}
+	return d.EndStart(nil)
+}
+
+// Stop stops the transport and closes StopChan(). Handlers run
+// while messages are delivered, so there is never anything in
+// flight to wait for.
+func (d *Direct) Stop(grace time.Duration) {
+	if !d.BeginStop() {
+		return
+	}
+	d.EndStop(0)
+}
@@ -0,0 +1,27 @@
+// Package qptest provides a simulated network of transports, for
+// testing code built on qp without real time passing.
+//
+// A Network carries messages between the Direct and PubSub
+// transports made from it, but only delivers them when the test
+// says so, and only once they are due on the Network's virtual
+// Clock:
+//
+//	clock := qptest.NewClock(time.Time{})
+//	network := qptest.NewNetwork(clock)
+//	transport := network.NewDirect()
+//	...
+//	future, _ := requester.Issue([]string{"service"}, data)
+//	network.Deliver()                  // request reaches the responder
+//	network.Advance(1 * time.Second)   // response is delayed, so it times out
+//	_, err := future.ResponseTimeout(clock.After(500 * time.Millisecond))
+//
+// A Script decides the Fate of every message sent on the Network,
+// so tests can delay, drop and duplicate messages. Messages that
+// are delayed differently overtake each other, and Pending and
+// DeliverPending let tests deliver them in any order at all.
+//
+// FaultyDirect and FaultyPubSub wrap any transport, including real
+// ones like redis.Direct, and inject the faults chosen by an
+// Injector: send errors, latency, loss, duplication, corruption
+// and outages of particular channels.
+package qptest
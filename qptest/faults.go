@@ -0,0 +1,208 @@
+package qptest
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+)
+
+// ErrInjected is returned by Send and Publish when the Injector
+// decides that they should fail.
+var ErrInjected = errors.New("injected fault")
+
+// ErrOutage is returned by Send and Publish on channels that are
+// having an outage.
+var ErrOutage = errors.New("channel is unavailable")
+
+// Faults describes the faults an Injector injects. Rates are the
+// probability, between 0 and 1, of the fault happening to each
+// message.
+type Faults struct {
+	// SendErrors is the rate at which Send and Publish fail with
+	// ErrInjected, without sending anything.
+	SendErrors float64
+	// Loss is the rate at which received messages are discarded
+	// before reaching the handler.
+	Loss float64
+	// Duplication is the rate at which received messages are
+	// handled twice.
+	Duplication float64
+	// Corruption is the rate at which received messages have a
+	// byte of their data changed.
+	Corruption float64
+	// Latency is how long every received message waits before it
+	// is handled, plus a random duration of up to Jitter.
+	Latency time.Duration
+	Jitter  time.Duration
+}
+
+// Injector decides which faults happen to which messages. It is
+// shared by the transports it wraps, and its faults and outages
+// may be changed while they are running.
+type Injector struct {
+	lock    sync.Mutex
+	faults  Faults
+	rand    *rand.Rand
+	outages map[string]struct{}
+}
+
+// NewInjector makes a new Injector. The seed makes the faults it
+// injects repeatable.
+func NewInjector(seed int64, faults Faults) *Injector {
+	return &Injector{
+		faults:  faults,
+		rand:    rand.New(rand.NewSource(seed)),
+		outages: make(map[string]struct{}),
+	}
+}
+
+// SetFaults changes the faults injected from now on.
+func (i *Injector) SetFaults(faults Faults) {
+	i.lock.Lock()
+	i.faults = faults
+	i.lock.Unlock()
+}
+
+// Outage makes the channel unavailable until Restore is called.
+// Sending on it fails with ErrOutage, and messages received on it
+// are discarded. The channel may be a pattern.
+func (i *Injector) Outage(channel string) {
+	i.lock.Lock()
+	i.outages[channel] = struct{}{}
+	i.lock.Unlock()
+}
+
+// Restore ends an outage that was started with Outage.
+func (i *Injector) Restore(channel string) {
+	i.lock.Lock()
+	delete(i.outages, channel)
+	i.lock.Unlock()
+}
+
+// out gets whether the channel is having an outage.
+// Callers must hold the lock.
+func (i *Injector) out(channel string) bool {
+	for pattern := range i.outages {
+		if qp.MatchChannel(pattern, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// chance gets whether something with the rate happens.
+// Callers must hold the lock.
+func (i *Injector) chance(rate float64) bool {
+	return rate > 0 && i.rand.Float64() < rate
+}
+
+// send decides whether sending on the channel should fail.
+func (i *Injector) send(channel string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.out(channel) {
+		return ErrOutage
+	}
+	if i.chance(i.faults.SendErrors) {
+		return ErrInjected
+	}
+	return nil
+}
+
+// handler wraps the handler so that the messages it receives
+// suffer the injected faults.
+func (i *Injector) handler(handler qp.Handler) qp.Handler {
+	return qp.HandlerFunc(func(msg *qp.Message) {
+		i.lock.Lock()
+		if i.out(msg.Source) || i.chance(i.faults.Loss) {
+			i.lock.Unlock()
+			return
+		}
+		copies := 1
+		if i.chance(i.faults.Duplication) {
+			copies = 2
+		}
+		if i.chance(i.faults.Corruption) && len(msg.Data) > 0 {
+			data := make([]byte, len(msg.Data))
+			copy(data, msg.Data)
+			data[i.rand.Intn(len(data))] ^= 0xff
+			msg = &qp.Message{Source: msg.Source, Data: data}
+		}
+		delay := i.faults.Latency
+		if i.faults.Jitter > 0 {
+			delay += time.Duration(i.rand.Int63n(int64(i.faults.Jitter)))
+		}
+		i.lock.Unlock()
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+		for n := 0; n < copies; n++ {
+			handler.Handle(msg)
+		}
+	})
+}
+
+// FaultyDirect is a qp.DirectTransport that injects faults into
+// another one.
+type FaultyDirect struct {
+	qp.DirectTransport
+	injector *Injector
+}
+
+// ensure the interface is satisfied
+var _ qp.DirectTransport = (*FaultyDirect)(nil)
+
+// NewFaultyDirect makes a new FaultyDirect that wraps the transport
+// and injects the injector's faults.
+func NewFaultyDirect(transport qp.DirectTransport, injector *Injector) *FaultyDirect {
+	return &FaultyDirect{DirectTransport: transport, injector: injector}
+}
+
+// Send sends data on the channel, unless the injector decides
+// that it fails.
+func (d *FaultyDirect) Send(channel string, data []byte) error {
+	if err := d.injector.send(channel); err != nil {
+		return err
+	}
+	return d.DirectTransport.Send(channel, data)
+}
+
+// OnMessage binds the handler to the specified channel. The
+// messages it receives suffer the injector's faults.
+func (d *FaultyDirect) OnMessage(channel string, handler qp.Handler) error {
+	return d.DirectTransport.OnMessage(channel, d.injector.handler(handler))
+}
+
+// FaultyPubSub is a qp.PubSubTransport that injects faults into
+// another one.
+type FaultyPubSub struct {
+	qp.PubSubTransport
+	injector *Injector
+}
+
+// ensure the interface is satisfied
+var _ qp.PubSubTransport = (*FaultyPubSub)(nil)
+
+// NewFaultyPubSub makes a new FaultyPubSub that wraps the transport
+// and injects the injector's faults.
+func NewFaultyPubSub(transport qp.PubSubTransport, injector *Injector) *FaultyPubSub {
+	return &FaultyPubSub{PubSubTransport: transport, injector: injector}
+}
+
+// Publish publishes data on the specified channel, unless the
+// injector decides that it fails.
+func (p *FaultyPubSub) Publish(channel string, data []byte) error {
+	if err := p.injector.send(channel); err != nil {
+		return err
+	}
+	return p.PubSubTransport.Publish(channel, data)
+}
+
+// Subscribe binds the handler to the specified channel. The
+// messages it receives suffer the injector's faults.
+func (p *FaultyPubSub) Subscribe(channel string, handler qp.Handler) (qp.Subscription, error) {
+	return p.PubSubTransport.Subscribe(channel, p.injector.handler(handler))
+}
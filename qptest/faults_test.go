@@ -0,0 +1,145 @@
+package qptest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/qp/go/inproc"
+	"github.com/qp/go/qptest"
+	"github.com/qp/go/transporttest"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultsOutage(t *testing.T) {
+
+	injector := qptest.NewInjector(1, qptest.Faults{})
+	network := qptest.NewNetwork(qptest.NewClock(time.Time{}))
+	sender := qptest.NewFaultyDirect(network.NewDirect(), injector)
+	receiver := qptest.NewFaultyDirect(network.NewDirect(), injector)
+	r := &recorder{}
+	require.NoError(t, receiver.OnMessage("orders.eu", r))
+	require.NoError(t, sender.Start())
+	require.NoError(t, receiver.Start())
+
+	// messages already on their way are lost too
+	require.NoError(t, sender.Send("orders.eu", []byte("one")))
+	injector.Outage("orders.>")
+	require.Equal(t, qptest.ErrOutage, sender.Send("orders.eu", []byte("two")))
+	network.Deliver()
+	require.Empty(t, r.received())
+
+	injector.Restore("orders.>")
+	require.NoError(t, sender.Send("orders.eu", []byte("three")))
+	network.Deliver()
+	require.Equal(t, []string{"three"}, r.received())
+
+}
+
+func TestFaultsRates(t *testing.T) {
+
+	for _, test := range []struct {
+		faults   qptest.Faults
+		expected []string
+	}{
+		{qptest.Faults{}, []string{"data"}},
+		{qptest.Faults{Loss: 1}, []string{}},
+		{qptest.Faults{Duplication: 1}, []string{"data", "data"}},
+	} {
+		injector := qptest.NewInjector(1, test.faults)
+		network := qptest.NewNetwork(qptest.NewClock(time.Time{}))
+		d := qptest.NewFaultyDirect(network.NewDirect(), injector)
+		r := &recorder{}
+		require.NoError(t, d.OnMessage("channel", r))
+		require.NoError(t, d.Start())
+		require.NoError(t, d.Send("channel", []byte("data")))
+		network.Deliver()
+		require.Equal(t, test.expected, r.received(), "%+v", test.faults)
+	}
+
+	injector := qptest.NewInjector(1, qptest.Faults{SendErrors: 1})
+	network := qptest.NewNetwork(qptest.NewClock(time.Time{}))
+	d := qptest.NewFaultyDirect(network.NewDirect(), injector)
+	require.NoError(t, d.Start())
+	require.Equal(t, qptest.ErrInjected, d.Send("channel", []byte("data")))
+	require.Empty(t, network.Pending())
+
+}
+
+func TestFaultsCorruption(t *testing.T) {
+
+	injector := qptest.NewInjector(1, qptest.Faults{Corruption: 1})
+	network := qptest.NewNetwork(qptest.NewClock(time.Time{}))
+	ps := qptest.NewFaultyPubSub(network.NewPubSub(), injector)
+	r := &recorder{}
+	_, err := ps.Subscribe("channel", r)
+	require.NoError(t, err)
+	require.NoError(t, ps.Start())
+
+	data := []byte("data")
+	require.NoError(t, ps.Publish("channel", data))
+	network.Deliver()
+	received := r.received()
+	require.Len(t, received, 1)
+	require.NotEqual(t, "data", received[0])
+	require.Equal(t, "data", string(data), "the sender's data should not change")
+
+}
+
+func TestFaultsLatency(t *testing.T) {
+
+	injector := qptest.NewInjector(1, qptest.Faults{Latency: 20 * time.Millisecond})
+	network := qptest.NewNetwork(qptest.NewClock(time.Time{}))
+	d := qptest.NewFaultyDirect(network.NewDirect(), injector)
+	require.NoError(t, d.OnMessage("channel", &recorder{}))
+	require.NoError(t, d.Start())
+	require.NoError(t, d.Send("channel", []byte("data")))
+	start := time.Now()
+	network.Deliver()
+	require.True(t, time.Since(start) >= 20*time.Millisecond)
+
+}
+
+// TestFaultsService checks that a service keeps working once the
+// faults stop.
+func TestFaultsService(t *testing.T) {
+
+	bus := inproc.NewBus()
+	defer bus.Close()
+	injector := qptest.NewInjector(1, qptest.Faults{Corruption: 1})
+	d := qptest.NewFaultyDirect(bus.NewDirect(), injector)
+	require.NoError(t, qp.ServiceFunc("service", "1", qp.JSON, d, func(r *qp.Transaction) *qp.Transaction {
+		r.Data = "handled"
+		return r
+	}))
+	require.NoError(t, d.Start())
+	defer d.Stop(stop.NoWait)
+	requester, err := qp.NewRequester("client", "1", qp.JSON, d)
+	require.NoError(t, err)
+
+	future, err := requester.Issue([]string{"service"}, "request")
+	require.NoError(t, err)
+	_, err = future.Response(50 * time.Millisecond)
+	require.Equal(t, qp.ErrTimeout, err)
+
+	injector.SetFaults(qptest.Faults{})
+	future, err = requester.Issue([]string{"service"}, "request")
+	require.NoError(t, err)
+	response, err := future.Response(1 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "handled", response.Data)
+
+}
+
+func TestFaultyConformance(t *testing.T) {
+	bus := inproc.NewBus()
+	defer bus.Close()
+	injector := qptest.NewInjector(1, qptest.Faults{})
+	transporttest.Direct(t, func() qp.DirectTransport {
+		return qptest.NewFaultyDirect(bus.NewDirect(), injector)
+	})
+	transporttest.PubSub(t, func() qp.PubSubTransport {
+		return qptest.NewFaultyPubSub(bus.NewPubSub(), injector)
+	})
+}
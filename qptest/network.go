@@ -0,0 +1,244 @@
+package qptest
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+)
+
+// ErrNoPending is returned by DeliverPending when there is no
+// pending message at the index.
+var ErrNoPending = errors.New("no pending message")
+
+// Fate describes what the Network does with a message.
+type Fate struct {
+	// Drop discards the message.
+	Drop bool
+	// Delay is how long after it was sent the message is due.
+	Delay time.Duration
+	// Duplicates is the number of extra copies of the message to
+	// deliver.
+	Duplicates int
+}
+
+// Script decides the Fate of each message sent on a Network.
+// Scripts are called with the Network locked, so they must not
+// call its methods.
+type Script func(msg *qp.Message) Fate
+
+// delivery is a message waiting to be delivered.
+type delivery struct {
+	msg    *qp.Message
+	due    time.Time
+	seq    uint64
+	direct bool
+}
+
+// Network is a simulated network that carries messages between
+// the transports made from it. Messages are only delivered when
+// Step, Deliver, Advance or DeliverPending is called, and handlers
+// run on the goroutine that called it.
+type Network struct {
+	clock   *Clock
+	lock    sync.Mutex
+	script  Script
+	pending []*delivery
+	seq     uint64
+	directs []*Direct
+	pubSubs []*PubSub
+	next    map[string]int
+}
+
+// NewNetwork makes a new Network that uses the clock to decide
+// when messages are due.
+func NewNetwork(clock *Clock) *Network {
+	return &Network{
+		clock: clock,
+		next:  make(map[string]int),
+	}
+}
+
+// Clock gets the Network's Clock.
+func (n *Network) Clock() *Clock {
+	return n.clock
+}
+
+// SetScript sets the Script that decides the Fate of messages sent
+// from now on. A nil Script delivers every message once, straight
+// away.
+func (n *Network) SetScript(script Script) {
+	n.lock.Lock()
+	n.script = script
+	n.lock.Unlock()
+}
+
+// send schedules the message according to the Script.
+func (n *Network) send(msg *qp.Message, direct bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	var fate Fate
+	if n.script != nil {
+		fate = n.script(msg)
+	}
+	if fate.Drop {
+		return
+	}
+	due := n.clock.Now().Add(fate.Delay)
+	for i := 0; i <= fate.Duplicates; i++ {
+		n.seq++
+		data := make([]byte, len(msg.Data))
+		copy(data, msg.Data)
+		n.pending = append(n.pending, &delivery{
+			msg:    &qp.Message{Source: msg.Source, Data: data},
+			due:    due,
+			seq:    n.seq,
+			direct: direct,
+		})
+	}
+	sort.SliceStable(n.pending, func(i, j int) bool {
+		if n.pending[i].due.Equal(n.pending[j].due) {
+			return n.pending[i].seq < n.pending[j].seq
+		}
+		return n.pending[i].due.Before(n.pending[j].due)
+	})
+}
+
+// Pending gets the messages that have not been delivered yet,
+// in the order they are due.
+func (n *Network) Pending() []*qp.Message {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	msgs := make([]*qp.Message, len(n.pending))
+	for i, d := range n.pending {
+		msgs[i] = d.msg
+	}
+	return msgs
+}
+
+// DeliverPending delivers the pending message at the index, as
+// returned by Pending, whether or not it is due yet.
+func (n *Network) DeliverPending(i int) error {
+	n.lock.Lock()
+	if i < 0 || i >= len(n.pending) {
+		n.lock.Unlock()
+		return ErrNoPending
+	}
+	d := n.pending[i]
+	n.pending = append(n.pending[:i:i], n.pending[i+1:]...)
+	n.lock.Unlock()
+	n.deliver(d)
+	return nil
+}
+
+// Step delivers the next message that is due, and returns false
+// if there are none.
+func (n *Network) Step() bool {
+	n.lock.Lock()
+	if len(n.pending) == 0 || n.pending[0].due.After(n.clock.Now()) {
+		n.lock.Unlock()
+		return false
+	}
+	d := n.pending[0]
+	n.pending = n.pending[1:]
+	n.lock.Unlock()
+	n.deliver(d)
+	return true
+}
+
+// Deliver delivers messages until none are due, including any
+// sent by handlers along the way. It returns the number of
+// messages delivered.
+func (n *Network) Deliver() int {
+	count := 0
+	for n.Step() {
+		count++
+	}
+	return count
+}
+
+// Advance moves the clock forward by the duration. Messages and
+// timers fire in the order they are due, and timers fire before
+// messages that are due at the same time.
+func (n *Network) Advance(d time.Duration) {
+	end := n.clock.Now().Add(d)
+	for {
+		n.Deliver()
+		next, ok := n.nextDue()
+		if timer, hasTimer := n.clock.next(); hasTimer && (!ok || timer.Before(next)) {
+			next, ok = timer, true
+		}
+		if !ok || next.After(end) {
+			break
+		}
+		n.clock.advanceTo(next)
+	}
+	n.clock.advanceTo(end)
+	n.Deliver()
+}
+
+// nextDue gets the time the next pending message is due.
+func (n *Network) nextDue() (time.Time, bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if len(n.pending) == 0 {
+		return time.Time{}, false
+	}
+	return n.pending[0].due, true
+}
+
+// deliver hands the message to the handlers that should get it.
+// Direct messages go to one running Direct handling the channel,
+// taking turns like a Redis list, and are lost if there is none.
+// PubSub messages go to every matching subscription.
+func (n *Network) deliver(d *delivery) {
+	var handlers []qp.Handler
+	n.lock.Lock()
+	if d.direct {
+		var candidates []qp.Handler
+		for _, instance := range n.directs {
+			if h := instance.handler(d.msg.Source); h != nil {
+				candidates = append(candidates, h)
+			}
+		}
+		if len(candidates) > 0 {
+			next := n.next[d.msg.Source] % len(candidates)
+			n.next[d.msg.Source] = next + 1
+			handlers = append(handlers, candidates[next])
+		}
+	} else {
+		for _, instance := range n.pubSubs {
+			handlers = append(handlers, instance.handlers(d.msg.Source)...)
+		}
+	}
+	n.lock.Unlock()
+	for _, h := range handlers {
+		h.Handle(d.msg)
+	}
+}
+
+// NewDirect makes a new Direct on the Network.
+func (n *Network) NewDirect() *Direct {
+	d := &Direct{
+		network:  n,
+		handlers: make(map[string]qp.Handler),
+	}
+	n.lock.Lock()
+	n.directs = append(n.directs, d)
+	n.lock.Unlock()
+	return d
+}
+
+// NewPubSub makes a new PubSub on the Network.
+func (n *Network) NewPubSub() *PubSub {
+	p := &PubSub{
+		network:       n,
+		subscriptions: make(map[string][]*subscription),
+	}
+	n.lock.Lock()
+	n.pubSubs = append(n.pubSubs, p)
+	n.lock.Unlock()
+	return p
+}
@@ -0,0 +1,242 @@
+package qptest_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/qp/go/qptest"
+	"github.com/qp/go/transporttest"
+	"github.com/stretchr/pat/start"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder records the data of the messages it handles.
+type recorder struct {
+	lock sync.Mutex
+	data []string
+}
+
+func (r *recorder) Handle(msg *qp.Message) {
+	r.lock.Lock()
+	r.data = append(r.data, string(msg.Data))
+	r.lock.Unlock()
+}
+
+func (r *recorder) received() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string{}, r.data...)
+}
+
+func TestNetworkDirect(t *testing.T) {
+
+	network := qptest.NewNetwork(qptest.NewClock(time.Time{}))
+	sender := network.NewDirect()
+	first, second := &recorder{}, &recorder{}
+	for _, r := range []*recorder{first, second} {
+		d := network.NewDirect()
+		require.NoError(t, d.OnMessage("work", r))
+		require.NoError(t, d.Start())
+	}
+	require.Equal(t, qp.ErrNotRunning, sender.Send("work", []byte("one")))
+	require.NoError(t, sender.Start())
+
+	for _, data := range []string{"one", "two", "three"} {
+		require.NoError(t, sender.Send("work", []byte(data)))
+	}
+	require.Empty(t, first.received(), "nothing is delivered until asked")
+	require.True(t, network.Step())
+	require.Equal(t, []string{"one"}, first.received())
+	require.Equal(t, 2, network.Deliver())
+	require.False(t, network.Step())
+	require.Equal(t, []string{"one", "three"}, first.received())
+	require.Equal(t, []string{"two"}, second.received())
+
+}
+
+func TestNetworkScript(t *testing.T) {
+
+	network := qptest.NewNetwork(qptest.NewClock(time.Time{}))
+	network.SetScript(func(msg *qp.Message) qptest.Fate {
+		switch string(msg.Data) {
+		case "dropped":
+			return qptest.Fate{Drop: true}
+		case "slow":
+			return qptest.Fate{Delay: 2 * time.Second}
+		case "twice":
+			return qptest.Fate{Duplicates: 1}
+		}
+		return qptest.Fate{}
+	})
+	r := &recorder{}
+	d := network.NewDirect()
+	require.NoError(t, d.OnMessage("work", r))
+	require.NoError(t, d.Start())
+
+	for _, data := range []string{"slow", "dropped", "twice", "fast"} {
+		require.NoError(t, d.Send("work", []byte(data)))
+	}
+	require.Len(t, network.Pending(), 4)
+	network.Deliver()
+	require.Equal(t, []string{"twice", "twice", "fast"}, r.received())
+
+	network.Advance(1 * time.Second)
+	require.Equal(t, []string{"twice", "twice", "fast"}, r.received())
+	network.Advance(1 * time.Second)
+	require.Equal(t, []string{"twice", "twice", "fast", "slow"}, r.received())
+	require.Empty(t, network.Pending())
+
+}
+
+func TestNetworkDeliverPending(t *testing.T) {
+
+	network := qptest.NewNetwork(qptest.NewClock(time.Time{}))
+	r := &recorder{}
+	d := network.NewDirect()
+	require.NoError(t, d.OnMessage("work", r))
+	require.NoError(t, d.Start())
+
+	for _, data := range []string{"one", "two", "three"} {
+		require.NoError(t, d.Send("work", []byte(data)))
+	}
+	require.NoError(t, network.DeliverPending(2))
+	require.NoError(t, network.DeliverPending(1))
+	require.Equal(t, qptest.ErrNoPending, network.DeliverPending(1))
+	network.Deliver()
+	require.Equal(t, []string{"three", "two", "one"}, r.received())
+
+}
+
+func TestNetworkPubSub(t *testing.T) {
+
+	network := qptest.NewNetwork(qptest.NewClock(time.Time{}))
+	publisher := network.NewPubSub()
+	all, created := &recorder{}, &recorder{}
+	subscriber := network.NewPubSub()
+	_, err := subscriber.Subscribe("orders.>", all)
+	require.NoError(t, err)
+	_, err = subscriber.Subscribe("orders.*.created", created)
+	require.NoError(t, err)
+	stopped := network.NewPubSub()
+	_, err = stopped.Subscribe("orders.>", all)
+	require.NoError(t, err)
+	require.NoError(t, publisher.Start())
+	require.NoError(t, subscriber.Start())
+	require.NoError(t, stopped.Start())
+	stopped.Stop(stop.NoWait)
+
+	require.NoError(t, publisher.Publish("orders.eu.created", []byte("one")))
+	require.NoError(t, publisher.Publish("orders.eu.deleted", []byte("two")))
+	network.Deliver()
+	require.Equal(t, []string{"one", "two"}, all.received())
+	require.Equal(t, []string{"one"}, created.received())
+
+}
+
+// service starts a Responder on the network that appends its name
+// to the data of each request, counting the requests it handles.
+func service(t *testing.T, network *qptest.Network, name string) *int {
+	d := network.NewDirect()
+	require.NoError(t, d.Start())
+	handled := new(int)
+	responder := qp.NewResponder(name, "1", qp.JSON, d)
+	require.NoError(t, responder.HandleFunc(name, func(r *qp.Transaction) *qp.Transaction {
+		*handled++
+		r.Data = r.Data.(string) + " " + name
+		return r
+	}))
+	return handled
+}
+
+// requester starts a Requester on the network.
+func requester(t *testing.T, network *qptest.Network) qp.Requester {
+	d := network.NewDirect()
+	require.NoError(t, d.Start())
+	r, err := qp.NewRequester("client", "1", qp.JSON, d)
+	require.NoError(t, err)
+	return r
+}
+
+func TestNetworkPipeline(t *testing.T) {
+
+	network := qptest.NewNetwork(qptest.NewClock(time.Time{}))
+	one := service(t, network, "one")
+	two := service(t, network, "two")
+	r := requester(t, network)
+
+	future, err := r.Issue([]string{"one", "two"}, "hello")
+	require.NoError(t, err)
+
+	require.True(t, network.Step())
+	require.Equal(t, 1, *one)
+	require.Equal(t, 0, *two)
+	require.Equal(t, "two", network.Pending()[0].Source)
+	require.True(t, network.Step())
+	require.Equal(t, 1, *two)
+	require.Equal(t, "client.1", network.Pending()[0].Source)
+	require.True(t, network.Step())
+
+	response, err := future.ResponseTimeout(network.Clock().After(1 * time.Second))
+	require.NoError(t, err)
+	require.Equal(t, "hello one two", response.Data)
+
+}
+
+func TestNetworkTimeout(t *testing.T) {
+
+	network := qptest.NewNetwork(qptest.NewClock(time.Time{}))
+	service(t, network, "slow")
+	r := requester(t, network)
+	network.SetScript(func(msg *qp.Message) qptest.Fate {
+		if msg.Source == "client.1" {
+			return qptest.Fate{Delay: 2 * time.Second}
+		}
+		return qptest.Fate{}
+	})
+
+	future, err := r.Issue([]string{"slow"}, "hello")
+	require.NoError(t, err)
+	timeout := network.Clock().After(1 * time.Second)
+	network.Advance(1 * time.Second)
+
+	response, err := future.ResponseTimeout(timeout)
+	require.Nil(t, response)
+	require.Equal(t, qp.ErrTimeout, err)
+
+}
+
+func TestNetworkDuplicateRequest(t *testing.T) {
+
+	network := qptest.NewNetwork(qptest.NewClock(time.Time{}))
+	handled := service(t, network, "service")
+	r := requester(t, network)
+	network.SetScript(func(msg *qp.Message) qptest.Fate {
+		if msg.Source == "service" {
+			return qptest.Fate{Duplicates: 1}
+		}
+		return qptest.Fate{}
+	})
+
+	future, err := r.Issue([]string{"service"}, "hello")
+	require.NoError(t, err)
+	require.Equal(t, 4, network.Deliver())
+	require.Equal(t, 2, *handled)
+
+	response, err := future.ResponseTimeout(network.Clock().After(1 * time.Second))
+	require.NoError(t, err)
+	require.Equal(t, "hello service", response.Data)
+
+}
+
+func TestNetworkLifecycle(t *testing.T) {
+	network := qptest.NewNetwork(qptest.NewClock(time.Time{}))
+	transporttest.Lifecycle(t, func() start.StartStopper {
+		return network.NewDirect()
+	})
+	transporttest.Lifecycle(t, func() start.StartStopper {
+		return network.NewPubSub()
+	})
+}
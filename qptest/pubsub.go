@@ -0,0 +1,116 @@
+package qptest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+)
+
+// PubSub is a qp.PubSubTransport on a simulated Network.
+type PubSub struct {
+	qp.Lifecycle
+	network       *Network
+	lock          sync.RWMutex
+	subscriptions map[string][]*subscription
+}
+
+// subscription is a single handler bound to a channel.
+type subscription struct {
+	handler qp.Handler
+}
+
+// ensure the interface is satisfied
+var _ qp.PubSubTransport = (*PubSub)(nil)
+
+// Publish publishes data on the specified channel.
+func (p *PubSub) Publish(channel string, data []byte) error {
+	if !p.Running() {
+		return qp.ErrNotRunning
+	}
+	p.network.send(&qp.Message{Source: channel, Data: data}, false)
+	return nil
+}
+
+// Subscribe binds the handler to the specified channel.
+func (p *PubSub) Subscribe(channel string, handler qp.Handler) (qp.Subscription, error) {
+	s := &subscription{handler: handler}
+	p.lock.Lock()
+	p.subscriptions[channel] = append(p.subscriptions[channel], s)
+	p.lock.Unlock()
+	return qp.SubscriptionFunc(func() error {
+		p.remove(channel, s)
+		return nil
+	}), nil
+}
+
+// remove unbinds a single subscription from the channel.
+func (p *PubSub) remove(channel string, s *subscription) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	subscriptions := p.subscriptions[channel]
+	for i, existing := range subscriptions {
+		if existing == s {
+			subscriptions = append(subscriptions[:i:i], subscriptions[i+1:]...)
+			break
+		}
+	}
+	if len(subscriptions) == 0 {
+		delete(p.subscriptions, channel)
+	} else {
+		p.subscriptions[channel] = subscriptions
+	}
+}
+
+// Unsubscribe unbinds all handlers from the specified channel.
+func (p *PubSub) Unsubscribe(channel string) error {
+	p.lock.Lock()
+	delete(p.subscriptions, channel)
+	p.lock.Unlock()
+	return nil
+}
+
+// handlers gets the handlers subscribed to channels matching the
+// channel, or none if the transport is not running. The handlers
+// are in order of channel, then of subscription, so that delivery
+// is always in the same order.
+func (p *PubSub) handlers(channel string) []qp.Handler {
+	if p.State() != qp.StateRunning {
+		return nil
+	}
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	var patterns []string
+	for pattern := range p.subscriptions {
+		if qp.MatchChannel(pattern, channel) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	sort.Strings(patterns)
+	var handlers []qp.Handler
+	for _, pattern := range patterns {
+		for _, s := range p.subscriptions[pattern] {
+			handlers = append(handlers, s.handler)
+		}
+	}
+	return handlers
+}
+
+// Start starts the transport.
+func (p *PubSub) Start() error {
+	if err := p.BeginStart(); err != nil {
+		return err
+	}
+	return p.EndStart(nil)
+}
+
+// Stop stops the transport and closes StopChan(). Handlers run
+// while messages are delivered, so there is never anything in
+// flight to wait for.
+func (p *PubSub) Stop(grace time.Duration) {
+	if !p.BeginStop() {
+		return
+	}
+	p.EndStop(0)
+}
@@ -3,26 +3,31 @@ package redis
 import (
 	"net"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/stretchr/pat/sleep"
 
 	"github.com/garyburd/redigo/redis"
 	"github.com/qp/go"
-	"github.com/stretchr/pat/stop"
 	"github.com/stretchr/slog"
 )
 
 // Direct represents a qp.DirectTransport.
 type Direct struct {
-	pool     *redis.Pool
-	stopChan chan stop.Signal
-	running  uint32
-	handlers map[string]qp.Handler
-	lock     sync.Mutex
-	shutdown chan qp.Signal
-	log      slog.Logger
+	qp.Lifecycle
+	pool      *redis.Pool
+	handlers  map[string]qp.Handler
+	options   map[string]qp.ChannelOptions
+	listeners map[string]*listener
+	lock      sync.Mutex
+	shutdown  chan qp.Signal
+	log       slog.Logger
+}
+
+// listener takes messages from a single channel.
+type listener struct {
+	quit       chan qp.Signal
+	dispatcher *qp.Dispatcher
 }
 
 // ensure the interface is satisfied
@@ -50,11 +55,11 @@ func NewDirectTimeout(url string, connectTimeout, readTimeout, writeTimeout time
 		},
 	}
 	p := &Direct{
-		pool:     pool,
-		handlers: make(map[string]qp.Handler),
-		shutdown: make(chan qp.Signal),
-		stopChan: stop.Make(),
-		log:      slog.NilLogger,
+		pool:      pool,
+		handlers:  make(map[string]qp.Handler),
+		options:   make(map[string]qp.ChannelOptions),
+		listeners: make(map[string]*listener),
+		log:       slog.NilLogger,
 	}
 	return p
 }
@@ -66,7 +71,7 @@ func (d *Direct) SetLogger(log slog.Logger) {
 
 // Send sends data on the channel.
 func (d *Direct) Send(channel string, data []byte) error {
-	if atomic.LoadUint32(&d.running) == 0 {
+	if !d.Running() {
 		return qp.ErrNotRunning
 	}
 	if d.log.Info() {
@@ -82,62 +87,121 @@ func (d *Direct) Send(channel string, data []byte) error {
 }
 
 // OnMessage binds the handler to the specified channel.
+// If the transport is running, it starts listening on the
+// channel straight away.
 func (d *Direct) OnMessage(channel string, handler qp.Handler) error {
-	if atomic.LoadUint32(&d.running) == 1 {
-		return qp.ErrRunning
-	}
 	if d.log.Info() {
 		d.log.Info("listening to", channel)
 	}
 	d.lock.Lock()
 	d.handlers[channel] = handler
+	if d.State() == qp.StateRunning {
+		d.listen(channel)
+	}
+	d.lock.Unlock()
+	return nil
+}
+
+// RemoveHandler unbinds the handler from the specified channel.
+// If the transport is running, it stops listening on the channel.
+// Handlers that are already running are left to finish, and a
+// message taken from Redis after the handler was removed is put
+// back on the list.
+func (d *Direct) RemoveHandler(channel string) error {
+	if d.log.Info() {
+		d.log.Info("no longer listening to", channel)
+	}
+	d.lock.Lock()
+	delete(d.handlers, channel)
+	d.unlisten(channel)
 	d.lock.Unlock()
 	return nil
 }
 
-func (d *Direct) processMessages() {
+// SetChannelOptions sets the options that control how messages
+// on the specified channel are dispatched to its handler.
+// When the channel is at capacity, no more messages are taken
+// from Redis until a handler returns.
+func (d *Direct) SetChannelOptions(channel string, options qp.ChannelOptions) error {
+	d.lock.Lock()
+	d.options[channel] = options
+	if _, ok := d.handlers[channel]; ok && d.State() == qp.StateRunning {
+		d.listen(channel)
+	}
+	d.lock.Unlock()
+	return nil
+}
+
+// listen starts taking messages from the channel, replacing
+// any existing listener.
+// Callers must hold the lock.
+func (d *Direct) listen(channel string) {
+	d.unlisten(channel)
+	quit := make(chan qp.Signal)
+	shutdown := d.shutdown
+	dispatcher := qp.NewDispatcher(d.handlers[channel], d.options[channel])
+	d.listeners[channel] = &listener{quit: quit, dispatcher: dispatcher}
 	go func() {
-		for c, h := range d.handlers {
-			go func(channel string, handler qp.Handler) {
-				sleeper := sleep.New()
-				sleeper.Add(1*time.Minute, 1*time.Second)
-				sleeper.Add(5*time.Minute, 10*time.Second)
-				sleeper.Add(10*time.Minute, 30*time.Second)
-				for {
-					select {
-					case <-d.shutdown:
-						if d.log.Info() {
-							d.log.Info("shutting down")
+		// unblock the listener if it is waiting on a full channel
+		select {
+		case <-quit:
+		case <-shutdown:
+			dispatcher.Close()
+		}
+	}()
+	go func() {
+		defer dispatcher.Close()
+		sleeper := sleep.New()
+		sleeper.Add(1*time.Minute, 1*time.Second)
+		sleeper.Add(5*time.Minute, 10*time.Second)
+		sleeper.Add(10*time.Minute, 30*time.Second)
+		for {
+			select {
+			case <-quit:
+				return
+			case <-shutdown:
+				if d.log.Info() {
+					d.log.Info("shutting down")
+				}
+				return
+			default:
+				conn := d.pool.Get()
+				err := d.handleMessage(conn, channel, dispatcher)
+				conn.Close()
+				if err != nil {
+					if d.log.Warn() {
+						d.log.Warn("failed to handle message:", err, "sleeping for", sleeper.Duration())
+					}
+					if sleeper.Sleep() == sleep.Abort {
+						if d.log.Err() {
+							d.log.Err("unable to connect to redis - aborting:", err)
 						}
 						return
-					default:
-						conn := d.pool.Get()
-						if err := d.handleMessage(conn, channel, handler); err != nil {
-							if d.log.Warn() {
-								d.log.Warn("failed to handle message:", err, "sleeping for", sleeper.Duration())
-							}
-							if sleeper.Sleep() == sleep.Abort {
-								if d.log.Err() {
-									d.log.Err("unable to connect to redis - aborting:", err)
-								}
-								return
-							}
-						} else {
-							if sleeper.Reset() {
-								if d.log.Warn() {
-									d.log.Warn("reconnected to redis after interruption")
-								}
-							}
+					}
+				} else {
+					if sleeper.Reset() {
+						if d.log.Warn() {
+							d.log.Warn("reconnected to redis after interruption")
 						}
-						conn.Close()
 					}
 				}
-			}(c, h)
+			}
 		}
 	}()
 }
 
-func (d *Direct) handleMessage(conn redis.Conn, channel string, handler qp.Handler) error {
+// unlisten stops taking messages from the channel.
+// Callers must hold the lock.
+func (d *Direct) unlisten(channel string) {
+	if l, ok := d.listeners[channel]; ok {
+		close(l.quit)
+		// anything taken from now on goes back on the list
+		l.dispatcher.Close()
+		delete(d.listeners, channel)
+	}
+}
+
+func (d *Direct) handleMessage(conn redis.Conn, channel string, dispatcher *qp.Dispatcher) error {
 	var data []byte
 	// BRPOP on the channel to wait for a new message
 	message, err := redis.Values(conn.Do("BRPOP", channel, "1"))
@@ -160,49 +224,69 @@ func (d *Direct) handleMessage(conn redis.Conn, channel string, handler qp.Handl
 	if d.log.Info() {
 		d.log.Info("handling message on", channel+":", string(data))
 	}
-	go handler.Handle(&qp.Message{Source: channel, Data: data})
+	// blocks while the channel is at capacity
+	if err := dispatcher.Dispatch(&qp.Message{Source: channel, Data: data}); err != nil {
+		// stopped while waiting - put the message back
+		// where the next BRPOP will find it
+		if d.log.Info() {
+			d.log.Info("returning message to", channel)
+		}
+		_, err := conn.Do("RPUSH", channel, data)
+		return err
+	}
 	return nil
 }
 
 // Start starts the transport.
+// A stopped transport may be started again.
 func (d *Direct) Start() error {
-	if atomic.LoadUint32(&d.running) == 0 {
-		atomic.StoreUint32(&d.running, 1)
-		if d.log.Info() {
-			d.log.Info("starting")
-		}
-		go d.processMessages()
-	} else {
-		return qp.ErrRunning
+	if err := d.BeginStart(); err != nil {
+		return err
 	}
-	return nil
+	if d.log.Info() {
+		d.log.Info("starting")
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.shutdown = make(chan qp.Signal)
+	for channel := range d.handlers {
+		d.listen(channel)
+	}
+	return d.EndStart(nil)
 }
 
 // Stop instructs the transport to gracefully stop and close the
 // StopChan when stopping has completed.
 //
-// In-flight requests will have "wait" duration to complete
-// before being abandoned.
+// No new messages are taken from Redis once Stop is called, and
+// in-flight requests have the grace period to complete before
+// being abandoned. Sends are still allowed until then, so that
+// handlers can pass their results on. It is safe to call Stop
+// more than once.
 func (d *Direct) Stop(grace time.Duration) {
+	if !d.BeginStop() {
+		return
+	}
 	if d.log.Info() {
 		d.log.Info("stopping...")
 	}
-	// stop processing new Sends
-	atomic.StoreUint32(&d.running, 0)
-	// wait for duration to allow in-flight requests to finish
-	time.Sleep(grace)
 	// instruct all receiving goroutines to shutdown
+	d.lock.Lock()
 	close(d.shutdown)
+	dispatchers := make([]*qp.Dispatcher, 0, len(d.listeners))
+	for channel, l := range d.listeners {
+		dispatchers = append(dispatchers, l.dispatcher)
+		delete(d.listeners, channel)
+	}
+	d.lock.Unlock()
+	// wait for in-flight requests to finish
+	abandoned := qp.Drain(grace, dispatchers...)
+	if abandoned > 0 && d.log.Warn() {
+		d.log.Warn("abandoned", abandoned, "in-flight requests")
+	}
 	// inform caller of stop complete
-	close(d.stopChan)
+	d.EndStop(abandoned)
 	if d.log.Info() {
 		d.log.Info("stopped")
 	}
 }
-
-// StopChan gets the stop channel which will block until
-// stopping has completed, at which point it is closed.
-// Callers should never close the stop channel.
-func (d *Direct) StopChan() <-chan stop.Signal {
-	return d.stopChan
-}
@@ -5,7 +5,9 @@ import (
 	"time"
 
 	"github.com/qp/go"
+	"github.com/qp/go/qptest"
 	"github.com/qp/go/redis"
+	"github.com/qp/go/transporttest"
 	"github.com/stretchr/pat/stop"
 	"github.com/stretchr/testify/require"
 )
@@ -40,3 +42,95 @@ func TestDirect(t *testing.T) {
 	}
 
 }
+
+func TestDirectOnMessageWhileRunning(t *testing.T) {
+
+	ensureRedis(t)
+
+	d := redis.NewDirect("127.0.0.1:6379")
+	defer func() {
+		d.Stop(stop.NoWait)
+		<-d.StopChan()
+	}()
+	require.NoError(t, d.Start())
+
+	msgs := make(chan *qp.Message)
+	data := []byte("testing")
+	require.NoError(t, d.OnMessage("running", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	})))
+	require.NoError(t, d.Send("running", data))
+
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "running", msg.Source)
+		require.Equal(t, data, msg.Data)
+	case <-time.After(1000 * time.Millisecond):
+		require.FailNow(t, "no message received")
+	}
+
+	require.NoError(t, d.RemoveHandler("running"))
+
+}
+
+func TestDirectStopDrains(t *testing.T) {
+
+	ensureRedis(t)
+
+	d := redis.NewDirect("127.0.0.1:6379")
+	started := make(chan struct{})
+	require.NoError(t, d.OnMessage("draining", qp.HandlerFunc(func(msg *qp.Message) {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+	})))
+	require.NoError(t, d.Start())
+	require.NoError(t, d.Send("draining", []byte("testing")))
+	<-started
+
+	start := time.Now()
+	d.Stop(1 * time.Second)
+	<-d.StopChan()
+	require.Equal(t, 0, d.Abandoned())
+	require.True(t, time.Since(start) < 500*time.Millisecond, "Stop should return once handlers finish")
+	d.Stop(stop.NoWait)
+
+}
+
+func TestDirectFaults(t *testing.T) {
+
+	ensureRedis(t)
+
+	injector := qptest.NewInjector(1, qptest.Faults{Loss: 1})
+	d := qptest.NewFaultyDirect(redis.NewDirect("127.0.0.1:6379"), injector)
+	require.NoError(t, qp.ServiceFunc("faulty", "1", qp.JSON, d, func(r *qp.Transaction) *qp.Transaction {
+		r.Data = "handled"
+		return r
+	}))
+	require.NoError(t, d.Start())
+	defer func() {
+		d.Stop(stop.NoWait)
+		<-d.StopChan()
+	}()
+	requester, err := qp.NewRequester("faulty.client", "1", qp.JSON, d)
+	require.NoError(t, err)
+
+	future, err := requester.Issue([]string{"faulty"}, "request")
+	require.NoError(t, err)
+	_, err = future.Response(100 * time.Millisecond)
+	require.Equal(t, qp.ErrTimeout, err)
+
+	injector.SetFaults(qptest.Faults{})
+	future, err = requester.Issue([]string{"faulty"}, "request")
+	require.NoError(t, err)
+	response, err := future.Response(2 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "handled", response.Data)
+
+}
+
+func TestDirectConformance(t *testing.T) {
+	ensureRedis(t)
+	transporttest.Direct(t, func() qp.DirectTransport {
+		return redis.NewDirect("127.0.0.1:6379")
+	})
+}
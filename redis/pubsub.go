@@ -1,29 +1,37 @@
 package redis
 
 import (
-	"net"
+	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
 	"github.com/qp/go"
 	"github.com/stretchr/pat/sleep"
-	"github.com/stretchr/pat/stop"
 	"github.com/stretchr/slog"
 )
 
-// PubSub represents a qp.PubSubTransport.
+// PubSub represents a qp.PubSubTransport. It subscribes to every
+// channel on a single connection.
 type PubSub struct {
-	pool     *redis.Pool
-	handlers map[string]qp.Handler
-	lock     sync.Mutex
-	running  uint32
+	qp.Lifecycle
+	pool          *redis.Pool
+	subscriptions map[string][]*subscription
+	options       map[string]qp.ChannelOptions
+	lock          sync.Mutex
+	// conn is the connection subscribed to the channels. Its Conn
+	// is nil while the transport is not connected.
+	conn     redis.PubSubConn
 	shutdown chan qp.Signal
-	stopChan chan stop.Signal
 	log      slog.Logger
 }
 
+// subscription is a single handler bound to a channel.
+type subscription struct {
+	handler    qp.Handler
+	dispatcher *qp.Dispatcher
+}
+
 // ensure the interface is satisfied
 var _ qp.PubSubTransport = (*PubSub)(nil)
 
@@ -46,11 +54,10 @@ func NewPubSubTimeout(url string, connectTimeout, readTimeout, writeTimeout time
 		},
 	}
 	p := &PubSub{
-		pool:     pool,
-		handlers: make(map[string]qp.Handler),
-		shutdown: make(chan qp.Signal),
-		stopChan: stop.Make(),
-		log:      slog.NilLogger,
+		pool:          pool,
+		subscriptions: make(map[string][]*subscription),
+		options:       make(map[string]qp.ChannelOptions),
+		log:           slog.NilLogger,
 	}
 	return p
 }
@@ -62,7 +69,7 @@ func (p *PubSub) SetLogger(log slog.Logger) {
 
 // Publish publishes data on the specified channel.
 func (p *PubSub) Publish(channel string, data []byte) error {
-	if atomic.LoadUint32(&p.running) == 0 {
+	if !p.Running() {
 		return qp.ErrNotRunning
 	}
 	if p.log.Info() {
@@ -78,109 +85,349 @@ func (p *PubSub) Publish(channel string, data []byte) error {
 }
 
 // Subscribe binds the handler to the specified channel.
-func (p *PubSub) Subscribe(channel string, handler qp.Handler) error {
-	if atomic.LoadUint32(&p.running) == 1 {
-		return qp.ErrRunning
-	}
+// If the transport is running, it subscribes to the channel
+// straight away.
+// All handlers on a channel share a single Redis subscription.
+func (p *PubSub) Subscribe(channel string, handler qp.Handler) (qp.Subscription, error) {
 	if p.log.Info() {
 		p.log.Info("subscribing to", channel)
 	}
 	p.lock.Lock()
-	p.handlers[channel] = handler
+	s := &subscription{
+		handler:    handler,
+		dispatcher: qp.NewDispatcher(handler, p.options[channel]),
+	}
+	p.subscriptions[channel] = append(p.subscriptions[channel], s)
+	if len(p.subscriptions[channel]) == 1 {
+		p.listen(channel)
+	}
+	p.lock.Unlock()
+	return qp.SubscriptionFunc(func() error {
+		p.remove(channel, s)
+		return nil
+	}), nil
+}
+
+// remove unbinds a single subscription from the channel,
+// unsubscribing from Redis if it was the last one.
+func (p *PubSub) remove(channel string, s *subscription) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	subscriptions := p.subscriptions[channel]
+	for i, existing := range subscriptions {
+		if existing == s {
+			s.dispatcher.Close()
+			subscriptions = append(subscriptions[:i:i], subscriptions[i+1:]...)
+			break
+		}
+	}
+	if len(subscriptions) == 0 {
+		delete(p.subscriptions, channel)
+		p.unlisten(channel)
+	} else {
+		p.subscriptions[channel] = subscriptions
+	}
+}
+
+// Unsubscribe unbinds all handlers from the specified channel.
+// If the transport is running, it unsubscribes from the channel.
+func (p *PubSub) Unsubscribe(channel string) error {
+	if p.log.Info() {
+		p.log.Info("unsubscribing from", channel)
+	}
+	p.lock.Lock()
+	for _, s := range p.subscriptions[channel] {
+		s.dispatcher.Close()
+	}
+	delete(p.subscriptions, channel)
+	p.unlisten(channel)
 	p.lock.Unlock()
 	return nil
 }
 
-func (p *PubSub) processMessages() {
-	go func() {
-		for c, h := range p.handlers {
-			go func(channel string, handler qp.Handler) {
-				sleeper := sleep.New()
-				sleeper.Add(1*time.Minute, 1*time.Second)
-				sleeper.Add(5*time.Minute, 10*time.Second)
-				sleeper.Add(10*time.Minute, 30*time.Second)
-
-				var conn redis.Conn
-				var psc redis.PubSubConn
-				closed := false
-
-				go func() {
-					<-p.shutdown
-					if p.log.Info() {
-						p.log.Info("received shutdown signal - shutting down")
-					}
-					closed = true
-					psc.Close()
-				}()
-				for {
-					conn = p.pool.Get()
-					psc = redis.PubSubConn{Conn: conn}
-					psc.PSubscribe(channel)
-					switch v := psc.Receive().(type) {
-					case redis.PMessage:
-						if sleeper.Reset() {
-							if p.log.Warn() {
-								p.log.Warn("reconnected to redis after interruption")
-							}
-						}
-						if p.log.Info() {
-							p.log.Info("handling message from", v.Channel+":", string(v.Data))
-						}
-						go handler.Handle(&qp.Message{Source: v.Channel, Data: v.Data})
-					case error, net.Error:
-						if closed {
-							return
-						}
-						if p.log.Warn() {
-							p.log.Warn("error when receiving from redis:", v)
-						}
-						if sleeper.Sleep() == sleep.Abort {
-							if p.log.Err() {
-								p.log.Err("unable to connect to redis - aborting:", v)
-							}
-							return
-						}
-					}
-				}
-			}(c, h)
-		}
-	}()
+// SetChannelOptions sets the options that control how messages
+// on the specified channel are dispatched to its handlers.
+func (p *PubSub) SetChannelOptions(channel string, options qp.ChannelOptions) error {
+	p.lock.Lock()
+	p.options[channel] = options
+	for _, s := range p.subscriptions[channel] {
+		s.dispatcher.Close()
+		s.dispatcher = qp.NewDispatcher(s.handler, options)
+	}
+	p.lock.Unlock()
+	return nil
+}
+
+// dispatchers gets the dispatchers of every handler
+// bound to the channel.
+func (p *PubSub) dispatchers(channel string) []*qp.Dispatcher {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	dispatchers := make([]*qp.Dispatcher, 0, len(p.subscriptions[channel]))
+	for _, s := range p.subscriptions[channel] {
+		dispatchers = append(dispatchers, s.dispatcher)
+	}
+	return dispatchers
 }
 
+// listen subscribes to the channel on the connection, if the
+// transport is connected. Otherwise it is subscribed to once the
+// transport connects.
+// Callers must hold the lock.
+func (p *PubSub) listen(channel string) {
+	if p.conn.Conn == nil {
+		return
+	}
+	var err error
+	if qp.IsPattern(channel) {
+		err = p.conn.PSubscribe(glob(channel))
+	} else {
+		err = p.conn.Subscribe(channel)
+	}
+	// a connection that failed is reconnected, and subscribed again
+	if err != nil && p.log.Warn() {
+		p.log.Warn("failed to subscribe to", channel+":", err)
+	}
+}
+
+// unlisten unsubscribes from the channel on the connection, once
+// it has no handlers. Patterns that share a Redis glob keep it
+// until the last of them goes.
+// Callers must hold the lock.
+func (p *PubSub) unlisten(channel string) {
+	if p.conn.Conn == nil {
+		return
+	}
+	var err error
+	if qp.IsPattern(channel) {
+		g := glob(channel)
+		for other := range p.subscriptions {
+			if qp.IsPattern(other) && glob(other) == g {
+				return
+			}
+		}
+		err = p.conn.PUnsubscribe(g)
+	} else {
+		err = p.conn.Unsubscribe(channel)
+	}
+	if err != nil && p.log.Warn() {
+		p.log.Warn("failed to unsubscribe from", channel+":", err)
+	}
+}
+
+// receive keeps a connection subscribed to every channel that has
+// handlers, and hands on the messages it receives, until shutdown
+// is closed.
+func (p *PubSub) receive(shutdown chan qp.Signal) {
+	sleeper := sleep.New()
+	sleeper.Add(1*time.Minute, 1*time.Second)
+	sleeper.Add(5*time.Minute, 10*time.Second)
+	sleeper.Add(10*time.Minute, 30*time.Second)
+	for {
+		// dial outside of the pool so the connection can
+		// safely be closed while receiving
+		c, err := p.pool.Dial()
+		conn := redis.PubSubConn{Conn: c}
+		p.lock.Lock()
+		select {
+		case <-shutdown:
+			p.lock.Unlock()
+			if c != nil {
+				c.Close()
+			}
+			return
+		default:
+		}
+		if err == nil {
+			err = p.subscribeAll(conn)
+		}
+		if err == nil {
+			p.conn = conn
+		}
+		p.lock.Unlock()
+
+		if err == nil {
+			if sleeper.Reset() && p.log.Warn() {
+				p.log.Warn("reconnected to redis after interruption")
+			}
+			// receive until the connection fails or is closed
+			err = p.receiveFrom(conn)
+			p.lock.Lock()
+			if p.conn.Conn == conn.Conn {
+				p.conn = redis.PubSubConn{}
+			}
+			p.lock.Unlock()
+		}
+		if c != nil {
+			c.Close()
+		}
+
+		select {
+		case <-shutdown:
+			if p.log.Info() {
+				p.log.Info("received shutdown signal - shutting down")
+			}
+			return
+		default:
+		}
+		if p.log.Warn() {
+			p.log.Warn("error when receiving from redis:", err)
+		}
+		if sleeper.Sleep() == sleep.Abort {
+			if p.log.Err() {
+				p.log.Err("unable to connect to redis - aborting:", err)
+			}
+			p.Fault(err)
+			return
+		}
+	}
+}
+
+// subscribeAll subscribes the new connection to every channel that
+// has handlers.
+// Callers must hold the lock.
+func (p *PubSub) subscribeAll(conn redis.PubSubConn) error {
+	var channels, globs []interface{}
+	for channel := range p.subscriptions {
+		if qp.IsPattern(channel) {
+			globs = append(globs, glob(channel))
+		} else {
+			channels = append(channels, channel)
+		}
+	}
+	if len(channels) > 0 {
+		if err := conn.Subscribe(channels...); err != nil {
+			return err
+		}
+	}
+	if len(globs) > 0 {
+		return conn.PSubscribe(globs...)
+	}
+	return nil
+}
+
+// receiveFrom hands on the messages received on the connection
+// until it fails or is closed.
+func (p *PubSub) receiveFrom(conn redis.PubSubConn) error {
+	for {
+		switch v := conn.Receive().(type) {
+		case redis.Message:
+			p.dispatch(v.Channel, &qp.Message{Source: v.Channel, Data: v.Data})
+		case redis.PMessage:
+			msg := &qp.Message{Source: v.Channel, Data: v.Data}
+			for _, pattern := range p.patterns(v.Pattern, v.Channel) {
+				p.dispatch(pattern, msg)
+			}
+		case error:
+			return v
+		}
+	}
+}
+
+// patterns gets the patterns with handlers whose Redis glob is g,
+// and that match the channel. Redis globs match more loosely than
+// qp patterns, and several patterns may share a glob.
+func (p *PubSub) patterns(g, channel string) []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var patterns []string
+	for pattern := range p.subscriptions {
+		if qp.IsPattern(pattern) && glob(pattern) == g && qp.MatchChannel(pattern, channel) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// dispatch hands the message to the handlers bound to the channel
+// or pattern.
+func (p *PubSub) dispatch(channel string, msg *qp.Message) {
+	dispatchers := p.dispatchers(channel)
+	if len(dispatchers) == 0 {
+		return
+	}
+	if p.log.Info() {
+		p.log.Info("handling message from", msg.Source+":", string(msg.Data))
+	}
+	for _, dispatcher := range dispatchers {
+		dispatcher.Dispatch(msg)
+	}
+}
+
+// glob turns a qp pattern into a Redis glob pattern that matches
+// at least the same channels. Both wildcards become "*", which
+// also matches dots, so messages must still be checked with
+// qp.MatchChannel.
+func glob(pattern string) string {
+	tokens := strings.Split(pattern, ".")
+	for i, token := range tokens {
+		if token == "*" || (token == ">" && i == len(tokens)-1) {
+			tokens[i] = "*"
+			continue
+		}
+		tokens[i] = globEscaper.Replace(token)
+	}
+	return strings.Join(tokens, ".")
+}
+
+// globEscaper escapes characters that are special in Redis globs.
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
 // Start starts the transport.
+// A stopped transport may be started again.
 func (p *PubSub) Start() error {
 	// TODO: discuss blocking this until all subscription
 	// acks are received?
-	if atomic.LoadUint32(&p.running) == 0 {
-		atomic.StoreUint32(&p.running, 1)
-		p.log.Info("starting")
-		p.processMessages()
-	} else {
-		return qp.ErrRunning
+	if err := p.BeginStart(); err != nil {
+		return err
 	}
-	return nil
+	p.log.Info("starting")
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.shutdown = make(chan qp.Signal)
+	for channel, subscriptions := range p.subscriptions {
+		for _, s := range subscriptions {
+			s.dispatcher.Close()
+			s.dispatcher = qp.NewDispatcher(s.handler, p.options[channel])
+		}
+	}
+	go p.receive(p.shutdown)
+	return p.EndStart(nil)
 }
 
 // Stop stops the transport and closes StopChan() when finished.
+//
+// No new messages are received once Stop is called, and messages
+// already being handled have the grace period to finish before
+// they are abandoned. It is safe to call Stop more than once.
 func (p *PubSub) Stop(grace time.Duration) {
-	if p.shutdown == nil {
+	if !p.BeginStop() {
 		return
 	}
 	p.log.Info("stopping...")
-	// stop processing new Publish calls
-	atomic.StoreUint32(&p.running, 0)
 	// instruct all listening goroutines to shutdown
+	var dispatchers []*qp.Dispatcher
+	p.lock.Lock()
 	close(p.shutdown)
-	p.shutdown = nil
-	// wait for duration to allow in-flight requests to finish
-	time.Sleep(grace)
+	if p.conn.Conn != nil {
+		p.conn.Close()
+		p.conn = redis.PubSubConn{}
+	}
+	for _, subscriptions := range p.subscriptions {
+		for _, s := range subscriptions {
+			dispatchers = append(dispatchers, s.dispatcher)
+		}
+	}
+	p.lock.Unlock()
+	// wait for in-flight messages to finish
+	abandoned := qp.Drain(grace, dispatchers...)
+	for _, d := range dispatchers {
+		d.Close()
+	}
+	if abandoned > 0 && p.log.Warn() {
+		p.log.Warn("abandoned", abandoned, "in-flight handlers")
+	}
 	// inform caller of stop complete
-	close(p.stopChan)
+	p.EndStop(abandoned)
 	p.log.Info("stopped")
 }
-
-// StopChan gets the stop channel which will be closed when
-// this transport has successfully stopped.
-func (p *PubSub) StopChan() <-chan stop.Signal {
-	return p.stopChan
-}
@@ -0,0 +1,97 @@
+package redis
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/qp/go"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGlob(t *testing.T) {
+
+	assert.Equal(t, "orders.*.created", glob("orders.*.created"))
+	assert.Equal(t, "orders.*", glob("orders.>"))
+	assert.Equal(t, `orders.eu\*.>.x`, glob("orders.eu*.>.x"))
+	assert.Equal(t, `orders\?.\[eu\].\\`, glob(`orders?.[eu].\`))
+
+}
+
+func TestPubSubOneConnection(t *testing.T) {
+
+	c, err := redis.Dial("tcp", "127.0.0.1:6379")
+	if err != nil {
+		t.Skip("skipping because redis is not running")
+	}
+	c.Close()
+
+	publisher := NewPubSub("127.0.0.1:6379")
+	require.NoError(t, publisher.Start())
+	defer publisher.Stop(stop.NoWait)
+	ps := NewPubSub("127.0.0.1:6379")
+	var dials int64
+	dial := ps.pool.Dial
+	ps.pool.Dial = func() (redis.Conn, error) {
+		atomic.AddInt64(&dials, 1)
+		return dial()
+	}
+	msgs := make(chan *qp.Message, 10)
+	handler := qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	})
+	_, err = ps.Subscribe("one.channel", handler)
+	require.NoError(t, err)
+	require.NoError(t, ps.Start())
+	defer ps.Stop(stop.NoWait)
+	// subscribed while running, on the same connection, including
+	// two patterns that share a Redis glob
+	_, err = ps.Subscribe("two.channel", handler)
+	require.NoError(t, err)
+	_, err = ps.Subscribe("three.*", handler)
+	require.NoError(t, err)
+	_, err = ps.Subscribe("three.>", handler)
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	receive := func(expected ...string) {
+		var sources []string
+		for range expected {
+			select {
+			case msg := <-msgs:
+				sources = append(sources, msg.Source)
+			case <-time.After(1 * time.Second):
+				require.FailNow(t, "no message received")
+			}
+		}
+		require.ElementsMatch(t, expected, sources)
+		select {
+		case msg := <-msgs:
+			require.FailNow(t, "unexpected message", msg.Source)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	require.NoError(t, publisher.Publish("one.channel", []byte("data")))
+	require.NoError(t, publisher.Publish("two.channel", []byte("data")))
+	require.NoError(t, publisher.Publish("three.x", []byte("data")))
+	receive("one.channel", "two.channel", "three.x", "three.x")
+
+	// channels are unsubscribed from on the same connection, and a
+	// glob is kept while a pattern still uses it
+	require.NoError(t, ps.Unsubscribe("one.channel"))
+	require.NoError(t, ps.Unsubscribe("three.*"))
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, publisher.Publish("one.channel", []byte("data")))
+	require.NoError(t, publisher.Publish("three.x", []byte("data")))
+	receive("three.x")
+	require.NoError(t, ps.Unsubscribe("three.>"))
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, publisher.Publish("three.x", []byte("data")))
+	receive()
+
+	require.Equal(t, int64(1), atomic.LoadInt64(&dials))
+
+}
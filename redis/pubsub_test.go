@@ -7,6 +7,7 @@ import (
 	"github.com/qp/go"
 
 	"github.com/qp/go/redis"
+	"github.com/qp/go/transporttest"
 	"github.com/stretchr/pat/stop"
 	"github.com/stretchr/testify/require"
 )
@@ -33,12 +34,14 @@ func TestPubSub(t *testing.T) {
 	msgs := make(chan *qp.Message)
 	data := []byte("testing")
 
-	require.NoError(t, ps.Subscribe("channel", qp.HandlerFunc(func(msg *qp.Message) {
+	_, err := ps.Subscribe("channel", qp.HandlerFunc(func(msg *qp.Message) {
 		msgs <- msg
-	})))
-	require.NoError(t, ps2.Subscribe("channel", qp.HandlerFunc(func(msg *qp.Message) {
+	}))
+	require.NoError(t, err)
+	_, err = ps2.Subscribe("channel", qp.HandlerFunc(func(msg *qp.Message) {
 		msgs <- msg
-	})))
+	}))
+	require.NoError(t, err)
 
 	require.NoError(t, publisher.Start())
 	require.NoError(t, ps.Start())
@@ -67,3 +70,103 @@ func TestPubSub(t *testing.T) {
 	}()
 
 }
+
+func TestPubSubMultipleHandlers(t *testing.T) {
+
+	ensureRedis(t)
+
+	ps := redis.NewPubSub("127.0.0.1:6379")
+	require.NoError(t, ps.Start())
+	defer func() {
+		ps.Stop(stop.NoWait)
+		<-ps.StopChan()
+	}()
+
+	first := make(chan *qp.Message, 2)
+	second := make(chan *qp.Message, 2)
+	sub, err := ps.Subscribe("user.created", qp.HandlerFunc(func(msg *qp.Message) {
+		first <- msg
+	}))
+	require.NoError(t, err)
+	_, err = ps.Subscribe("user.created", qp.HandlerFunc(func(msg *qp.Message) {
+		second <- msg
+	}))
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	require.NoError(t, ps.Publish("user.created", []byte("one")))
+	for _, msgs := range []chan *qp.Message{first, second} {
+		select {
+		case msg := <-msgs:
+			require.Equal(t, "one", string(msg.Data))
+		case <-time.After(1000 * time.Millisecond):
+			require.FailNow(t, "no message received")
+		}
+	}
+
+	require.NoError(t, sub.Unsubscribe())
+	require.NoError(t, ps.Publish("user.created", []byte("two")))
+	select {
+	case msg := <-second:
+		require.Equal(t, "two", string(msg.Data))
+	case <-time.After(1000 * time.Millisecond):
+		require.FailNow(t, "no message received")
+	}
+	select {
+	case <-first:
+		require.FailNow(t, "unsubscribed handler should not receive messages")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+}
+
+func TestPubSubPatterns(t *testing.T) {
+
+	ensureRedis(t)
+
+	ps := redis.NewPubSub("127.0.0.1:6379")
+	require.NoError(t, ps.Start())
+	defer func() {
+		ps.Stop(stop.NoWait)
+		<-ps.StopChan()
+	}()
+
+	created := make(chan *qp.Message, 10)
+	literal := make(chan *qp.Message, 10)
+	_, err := ps.Subscribe("orders.*.created", qp.HandlerFunc(func(msg *qp.Message) {
+		created <- msg
+	}))
+	require.NoError(t, err)
+	_, err = ps.Subscribe("orders?", qp.HandlerFunc(func(msg *qp.Message) {
+		literal <- msg
+	}))
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	require.NoError(t, ps.Publish("orders.eu.west.created", []byte("one")))
+	require.NoError(t, ps.Publish("orders1", []byte("two")))
+	require.NoError(t, ps.Publish("orders.eu.created", []byte("three")))
+
+	select {
+	case msg := <-created:
+		require.Equal(t, "orders.eu.created", msg.Source)
+		require.Equal(t, "three", string(msg.Data))
+	case <-time.After(1000 * time.Millisecond):
+		require.FailNow(t, "no message received")
+	}
+	select {
+	case <-literal:
+		require.FailNow(t, "orders? is not a pattern")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+}
+
+func TestPubSubConformance(t *testing.T) {
+	ensureRedis(t)
+	transporttest.PubSub(t, func() qp.PubSubTransport {
+		return redis.NewPubSub("127.0.0.1:6379")
+	})
+}
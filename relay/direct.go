@@ -0,0 +1,76 @@
+package relay
+
+import (
+	"sync"
+
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+)
+
+// Direct drains the queues of channels on one qp.DirectTransport,
+// and sends the messages on another.
+type Direct struct {
+	relay
+	source      qp.DirectTransport
+	destination qp.DirectTransport
+	lock        sync.Mutex
+	channels    map[string]struct{}
+}
+
+// NewDirect makes a new Direct that drains queues on the source
+// into the destination.
+func NewDirect(source, destination qp.DirectTransport) *Direct {
+	return NewDirectOptions(source, destination, Options{})
+}
+
+// NewDirectOptions makes a new Direct with the specified options.
+func NewDirectOptions(source, destination qp.DirectTransport, options Options) *Direct {
+	return &Direct{
+		relay:       relay{options: options, log: slog.NilLogger},
+		source:      source,
+		destination: destination,
+		channels:    make(map[string]struct{}),
+	}
+}
+
+// SetLogger sets the Logger to log to.
+func (d *Direct) SetLogger(log slog.Logger) {
+	d.log = log
+}
+
+// Relay starts draining the queue of the channel, by binding a
+// handler to it on the source that competes with any others for its
+// messages. Messages are sent while both transports are running,
+// and those that cannot be sent on the destination are dropped.
+func (d *Direct) Relay(channel string) error {
+	if err := d.source.OnMessage(channel, qp.HandlerFunc(d.handle)); err != nil {
+		return err
+	}
+	d.lock.Lock()
+	d.channels[channel] = struct{}{}
+	d.lock.Unlock()
+	return nil
+}
+
+// Remove stops draining the queue of the channel.
+func (d *Direct) Remove(channel string) error {
+	d.lock.Lock()
+	_, ok := d.channels[channel]
+	delete(d.channels, channel)
+	d.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	return d.source.RemoveHandler(channel)
+}
+
+// handle sends the message on the destination.
+func (d *Direct) handle(msg *qp.Message) {
+	channel, data, ok := d.copy(msg)
+	if !ok {
+		return
+	}
+	if err := d.destination.Send(channel, data); err != nil && d.log.Warn() {
+		d.log.Warn("failed to send", msg, "to", channel, ":", err)
+	}
+}
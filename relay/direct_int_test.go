@@ -0,0 +1,128 @@
+package relay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/qp/go/inproc"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectRequestResponse(t *testing.T) {
+
+	oldBus, newBus := inproc.NewBus(), inproc.NewBus()
+	defer oldBus.Close()
+	defer newBus.Close()
+	client, service := oldBus.NewDirect(), newBus.NewDirect()
+
+	// the service has moved to the new broker, and its responses
+	// come back to the client on the old one
+	requester, err := qp.NewRequester("client", "one", qp.JSON, client)
+	require.NoError(t, err)
+	froms := make(chan []string, 1)
+	responder := qp.NewResponder("service", "one", qp.JSON, service)
+	require.NoError(t, responder.HandleFunc("service", func(tx *qp.Transaction) *qp.Transaction {
+		froms <- tx.From
+		tx.Data = "handled " + tx.Data.(string)
+		return tx
+	}))
+	require.NoError(t, NewDirectOptions(client, service, Options{ID: "relay.requests"}).Relay("service"))
+	require.NoError(t, NewDirectOptions(service, client, Options{ID: "relay.responses"}).Relay("client.one"))
+	require.NoError(t, client.Start())
+	defer client.Stop(stop.NoWait)
+	require.NoError(t, service.Start())
+	defer service.Stop(stop.NoWait)
+
+	future, err := requester.Issue([]string{"service"}, "request")
+	require.NoError(t, err)
+	response, err := future.Response(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "handled request", response.Data)
+	// the relay leaves From as it is
+	require.Equal(t, []string{"client.one"}, <-froms)
+	require.Equal(t, []qp.Hop{{Relay: "relay.requests", Channel: "service"}, {Relay: "relay.responses", Channel: "client.one"}}, response.Hops)
+
+}
+
+func TestDirectSharedID(t *testing.T) {
+
+	dc1, dc2 := inproc.NewBus(), inproc.NewBus()
+	defer dc1.Close()
+	defer dc2.Close()
+	client, service := dc1.NewDirect(), dc2.NewDirect()
+
+	// the relays that take requests there and responses back share
+	// an ID
+	requester, err := qp.NewRequester("client", "one", qp.JSON, client)
+	require.NoError(t, err)
+	responder := qp.NewResponder("service", "one", qp.JSON, service)
+	require.NoError(t, responder.HandleFunc("service", func(tx *qp.Transaction) *qp.Transaction {
+		return tx
+	}))
+	options := Options{ID: "relay.dc"}
+	require.NoError(t, NewDirectOptions(client, service, options).Relay("service"))
+	require.NoError(t, NewDirectOptions(service, client, options).Relay("client.one"))
+	require.NoError(t, client.Start())
+	defer client.Stop(stop.NoWait)
+	require.NoError(t, service.Start())
+	defer service.Stop(stop.NoWait)
+
+	future, err := requester.Issue([]string{"service"}, "request")
+	require.NoError(t, err)
+	response, err := future.Response(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "request", response.Data)
+	require.Equal(t, "client.one", response.From[0])
+	require.Len(t, response.From, 2)
+	require.Equal(t, []qp.Hop{{Relay: "relay.dc", Channel: "service"}, {Relay: "relay.dc", Channel: "client.one"}}, response.Hops)
+
+}
+
+func TestDirectRelay(t *testing.T) {
+
+	oldBus, newBus := inproc.NewBus(), inproc.NewBus()
+	defer oldBus.Close()
+	defer newBus.Close()
+	source, destination := oldBus.NewDirect(), newBus.NewDirect()
+	msgs := make(chan *qp.Message, 10)
+	require.NoError(t, destination.OnMessage("tasks", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	})))
+	r := NewDirectOptions(source, destination, Options{ID: "relay.jobs", Rename: Prefix("jobs", "tasks")})
+	require.NoError(t, r.Relay("jobs"))
+	require.NoError(t, source.Start())
+	defer source.Stop(stop.NoWait)
+	require.NoError(t, destination.Start())
+	defer destination.Stop(stop.NoWait)
+
+	// data that is not an envelope is copied as it is
+	require.NoError(t, source.Send("jobs", []byte("raw")))
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "raw", string(msg.Data))
+	case <-time.After(time.Second):
+		require.FailNow(t, "not relayed")
+	}
+
+	// transactions that the relay has copied to the channel are not
+	// copied from it
+	data, err := qp.JSON.Marshal(&qp.Transaction{From: []string{"client.one"}, Data: "again", Hops: []qp.Hop{{Relay: "relay.jobs", Channel: "jobs"}}})
+	require.NoError(t, err)
+	require.NoError(t, source.Send("jobs", data))
+	select {
+	case msg := <-msgs:
+		require.FailNow(t, "relayed again", "%v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, r.Remove("jobs"))
+	require.NoError(t, source.Send("jobs", []byte("raw")))
+	select {
+	case msg := <-msgs:
+		require.FailNow(t, "relayed after Remove", "%v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+}
@@ -0,0 +1,34 @@
+// Package relay copies messages from one transport to another, to
+// connect brokers that are apart, or to move services from one
+// broker to another a few channels at a time.
+//
+// A PubSub copies the events published on channels of one
+// PubSubTransport to another, and a Direct drains the queues of
+// channels on one DirectTransport into another:
+//
+//	events := relay.NewPubSubOptions(oldPubSub, newPubSub, relay.Options{ID: "relay.migration"})
+//	events.Relay("orders.>")
+//	requests := relay.NewDirect(oldDirect, newDirect)
+//	requests.Relay("orders.create")
+//
+// Relays do not start or stop the transports, and only copy
+// messages while both are running. Responders send responses on the
+// transport the request reached them on, so a Direct that relays
+// requests needs another that relays the requesters' channels back.
+//
+// Messages can be renamed on the way, with Prefix for instance, and
+// filtered. When the relay has an ID it adds a qp.Hop with it, and
+// the channel it copies to, to the Hops of each envelope it copies,
+// so that relays that copy messages in both directions between two
+// brokers do not copy them back. The From field is left as it is.
+// Events are not copied again by a relay they have a hop through.
+// Transactions are not copied by a relay from the channel it has
+// copied them to, so responses can come back through relays that
+// share the ID of those the requests went through. Relays that
+// mirror channels between two brokers in both directions share an
+// ID:
+//
+//	options := relay.Options{ID: "relay.dc1-dc2"}
+//	relay.NewPubSubOptions(dc1, dc2, options).Relay("orders.>")
+//	relay.NewPubSubOptions(dc2, dc1, options).Relay("orders.>")
+package relay
@@ -0,0 +1,49 @@
+package relay
+
+import (
+	"strings"
+
+	"github.com/qp/go"
+)
+
+// Options controls which messages a relay copies, and how.
+type Options struct {
+	// ID identifies the relay in the Hops of the envelopes it
+	// copies, and events that already went through it, or
+	// transactions it has copied to the channel they are on, are
+	// not copied again, so that relays that mirror channels in both
+	// directions do not send messages round in a loop. Relays that
+	// mirror the same channels both ways should share an ID. Empty
+	// means messages are copied as they are, with no loop
+	// prevention.
+	ID string
+	// Codec decodes and encodes the envelopes when ID is set. Nil
+	// means qp.JSON.
+	Codec qp.Codec
+	// Rename gets the channel a message is copied to from the one
+	// it came from. An empty channel means the message is not
+	// copied. Nil means messages keep their channels.
+	Rename func(channel string) string
+	// Filter gets whether the message should be copied. Nil means
+	// every message is.
+	Filter func(msg *qp.Message) bool
+}
+
+// codec gets the Codec envelopes are decoded with.
+func (o Options) codec() qp.Codec {
+	if o.Codec == nil {
+		return qp.JSON
+	}
+	return o.Codec
+}
+
+// Prefix makes a Rename function that replaces the prefix old with
+// new, leaving channels that do not start with old as they are.
+func Prefix(old, new string) func(channel string) string {
+	return func(channel string) string {
+		if strings.HasPrefix(channel, old) {
+			return new + channel[len(old):]
+		}
+		return channel
+	}
+}
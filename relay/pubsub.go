@@ -0,0 +1,80 @@
+package relay
+
+import (
+	"sync"
+
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+)
+
+// PubSub copies the events published on channels of one
+// qp.PubSubTransport to another.
+type PubSub struct {
+	relay
+	source        qp.PubSubTransport
+	destination   qp.PubSubTransport
+	lock          sync.Mutex
+	subscriptions map[string]qp.Subscription
+}
+
+// NewPubSub makes a new PubSub that copies events from the source
+// to the destination.
+func NewPubSub(source, destination qp.PubSubTransport) *PubSub {
+	return NewPubSubOptions(source, destination, Options{})
+}
+
+// NewPubSubOptions makes a new PubSub with the specified options.
+func NewPubSubOptions(source, destination qp.PubSubTransport, options Options) *PubSub {
+	return &PubSub{
+		relay:         relay{options: options, log: slog.NilLogger},
+		source:        source,
+		destination:   destination,
+		subscriptions: make(map[string]qp.Subscription),
+	}
+}
+
+// SetLogger sets the Logger to log to.
+func (p *PubSub) SetLogger(log slog.Logger) {
+	p.log = log
+}
+
+// Relay starts copying the events published on the channel, which
+// may be a pattern. Events are copied while both transports are
+// running, and those that cannot be published on the destination
+// are dropped.
+func (p *PubSub) Relay(channel string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.subscriptions[channel]; ok {
+		return nil
+	}
+	s, err := p.source.Subscribe(channel, qp.HandlerFunc(p.handle))
+	if err != nil {
+		return err
+	}
+	p.subscriptions[channel] = s
+	return nil
+}
+
+// Remove stops copying the events published on the channel.
+func (p *PubSub) Remove(channel string) error {
+	p.lock.Lock()
+	s, ok := p.subscriptions[channel]
+	delete(p.subscriptions, channel)
+	p.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	return s.Unsubscribe()
+}
+
+// handle copies the event to the destination.
+func (p *PubSub) handle(msg *qp.Message) {
+	channel, data, ok := p.copy(msg)
+	if !ok {
+		return
+	}
+	if err := p.destination.Publish(channel, data); err != nil && p.log.Warn() {
+		p.log.Warn("failed to copy", msg, "to", channel, ":", err)
+	}
+}
@@ -0,0 +1,168 @@
+package relay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/qp/go/inproc"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+// broker is a PubSub on its own Bus.
+type broker struct {
+	bus    *inproc.Bus
+	pubSub *inproc.PubSub
+}
+
+func newBroker(t *testing.T) *broker {
+	b := &broker{bus: inproc.NewBus()}
+	b.pubSub = b.bus.NewPubSub()
+	require.NoError(t, b.pubSub.Start())
+	return b
+}
+
+func (b *broker) close() {
+	b.pubSub.Stop(stop.NoWait)
+	b.bus.Close()
+}
+
+// subscribe subscribes to the channel, sending the events that are
+// published on it to the returned channel.
+func (b *broker) subscribe(t *testing.T, channel string) chan *qp.Event {
+	events := make(chan *qp.Event, 100)
+	_, err := qp.NewSubscriber(qp.JSON, b.pubSub).SubscribeFunc(channel, func(event *qp.Event) {
+		events <- event
+	})
+	require.NoError(t, err)
+	return events
+}
+
+// receive waits for an event.
+func receive(t *testing.T, events chan *qp.Event) *qp.Event {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		require.FailNow(t, "no event")
+	}
+	return nil
+}
+
+// receiveNone fails if an event arrives soon.
+func receiveNone(t *testing.T, events chan *qp.Event) {
+	select {
+	case event := <-events:
+		require.FailNow(t, "unexpected event", "%v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPubSubRelay(t *testing.T) {
+
+	source, destination := newBroker(t), newBroker(t)
+	defer source.close()
+	defer destination.close()
+	events := destination.subscribe(t, "orders.>")
+	r := NewPubSub(source.pubSub, destination.pubSub)
+	require.NoError(t, r.Relay("orders.>"))
+
+	publisher := qp.NewPublisher("shop", "one", qp.JSON, source.pubSub)
+	require.NoError(t, publisher.Publish("orders.created", "order"))
+	event := receive(t, events)
+	require.Equal(t, "shop.one", event.From)
+	require.Equal(t, "order", event.Data)
+
+	require.NoError(t, publisher.Publish("customers.created", "customer"))
+	receiveNone(t, events)
+
+	require.NoError(t, r.Remove("orders.>"))
+	require.NoError(t, publisher.Publish("orders.created", "order"))
+	receiveNone(t, events)
+
+}
+
+func TestPubSubRenameFilter(t *testing.T) {
+
+	source, destination := newBroker(t), newBroker(t)
+	defer source.close()
+	defer destination.close()
+	events := destination.subscribe(t, ">")
+	r := NewPubSubOptions(source.pubSub, destination.pubSub, Options{
+		Rename: Prefix("orders.", "dc1.orders."),
+		Filter: func(msg *qp.Message) bool {
+			return msg.Source != "orders.secret"
+		},
+	})
+	require.NoError(t, r.Relay("orders.*"))
+
+	publisher := qp.NewPublisher("shop", "one", qp.JSON, source.pubSub)
+	require.NoError(t, publisher.Publish("orders.secret", "secret"))
+	require.NoError(t, publisher.Publish("orders.created", "order"))
+	event := receive(t, events)
+	require.Equal(t, "order", event.Data)
+	receiveNone(t, events)
+
+	channels := make(chan string, 1)
+	_, err := destination.pubSub.Subscribe("dc1.orders.created", qp.HandlerFunc(func(msg *qp.Message) {
+		channels <- msg.Source
+	}))
+	require.NoError(t, err)
+	require.NoError(t, publisher.Publish("orders.created", "order"))
+	select {
+	case channel := <-channels:
+		require.Equal(t, "dc1.orders.created", channel)
+	case <-time.After(time.Second):
+		require.FailNow(t, "not renamed")
+	}
+
+}
+
+func TestPubSubLoopPrevention(t *testing.T) {
+
+	dc1, dc2 := newBroker(t), newBroker(t)
+	defer dc1.close()
+	defer dc2.close()
+	events1, events2 := dc1.subscribe(t, "orders.>"), dc2.subscribe(t, "orders.>")
+	options := Options{ID: "relay.dc"}
+	require.NoError(t, NewPubSubOptions(dc1.pubSub, dc2.pubSub, options).Relay("orders.>"))
+	require.NoError(t, NewPubSubOptions(dc2.pubSub, dc1.pubSub, options).Relay("orders.>"))
+
+	// each event reaches each broker once
+	require.NoError(t, qp.NewPublisher("shop", "one", qp.JSON, dc1.pubSub).Publish("orders.created", "one"))
+	hops := []qp.Hop{{Relay: "relay.dc", Channel: "orders.created"}}
+	event := receive(t, events1)
+	require.Equal(t, "shop.one", event.From)
+	require.Empty(t, event.Hops)
+	event = receive(t, events2)
+	require.Equal(t, "shop.one", event.From)
+	require.Equal(t, hops, event.Hops)
+	require.NoError(t, qp.NewPublisher("shop", "two", qp.JSON, dc2.pubSub).Publish("orders.created", "two"))
+	event = receive(t, events2)
+	require.Equal(t, "shop.two", event.From)
+	require.Empty(t, event.Hops)
+	event = receive(t, events1)
+	require.Equal(t, "shop.two", event.From)
+	require.Equal(t, hops, event.Hops)
+	receiveNone(t, events1)
+	receiveNone(t, events2)
+
+}
+
+func TestPubSubRenameOnSameTransport(t *testing.T) {
+
+	b := newBroker(t)
+	defer b.close()
+	events := b.subscribe(t, "copy.>")
+	// copying onto a channel that is relayed again stops after the
+	// first copy
+	require.NoError(t, NewPubSubOptions(b.pubSub, b.pubSub, Options{ID: "relay.copy", Rename: Prefix("", "copy.")}).Relay(">"))
+
+	require.NoError(t, qp.NewPublisher("shop", "one", qp.JSON, b.pubSub).Publish("orders", "one"))
+	event := receive(t, events)
+	require.Equal(t, "shop.one", event.From)
+	require.Equal(t, []qp.Hop{{Relay: "relay.copy", Channel: "copy.orders"}}, event.Hops)
+	receiveNone(t, events)
+
+}
@@ -0,0 +1,83 @@
+package relay
+
+import (
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+)
+
+// relay decides what each message is copied as.
+type relay struct {
+	options Options
+	log     slog.Logger
+}
+
+// copy gets the channel and data the message is copied as, or
+// false if it is not copied.
+func (r *relay) copy(msg *qp.Message) (string, []byte, bool) {
+	if r.options.Filter != nil && !r.options.Filter(msg) {
+		return "", nil, false
+	}
+	channel := msg.Source
+	if r.options.Rename != nil {
+		if channel = r.options.Rename(channel); channel == "" {
+			return "", nil, false
+		}
+	}
+	if r.options.ID == "" {
+		return channel, msg.Data, true
+	}
+	data, ok := r.stamp(msg.Data, msg.Source, channel)
+	return channel, data, ok
+}
+
+// stamp records the relay's hop to the destination channel in the
+// envelope, or returns false if the envelope has already been
+// through it: events that it has copied before, and transactions
+// that it has copied to the source channel, which it would send
+// back where they came from. Data that is neither an event nor a
+// transaction is copied as it is.
+func (r *relay) stamp(data []byte, source, destination string) ([]byte, bool) {
+	codec := r.options.codec()
+	var event qp.Event
+	if err := codec.Unmarshal(data, &event); err == nil && event.From != "" {
+		for _, hop := range event.Hops {
+			if hop.Relay == r.options.ID {
+				if r.log.Info() {
+					r.log.Info("not copying message that has been through", r.options.ID)
+				}
+				return nil, false
+			}
+		}
+		event.Hops = append(event.Hops, qp.Hop{Relay: r.options.ID, Channel: destination})
+		return r.encode(&event)
+	}
+	var tx qp.Transaction
+	if err := codec.Unmarshal(data, &tx); err == nil && len(tx.From) > 0 {
+		for _, hop := range tx.Hops {
+			if hop.Relay == r.options.ID && hop.Channel == source {
+				if r.log.Info() {
+					r.log.Info("not copying message that", r.options.ID, "copied to", source)
+				}
+				return nil, false
+			}
+		}
+		tx.Hops = append(tx.Hops, qp.Hop{Relay: r.options.ID, Channel: destination})
+		return r.encode(&tx)
+	}
+	if r.log.Warn() {
+		r.log.Warn("copying message that is not an envelope as it is")
+	}
+	return data, true
+}
+
+// encode encodes the stamped envelope.
+func (r *relay) encode(envelope interface{}) ([]byte, bool) {
+	data, err := r.options.codec().Marshal(envelope)
+	if err != nil {
+		if r.log.Err() {
+			r.log.Err("failed to encode envelope:", err)
+		}
+		return nil, false
+	}
+	return data, true
+}
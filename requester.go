@@ -32,12 +32,18 @@ type Transaction struct {
 	ID RequestID `json:"id"`
 	// Data is an arbitrary data payload
 	Data interface{} `json:"data"`
+	// Aborted is set when a stage aborts the Transaction before the
+	// end of its pipeline
+	Aborted bool `json:"aborted,omitempty"`
+	// Hops are the relays the Transaction went through, in order
+	Hops []Hop `json:"hops,omitempty"`
 }
 
 // Abort clears the To slice indicating that the Transaction should
-// be sent back to the originator.
+// be sent back to the originator, and marks it Aborted.
 func (r *Transaction) Abort() {
 	r.To = []string{}
+	r.Aborted = true
 }
 
 // newRequest makes a new request object and generates a unique ID in the from array.
@@ -54,6 +60,7 @@ type Requester interface {
 	// the message, in order, and have an opportunity to mutate it before it is dispatched
 	// to the next endpoint in the pipeline.
 	// The provided object will be serialized and send as the "data" field in the message.
+	// An error is returned if the request could not be sent.
 	Issue(pipeline []string, obj interface{}) (*Future, error)
 }
 
@@ -128,7 +135,10 @@ func (r *requester) Issue(pipeline []string, obj interface{}) (*Future, error) {
 	}
 	f := newFuture(transaction.ID)
 	r.resolver.Track(f)
-	r.transport.Send(to, bytes)
+	if err := r.transport.Send(to, bytes); err != nil {
+		r.resolver.Forget(transaction.ID)
+		return nil, err
+	}
 
 	return f, nil
 }
@@ -157,13 +167,19 @@ func newFuture(id RequestID) *Future {
 // available, or if the timeout is reached.
 // If the Response times out, nil is returned.
 func (r *Future) Response(timeout time.Duration) (*Transaction, error) {
+	return r.ResponseTimeout(time.After(timeout))
+}
+
+// ResponseTimeout is like Response, except that it times out when
+// the timeout channel receives, which lets tests control time.
+func (r *Future) ResponseTimeout(timeout <-chan time.Time) (*Transaction, error) {
 	select {
 	case <-r.fetched: // response already here
 		return r.cached, nil
 	case r.cached = <-r.response: // response arrived
 		close(r.fetched)
 		return r.cached, nil
-	case <-time.After(timeout):
+	case <-timeout:
 		// timed out
 		return nil, ErrTimeout
 	}
@@ -190,6 +206,14 @@ func (c *reqResolver) Track(future *Future) {
 	c.lock.Unlock()
 }
 
+// Forget stops tracking the Future for a request
+// that could not be sent
+func (c *reqResolver) Forget(id RequestID) {
+	c.lock.Lock()
+	delete(c.items, id)
+	c.lock.Unlock()
+}
+
 // Resolve resolves a Future by matching it up
 // with the given Response
 func (c *reqResolver) Resolve(response *Transaction) error {
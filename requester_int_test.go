@@ -0,0 +1,34 @@
+package qp
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/slog"
+	"github.com/stretchr/testify/require"
+)
+
+// failingTransport fails to send anything.
+type failingTransport struct {
+	DirectTransport
+}
+
+func (failingTransport) Send(channel string, data []byte) error {
+	return errors.New("send failed")
+}
+
+func TestIssueForgetsUnsentRequests(t *testing.T) {
+
+	r := &requester{
+		codec:           JSON,
+		transport:       failingTransport{},
+		responseChannel: "name.instance",
+		resolver:        newResolver(),
+		logger:          slog.NilLogger,
+	}
+	future, err := r.Issue([]string{"one"}, "data")
+	require.EqualError(t, err, "send failed")
+	require.Nil(t, future)
+	require.Empty(t, r.resolver.items)
+
+}
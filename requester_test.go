@@ -52,8 +52,10 @@ func TestRequester(t *testing.T) {
 func TestAbort(t *testing.T) {
 
 	r := qp.Transaction{To: []string{"one", "two", "three"}}
+	require.False(t, r.Aborted)
 	r.Abort()
 	require.Equal(t, 0, len(r.To))
+	require.True(t, r.Aborted)
 
 }
 
@@ -91,3 +93,16 @@ func TestRequesterResponseTimeout(t *testing.T) {
 	require.Equal(t, qp.ErrTimeout, err)
 
 }
+
+func TestRequesterSendError(t *testing.T) {
+
+	tp := &TestDirectTransport{}
+	r, err := qp.NewRequester("name", "instance", qp.JSON, tp)
+	require.NoError(t, err)
+	tp.Err = qp.ErrNotRunning
+
+	future, err := r.Issue([]string{"one"}, "data")
+	require.Equal(t, qp.ErrNotRunning, err)
+	require.Nil(t, future)
+
+}
@@ -0,0 +1,377 @@
+package sqldb
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+)
+
+// Direct represents a qp.DirectTransport. Each message sent is a
+// row of the messages table until a handler has finished with it,
+// so messages wait for a handler, and outlive the transports.
+// Transports take messages from the table by claiming them, so
+// each goes to one of them. Messages taken MaxAttempts times
+// without a handler finishing with them are moved to the dead
+// table.
+type Direct struct {
+	qp.Lifecycle
+	store     *store
+	options   Options
+	acks      *acker
+	handlers  map[string]qp.Handler
+	channels  map[string]qp.ChannelOptions
+	listeners map[string]*listener
+	lock      sync.Mutex
+	listening sync.WaitGroup
+	quit      chan qp.Signal
+	log       slog.Logger
+}
+
+// listener claims the messages on a single channel.
+type listener struct {
+	channel    string
+	dispatcher *qp.Dispatcher
+	wake       chan qp.Signal
+	quit       chan qp.Signal
+}
+
+// ensure the interface is satisfied
+var _ qp.DirectTransport = (*Direct)(nil)
+
+// NewDirect makes a new Direct transport that keeps messages in
+// the Postgres database.
+func NewDirect(db *sql.DB) *Direct {
+	return NewDirectOptions(db, Options{})
+}
+
+// NewDirectOptions makes a new Direct transport with the specified
+// options.
+func NewDirectOptions(db *sql.DB, options Options) *Direct {
+	s := newStore(db, options)
+	return &Direct{
+		store:     s,
+		options:   options,
+		acks:      newAcker(s),
+		handlers:  make(map[string]qp.Handler),
+		channels:  make(map[string]qp.ChannelOptions),
+		listeners: make(map[string]*listener),
+		log:       slog.NilLogger,
+	}
+}
+
+// SetLogger sets the Logger to log to.
+func (d *Direct) SetLogger(log slog.Logger) {
+	d.log = log
+	d.acks.log = log
+}
+
+// Send sends data on the channel. It returns once the message is
+// in the database.
+func (d *Direct) Send(channel string, data []byte) error {
+	if !d.Running() {
+		return qp.ErrNotRunning
+	}
+	if d.log.Info() {
+		d.log.Info("sending to", channel, string(data))
+	}
+	if err := d.store.enqueue(channel, data); err != nil {
+		if d.log.Err() {
+			d.log.Err("send failed", err)
+		}
+		return err
+	}
+	// a listener in this transport need not wait to poll
+	d.lock.Lock()
+	if l, ok := d.listeners[channel]; ok {
+		l.signal()
+	}
+	d.lock.Unlock()
+	return nil
+}
+
+// OnMessage binds the handler to the specified channel.
+// If the transport is running, it starts taking messages from the
+// channel straight away.
+func (d *Direct) OnMessage(channel string, handler qp.Handler) error {
+	if d.log.Info() {
+		d.log.Info("listening to", channel)
+	}
+	d.lock.Lock()
+	d.handlers[channel] = handler
+	if d.State() == qp.StateRunning {
+		d.listen(channel)
+	}
+	d.lock.Unlock()
+	return nil
+}
+
+// RemoveHandler unbinds the handler from the specified channel.
+// If the transport is running, it stops taking messages from the
+// channel. Handlers that are already running are left to finish,
+// and messages taken but not yet handed to the handler are put
+// back.
+func (d *Direct) RemoveHandler(channel string) error {
+	if d.log.Info() {
+		d.log.Info("no longer listening to", channel)
+	}
+	d.lock.Lock()
+	delete(d.handlers, channel)
+	d.unlisten(channel)
+	d.lock.Unlock()
+	return nil
+}
+
+// SetChannelOptions sets the options that control how messages
+// on the specified channel are dispatched to its handler.
+func (d *Direct) SetChannelOptions(channel string, options qp.ChannelOptions) error {
+	d.lock.Lock()
+	d.channels[channel] = options
+	if _, ok := d.handlers[channel]; ok && d.State() == qp.StateRunning {
+		d.listen(channel)
+	}
+	d.lock.Unlock()
+	return nil
+}
+
+// listen starts taking messages from the channel, replacing any
+// existing listener.
+// Callers must hold the lock.
+func (d *Direct) listen(channel string) {
+	d.unlisten(channel)
+	l := &listener{
+		channel:    channel,
+		dispatcher: qp.NewDispatcher(d.acks.wrap(d.handlers[channel]), d.channels[channel]),
+		wake:       make(chan qp.Signal, 1),
+		quit:       make(chan qp.Signal),
+	}
+	d.listeners[channel] = l
+	d.listening.Add(1)
+	go func() {
+		defer d.listening.Done()
+		d.run(l)
+	}()
+}
+
+// unlisten stops taking messages from the channel.
+// Callers must hold the lock.
+func (d *Direct) unlisten(channel string) {
+	if l, ok := d.listeners[channel]; ok {
+		close(l.quit)
+		// anything claimed from now on is put back
+		l.dispatcher.Close()
+		delete(d.listeners, channel)
+	}
+}
+
+// run claims messages for the listener until it quits, waiting
+// for the poll interval whenever there were none.
+func (d *Direct) run(l *listener) {
+	for {
+		select {
+		case <-l.quit:
+			return
+		default:
+		}
+		messages, err := d.store.claim(l.channel, d.options.batch(), d.options.visibilityTimeout(), d.options.maxAttempts())
+		if err != nil && d.log.Warn() {
+			d.log.Warn("failed to take messages from", l.channel+":", err)
+		}
+		for i, m := range messages {
+			select {
+			case <-l.quit:
+				d.acks.release(messages[i:])
+				return
+			default:
+			}
+			d.dispatch(l, m)
+		}
+		if err == nil && len(messages) == d.options.batch() {
+			// there may well be more
+			continue
+		}
+		select {
+		case <-l.quit:
+			return
+		case <-l.wake:
+		case <-time.After(d.options.pollInterval()):
+		}
+	}
+}
+
+// dispatch hands the message to the listener's handler.
+func (d *Direct) dispatch(l *listener, m message) {
+	msg := &qp.Message{Source: m.channel, Data: m.data}
+	if d.log.Info() {
+		d.log.Info("handling message on", m.channel+":", string(m.data))
+	}
+	d.acks.track(msg, m)
+	// blocks while the channel is at capacity
+	if err := l.dispatcher.Dispatch(msg); err != nil {
+		d.acks.handled(msg, false)
+	}
+}
+
+// clean moves the messages that ran out of attempts to the dead
+// table, and deletes messages older than the retention period,
+// until quit is closed.
+func (d *Direct) clean(quit chan qp.Signal) {
+	for {
+		select {
+		case <-quit:
+			return
+		case <-time.After(d.options.cleanup()):
+		}
+		n, err := d.store.bury(d.options.maxAttempts())
+		if err != nil && d.log.Warn() {
+			d.log.Warn("failed to move dead messages:", err)
+		}
+		if n > 0 && d.log.Warn() {
+			d.log.Warn("gave up on", n, "messages after", d.options.maxAttempts(), "attempts")
+		}
+		n, err = d.store.expire(d.options.retention())
+		if err != nil && d.log.Warn() {
+			d.log.Warn("failed to delete old messages:", err)
+		}
+		if n > 0 && d.log.Info() {
+			d.log.Info("deleted", n, "old messages")
+		}
+	}
+}
+
+// signal wakes the listener, if it is waiting to poll.
+func (l *listener) signal() {
+	select {
+	case l.wake <- qp.Signal{}:
+	default:
+	}
+}
+
+// Start creates the tables, unless they already exist, and starts
+// taking messages for the handlers.
+// A stopped transport may be started again.
+func (d *Direct) Start() error {
+	if err := d.BeginStart(); err != nil {
+		return err
+	}
+	if d.log.Info() {
+		d.log.Info("starting")
+	}
+	if err := d.store.setup(); err != nil {
+		return d.EndStart(err)
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for channel := range d.handlers {
+		d.listen(channel)
+	}
+	d.quit = make(chan qp.Signal)
+	d.listening.Add(1)
+	go func(quit chan qp.Signal) {
+		defer d.listening.Done()
+		d.clean(quit)
+	}(d.quit)
+	return d.EndStart(nil)
+}
+
+// Stop instructs the transport to gracefully stop and close the
+// StopChan when stopping has completed.
+//
+// No new messages are taken once Stop is called, and in-flight
+// requests have the grace period to complete before being
+// abandoned. Abandoned messages stay in the table, and are taken
+// again once their visibility timeout has passed. Sends are still
+// allowed until then, so that handlers can pass their results on.
+// It is safe to call Stop more than once.
+func (d *Direct) Stop(grace time.Duration) {
+	if !d.BeginStop() {
+		return
+	}
+	if d.log.Info() {
+		d.log.Info("stopping...")
+	}
+	close(d.quit)
+	d.lock.Lock()
+	dispatchers := make([]*qp.Dispatcher, 0, len(d.listeners))
+	for channel, l := range d.listeners {
+		close(l.quit)
+		dispatchers = append(dispatchers, l.dispatcher)
+		delete(d.listeners, channel)
+	}
+	d.lock.Unlock()
+	// wait for in-flight requests to finish
+	abandoned := qp.Drain(grace, dispatchers...)
+	for _, dispatcher := range dispatchers {
+		dispatcher.Close()
+	}
+	d.listening.Wait()
+	if abandoned > 0 && d.log.Warn() {
+		d.log.Warn("abandoned", abandoned, "in-flight requests")
+	}
+	// inform caller of stop complete
+	d.EndStop(abandoned)
+	if d.log.Info() {
+		d.log.Info("stopped")
+	}
+}
+
+// acker deletes each message once its handler has returned, and
+// puts back those that could not be handed to it.
+type acker struct {
+	store *store
+	log   slog.Logger
+
+	lock    sync.Mutex
+	pending map[*qp.Message]message
+}
+
+func newAcker(s *store) *acker {
+	return &acker{store: s, log: slog.NilLogger, pending: make(map[*qp.Message]message)}
+}
+
+// wrap makes a handler that tells the acker when the handler has
+// returned.
+func (a *acker) wrap(handler qp.Handler) qp.Handler {
+	return qp.HandlerFunc(func(msg *qp.Message) {
+		handler.Handle(msg)
+		a.handled(msg, true)
+	})
+}
+
+// track starts tracking the message claimed as m.
+func (a *acker) track(msg *qp.Message, m message) {
+	a.lock.Lock()
+	a.pending[msg] = m
+	a.lock.Unlock()
+}
+
+// handled records that the handler of the message has returned, so
+// that the message is deleted, or that it could not be given the
+// message, so that the message is put back.
+func (a *acker) handled(msg *qp.Message, ok bool) {
+	a.lock.Lock()
+	m, found := a.pending[msg]
+	delete(a.pending, msg)
+	a.lock.Unlock()
+	if !found {
+		return
+	}
+	if !ok {
+		a.release([]message{m})
+		return
+	}
+	if err := a.store.ack(m); err != nil && a.log.Warn() {
+		a.log.Warn("failed to delete handled message on", m.channel+":", err)
+	}
+}
+
+// release puts the messages back, for any transport to take.
+func (a *acker) release(messages []message) {
+	for _, m := range messages {
+		if err := a.store.release(m); err != nil && a.log.Warn() {
+			a.log.Warn("failed to put back message on", m.channel+":", err)
+		}
+	}
+}
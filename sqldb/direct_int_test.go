@@ -0,0 +1,209 @@
+package sqldb
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/qp/go"
+	"github.com/qp/go/transporttest"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+// testOptions polls often, so that the tests need not wait.
+var testOptions = Options{Dialect: SQLite, PollInterval: 10 * time.Millisecond}
+
+// openDB opens an in-memory SQLite database, which lasts as long as
+// its one connection.
+func openDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	return db
+}
+
+func TestDirectConformance(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+	transporttest.Direct(t, func() qp.DirectTransport {
+		return NewDirectOptions(db, testOptions)
+	})
+}
+
+func TestDirectDurable(t *testing.T) {
+
+	db := openDB(t)
+	defer db.Close()
+	sender := NewDirectOptions(db, testOptions)
+	require.NoError(t, sender.Start())
+	require.NoError(t, sender.Send("durable", []byte("waiting")))
+	sender.Stop(stop.NoWait)
+	<-sender.StopChan()
+
+	// the message waits in the table for a handler
+	msgs := make(chan *qp.Message, 10)
+	d := NewDirectOptions(db, testOptions)
+	require.NoError(t, d.OnMessage("durable", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	})))
+	require.NoError(t, d.Start())
+	defer d.Stop(stop.NoWait)
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "durable", msg.Source)
+		require.Equal(t, "waiting", string(msg.Data))
+	case <-time.After(1 * time.Second):
+		require.FailNow(t, "waiting message not received")
+	}
+
+}
+
+func TestDirectVisibilityTimeout(t *testing.T) {
+
+	db := openDB(t)
+	defer db.Close()
+	s := newStore(db, testOptions)
+	require.NoError(t, s.setup())
+	require.NoError(t, s.enqueue("visibility", []byte("one")))
+
+	first, err := s.claim("visibility", 10, 50*time.Millisecond, DefaultMaxAttempts)
+	require.NoError(t, err)
+	require.Len(t, first, 1)
+	none, err := s.claim("visibility", 10, 50*time.Millisecond, DefaultMaxAttempts)
+	require.NoError(t, err)
+	require.Empty(t, none)
+
+	// once the timeout passes, the message is claimed again, and the
+	// first claim can no longer delete it
+	time.Sleep(60 * time.Millisecond)
+	second, err := s.claim("visibility", 10, time.Minute, DefaultMaxAttempts)
+	require.NoError(t, err)
+	require.Len(t, second, 1)
+	require.Equal(t, first[0].id, second[0].id)
+	require.NoError(t, s.ack(first[0]))
+	require.NoError(t, s.release(first[0]))
+	none, err = s.claim("visibility", 10, time.Minute, DefaultMaxAttempts)
+	require.NoError(t, err)
+	require.Empty(t, none)
+
+	require.NoError(t, s.ack(second[0]))
+	require.NoError(t, s.release(second[0]))
+	none, err = s.claim("visibility", 10, time.Minute, DefaultMaxAttempts)
+	require.NoError(t, err)
+	require.Empty(t, none)
+
+}
+
+func TestDirectAbandonedRedelivered(t *testing.T) {
+
+	db := openDB(t)
+	defer db.Close()
+	options := testOptions
+	options.VisibilityTimeout = 100 * time.Millisecond
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan *qp.Message, 1)
+	first := NewDirectOptions(db, options)
+	require.NoError(t, first.OnMessage("abandoned", qp.HandlerFunc(func(msg *qp.Message) {
+		started <- msg
+		<-release
+	})))
+	require.NoError(t, first.Start())
+	require.NoError(t, first.Send("abandoned", []byte("one")))
+	<-started
+	first.Stop(10 * time.Millisecond)
+	<-first.StopChan()
+	require.Equal(t, 1, first.Abandoned())
+
+	// the message is claimed again once its visibility timeout passes
+	msgs := make(chan *qp.Message, 1)
+	second := NewDirectOptions(db, options)
+	require.NoError(t, second.OnMessage("abandoned", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	})))
+	require.NoError(t, second.Start())
+	defer second.Stop(stop.NoWait)
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "one", string(msg.Data))
+	case <-time.After(1 * time.Second):
+		require.FailNow(t, "message was not delivered again")
+	}
+
+}
+
+// count gets the number of rows in the table.
+func count(t *testing.T, db *sql.DB, table string) int {
+	var n int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM `+table).Scan(&n))
+	return n
+}
+
+func TestDirectMaxAttempts(t *testing.T) {
+
+	db := openDB(t)
+	defer db.Close()
+	s := newStore(db, testOptions)
+	require.NoError(t, s.setup())
+	require.NoError(t, s.enqueue("attempts", []byte("one")))
+
+	// claims put back without being handled are not attempts
+	claimed, err := s.claim("attempts", 10, time.Minute, 2)
+	require.NoError(t, err)
+	require.NoError(t, s.release(claimed[0]))
+	for i := 0; i < 2; i++ {
+		claimed, err = s.claim("attempts", 10, 10*time.Millisecond, 2)
+		require.NoError(t, err)
+		require.Len(t, claimed, 1)
+		time.Sleep(20 * time.Millisecond)
+	}
+	none, err := s.claim("attempts", 10, time.Minute, 2)
+	require.NoError(t, err)
+	require.Empty(t, none)
+
+	// the running transport moves it to the dead table
+	options := testOptions
+	options.MaxAttempts = 2
+	options.Cleanup = 10 * time.Millisecond
+	d := NewDirectOptions(db, options)
+	require.NoError(t, d.OnMessage("attempts", qp.HandlerFunc(func(*qp.Message) {
+		t.Error("message given up on was handled")
+	})))
+	require.NoError(t, d.Start())
+	defer d.Stop(stop.NoWait)
+	deadline := time.Now().Add(1 * time.Second)
+	for count(t, db, "qp_dead") == 0 {
+		require.True(t, time.Now().Before(deadline), "message not moved to the dead table")
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, 0, count(t, db, "qp_messages"))
+	var data []byte
+	var attempts int
+	require.NoError(t, db.QueryRow(`SELECT data, attempts FROM qp_dead`).Scan(&data, &attempts))
+	require.Equal(t, "one", string(data))
+	require.Equal(t, 2, attempts)
+
+}
+
+func TestDirectExpired(t *testing.T) {
+
+	db := openDB(t)
+	defer db.Close()
+	s := newStore(db, testOptions)
+	require.NoError(t, s.setup())
+	require.NoError(t, s.enqueue("nobody", []byte("old")))
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, s.enqueue("nobody", []byte("new")))
+
+	// messages nobody handled are deleted once they are too old
+	n, err := s.expire(10 * time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+	require.Equal(t, 1, count(t, db, "qp_messages"))
+	n, err = s.expire(time.Minute)
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+}
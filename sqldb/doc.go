@@ -0,0 +1,33 @@
+// Package sqldb implements the qp transports on a SQL database,
+// either PostgreSQL or SQLite, through database/sql. The package
+// does not import a driver; programs import the one they use.
+//
+// Direct channels are queues in the messages table. Send inserts a
+// row, and transports claim rows oldest first, hiding them from the
+// others for the visibility timeout; Postgres claims with
+// SELECT ... FOR UPDATE SKIP LOCKED, so any number of transports can
+// share the table. Rows are deleted once their handlers have
+// returned, so messages wait for a handler and outlive the
+// transports, and those whose handlers were abandoned are claimed
+// again once their visibility timeout has passed. Messages claimed
+// MaxAttempts times are moved to the dead table instead, where they
+// can be looked into. Times are taken from the database's clock, so
+// the transports' clocks need not agree.
+//
+// PubSub channels share the events table. Publish inserts a row,
+// and each PubSub polls for the rows added since it started, so
+// every running PubSub gets every message. IDs can become visible
+// out of order, when the transactions that took them commit out of
+// order, so a PubSub keeps looking for the IDs later rows passed
+// over for a minute, and hands on those that appear after the later
+// rows.
+//
+// Rows of every table are deleted once they are older than the
+// retention period, so that messages nobody handles do not pile up.
+//
+// Both transports poll, as plain SQL gives them no way to be told
+// of new rows, but a transport that sent or published a message
+// itself looks for it straight away. SQLite only allows one writer
+// at a time, so a SQLite database should be opened with
+// db.SetMaxOpenConns(1).
+package sqldb
@@ -0,0 +1,121 @@
+package sqldb
+
+import "time"
+
+// Dialect is the flavour of SQL the database speaks.
+type Dialect int
+
+// the databases the transports can use
+const (
+	// Postgres is PostgreSQL 9.5 or later, which can claim messages
+	// with SKIP LOCKED.
+	Postgres Dialect = iota
+	// SQLite is SQLite 3.35 or later, which can return the rows an
+	// UPDATE changed.
+	SQLite
+)
+
+// Options controls how a transport uses the database.
+type Options struct {
+	// Dialect is the flavour of SQL the database speaks. The zero
+	// value is Postgres.
+	Dialect Dialect
+	// Table is the prefix of the tables the transports keep
+	// messages in: Table_messages for Direct, Table_dead for the
+	// messages Direct gave up on, and Table_events for PubSub. It
+	// must be a valid SQL identifier. Empty means DefaultTable.
+	Table string
+	// PollInterval is how often the transports look for new
+	// messages when there were none. Zero means
+	// DefaultPollInterval.
+	PollInterval time.Duration
+	// Batch is the most messages taken from the database at once.
+	// Zero means DefaultBatch.
+	Batch int
+	// VisibilityTimeout is how long a message Direct has taken is
+	// hidden from other transports. A message whose handler has not
+	// finished with it by then, such as because its transport went
+	// away, is taken again. Zero means DefaultVisibilityTimeout.
+	VisibilityTimeout time.Duration
+	// MaxAttempts is how many times Direct takes a message before
+	// giving up on it, and moving it to the dead table once its
+	// last visibility timeout has passed. Zero means
+	// DefaultMaxAttempts.
+	MaxAttempts int
+	// Retention is how long messages are kept before they are
+	// deleted: those PubSub published, those Direct sent that no
+	// handler has finished with, and those in the dead table. Zero
+	// means DefaultRetention.
+	Retention time.Duration
+	// Cleanup is how often the transports delete messages older
+	// than Retention, and Direct moves the messages it gave up on
+	// to the dead table. Zero means DefaultCleanup.
+	Cleanup time.Duration
+}
+
+// the defaults used when Options does not set a value
+const (
+	DefaultTable             = "qp"
+	DefaultPollInterval      = 100 * time.Millisecond
+	DefaultBatch             = 10
+	DefaultVisibilityTimeout = 30 * time.Second
+	DefaultMaxAttempts       = 5
+	DefaultRetention         = 24 * time.Hour
+	DefaultCleanup           = 1 * time.Minute
+)
+
+// table gets the prefix of the tables.
+func (o Options) table() string {
+	if o.Table == "" {
+		return DefaultTable
+	}
+	return o.Table
+}
+
+// pollInterval gets how often to look for new messages.
+func (o Options) pollInterval() time.Duration {
+	if o.PollInterval == 0 {
+		return DefaultPollInterval
+	}
+	return o.PollInterval
+}
+
+// batch gets the most messages to take at once.
+func (o Options) batch() int {
+	if o.Batch == 0 {
+		return DefaultBatch
+	}
+	return o.Batch
+}
+
+// visibilityTimeout gets how long a taken message is hidden.
+func (o Options) visibilityTimeout() time.Duration {
+	if o.VisibilityTimeout == 0 {
+		return DefaultVisibilityTimeout
+	}
+	return o.VisibilityTimeout
+}
+
+// maxAttempts gets how many times a message is taken.
+func (o Options) maxAttempts() int {
+	if o.MaxAttempts == 0 {
+		return DefaultMaxAttempts
+	}
+	return o.MaxAttempts
+}
+
+// retention gets how long published messages are kept.
+func (o Options) retention() time.Duration {
+	if o.Retention == 0 {
+		return DefaultRetention
+	}
+	return o.Retention
+}
+
+// cleanup gets how often old messages are deleted.
+func (o Options) cleanup() time.Duration {
+	if o.Cleanup == 0 {
+		return DefaultCleanup
+	}
+	return o.Cleanup
+}
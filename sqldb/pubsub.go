@@ -0,0 +1,367 @@
+package sqldb
+
+import (
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+)
+
+// gapTimeout is how long PubSub keeps looking for an event whose ID
+// was passed over by later ones. IDs can appear out of order when
+// transactions that publish commit out of order, and some never
+// appear because their transactions rolled back.
+const gapTimeout = 1 * time.Minute
+
+// maxGaps is the most passed over IDs PubSub looks for at once. The
+// oldest are given up to keep within it.
+const maxGaps = 500
+
+// PubSub represents a qp.PubSubTransport. Each message published
+// is a row of the events table, which every PubSub polls for rows
+// added since it started. Rows are deleted once they are older than
+// the Retention option.
+type PubSub struct {
+	qp.Lifecycle
+	store         *store
+	options       Options
+	subscriptions map[string][]*subscription
+	channels      map[string]qp.ChannelOptions
+	lock          sync.Mutex
+	wake          chan qp.Signal
+	quit          chan qp.Signal
+	done          chan qp.Signal
+	log           slog.Logger
+}
+
+// subscription is a single handler bound to a channel.
+type subscription struct {
+	handler    qp.Handler
+	dispatcher *qp.Dispatcher
+}
+
+// ensure the interface is satisfied
+var _ qp.PubSubTransport = (*PubSub)(nil)
+
+// NewPubSub makes a new PubSub transport that keeps messages in the
+// Postgres database.
+func NewPubSub(db *sql.DB) *PubSub {
+	return NewPubSubOptions(db, Options{})
+}
+
+// NewPubSubOptions makes a new PubSub transport with the specified
+// options.
+func NewPubSubOptions(db *sql.DB, options Options) *PubSub {
+	return &PubSub{
+		store:         newStore(db, options),
+		options:       options,
+		subscriptions: make(map[string][]*subscription),
+		channels:      make(map[string]qp.ChannelOptions),
+		wake:          make(chan qp.Signal, 1),
+		log:           slog.NilLogger,
+	}
+}
+
+// SetLogger sets the Logger to log to.
+func (p *PubSub) SetLogger(log slog.Logger) {
+	p.log = log
+}
+
+// Publish publishes data on the specified channel. It returns once
+// the message is in the database.
+func (p *PubSub) Publish(channel string, data []byte) error {
+	if !p.Running() {
+		return qp.ErrNotRunning
+	}
+	if p.log.Info() {
+		p.log.Info("publish to", channel, string(data))
+	}
+	if err := p.store.publish(channel, data); err != nil {
+		if p.log.Err() {
+			p.log.Err("publish failed", err)
+		}
+		return err
+	}
+	// this transport need not wait to poll
+	select {
+	case p.wake <- qp.Signal{}:
+	default:
+	}
+	return nil
+}
+
+// Subscribe binds the handler to the specified channel.
+// It may be called while the transport is running, and the handler
+// gets the messages published from then on.
+func (p *PubSub) Subscribe(channel string, handler qp.Handler) (qp.Subscription, error) {
+	if p.log.Info() {
+		p.log.Info("subscribing to", channel)
+	}
+	p.lock.Lock()
+	s := &subscription{
+		handler:    handler,
+		dispatcher: qp.NewDispatcher(handler, p.channels[channel]),
+	}
+	p.subscriptions[channel] = append(p.subscriptions[channel], s)
+	p.lock.Unlock()
+	return qp.SubscriptionFunc(func() error {
+		p.remove(channel, s)
+		return nil
+	}), nil
+}
+
+// remove unbinds a single subscription from the channel.
+func (p *PubSub) remove(channel string, s *subscription) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	subscriptions := p.subscriptions[channel]
+	for i, existing := range subscriptions {
+		if existing == s {
+			s.dispatcher.Close()
+			subscriptions = append(subscriptions[:i:i], subscriptions[i+1:]...)
+			break
+		}
+	}
+	if len(subscriptions) == 0 {
+		delete(p.subscriptions, channel)
+	} else {
+		p.subscriptions[channel] = subscriptions
+	}
+}
+
+// Unsubscribe unbinds all handlers from the specified channel.
+func (p *PubSub) Unsubscribe(channel string) error {
+	if p.log.Info() {
+		p.log.Info("unsubscribing from", channel)
+	}
+	p.lock.Lock()
+	for _, s := range p.subscriptions[channel] {
+		s.dispatcher.Close()
+	}
+	delete(p.subscriptions, channel)
+	p.lock.Unlock()
+	return nil
+}
+
+// SetChannelOptions sets the options that control how messages
+// on the specified channel are dispatched to its handlers.
+func (p *PubSub) SetChannelOptions(channel string, options qp.ChannelOptions) error {
+	p.lock.Lock()
+	p.channels[channel] = options
+	for _, s := range p.subscriptions[channel] {
+		s.dispatcher.Close()
+		s.dispatcher = qp.NewDispatcher(s.handler, options)
+	}
+	p.lock.Unlock()
+	return nil
+}
+
+// dispatchers gets the dispatchers of every handler bound to the
+// channel, or to a pattern that matches it.
+func (p *PubSub) dispatchers(channel string) []*qp.Dispatcher {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var dispatchers []*qp.Dispatcher
+	for pattern, subscriptions := range p.subscriptions {
+		if pattern != channel && !qp.MatchChannel(pattern, channel) {
+			continue
+		}
+		for _, s := range subscriptions {
+			dispatchers = append(dispatchers, s.dispatcher)
+		}
+	}
+	return dispatchers
+}
+
+// poll hands on the events added after the ID until quit is
+// closed, waiting for the poll interval whenever there were none.
+// IDs passed over by later events are looked for until gapTimeout
+// has passed, and their events handed on, after the later ones, if
+// they appear.
+func (p *PubSub) poll(last int64, quit chan qp.Signal) {
+	defer close(p.done)
+	missing := make(gaps)
+	for {
+		select {
+		case <-quit:
+			return
+		default:
+		}
+		if ids := missing.ids(time.Now()); len(ids) > 0 {
+			events, err := p.store.fill(ids)
+			if err != nil && p.log.Warn() {
+				p.log.Warn("failed to take late messages:", err)
+			}
+			for _, m := range events {
+				delete(missing, m.id)
+				p.dispatch(m)
+			}
+		}
+		events, err := p.store.poll(last, p.options.batch())
+		if err != nil && p.log.Warn() {
+			p.log.Warn("failed to take messages:", err)
+		}
+		for _, m := range events {
+			missing.add(last+1, m.id, time.Now())
+			last = m.id
+			p.dispatch(m)
+		}
+		if err == nil && len(events) == p.options.batch() {
+			// there may well be more
+			continue
+		}
+		select {
+		case <-quit:
+			return
+		case <-p.wake:
+		case <-time.After(p.options.pollInterval()):
+		}
+	}
+}
+
+// gaps holds the event IDs that have been passed over, and when.
+type gaps map[int64]time.Time
+
+// add adds the IDs from the first up to the last, not including it,
+// then gives up the oldest IDs beyond maxGaps.
+func (g gaps) add(first, last int64, now time.Time) {
+	if last-first > maxGaps {
+		first = last - maxGaps
+	}
+	for id := first; id < last; id++ {
+		g[id] = now
+	}
+	if len(g) > maxGaps {
+		ids := g.ids(now)
+		for _, id := range ids[:len(ids)-maxGaps] {
+			delete(g, id)
+		}
+	}
+}
+
+// ids gives up the IDs passed over longer than gapTimeout ago, and
+// gets the others, oldest first.
+func (g gaps) ids(now time.Time) []int64 {
+	ids := make([]int64, 0, len(g))
+	for id, passed := range g {
+		if now.Sub(passed) >= gapTimeout {
+			delete(g, id)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// dispatch hands the event to the handlers bound to its channel.
+func (p *PubSub) dispatch(m message) {
+	dispatchers := p.dispatchers(m.channel)
+	if len(dispatchers) == 0 {
+		return
+	}
+	if p.log.Info() {
+		p.log.Info("handling message from", m.channel+":", string(m.data))
+	}
+	msg := &qp.Message{Source: m.channel, Data: m.data}
+	for _, dispatcher := range dispatchers {
+		// blocks while the channel is at capacity
+		dispatcher.Dispatch(msg)
+	}
+}
+
+// clean deletes events older than the retention period until quit
+// is closed.
+func (p *PubSub) clean(quit chan qp.Signal) {
+	for {
+		select {
+		case <-quit:
+			return
+		case <-time.After(p.options.cleanup()):
+		}
+		n, err := p.store.cleanup(p.options.retention())
+		if err != nil && p.log.Warn() {
+			p.log.Warn("failed to delete old messages:", err)
+		}
+		if n > 0 && p.log.Info() {
+			p.log.Info("deleted", n, "old messages")
+		}
+	}
+}
+
+// Start creates the tables, unless they already exist, and starts
+// handing on the messages published from then on.
+// A stopped transport may be started again.
+func (p *PubSub) Start() error {
+	if err := p.BeginStart(); err != nil {
+		return err
+	}
+	if p.log.Info() {
+		p.log.Info("starting")
+	}
+	if err := p.store.setup(); err != nil {
+		return p.EndStart(err)
+	}
+	last, err := p.store.latest()
+	if err != nil {
+		return p.EndStart(err)
+	}
+	p.lock.Lock()
+	for channel, subscriptions := range p.subscriptions {
+		for _, s := range subscriptions {
+			s.dispatcher.Close()
+			s.dispatcher = qp.NewDispatcher(s.handler, p.channels[channel])
+		}
+	}
+	p.lock.Unlock()
+	p.quit = make(chan qp.Signal)
+	p.done = make(chan qp.Signal)
+	go p.poll(last, p.quit)
+	go p.clean(p.quit)
+	return p.EndStart(nil)
+}
+
+// Stop stops the transport and closes StopChan() when finished.
+//
+// No new messages are taken once Stop is called, and the messages
+// already being handled have the grace period to finish before
+// they are abandoned. It is safe to call Stop more than once.
+func (p *PubSub) Stop(grace time.Duration) {
+	if !p.BeginStop() {
+		return
+	}
+	if p.log.Info() {
+		p.log.Info("stopping...")
+	}
+	deadline := time.Now().Add(grace)
+	close(p.quit)
+	select {
+	case <-p.done:
+	case <-time.After(grace):
+	}
+	var dispatchers []*qp.Dispatcher
+	p.lock.Lock()
+	for _, subscriptions := range p.subscriptions {
+		for _, s := range subscriptions {
+			dispatchers = append(dispatchers, s.dispatcher)
+		}
+	}
+	p.lock.Unlock()
+	abandoned := qp.Drain(deadline.Sub(time.Now()), dispatchers...)
+	for _, dispatcher := range dispatchers {
+		dispatcher.Close()
+	}
+	// anything still waiting is dropped by the closed dispatchers
+	<-p.done
+	if abandoned > 0 && p.log.Warn() {
+		p.log.Warn("abandoned", abandoned, "in-flight handlers")
+	}
+	// inform caller of stop complete
+	p.EndStop(abandoned)
+	if p.log.Info() {
+		p.log.Info("stopped")
+	}
+}
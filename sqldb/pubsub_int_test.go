@@ -0,0 +1,134 @@
+package sqldb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/qp/go/transporttest"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPubSubConformance(t *testing.T) {
+	db := openDB(t)
+	defer db.Close()
+	transporttest.PubSub(t, func() qp.PubSubTransport {
+		return NewPubSubOptions(db, testOptions)
+	})
+}
+
+func TestPubSubOtherTransport(t *testing.T) {
+
+	db := openDB(t)
+	defer db.Close()
+	msgs := make(chan *qp.Message, 10)
+	subscriber := NewPubSubOptions(db, testOptions)
+	_, err := subscriber.Subscribe("others.*", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	}))
+	require.NoError(t, err)
+	require.NoError(t, subscriber.Start())
+	defer subscriber.Stop(stop.NoWait)
+
+	// messages from other transports are found by polling
+	publisher := NewPubSubOptions(db, testOptions)
+	require.NoError(t, publisher.Start())
+	defer publisher.Stop(stop.NoWait)
+	require.NoError(t, publisher.Publish("others.one", []byte("polled")))
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "others.one", msg.Source)
+		require.Equal(t, "polled", string(msg.Data))
+	case <-time.After(1 * time.Second):
+		require.FailNow(t, "published message not received")
+	}
+
+}
+
+func TestPubSubRetention(t *testing.T) {
+
+	db := openDB(t)
+	defer db.Close()
+	options := testOptions
+	options.Retention = 50 * time.Millisecond
+	options.Cleanup = 10 * time.Millisecond
+	p := NewPubSubOptions(db, options)
+	require.NoError(t, p.Start())
+	defer p.Stop(stop.NoWait)
+	require.NoError(t, p.Publish("retention", []byte("old")))
+
+	// old messages are deleted
+	deadline := time.Now().Add(1 * time.Second)
+	for {
+		var n int
+		require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM qp_events`).Scan(&n))
+		if n == 0 {
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "old messages not deleted")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+}
+
+func TestPubSubLateEvent(t *testing.T) {
+
+	db := openDB(t)
+	defer db.Close()
+	msgs := make(chan *qp.Message, 10)
+	p := NewPubSubOptions(db, testOptions)
+	_, err := p.Subscribe("late", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	}))
+	require.NoError(t, err)
+	require.NoError(t, p.Start())
+	defer p.Stop(stop.NoWait)
+	receive := func() string {
+		select {
+		case msg := <-msgs:
+			return string(msg.Data)
+		case <-time.After(1 * time.Second):
+			require.FailNow(t, "published message not received")
+		}
+		return ""
+	}
+
+	// a transaction that took an earlier ID commits after a later
+	// one, as Postgres sequences allow
+	insert := `INSERT INTO qp_events (id, channel, data, created) VALUES (?, 'late', ?, ?)`
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	_, err = db.Exec(insert, 2, []byte("two"), now)
+	require.NoError(t, err)
+	require.Equal(t, "two", receive())
+	time.Sleep(5 * testOptions.PollInterval)
+	_, err = db.Exec(insert, 1, []byte("one"), now)
+	require.NoError(t, err)
+	require.Equal(t, "one", receive())
+	_, err = db.Exec(insert, 3, []byte("three"), now)
+	require.NoError(t, err)
+	require.Equal(t, "three", receive())
+
+}
+
+func TestGaps(t *testing.T) {
+
+	g := make(gaps)
+	start := time.Now()
+	g.add(1, 4, start)
+	g.add(5, 5, start)
+	require.Equal(t, []int64{1, 2, 3}, g.ids(start))
+	delete(g, 2)
+	g.add(10, 12, start.Add(gapTimeout/2))
+	require.Equal(t, []int64{1, 3, 10, 11}, g.ids(start.Add(gapTimeout/2)))
+
+	// IDs are given up after the timeout
+	require.Equal(t, []int64{10, 11}, g.ids(start.Add(gapTimeout)))
+
+	// and beyond the most that are looked for, oldest first
+	g.add(100, 100+2*maxGaps, start)
+	ids := g.ids(start)
+	require.Len(t, ids, maxGaps)
+	require.Equal(t, int64(100+maxGaps), ids[0])
+
+}
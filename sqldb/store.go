@@ -0,0 +1,291 @@
+package sqldb
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// store runs the statements the transports need against the
+// database, in its dialect.
+type store struct {
+	db       *sql.DB
+	dialect  Dialect
+	messages string
+	dead     string
+	events   string
+}
+
+// message is a row of the messages or events table.
+type message struct {
+	id      int64
+	claim   int64
+	channel string
+	data    []byte
+}
+
+func newStore(db *sql.DB, options Options) *store {
+	return &store{
+		db:       db,
+		dialect:  options.Dialect,
+		messages: options.table() + "_messages",
+		dead:     options.table() + "_dead",
+		events:   options.table() + "_events",
+	}
+}
+
+// bind rewrites the ? placeholders in the query as the dialect
+// needs them.
+func (s *store) bind(query string) string {
+	if s.dialect != Postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// clock gets the SQL for the database's time in milliseconds, as
+// the tables keep it, so that the transports' clocks need not agree.
+func (s *store) clock() string {
+	if s.dialect == SQLite {
+		return `CAST((julianday('now') - 2440587.5) * 86400000 AS INTEGER)`
+	}
+	return `CAST(EXTRACT(EPOCH FROM CURRENT_TIMESTAMP) * 1000 AS BIGINT)`
+}
+
+// setup creates the tables and their indexes, unless they already
+// exist.
+func (s *store) setup() error {
+	id, blob := "BIGSERIAL PRIMARY KEY", "BYTEA"
+	if s.dialect == SQLite {
+		id, blob = "INTEGER PRIMARY KEY AUTOINCREMENT", "BLOB"
+	}
+	for _, statement := range []string{
+		`CREATE TABLE IF NOT EXISTS ` + s.messages + ` (
+			id ` + id + `,
+			channel TEXT NOT NULL,
+			data ` + blob + ` NOT NULL,
+			created BIGINT NOT NULL,
+			visible BIGINT NOT NULL,
+			claim BIGINT NOT NULL,
+			attempts INTEGER NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS ` + s.messages + `_waiting ON ` + s.messages + ` (channel, visible, id)`,
+		`CREATE INDEX IF NOT EXISTS ` + s.messages + `_created ON ` + s.messages + ` (created)`,
+		`CREATE TABLE IF NOT EXISTS ` + s.dead + ` (
+			id BIGINT PRIMARY KEY,
+			channel TEXT NOT NULL,
+			data ` + blob + ` NOT NULL,
+			created BIGINT NOT NULL,
+			attempts INTEGER NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS ` + s.dead + `_created ON ` + s.dead + ` (created)`,
+		`CREATE TABLE IF NOT EXISTS ` + s.events + ` (
+			id ` + id + `,
+			channel TEXT NOT NULL,
+			data ` + blob + ` NOT NULL,
+			created BIGINT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS ` + s.events + `_created ON ` + s.events + ` (created)`,
+	} {
+		if _, err := s.db.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enqueue adds a message to the channel's queue.
+func (s *store) enqueue(channel string, data []byte) error {
+	_, err := s.db.Exec(s.bind(`INSERT INTO `+s.messages+` (channel, data, created, visible, claim, attempts) VALUES (?, ?, `+s.clock()+`, 0, 0, 0)`),
+		channel, nonNil(data))
+	return err
+}
+
+// claim takes up to n messages waiting on the channel that have
+// been claimed fewer than maxAttempts times, oldest first, hiding
+// them from other transports until the visibility timeout has
+// passed. Postgres skips messages that other transports are
+// claiming at the same time, and SQLite only ever runs one claim
+// at a time.
+func (s *store) claim(channel string, n int, visibility time.Duration, maxAttempts int) ([]message, error) {
+	lock := " FOR UPDATE SKIP LOCKED"
+	if s.dialect == SQLite {
+		lock = ""
+	}
+	claim := token()
+	rows, err := s.db.Query(s.bind(`UPDATE `+s.messages+` SET visible = `+s.clock()+` + ?, claim = ?, attempts = attempts + 1
+		WHERE id IN (SELECT id FROM `+s.messages+` WHERE channel = ? AND visible <= `+s.clock()+` AND attempts < ? ORDER BY id LIMIT ?`+lock+`)
+		RETURNING id, data`),
+		milliseconds(visibility), claim, channel, maxAttempts, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var messages []message
+	for rows.Next() {
+		m := message{claim: claim, channel: channel}
+		if err := rows.Scan(&m.id, &m.data); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// RETURNING does not keep the order the rows were chosen in
+	sort.Slice(messages, func(i, j int) bool { return messages[i].id < messages[j].id })
+	return messages, nil
+}
+
+// ack deletes a claimed message, unless its claim has expired and
+// another transport has claimed it since.
+func (s *store) ack(m message) error {
+	_, err := s.db.Exec(s.bind(`DELETE FROM `+s.messages+` WHERE id = ? AND claim = ?`), m.id, m.claim)
+	return err
+}
+
+// release makes a claimed message visible again straight away. It
+// was never handed to a handler, so the claim is not counted as an
+// attempt.
+func (s *store) release(m message) error {
+	_, err := s.db.Exec(s.bind(`UPDATE `+s.messages+` SET visible = 0, attempts = attempts - 1 WHERE id = ? AND claim = ?`), m.id, m.claim)
+	return err
+}
+
+// bury moves the messages that have been claimed maxAttempts times,
+// and whose last claim has expired, to the dead table, returning
+// how many it moved.
+func (s *store) bury(maxAttempts int) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(s.bind(`INSERT INTO `+s.dead+` (id, channel, data, created, attempts)
+		SELECT id, channel, data, created, attempts FROM `+s.messages+` WHERE attempts >= ? AND visible <= `+s.clock()), maxAttempts)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	if _, err := tx.Exec(s.bind(`DELETE FROM `+s.messages+` WHERE attempts >= ? AND id IN (SELECT id FROM `+s.dead+`)`), maxAttempts); err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// expire deletes the messages and dead messages older than the
+// retention period, returning how many it deleted.
+func (s *store) expire(retention time.Duration) (int64, error) {
+	var deleted int64
+	for _, table := range []string{s.messages, s.dead} {
+		n, err := s.deleteOld(table, retention)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
+
+// publish adds a message to the events.
+func (s *store) publish(channel string, data []byte) error {
+	_, err := s.db.Exec(s.bind(`INSERT INTO `+s.events+` (channel, data, created) VALUES (?, ?, `+s.clock()+`)`),
+		channel, nonNil(data))
+	return err
+}
+
+// latest gets the ID of the latest event, or zero if there are
+// none.
+func (s *store) latest() (int64, error) {
+	var id int64
+	err := s.db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM ` + s.events).Scan(&id)
+	return id, err
+}
+
+// poll gets up to n events after the ID, oldest first.
+func (s *store) poll(after int64, n int) ([]message, error) {
+	return s.queryEvents(`SELECT id, channel, data FROM `+s.events+` WHERE id > ? ORDER BY id LIMIT ?`, after, n)
+}
+
+// fill gets the events with the IDs that are there, oldest first.
+func (s *store) fill(ids []int64) ([]message, error) {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return s.queryEvents(`SELECT id, channel, data FROM `+s.events+` WHERE id IN (?`+strings.Repeat(", ?", len(ids)-1)+`) ORDER BY id`, args...)
+}
+
+// queryEvents runs the query for events.
+func (s *store) queryEvents(query string, args ...interface{}) ([]message, error) {
+	rows, err := s.db.Query(s.bind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var messages []message
+	for rows.Next() {
+		var m message
+		if err := rows.Scan(&m.id, &m.channel, &m.data); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// cleanup deletes the events older than the retention period,
+// returning how many it deleted.
+func (s *store) cleanup(retention time.Duration) (int64, error) {
+	return s.deleteOld(s.events, retention)
+}
+
+// deleteOld deletes the rows of the table older than the retention
+// period, returning how many it deleted.
+func (s *store) deleteOld(table string, retention time.Duration) (int64, error) {
+	result, err := s.db.Exec(s.bind(`DELETE FROM `+table+` WHERE created < `+s.clock()+` - ?`), milliseconds(retention))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// milliseconds gets the duration in milliseconds, as the tables
+// keep times.
+func milliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+// token makes a random claim token, so that a transport only acks
+// messages it still has claimed.
+func token() int64 {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return int64(binary.BigEndian.Uint64(b) >> 1)
+}
+
+// nonNil gets the data, or empty data in place of nil, since the
+// columns are NOT NULL.
+func nonNil(data []byte) []byte {
+	if data == nil {
+		return []byte{}
+	}
+	return data
+}
@@ -0,0 +1,174 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recorder is a database/sql driver that records the statements it
+// runs, and answers each query with the rows it was given last, so
+// that the statements for Postgres can be checked without one.
+type recorder struct {
+	lock       sync.Mutex
+	statements []statement
+	columns    []string
+	rows       [][]driver.Value
+}
+
+// statement is a statement the recorder ran.
+type statement struct {
+	query string
+	args  []driver.Value
+}
+
+func (r *recorder) Connect(context.Context) (driver.Conn, error) { return r, nil }
+func (r *recorder) Driver() driver.Driver                        { return r }
+func (r *recorder) Open(string) (driver.Conn, error)             { return r, nil }
+func (r *recorder) Prepare(query string) (driver.Stmt, error)    { return &recordedStmt{r, query}, nil }
+func (r *recorder) Close() error                                 { return nil }
+func (r *recorder) Begin() (driver.Tx, error)                    { return nil, driver.ErrSkip }
+
+// answer sets the rows the next queries get.
+func (r *recorder) answer(columns []string, rows ...[]driver.Value) {
+	r.lock.Lock()
+	r.columns, r.rows = columns, rows
+	r.lock.Unlock()
+}
+
+// last gets the statement run last.
+func (r *recorder) last() statement {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.statements[len(r.statements)-1]
+}
+
+func (r *recorder) record(query string, args []driver.Value) {
+	r.lock.Lock()
+	r.statements = append(r.statements, statement{query: query, args: args})
+	r.lock.Unlock()
+}
+
+type recordedStmt struct {
+	r     *recorder
+	query string
+}
+
+func (s *recordedStmt) Close() error  { return nil }
+func (s *recordedStmt) NumInput() int { return -1 }
+
+func (s *recordedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.r.record(s.query, args)
+	return driver.RowsAffected(0), nil
+}
+
+func (s *recordedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.r.record(s.query, args)
+	s.r.lock.Lock()
+	defer s.r.lock.Unlock()
+	return &recordedRows{columns: s.r.columns, rows: s.r.rows}, nil
+}
+
+type recordedRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *recordedRows) Columns() []string { return r.columns }
+func (r *recordedRows) Close() error      { return nil }
+
+func (r *recordedRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// placeholders gets the placeholders in the query, in order.
+var placeholders = regexp.MustCompile(`\?|\$\d+`)
+
+func TestStorePostgresClaim(t *testing.T) {
+
+	r := &recorder{}
+	db := sql.OpenDB(r)
+	defer db.Close()
+	s := newStore(db, Options{})
+	r.answer([]string{"id", "data"},
+		[]driver.Value{int64(2), []byte("two")},
+		[]driver.Value{int64(1), []byte("one")})
+
+	messages, err := s.claim("orders", 10, time.Minute, 3)
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	require.Equal(t, int64(1), messages[0].id)
+	require.Equal(t, "one", string(messages[0].data))
+	require.Equal(t, messages[0].claim, messages[1].claim)
+
+	// claims skip the rows other transports are claiming, and bind
+	// the arguments with numbered placeholders
+	claim := r.last()
+	require.Contains(t, claim.query, "ORDER BY id LIMIT $5 FOR UPDATE SKIP LOCKED)")
+	require.Equal(t, []string{"$1", "$2", "$3", "$4", "$5"}, placeholders.FindAllString(claim.query, -1))
+	require.Len(t, claim.args, 5)
+	require.Equal(t, messages[0].claim, claim.args[1])
+	require.Equal(t, "orders", claim.args[2])
+	require.Equal(t, int64(3), claim.args[3])
+	require.Equal(t, int64(10), claim.args[4])
+	// visibility is timed by the database's clock
+	require.Contains(t, claim.query, "visible = CAST(EXTRACT(EPOCH FROM CURRENT_TIMESTAMP) * 1000 AS BIGINT) + $1")
+	require.Equal(t, int64(60000), claim.args[0])
+
+	require.NoError(t, s.ack(messages[0]))
+	ack := r.last()
+	require.Equal(t, `DELETE FROM qp_messages WHERE id = $1 AND claim = $2`, ack.query)
+	require.Equal(t, []driver.Value{int64(1), messages[0].claim}, ack.args)
+
+}
+
+func TestStorePostgresEvents(t *testing.T) {
+
+	r := &recorder{}
+	db := sql.OpenDB(r)
+	defer db.Close()
+	s := newStore(db, Options{Table: "events"})
+	r.answer([]string{"id", "channel", "data"}, []driver.Value{int64(3), "late", []byte("three")})
+
+	events, err := s.fill([]int64{3, 5, 8})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, "late", events[0].channel)
+	fill := r.last()
+	require.Equal(t, `SELECT id, channel, data FROM events_events WHERE id IN ($1, $2, $3) ORDER BY id`, fill.query)
+	require.Equal(t, []driver.Value{int64(3), int64(5), int64(8)}, fill.args)
+
+	_, err = s.poll(3, 10)
+	require.NoError(t, err)
+	require.Equal(t, `SELECT id, channel, data FROM events_events WHERE id > $1 ORDER BY id LIMIT $2`, r.last().query)
+
+}
+
+func TestStoreSQLiteClaim(t *testing.T) {
+
+	r := &recorder{}
+	db := sql.OpenDB(r)
+	defer db.Close()
+	s := newStore(db, Options{Dialect: SQLite})
+	r.answer([]string{"id", "data"})
+
+	_, err := s.claim("orders", 10, time.Minute, 3)
+	require.NoError(t, err)
+	claim := r.last()
+	require.NotContains(t, claim.query, "SKIP LOCKED")
+	require.Contains(t, claim.query, "julianday('now')")
+	require.Equal(t, []string{"?", "?", "?", "?", "?"}, placeholders.FindAllString(claim.query, -1))
+
+}
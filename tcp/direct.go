@@ -0,0 +1,273 @@
+package tcp
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+)
+
+// Direct represents a qp.DirectTransport.
+type Direct struct {
+	qp.Lifecycle
+	node        *node
+	lock        sync.RWMutex
+	handlers    map[string]qp.Handler
+	options     map[string]qp.ChannelOptions
+	dispatchers map[string]*qp.Dispatcher
+	// pending holds messages sent on channels that no node handles
+	// yet, and next holds the position of the next node to take a
+	// message from each channel.
+	pending []*qp.Message
+	next    map[string]int
+	log     slog.Logger
+}
+
+// ensure the interface is satisfied
+var _ qp.DirectTransport = (*Direct)(nil)
+
+// NewDirect makes a new Direct that listens on the address and
+// connects to the peers.
+func NewDirect(addr string, peers ...string) *Direct {
+	return NewDirectOptions(addr, Options{Peers: peers})
+}
+
+// NewDirectOptions makes a new Direct that listens on the address
+// and finds other nodes as the options describe.
+func NewDirectOptions(addr string, options Options) *Direct {
+	d := &Direct{
+		node:        newNode(addr, options),
+		handlers:    make(map[string]qp.Handler),
+		options:     make(map[string]qp.ChannelOptions),
+		dispatchers: make(map[string]*qp.Dispatcher),
+		next:        make(map[string]int),
+		log:         slog.NilLogger,
+	}
+	d.node.announce = d.channels
+	d.node.deliver = d.receive
+	d.node.routed = d.flush
+	return d
+}
+
+// SetLogger sets the Logger to log to.
+func (d *Direct) SetLogger(log slog.Logger) {
+	d.log = log
+	d.node.log = log
+}
+
+// Addr gets the address other nodes use to reach this one. It is
+// only known once the transport has started.
+func (d *Direct) Addr() string {
+	return d.node.address()
+}
+
+// Send sends data on the channel.
+//
+// Each message goes to one node handling the channel, and the
+// nodes take turns. If no node handles the channel yet, the message
+// waits until one does, like a message on a Redis list.
+func (d *Direct) Send(channel string, data []byte) error {
+	if !d.Running() {
+		return qp.ErrNotRunning
+	}
+	if d.log.Info() {
+		d.log.Info("sending to", channel, string(data))
+	}
+	return d.route(&qp.Message{Source: channel, Data: data})
+}
+
+// route sends the message to the next node handling its channel,
+// or holds it until there is one.
+func (d *Direct) route(msg *qp.Message) error {
+	routes := d.node.routes(func(announced string) bool {
+		return announced == msg.Source
+	})
+	d.lock.Lock()
+	dispatcher, local := d.dispatchers[msg.Source]
+	if local {
+		// this node is always first
+		routes = append([]string{""}, routes...)
+	}
+	if len(routes) == 0 {
+		d.hold(msg)
+		d.lock.Unlock()
+		return nil
+	}
+	start := d.next[msg.Source]
+	d.next[msg.Source] = start + 1
+	d.lock.Unlock()
+	for i := range routes {
+		addr := routes[(start+i)%len(routes)]
+		if addr == "" {
+			// blocks while the channel is at capacity
+			if err := dispatcher.Dispatch(msg); err == nil {
+				return nil
+			}
+			continue
+		}
+		if d.node.send(addr, msg.Source, msg.Data) {
+			return nil
+		}
+	}
+	return ErrUnavailable
+}
+
+// hold keeps the message until a node handles its channel,
+// discarding the oldest message if too many are waiting.
+// Callers must hold the lock.
+func (d *Direct) hold(msg *qp.Message) {
+	d.pending = append(d.pending, msg)
+	if len(d.pending) > d.node.options.QueueSize {
+		if d.log.Warn() {
+			d.log.Warn("no node handles", d.pending[0].Source, "- dropping message")
+		}
+		d.pending = d.pending[1:]
+	}
+}
+
+// flush tries to route the messages that are waiting, now that
+// the channels handled by the nodes have changed.
+func (d *Direct) flush() {
+	d.lock.Lock()
+	pending := d.pending
+	d.pending = nil
+	d.lock.Unlock()
+	for _, msg := range pending {
+		if err := d.route(msg); err != nil && d.log.Warn() {
+			d.log.Warn("failed to send waiting message to", msg.Source+":", err)
+		}
+	}
+}
+
+// receive handles a message sent by another node.
+func (d *Direct) receive(channel string, data []byte) {
+	msg := &qp.Message{Source: channel, Data: data}
+	d.lock.RLock()
+	dispatcher, ok := d.dispatchers[channel]
+	d.lock.RUnlock()
+	if !ok {
+		// the handler was removed after the sender chose this node
+		if err := d.route(msg); err != nil && d.log.Warn() {
+			d.log.Warn("failed to pass on message to", channel+":", err)
+		}
+		return
+	}
+	// blocks the connection while the channel is at capacity
+	if err := dispatcher.Dispatch(msg); err != nil && d.log.Warn() {
+		d.log.Warn("dropped message to", channel, "while stopping")
+	}
+}
+
+// channels gets the channels this node handles.
+func (d *Direct) channels() []string {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	channels := make([]string, 0, len(d.handlers))
+	for channel := range d.handlers {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// OnMessage binds the handler to the specified channel, and tells
+// the other nodes that this node handles it.
+func (d *Direct) OnMessage(channel string, handler qp.Handler) error {
+	d.lock.Lock()
+	d.handlers[channel] = handler
+	d.setDispatcher(channel)
+	d.lock.Unlock()
+	d.node.broadcast()
+	d.flush()
+	return nil
+}
+
+// RemoveHandler unbinds the handler from the specified channel,
+// and tells the other nodes that this node no longer handles it.
+func (d *Direct) RemoveHandler(channel string) error {
+	d.lock.Lock()
+	delete(d.handlers, channel)
+	if dispatcher, ok := d.dispatchers[channel]; ok {
+		dispatcher.Close()
+		delete(d.dispatchers, channel)
+	}
+	d.lock.Unlock()
+	d.node.broadcast()
+	return nil
+}
+
+// SetChannelOptions sets the options that control how messages
+// on the specified channel are dispatched to its handler.
+func (d *Direct) SetChannelOptions(channel string, options qp.ChannelOptions) error {
+	d.lock.Lock()
+	d.options[channel] = options
+	if _, ok := d.handlers[channel]; ok {
+		d.setDispatcher(channel)
+	}
+	d.lock.Unlock()
+	return nil
+}
+
+// setDispatcher replaces the dispatcher for the channel.
+// Callers must hold the lock.
+func (d *Direct) setDispatcher(channel string) {
+	if dispatcher, ok := d.dispatchers[channel]; ok {
+		dispatcher.Close()
+	}
+	d.dispatchers[channel] = qp.NewDispatcher(d.handlers[channel], d.options[channel])
+}
+
+// Start starts listening for other nodes and connecting to the
+// peers. A stopped transport may be started again.
+func (d *Direct) Start() error {
+	if err := d.BeginStart(); err != nil {
+		return err
+	}
+	d.lock.Lock()
+	d.pending = nil
+	for channel := range d.handlers {
+		d.setDispatcher(channel)
+	}
+	d.lock.Unlock()
+	return d.EndStart(d.node.start())
+}
+
+// Stop stops the transport and closes StopChan() when finished.
+//
+// No new messages are taken from other nodes once Stop is called,
+// and messages already being handled have the grace period to
+// finish before they are abandoned. Messages waiting for a node to
+// handle their channel are discarded. It is safe to call Stop more
+// than once.
+func (d *Direct) Stop(grace time.Duration) {
+	if !d.BeginStop() {
+		return
+	}
+	if d.log.Info() {
+		d.log.Info("stopping...")
+	}
+	d.node.stopReceiving()
+	d.lock.RLock()
+	dispatchers := make([]*qp.Dispatcher, 0, len(d.dispatchers))
+	for _, dispatcher := range d.dispatchers {
+		dispatchers = append(dispatchers, dispatcher)
+	}
+	d.lock.RUnlock()
+	abandoned := qp.Drain(grace, dispatchers...)
+	for _, dispatcher := range dispatchers {
+		dispatcher.Close()
+	}
+	if abandoned > 0 && d.log.Warn() {
+		d.log.Warn("abandoned", abandoned, "in-flight handlers")
+	}
+	d.node.stop()
+	d.lock.Lock()
+	d.pending = nil
+	d.lock.Unlock()
+	d.EndStop(abandoned)
+	if d.log.Info() {
+		d.log.Info("stopped")
+	}
+}
@@ -0,0 +1,102 @@
+package tcp_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/qp/go/tcp"
+	"github.com/qp/go/transporttest"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+// seed starts a node that other nodes find each other through.
+func seed(t *testing.T) *tcp.Direct {
+	d := tcp.NewDirectOptions("127.0.0.1:0", tcp.Options{Gossip: true})
+	require.NoError(t, d.Start())
+	return d
+}
+
+// freeAddr gets a local address that nothing is listening on.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestDirectConformance(t *testing.T) {
+	s := seed(t)
+	defer s.Stop(stop.NoWait)
+	transporttest.Direct(t, func() qp.DirectTransport {
+		return tcp.NewDirectOptions("127.0.0.1:0", tcp.Options{Peers: []string{s.Addr()}, Gossip: true})
+	})
+}
+
+func TestDirectRemote(t *testing.T) {
+
+	receiver := tcp.NewDirect("127.0.0.1:0")
+	msgs := make(chan *qp.Message, 10)
+	require.NoError(t, receiver.OnMessage("remote", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	})))
+	require.NoError(t, receiver.Start())
+	defer receiver.Stop(stop.NoWait)
+	sender := tcp.NewDirect("127.0.0.1:0", receiver.Addr())
+	require.NoError(t, sender.Start())
+	defer sender.Stop(stop.NoWait)
+
+	// waits on the sender until the receiver announces the channel
+	data := make([]byte, 1<<20)
+	data[len(data)-1] = 1
+	require.NoError(t, sender.Send("remote", data))
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "remote", msg.Source)
+		require.Equal(t, data, msg.Data)
+	case <-time.After(1 * time.Second):
+		require.FailNow(t, "no message received")
+	}
+
+}
+
+func TestDirectReconnect(t *testing.T) {
+
+	addr := freeAddr(t)
+	msgs := make(chan *qp.Message, 10)
+	receiver := tcp.NewDirect(addr)
+	require.NoError(t, receiver.OnMessage("reconnect", qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	})))
+	sender := tcp.NewDirect("127.0.0.1:0", addr)
+	require.NoError(t, sender.Start())
+	defer sender.Stop(stop.NoWait)
+
+	// the sender keeps trying until the receiver starts
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, receiver.Start())
+	require.NoError(t, sender.Send("reconnect", []byte("one")))
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "one", string(msg.Data))
+	case <-time.After(2 * time.Second):
+		require.FailNow(t, "no message received")
+	}
+
+	receiver.Stop(stop.NoWait)
+	<-receiver.StopChan()
+	require.NoError(t, receiver.Start())
+	defer receiver.Stop(stop.NoWait)
+	// once the receiver is back, the message is sent to it
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, sender.Send("reconnect", []byte("two")))
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "two", string(msg.Data))
+	case <-time.After(2 * time.Second):
+		require.FailNow(t, "no message received after reconnecting")
+	}
+
+}
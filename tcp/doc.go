@@ -0,0 +1,17 @@
+// Package tcp provides transports that connect directly to each
+// other over TCP, with no broker in between.
+//
+// Every transport is a node that listens on an address and connects
+// to its peers. Nodes tell each other which channels they handle,
+// so that each message is sent straight to a node that wants it:
+//
+//	d := tcp.NewDirect(":7000", "10.0.0.2:7000", "10.0.0.3:7000")
+//
+// With Options.Gossip, nodes also share the addresses of the nodes
+// they know, so a node only needs the address of one other to find
+// the rest. Connections that fail are retried, with a growing delay
+// between attempts.
+//
+// Messages are framed with their length, and are delivered at most
+// once: messages being written when a connection fails are lost.
+package tcp
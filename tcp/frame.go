@@ -0,0 +1,109 @@
+package tcp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// frame types
+const (
+	// frameHello introduces a node by the address it can be
+	// reached on.
+	frameHello byte = iota + 1
+	// frameAnnounce lists the channels a node handles, replacing
+	// any it announced before.
+	frameAnnounce
+	// framePeers lists the addresses of the other nodes a node
+	// knows about.
+	framePeers
+	// frameMessage carries a message's channel and data.
+	frameMessage
+)
+
+// MaxFrameSize is the largest frame a node will read. Larger
+// frames close the connection.
+var MaxFrameSize = 64 << 20
+
+// errFrameSize is returned when reading a frame larger than
+// MaxFrameSize.
+var errFrameSize = errors.New("frame is too large")
+
+// errFrameFormat is returned when reading a frame whose fields
+// do not add up.
+var errFrameFormat = errors.New("malformed frame")
+
+// encodeFrame makes a frame of the type with the fields.
+//
+// Frames start with their length as a big endian uint32, followed
+// by the type byte and then each field, itself prefixed with its
+// length as a big endian uint32.
+func encodeFrame(t byte, fields ...[]byte) []byte {
+	size := 1
+	for _, f := range fields {
+		size += 4 + len(f)
+	}
+	b := make([]byte, 4+size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	b[4] = t
+	i := 5
+	for _, f := range fields {
+		binary.BigEndian.PutUint32(b[i:], uint32(len(f)))
+		i += 4
+		i += copy(b[i:], f)
+	}
+	return b
+}
+
+// encodeStrings makes a frame of the type with the strings as
+// its fields.
+func encodeStrings(t byte, strings []string) []byte {
+	fields := make([][]byte, len(strings))
+	for i, s := range strings {
+		fields[i] = []byte(s)
+	}
+	return encodeFrame(t, fields...)
+}
+
+// readFrame reads the next frame, returning its type and fields.
+func readFrame(r *bufio.Reader) (byte, [][]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := int(binary.BigEndian.Uint32(header[:]))
+	if size < 1 {
+		return 0, nil, errFrameFormat
+	}
+	if size > MaxFrameSize {
+		return 0, nil, errFrameSize
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+	var fields [][]byte
+	for i := 1; i < len(b); {
+		if i+4 > len(b) {
+			return 0, nil, errFrameFormat
+		}
+		n := int(binary.BigEndian.Uint32(b[i:]))
+		i += 4
+		if n > len(b)-i {
+			return 0, nil, errFrameFormat
+		}
+		fields = append(fields, b[i:i+n])
+		i += n
+	}
+	return b[0], fields, nil
+}
+
+// fieldStrings gets the fields as strings.
+func fieldStrings(fields [][]byte) []string {
+	s := make([]string, len(fields))
+	for i, f := range fields {
+		s[i] = string(f)
+	}
+	return s
+}
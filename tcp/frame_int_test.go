@@ -0,0 +1,58 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrame(t *testing.T) {
+
+	var buf bytes.Buffer
+	buf.Write(encodeFrame(frameMessage, []byte("channel"), []byte("data")))
+	buf.Write(encodeStrings(frameAnnounce, []string{"one", "", "three"}))
+	buf.Write(encodeStrings(framePeers, nil))
+	r := bufio.NewReader(&buf)
+
+	typ, fields, err := readFrame(r)
+	require.NoError(t, err)
+	require.Equal(t, frameMessage, typ)
+	require.Equal(t, [][]byte{[]byte("channel"), []byte("data")}, fields)
+
+	typ, fields, err = readFrame(r)
+	require.NoError(t, err)
+	require.Equal(t, frameAnnounce, typ)
+	require.Equal(t, []string{"one", "", "three"}, fieldStrings(fields))
+
+	typ, fields, err = readFrame(r)
+	require.NoError(t, err)
+	require.Equal(t, framePeers, typ)
+	require.Empty(t, fields)
+
+}
+
+func TestFrameMalformed(t *testing.T) {
+
+	// a field claims to be longer than the frame
+	frame := encodeFrame(frameMessage, []byte("channel"))
+	frame[8] = 0xff
+	_, _, err := readFrame(bufio.NewReader(bytes.NewReader(frame)))
+	require.Equal(t, errFrameFormat, err)
+
+	max := MaxFrameSize
+	MaxFrameSize = 10
+	defer func() { MaxFrameSize = max }()
+	frame = encodeFrame(frameMessage, []byte("channel"), []byte("data"))
+	_, _, err = readFrame(bufio.NewReader(bytes.NewReader(frame)))
+	require.Equal(t, errFrameSize, err)
+
+}
+
+func TestBackoff(t *testing.T) {
+
+	require.True(t, backoff(1) < backoff(2))
+	require.Equal(t, backoff(100), backoff(200))
+
+}
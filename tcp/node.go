@@ -0,0 +1,454 @@
+package tcp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+)
+
+// ErrUnavailable is returned when sending a message whose only
+// routes are to nodes that are too far behind to take it.
+var ErrUnavailable = errors.New("no node is available for the channel")
+
+// Options controls how a transport finds and talks to other nodes.
+type Options struct {
+	// Peers are the addresses of the nodes to connect to. They are
+	// reconnected to whenever the connection is lost.
+	Peers []string
+	// Gossip, when true, shares the addresses of known nodes with
+	// every node that connects, so that each node only needs the
+	// address of one other to find the rest.
+	Gossip bool
+	// Advertise is the address other nodes use to reach this one.
+	// When empty, it is the address the node listens on.
+	Advertise string
+	// QueueSize is the number of messages that may wait to be
+	// written to each node, and the number of direct messages
+	// that may wait for a node to handle their channel.
+	// Zero means DefaultQueueSize.
+	QueueSize int
+	// DialTimeout is how long to wait when connecting to a node.
+	// Zero means one second.
+	DialTimeout time.Duration
+}
+
+// DefaultQueueSize is the QueueSize used when Options does not
+// set one.
+const DefaultQueueSize = 1024
+
+// gossipAttempts is the number of times in a row a node learned
+// through gossip may fail to connect before it is forgotten.
+const gossipAttempts = 5
+
+// node connects to the other nodes and carries frames between
+// them. Transports tell it what to announce and how to deliver the
+// messages it receives.
+type node struct {
+	addr     string
+	options  Options
+	log      slog.Logger
+	announce func() []string
+	deliver  func(channel string, data []byte)
+	routed   func()
+
+	lock      sync.Mutex
+	listener  net.Listener
+	advertise string
+	peers     map[string]*peer
+	inbound   map[net.Conn]struct{}
+	receiving chan qp.Signal
+	shutdown  chan qp.Signal
+	readers   sync.WaitGroup
+	writers   sync.WaitGroup
+}
+
+// peer is another node.
+type peer struct {
+	addr string
+	seed bool
+	out  chan []byte
+	// channels are the channels the peer last announced, and conn
+	// is the connection it announced them on.
+	channels []string
+	conn     net.Conn
+	// stale is whether the peer missed an announcement because its
+	// queue was full, so that it is sent again once the queue
+	// drains.
+	stale bool
+}
+
+func newNode(addr string, options Options) *node {
+	if options.QueueSize == 0 {
+		options.QueueSize = DefaultQueueSize
+	}
+	if options.DialTimeout == 0 {
+		options.DialTimeout = 1 * time.Second
+	}
+	return &node{
+		addr:    addr,
+		options: options,
+		log:     slog.NilLogger,
+	}
+}
+
+// start listens for other nodes and starts connecting to the peers.
+func (n *node) start() error {
+	listener, err := net.Listen("tcp", n.addr)
+	if err != nil {
+		return err
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.listener = listener
+	n.advertise = n.options.Advertise
+	if n.advertise == "" {
+		n.advertise = listener.Addr().String()
+	}
+	n.peers = make(map[string]*peer)
+	n.inbound = make(map[net.Conn]struct{})
+	n.receiving = make(chan qp.Signal)
+	n.shutdown = make(chan qp.Signal)
+	for _, addr := range n.options.Peers {
+		n.addPeer(addr, true)
+	}
+	n.readers.Add(1)
+	go n.accept(listener)
+	if n.log.Info() {
+		n.log.Info("listening on", n.advertise)
+	}
+	return nil
+}
+
+// stopReceiving stops taking messages from other nodes, while
+// still allowing messages to be sent to them.
+func (n *node) stopReceiving() {
+	n.lock.Lock()
+	close(n.receiving)
+	n.listener.Close()
+	for conn := range n.inbound {
+		conn.Close()
+	}
+	n.lock.Unlock()
+}
+
+// stop disconnects from the other nodes. Transports must close
+// their dispatchers first, in case a connection is waiting for
+// one to take a message.
+func (n *node) stop() {
+	n.lock.Lock()
+	close(n.shutdown)
+	n.lock.Unlock()
+	n.readers.Wait()
+	n.writers.Wait()
+}
+
+// address gets the address other nodes use to reach this one.
+func (n *node) address() string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.advertise
+}
+
+// addPeer starts connecting to the node at the address, unless it
+// is already known.
+// Callers must hold the lock.
+func (n *node) addPeer(addr string, seed bool) {
+	if addr == n.advertise || addr == "" {
+		return
+	}
+	if _, ok := n.peers[addr]; ok {
+		return
+	}
+	p := &peer{
+		addr: addr,
+		seed: seed,
+		out:  make(chan []byte, n.options.QueueSize),
+	}
+	n.peers[addr] = p
+	n.writers.Add(1)
+	go n.connect(p, n.shutdown)
+}
+
+// removePeer forgets the peer.
+func (n *node) removePeer(p *peer) {
+	n.lock.Lock()
+	if n.peers[p.addr] == p {
+		delete(n.peers, p.addr)
+	}
+	n.lock.Unlock()
+	if n.log.Info() {
+		n.log.Info("forgot", p.addr)
+	}
+}
+
+// connect keeps a connection open to the peer, writing the frames
+// sent to it, until the node stops.
+func (n *node) connect(p *peer, shutdown chan qp.Signal) {
+	defer n.writers.Done()
+	failures := 0
+	for {
+		conn, err := net.DialTimeout("tcp", p.addr, n.options.DialTimeout)
+		if err != nil {
+			failures++
+			if !p.seed && failures >= gossipAttempts {
+				n.removePeer(p)
+				return
+			}
+			if n.log.Warn() {
+				n.log.Warn("failed to connect to", p.addr+":", err)
+			}
+			select {
+			case <-shutdown:
+				return
+			case <-time.After(backoff(failures)):
+			}
+			continue
+		}
+		failures = 0
+		if n.log.Info() {
+			n.log.Info("connected to", p.addr)
+		}
+		if done := n.write(p, conn, shutdown); done {
+			return
+		}
+	}
+}
+
+// backoff gets how long to wait before trying to connect again.
+func backoff(failures int) time.Duration {
+	d := 50 * time.Millisecond
+	for i := 1; i < failures && d < 5*time.Second; i++ {
+		d *= 2
+	}
+	if d > 5*time.Second {
+		d = 5 * time.Second
+	}
+	return d
+}
+
+// write introduces this node on the connection and then writes
+// the frames sent to the peer. It returns true once the node stops,
+// or false if the connection fails.
+func (n *node) write(p *peer, conn net.Conn, shutdown chan qp.Signal) bool {
+	defer conn.Close()
+	// nothing is read from the connection, so reading only returns
+	// once the peer has gone
+	gone := make(chan qp.Signal)
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(gone)
+	}()
+	w := bufio.NewWriter(conn)
+	n.lock.Lock()
+	greeting := [][]byte{
+		encodeFrame(frameHello, []byte(n.advertise)),
+		encodeStrings(frameAnnounce, n.announce()),
+	}
+	p.stale = false
+	if n.options.Gossip {
+		var addrs []string
+		for addr := range n.peers {
+			addrs = append(addrs, addr)
+		}
+		greeting = append(greeting, encodeStrings(framePeers, addrs))
+	}
+	n.lock.Unlock()
+	for _, frame := range greeting {
+		if _, err := w.Write(frame); err != nil {
+			return false
+		}
+	}
+	for {
+		if err := w.Flush(); err != nil {
+			return false
+		}
+		select {
+		case frame := <-p.out:
+			if _, err := w.Write(frame); err != nil {
+				if n.log.Warn() {
+					n.log.Warn("lost connection to", p.addr+":", err)
+				}
+				return false
+			}
+			// write whatever else is waiting before flushing
+			for more := true; more; {
+				select {
+				case frame := <-p.out:
+					if _, err := w.Write(frame); err != nil {
+						return false
+					}
+				default:
+					more = false
+				}
+			}
+			if frame := n.reannounce(p); frame != nil {
+				if _, err := w.Write(frame); err != nil {
+					return false
+				}
+			}
+		case <-gone:
+			if n.log.Warn() {
+				n.log.Warn("lost connection to", p.addr)
+			}
+			return false
+		case <-shutdown:
+			return true
+		}
+	}
+}
+
+// accept takes connections from other nodes until the listener
+// is closed.
+func (n *node) accept(listener net.Listener) {
+	defer n.readers.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		n.lock.Lock()
+		select {
+		case <-n.receiving:
+			n.lock.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		n.inbound[conn] = struct{}{}
+		n.readers.Add(1)
+		n.lock.Unlock()
+		go n.read(conn)
+	}
+}
+
+// read handles the frames another node sends on the connection.
+func (n *node) read(conn net.Conn) {
+	defer n.readers.Done()
+	var from string
+	defer func() {
+		conn.Close()
+		n.lock.Lock()
+		delete(n.inbound, conn)
+		// the peer's announcements only hold while it is connected
+		if p, ok := n.peers[from]; ok && p.conn == conn {
+			p.channels = nil
+			p.conn = nil
+		}
+		n.lock.Unlock()
+	}()
+	r := bufio.NewReader(conn)
+	for {
+		t, fields, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		switch t {
+		case frameHello:
+			if len(fields) != 1 {
+				return
+			}
+			from = string(fields[0])
+			n.lock.Lock()
+			n.addPeer(from, false)
+			n.lock.Unlock()
+		case frameAnnounce:
+			n.lock.Lock()
+			if p, ok := n.peers[from]; ok {
+				p.channels = fieldStrings(fields)
+				p.conn = conn
+			}
+			n.lock.Unlock()
+			n.routed()
+		case framePeers:
+			if !n.options.Gossip {
+				continue
+			}
+			n.lock.Lock()
+			for _, addr := range fieldStrings(fields) {
+				n.addPeer(addr, false)
+			}
+			n.lock.Unlock()
+		case frameMessage:
+			if len(fields) != 2 {
+				return
+			}
+			n.deliver(string(fields[0]), fields[1])
+		}
+	}
+}
+
+// broadcast sends the node's announcement to every peer. Peers
+// whose queues are full are sent it once their queues drain.
+func (n *node) broadcast() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.peers == nil {
+		return
+	}
+	frame := encodeStrings(frameAnnounce, n.announce())
+	for _, p := range n.peers {
+		select {
+		case p.out <- frame:
+		default:
+			p.stale = true
+			if n.log.Warn() {
+				n.log.Warn("announcement to", p.addr, "delayed until its queue drains")
+			}
+		}
+	}
+}
+
+// reannounce gets the node's announcement if the peer missed it
+// while its queue was full, or nil if it did not.
+func (n *node) reannounce(p *peer) []byte {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if !p.stale {
+		return nil
+	}
+	p.stale = false
+	return encodeStrings(frameAnnounce, n.announce())
+}
+
+// routes gets the addresses of the peers whose announced channels
+// match the channel, in order.
+func (n *node) routes(match func(announced string) bool) []string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	var addrs []string
+	for addr, p := range n.peers {
+		for _, announced := range p.channels {
+			if match(announced) {
+				addrs = append(addrs, addr)
+				break
+			}
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// send queues the message to be written to the peer, and returns
+// false if the peer is unknown or too far behind to take it.
+func (n *node) send(addr, channel string, data []byte) bool {
+	n.lock.Lock()
+	p, ok := n.peers[addr]
+	n.lock.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case p.out <- encodeFrame(frameMessage, []byte(channel), data):
+		return true
+	default:
+		return false
+	}
+}
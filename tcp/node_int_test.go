@@ -0,0 +1,68 @@
+package tcp
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBroadcastFullQueue(t *testing.T) {
+
+	// a peer that does not read until the node's queue to it is full
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	addr := l.Addr().String()
+	var lock sync.Mutex
+	channels := []string{"before"}
+	n := newNode("127.0.0.1:0", Options{Peers: []string{addr}, QueueSize: 1})
+	n.announce = func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return channels
+	}
+	n.deliver = func(string, []byte) {}
+	n.routed = func() {}
+	require.NoError(t, n.start())
+	defer func() {
+		n.stopReceiving()
+		n.stop()
+	}()
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.(*net.TCPConn).SetReadBuffer(4096)
+
+	data := make([]byte, 1<<16)
+	deadline := time.Now().Add(5 * time.Second)
+	for n.send(addr, "fill", data) {
+		require.True(t, time.Now().Before(deadline), "queue never filled")
+	}
+	lock.Lock()
+	channels = []string{"after"}
+	lock.Unlock()
+	n.broadcast()
+
+	// the announcement follows the queued messages once the peer
+	// reads them
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	var announced [][]string
+	for {
+		typ, fields, err := readFrame(r)
+		require.NoError(t, err)
+		if typ != frameAnnounce {
+			continue
+		}
+		announced = append(announced, fieldStrings(fields))
+		if len(announced) == 2 {
+			break
+		}
+	}
+	require.Equal(t, [][]string{{"before"}, {"after"}}, announced)
+
+}
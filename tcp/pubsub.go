@@ -0,0 +1,236 @@
+package tcp
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/slog"
+)
+
+// PubSub represents a qp.PubSubTransport.
+type PubSub struct {
+	qp.Lifecycle
+	node          *node
+	lock          sync.RWMutex
+	subscriptions map[string][]*subscription
+	options       map[string]qp.ChannelOptions
+	log           slog.Logger
+}
+
+// subscription is a single handler bound to a channel.
+type subscription struct {
+	handler    qp.Handler
+	dispatcher *qp.Dispatcher
+}
+
+// ensure the interface is satisfied
+var _ qp.PubSubTransport = (*PubSub)(nil)
+
+// NewPubSub makes a new PubSub that listens on the address and
+// connects to the peers.
+func NewPubSub(addr string, peers ...string) *PubSub {
+	return NewPubSubOptions(addr, Options{Peers: peers})
+}
+
+// NewPubSubOptions makes a new PubSub that listens on the address
+// and finds other nodes as the options describe.
+func NewPubSubOptions(addr string, options Options) *PubSub {
+	p := &PubSub{
+		node:          newNode(addr, options),
+		subscriptions: make(map[string][]*subscription),
+		options:       make(map[string]qp.ChannelOptions),
+		log:           slog.NilLogger,
+	}
+	p.node.announce = p.channels
+	p.node.deliver = p.receive
+	p.node.routed = func() {}
+	return p
+}
+
+// SetLogger sets the Logger to log to.
+func (p *PubSub) SetLogger(log slog.Logger) {
+	p.log = log
+	p.node.log = log
+}
+
+// Addr gets the address other nodes use to reach this one. It is
+// only known once the transport has started.
+func (p *PubSub) Addr() string {
+	return p.node.address()
+}
+
+// Publish publishes data on the specified channel, to this node
+// and every node subscribed to it. ErrUnavailable is returned if
+// any of the nodes are too far behind to take the message, though
+// the others still get it.
+func (p *PubSub) Publish(channel string, data []byte) error {
+	if !p.Running() {
+		return qp.ErrNotRunning
+	}
+	if p.log.Info() {
+		p.log.Info("publishing to", channel, string(data))
+	}
+	var err error
+	routes := p.node.routes(func(pattern string) bool {
+		return qp.MatchChannel(pattern, channel)
+	})
+	for _, addr := range routes {
+		if !p.node.send(addr, channel, data) {
+			if p.log.Warn() {
+				p.log.Warn("dropped message to", channel, "for", addr)
+			}
+			err = ErrUnavailable
+		}
+	}
+	p.receive(channel, data)
+	return err
+}
+
+// receive hands a message to the matching subscriptions.
+func (p *PubSub) receive(channel string, data []byte) {
+	msg := &qp.Message{Source: channel, Data: data}
+	var dispatchers []*qp.Dispatcher
+	p.lock.RLock()
+	for pattern, subscriptions := range p.subscriptions {
+		if !qp.MatchChannel(pattern, channel) {
+			continue
+		}
+		for _, s := range subscriptions {
+			dispatchers = append(dispatchers, s.dispatcher)
+		}
+	}
+	p.lock.RUnlock()
+	// blocks while a channel is at capacity
+	for _, d := range dispatchers {
+		d.Dispatch(msg)
+	}
+}
+
+// channels gets the channels this node subscribes to.
+func (p *PubSub) channels() []string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	channels := make([]string, 0, len(p.subscriptions))
+	for channel := range p.subscriptions {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// Subscribe binds the handler to the specified channel, and tells
+// the other nodes that this node subscribes to it.
+func (p *PubSub) Subscribe(channel string, handler qp.Handler) (qp.Subscription, error) {
+	p.lock.Lock()
+	s := &subscription{
+		handler:    handler,
+		dispatcher: qp.NewDispatcher(handler, p.options[channel]),
+	}
+	p.subscriptions[channel] = append(p.subscriptions[channel], s)
+	p.lock.Unlock()
+	p.node.broadcast()
+	return qp.SubscriptionFunc(func() error {
+		p.remove(channel, s)
+		return nil
+	}), nil
+}
+
+// remove unbinds a single subscription from the channel.
+func (p *PubSub) remove(channel string, s *subscription) {
+	p.lock.Lock()
+	subscriptions := p.subscriptions[channel]
+	for i, existing := range subscriptions {
+		if existing == s {
+			s.dispatcher.Close()
+			subscriptions = append(subscriptions[:i:i], subscriptions[i+1:]...)
+			break
+		}
+	}
+	if len(subscriptions) == 0 {
+		delete(p.subscriptions, channel)
+	} else {
+		p.subscriptions[channel] = subscriptions
+	}
+	p.lock.Unlock()
+	p.node.broadcast()
+}
+
+// Unsubscribe unbinds all handlers from the specified channel.
+func (p *PubSub) Unsubscribe(channel string) error {
+	p.lock.Lock()
+	for _, s := range p.subscriptions[channel] {
+		s.dispatcher.Close()
+	}
+	delete(p.subscriptions, channel)
+	p.lock.Unlock()
+	p.node.broadcast()
+	return nil
+}
+
+// SetChannelOptions sets the options that control how messages
+// on the specified channel are dispatched to its handlers.
+func (p *PubSub) SetChannelOptions(channel string, options qp.ChannelOptions) error {
+	p.lock.Lock()
+	p.options[channel] = options
+	for _, s := range p.subscriptions[channel] {
+		s.dispatcher.Close()
+		s.dispatcher = qp.NewDispatcher(s.handler, options)
+	}
+	p.lock.Unlock()
+	return nil
+}
+
+// Start starts listening for other nodes and connecting to the
+// peers. A stopped transport may be started again.
+func (p *PubSub) Start() error {
+	if err := p.BeginStart(); err != nil {
+		return err
+	}
+	p.lock.Lock()
+	for channel, subscriptions := range p.subscriptions {
+		for _, s := range subscriptions {
+			s.dispatcher.Close()
+			s.dispatcher = qp.NewDispatcher(s.handler, p.options[channel])
+		}
+	}
+	p.lock.Unlock()
+	return p.EndStart(p.node.start())
+}
+
+// Stop stops the transport and closes StopChan() when finished.
+//
+// No new messages are taken from other nodes once Stop is called,
+// and messages already being handled have the grace period to
+// finish before they are abandoned. It is safe to call Stop more
+// than once.
+func (p *PubSub) Stop(grace time.Duration) {
+	if !p.BeginStop() {
+		return
+	}
+	if p.log.Info() {
+		p.log.Info("stopping...")
+	}
+	p.node.stopReceiving()
+	var dispatchers []*qp.Dispatcher
+	p.lock.RLock()
+	for _, subscriptions := range p.subscriptions {
+		for _, s := range subscriptions {
+			dispatchers = append(dispatchers, s.dispatcher)
+		}
+	}
+	p.lock.RUnlock()
+	abandoned := qp.Drain(grace, dispatchers...)
+	for _, d := range dispatchers {
+		d.Close()
+	}
+	if abandoned > 0 && p.log.Warn() {
+		p.log.Warn("abandoned", abandoned, "in-flight handlers")
+	}
+	p.node.stop()
+	p.EndStop(abandoned)
+	if p.log.Info() {
+		p.log.Info("stopped")
+	}
+}
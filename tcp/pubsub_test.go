@@ -0,0 +1,21 @@
+package tcp_test
+
+import (
+	"testing"
+
+	"github.com/qp/go"
+	"github.com/qp/go/tcp"
+	"github.com/qp/go/transporttest"
+	"github.com/stretchr/pat/stop"
+)
+
+func TestPubSubConformance(t *testing.T) {
+	s := tcp.NewPubSubOptions("127.0.0.1:0", tcp.Options{Gossip: true})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(stop.NoWait)
+	transporttest.PubSub(t, func() qp.PubSubTransport {
+		return tcp.NewPubSubOptions("127.0.0.1:0", tcp.Options{Peers: []string{s.Addr()}, Gossip: true})
+	})
+}
@@ -5,12 +5,14 @@ import (
 	"time"
 
 	"github.com/qp/go"
-	"github.com/stretchr/pat/stop"
 )
 
 // Direct represents a qp.DirectTransport.
+//
+// Direct embeds qp.Lifecycle, which provides StopChan and
+// tracks whether the transport is running.
 type Direct struct {
-	stopChan chan stop.Signal
+	qp.Lifecycle
 }
 
 // ensure the interface is satisfied
@@ -18,9 +20,7 @@ var _ qp.DirectTransport = (*Direct)(nil)
 
 // NewDirect makes a new direct transport.
 func NewDirect() *Direct {
-	return &Direct{
-		stopChan: stop.Make(),
-	}
+	return &Direct{}
 }
 
 // Send sends data on the channel.
@@ -33,23 +33,33 @@ func (d *Direct) OnMessage(channel string, handler qp.Handler) error {
 	return errors.New("not implemented")
 }
 
+// RemoveHandler unbinds the handler from the specified channel.
+func (d *Direct) RemoveHandler(channel string) error {
+	return errors.New("not implemented")
+}
+
 // Start starts the transport.
+// A stopped transport must be able to start again.
 func (d *Direct) Start() error {
-	return errors.New("not implemented")
+	if err := d.BeginStart(); err != nil {
+		return err
+	}
+	// do work to start
+	return d.EndStart(errors.New("not implemented"))
 }
 
 // Stop instructs the transport to gracefully stop and close the
 // StopChan when stopping has completed.
 //
 // In-flight requests will have "wait" duration to complete
-// before being abandoned.
+// before being abandoned. Transports should stop taking new
+// messages straight away, then use qp.Drain to wait for the
+// dispatchers of each channel. It must be safe to call Stop
+// more than once.
 func (d *Direct) Stop(wait time.Duration) {
-
-}
-
-// StopChan gets the stop channel which will block until
-// stopping has completed, at which point it is closed.
-// Callers should never close the stop channel.
-func (d *Direct) StopChan() <-chan stop.Signal {
-	return stop.Stopped()
+	if !d.BeginStop() {
+		return
+	}
+	// do work to stop
+	d.EndStop(0)
 }
@@ -1,3 +1,6 @@
 // Package templates contains template code for writing QP
 // components, such as codecs and transports.
+//
+// New transports should pass the tests in the transporttest
+// package.
 package templates
@@ -5,12 +5,14 @@ import (
 	"time"
 
 	"github.com/qp/go"
-	"github.com/stretchr/pat/stop"
 )
 
 // PubSub represents a qp.PubSubTransport.
+//
+// PubSub embeds qp.Lifecycle, which provides StopChan and
+// tracks whether the transport is running.
 type PubSub struct {
-	stopChan chan stop.Signal
+	qp.Lifecycle
 }
 
 // ensure the interface is satisfied
@@ -18,10 +20,7 @@ var _ qp.PubSubTransport = (*PubSub)(nil)
 
 // NewPubSub makes a new PubSub.
 func NewPubSub() *PubSub {
-	p := &PubSub{
-		stopChan: stop.Make(),
-	}
-	return p
+	return &PubSub{}
 }
 
 // Publish publishes data on the specified channel.
@@ -30,23 +29,34 @@ func (p *PubSub) Publish(channel string, data []byte) error {
 }
 
 // Subscribe binds the handler to the specified channel.
-func (p *PubSub) Subscribe(channel string, handler qp.Handler) error {
+func (p *PubSub) Subscribe(channel string, handler qp.Handler) (qp.Subscription, error) {
+	return nil, errors.New("not implemented")
+}
+
+// Unsubscribe unbinds all handlers from the specified channel.
+func (p *PubSub) Unsubscribe(channel string) error {
 	return errors.New("not implemented")
 }
 
 // Start starts the transport.
+// A stopped transport must be able to start again.
 func (p *PubSub) Start() error {
-	return errors.New("not implemented")
+	if err := p.BeginStart(); err != nil {
+		return err
+	}
+	// do work to start
+	return p.EndStart(errors.New("not implemented"))
 }
 
 // Stop stops the transport and closes StopChan() when finished.
+//
+// Transports should stop receiving messages straight away, then
+// use qp.Drain to give handlers the grace period to finish.
+// It must be safe to call Stop more than once.
 func (p *PubSub) Stop(grace time.Duration) {
+	if !p.BeginStop() {
+		return
+	}
 	// do work to stop
-	close(p.stopChan)
-}
-
-// StopChan gets the stop channel which will be closed when
-// this transport has successfully stopped.
-func (p *PubSub) StopChan() <-chan stop.Signal {
-	return p.stopChan
+	p.EndStop(0)
 }
@@ -42,6 +42,23 @@ func (f HandlerFunc) Handle(msg *Message) {
 	f(msg)
 }
 
+// Subscription represents a single handler bound to a
+// channel by a PubSubTransport.
+type Subscription interface {
+	// Unsubscribe unbinds the handler from the channel, leaving
+	// any other handlers on the channel in place.
+	Unsubscribe() error
+}
+
+// SubscriptionFunc represents functions capable of acting
+// as a Subscription.
+type SubscriptionFunc func() error
+
+// Unsubscribe calls the SubscriptionFunc.
+func (f SubscriptionFunc) Unsubscribe() error {
+	return f()
+}
+
 // PubSubTransport represents a transport capable of
 // providing publish/subscribe capabilities.
 type PubSubTransport interface {
@@ -49,9 +66,16 @@ type PubSubTransport interface {
 	// Publish publishes data on the specified channel.
 	Publish(channel string, data []byte) error
 	// Subscribe binds the handler to the specified channel.
-	// Only one handler can be associated with a given channel.
-	// Multiple calls to Subscribe with the same channel will replace the previous handler.
-	Subscribe(channel string, handler Handler) error
+	// Many handlers can be associated with a given channel, and
+	// each of them receives every message published on it.
+	// The channel may be a pattern, as described in the package
+	// documentation.
+	// The returned Subscription unbinds just this handler.
+	// Subscribe may be called while the transport is running.
+	Subscribe(channel string, handler Handler) (Subscription, error)
+	// Unsubscribe unbinds all handlers from the specified channel.
+	// Unsubscribe may be called while the transport is running.
+	Unsubscribe(channel string) error
 }
 
 // DirectTransport represents a transport capable of
@@ -63,5 +87,9 @@ type DirectTransport interface {
 	// OnMessage binds the handler to the specified channel.
 	// Only one handler can be associated with a given channel.
 	// Multiple calls to OnMessage wiht the same channel will replace the previous handler.
+	// OnMessage may be called while the transport is running.
 	OnMessage(channel string, handler Handler) error
+	// RemoveHandler unbinds the handler from the specified channel.
+	// RemoveHandler may be called while the transport is running.
+	RemoveHandler(channel string) error
 }
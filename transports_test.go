@@ -25,11 +25,17 @@ func (t *TestPubSubTransport) Publish(c string, d []byte) error {
 	t.Published[c] = d
 	return t.Err
 }
-func (t *TestPubSubTransport) Subscribe(c string, h qp.Handler) error {
+func (t *TestPubSubTransport) Subscribe(c string, h qp.Handler) (qp.Subscription, error) {
 	if t.Subscribed == nil {
 		t.Subscribed = make(map[string]qp.Handler)
 	}
 	t.Subscribed[c] = h
+	return qp.SubscriptionFunc(func() error {
+		return t.Unsubscribe(c)
+	}), t.Err
+}
+func (t *TestPubSubTransport) Unsubscribe(c string) error {
+	delete(t.Subscribed, c)
 	return t.Err
 }
 func (t *TestPubSubTransport) Start() error {
@@ -57,6 +63,10 @@ func (t *TestDirectTransport) OnMessage(s string, h qp.Handler) error {
 	t.OnMessages[s] = h
 	return t.Err
 }
+func (t *TestDirectTransport) RemoveHandler(s string) error {
+	delete(t.OnMessages, s)
+	return t.Err
+}
 func (t *TestDirectTransport) Send(s string, d []byte) error {
 	if t.Sends == nil {
 		t.Sends = make(map[string][]byte)
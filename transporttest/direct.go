@@ -0,0 +1,181 @@
+package transporttest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/qp/go"
+	"github.com/stretchr/pat/start"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+// Direct tests that the transports made by makeTransport behave
+// like every qp.DirectTransport should. Each call to makeTransport
+// must return a new transport connected to the same broker.
+func Direct(t *testing.T, makeTransport func() qp.DirectTransport) {
+
+	t.Run("Lifecycle", func(t *testing.T) {
+		Lifecycle(t, func() start.StartStopper {
+			return makeTransport()
+		})
+	})
+	t.Run("NotRunning", func(t *testing.T) {
+		d := makeTransport()
+		require.Equal(t, qp.ErrNotRunning, d.Send(channel("notrunning"), []byte("data")))
+		require.NoError(t, d.Start())
+		d.Stop(stop.NoWait)
+		requireStopped(t, d, "after Stop")
+		require.Equal(t, qp.ErrNotRunning, d.Send(channel("notrunning"), []byte("data")))
+	})
+	t.Run("Delivery", func(t *testing.T) {
+		testDirectDelivery(t, makeTransport)
+	})
+	t.Run("CompetingConsumers", func(t *testing.T) {
+		testDirectCompetingConsumers(t, makeTransport)
+	})
+	t.Run("RemoveHandler", func(t *testing.T) {
+		testDirectRemoveHandler(t, makeTransport)
+	})
+	t.Run("Concurrency", func(t *testing.T) {
+		testDirectConcurrency(t, makeTransport)
+	})
+	t.Run("LargePayload", func(t *testing.T) {
+		testDirectLargePayload(t, makeTransport)
+	})
+	t.Run("StopDrains", func(t *testing.T) {
+		testDirectStopDrains(t, makeTransport)
+	})
+	t.Run("Restart", func(t *testing.T) {
+		testDirectRestart(t, makeTransport)
+	})
+
+}
+
+func testDirectDelivery(t *testing.T, makeTransport func() qp.DirectTransport) {
+	d := makeTransport()
+	ch := channel("delivery")
+	handler, msgs := collect()
+	require.NoError(t, d.OnMessage(ch, handler))
+	defer run(t, d)()
+
+	require.NoError(t, d.Send(ch, []byte("one")))
+	msg := receive(t, msgs, 1)[0]
+	require.Equal(t, ch, msg.Source)
+	require.Equal(t, "one", string(msg.Data))
+}
+
+func testDirectCompetingConsumers(t *testing.T, makeTransport func() qp.DirectTransport) {
+	sender, first, second := makeTransport(), makeTransport(), makeTransport()
+	ch := channel("competing")
+	msgs := make(chan *qp.Message, 100)
+	counts := make([]int, 2)
+	var lock sync.Mutex
+	for i, d := range []qp.DirectTransport{first, second} {
+		i := i
+		require.NoError(t, d.OnMessage(ch, qp.HandlerFunc(func(msg *qp.Message) {
+			lock.Lock()
+			counts[i]++
+			lock.Unlock()
+			msgs <- msg
+		})))
+	}
+	defer run(t, sender, first, second)()
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, sender.Send(ch, []byte(fmt.Sprint(i))))
+	}
+	seen := make(map[string]bool)
+	for _, msg := range receive(t, msgs, 20) {
+		require.False(t, seen[string(msg.Data)], "message %s delivered more than once", msg.Data)
+		seen[string(msg.Data)] = true
+	}
+	receiveNone(t, msgs)
+	lock.Lock()
+	require.Equal(t, 20, counts[0]+counts[1])
+	lock.Unlock()
+}
+
+func testDirectRemoveHandler(t *testing.T, makeTransport func() qp.DirectTransport) {
+	d := makeTransport()
+	ch := channel("removehandler")
+	handler, msgs := collect()
+	require.NoError(t, d.OnMessage(ch, handler))
+	defer run(t, d)()
+
+	require.NoError(t, d.Send(ch, []byte("one")))
+	receive(t, msgs, 1)
+	require.NoError(t, d.RemoveHandler(ch))
+	require.NoError(t, d.Send(ch, []byte("two")))
+	receiveNone(t, msgs)
+}
+
+func testDirectConcurrency(t *testing.T, makeTransport func() qp.DirectTransport) {
+	d := makeTransport()
+	ch := channel("concurrency")
+	handler, msgs := collect()
+	require.NoError(t, d.OnMessage(ch, handler))
+	defer run(t, d)()
+
+	const senders, each = 10, 10
+	errs := make(chan error, senders*each)
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < each; j++ {
+				errs <- d.Send(ch, []byte(fmt.Sprintf("%d.%d", i, j)))
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	seen := make(map[string]bool)
+	for _, msg := range receive(t, msgs, senders*each) {
+		seen[string(msg.Data)] = true
+	}
+	require.Equal(t, senders*each, len(seen))
+}
+
+func testDirectLargePayload(t *testing.T, makeTransport func() qp.DirectTransport) {
+	d := makeTransport()
+	ch := channel("large")
+	handler, msgs := collect()
+	require.NoError(t, d.OnMessage(ch, handler))
+	defer run(t, d)()
+
+	data := payload(LargePayload)
+	require.NoError(t, d.Send(ch, data))
+	require.Equal(t, data, receive(t, msgs, 1)[0].Data)
+}
+
+func testDirectStopDrains(t *testing.T, makeTransport func() qp.DirectTransport) {
+	d := makeTransport()
+	ch := channel("stopdrains")
+	handler, started, release := blocking()
+	require.NoError(t, d.OnMessage(ch, handler))
+	require.NoError(t, d.Start())
+
+	require.NoError(t, d.Send(ch, []byte("one")))
+	receive(t, started, 1)
+	stopDrains(t, d, release)
+}
+
+func testDirectRestart(t *testing.T, makeTransport func() qp.DirectTransport) {
+	d := makeTransport()
+	ch := channel("restart")
+	handler, msgs := collect()
+	require.NoError(t, d.OnMessage(ch, handler))
+	require.NoError(t, d.Start())
+	d.Stop(stop.NoWait)
+	requireStopped(t, d, "after Stop")
+	defer run(t, d)()
+
+	require.NoError(t, d.Send(ch, []byte("one")))
+	require.Equal(t, "one", string(receive(t, msgs, 1)[0].Data))
+}
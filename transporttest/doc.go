@@ -0,0 +1,19 @@
+// Package transporttest provides tests that every QP transport
+// is expected to pass.
+//
+// Transport packages call Direct or PubSub from their own tests,
+// passing a function that makes a new transport. The same battery
+// of tests then runs against every transport, covering delivery,
+// competing consumers, fan-out, patterns, lifecycle errors, stop
+// semantics, concurrency and large payloads:
+//
+//	func TestDirectConformance(t *testing.T) {
+//	  transporttest.Direct(t, func() qp.DirectTransport {
+//	    return inproc.NewDirect()
+//	  })
+//	}
+//
+// Transports that need a broker should skip the test when the
+// broker is not available, and every transport made by the
+// function must be connected to the same broker.
+package transporttest
@@ -0,0 +1,112 @@
+package transporttest
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/pat/start"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+// Settle is how long the tests wait after binding handlers before
+// sending messages, for transports whose subscriptions take effect
+// some time after Start or Subscribe returns.
+var Settle = 100 * time.Millisecond
+
+// LargePayload is the size in bytes of the message sent by the
+// large payload tests.
+var LargePayload = 1 << 20
+
+var channelCount uint64
+
+// channel makes a channel name that no other test uses, so that
+// messages left behind on a broker cannot leak between tests.
+func channel(name string) string {
+	n := atomic.AddUint64(&channelCount, 1)
+	return fmt.Sprintf("transporttest.%s.%d.%d", name, time.Now().UnixNano(), n)
+}
+
+// collect makes a handler that sends messages to the returned
+// channel.
+func collect() (qp.Handler, chan *qp.Message) {
+	msgs := make(chan *qp.Message, 1000)
+	return qp.HandlerFunc(func(msg *qp.Message) {
+		msgs <- msg
+	}), msgs
+}
+
+// receive waits for n messages and returns them.
+func receive(t *testing.T, msgs chan *qp.Message, n int) []*qp.Message {
+	var received []*qp.Message
+	for len(received) < n {
+		select {
+		case msg := <-msgs:
+			received = append(received, msg)
+		case <-time.After(Timeout):
+			require.FailNow(t, fmt.Sprintf("received %d of %d messages", len(received), n))
+		}
+	}
+	return received
+}
+
+// receiveNone fails if a message arrives within Settle.
+func receiveNone(t *testing.T, msgs chan *qp.Message) {
+	select {
+	case msg := <-msgs:
+		require.FailNow(t, "unexpected message", "%v", msg)
+	case <-time.After(Settle):
+	}
+}
+
+// payload makes some data of the given size.
+func payload(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+// run starts the transports, failing the test if any of them
+// cannot start, and returns a function that stops them all.
+func run(t *testing.T, transports ...start.StartStopper) func() {
+	for _, transport := range transports {
+		require.NoError(t, transport.Start())
+	}
+	return func() {
+		for _, transport := range transports {
+			transport.Stop(stop.NoWait)
+		}
+		for _, transport := range transports {
+			requireStopped(t, transport, "after Stop")
+		}
+	}
+}
+
+// blocking makes a handler that signals started when it is
+// called, then waits until release is closed.
+func blocking() (handler qp.Handler, started chan *qp.Message, release chan struct{}) {
+	started = make(chan *qp.Message, 1)
+	release = make(chan struct{})
+	return qp.HandlerFunc(func(msg *qp.Message) {
+		started <- msg
+		<-release
+	}), started, release
+}
+
+// stopDrains checks that Stop waits for the handler, which must
+// be blocked on release, before closing StopChan.
+func stopDrains(t *testing.T, transport start.StartStopper, release chan struct{}) {
+	go transport.Stop(Timeout)
+	select {
+	case <-transport.StopChan():
+		require.FailNow(t, "StopChan closed before in-flight handler finished")
+	case <-time.After(Settle):
+	}
+	close(release)
+	requireStopped(t, transport, "after in-flight handler finished")
+}
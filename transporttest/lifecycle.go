@@ -0,0 +1,58 @@
+package transporttest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/pat/start"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+// Timeout is how long the tests wait for a transport to do
+// something before failing.
+var Timeout = 5 * time.Second
+
+// Lifecycle tests that the transport made by makeTransport starts,
+// stops and restarts the way every transport should.
+func Lifecycle(t *testing.T, makeTransport func() start.StartStopper) {
+
+	transport := makeTransport()
+
+	// a new transport is not running
+	requireStopped(t, transport, "new transport")
+	transport.Stop(stop.NoWait)
+	requireStopped(t, transport, "Stop before Start")
+
+	for run := 0; run < 2; run++ {
+
+		require.NoError(t, transport.Start(), "Start (run %d)", run)
+		requireRunning(t, transport, "after Start")
+		require.Equal(t, qp.ErrRunning, transport.Start(), "Start while running")
+		requireRunning(t, transport, "after second Start")
+
+		transport.Stop(stop.NoWait)
+		requireStopped(t, transport, "after Stop")
+		transport.Stop(stop.NoWait)
+		requireStopped(t, transport, "after second Stop")
+
+	}
+
+}
+
+func requireRunning(t *testing.T, transport start.StartStopper, msg string) {
+	select {
+	case <-transport.StopChan():
+		require.FailNow(t, "StopChan should not be closed while running", msg)
+	default:
+	}
+}
+
+func requireStopped(t *testing.T, transport start.StartStopper, msg string) {
+	select {
+	case <-transport.StopChan():
+	case <-time.After(Timeout):
+		require.FailNow(t, "StopChan should be closed when stopped", msg)
+	}
+}
@@ -0,0 +1,223 @@
+package transporttest
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qp/go"
+	"github.com/stretchr/pat/start"
+	"github.com/stretchr/pat/stop"
+	"github.com/stretchr/testify/require"
+)
+
+// PubSub tests that the transports made by makeTransport behave
+// like every qp.PubSubTransport should. Each call to makeTransport
+// must return a new transport connected to the same broker.
+func PubSub(t *testing.T, makeTransport func() qp.PubSubTransport) {
+
+	t.Run("Lifecycle", func(t *testing.T) {
+		Lifecycle(t, func() start.StartStopper {
+			return makeTransport()
+		})
+	})
+	t.Run("NotRunning", func(t *testing.T) {
+		p := makeTransport()
+		require.Equal(t, qp.ErrNotRunning, p.Publish(channel("notrunning"), []byte("data")))
+		require.NoError(t, p.Start())
+		p.Stop(stop.NoWait)
+		requireStopped(t, p, "after Stop")
+		require.Equal(t, qp.ErrNotRunning, p.Publish(channel("notrunning"), []byte("data")))
+	})
+	t.Run("Delivery", func(t *testing.T) {
+		testPubSubDelivery(t, makeTransport)
+	})
+	t.Run("FanOut", func(t *testing.T) {
+		testPubSubFanOut(t, makeTransport)
+	})
+	t.Run("Unsubscribe", func(t *testing.T) {
+		testPubSubUnsubscribe(t, makeTransport)
+	})
+	t.Run("Patterns", func(t *testing.T) {
+		testPubSubPatterns(t, makeTransport)
+	})
+	t.Run("Concurrency", func(t *testing.T) {
+		testPubSubConcurrency(t, makeTransport)
+	})
+	t.Run("LargePayload", func(t *testing.T) {
+		testPubSubLargePayload(t, makeTransport)
+	})
+	t.Run("StopDrains", func(t *testing.T) {
+		testPubSubStopDrains(t, makeTransport)
+	})
+	t.Run("Restart", func(t *testing.T) {
+		testPubSubRestart(t, makeTransport)
+	})
+
+}
+
+func testPubSubDelivery(t *testing.T, makeTransport func() qp.PubSubTransport) {
+	p := makeTransport()
+	ch := channel("delivery")
+	handler, msgs := collect()
+	_, err := p.Subscribe(ch, handler)
+	require.NoError(t, err)
+	defer run(t, p)()
+	time.Sleep(Settle)
+
+	require.NoError(t, p.Publish(ch, []byte("one")))
+	msg := receive(t, msgs, 1)[0]
+	require.Equal(t, ch, msg.Source)
+	require.Equal(t, "one", string(msg.Data))
+}
+
+func testPubSubFanOut(t *testing.T, makeTransport func() qp.PubSubTransport) {
+	publisher, first, second := makeTransport(), makeTransport(), makeTransport()
+	ch := channel("fanout")
+	var received []chan *qp.Message
+	for _, p := range []qp.PubSubTransport{first, second, second} {
+		handler, msgs := collect()
+		_, err := p.Subscribe(ch, handler)
+		require.NoError(t, err)
+		received = append(received, msgs)
+	}
+	defer run(t, publisher, first, second)()
+	time.Sleep(Settle)
+
+	require.NoError(t, publisher.Publish(ch, []byte("one")))
+	for _, msgs := range received {
+		require.Equal(t, "one", string(receive(t, msgs, 1)[0].Data))
+		receiveNone(t, msgs)
+	}
+}
+
+func testPubSubUnsubscribe(t *testing.T, makeTransport func() qp.PubSubTransport) {
+	p := makeTransport()
+	ch := channel("unsubscribe")
+	firstHandler, first := collect()
+	secondHandler, second := collect()
+	sub, err := p.Subscribe(ch, firstHandler)
+	require.NoError(t, err)
+	_, err = p.Subscribe(ch, secondHandler)
+	require.NoError(t, err)
+	defer run(t, p)()
+	time.Sleep(Settle)
+
+	// unsubscribing one handler leaves the other in place
+	require.NoError(t, sub.Unsubscribe())
+	require.NoError(t, p.Publish(ch, []byte("one")))
+	receive(t, second, 1)
+	receiveNone(t, first)
+
+	// unsubscribing the channel removes every handler
+	require.NoError(t, p.Unsubscribe(ch))
+	time.Sleep(Settle)
+	require.NoError(t, p.Publish(ch, []byte("two")))
+	receiveNone(t, second)
+}
+
+func testPubSubPatterns(t *testing.T, makeTransport func() qp.PubSubTransport) {
+	p := makeTransport()
+	root := channel("patterns")
+	createdHandler, created := collect()
+	allHandler, all := collect()
+	_, err := p.Subscribe(root+".*.created", createdHandler)
+	require.NoError(t, err)
+	_, err = p.Subscribe(root+".>", allHandler)
+	require.NoError(t, err)
+	defer run(t, p)()
+	time.Sleep(Settle)
+
+	require.NoError(t, p.Publish(root+".eu.created", []byte("one")))
+	require.NoError(t, p.Publish(root+".eu.west.created", []byte("two")))
+	require.NoError(t, p.Publish(root, []byte("three")))
+
+	require.Equal(t, root+".eu.created", receive(t, created, 1)[0].Source)
+	receiveNone(t, created)
+	var sources []string
+	for _, msg := range receive(t, all, 2) {
+		sources = append(sources, msg.Source)
+	}
+	sort.Strings(sources)
+	require.Equal(t, []string{root + ".eu.created", root + ".eu.west.created"}, sources)
+	receiveNone(t, all)
+}
+
+func testPubSubConcurrency(t *testing.T, makeTransport func() qp.PubSubTransport) {
+	p := makeTransport()
+	ch := channel("concurrency")
+	handler, msgs := collect()
+	_, err := p.Subscribe(ch, handler)
+	require.NoError(t, err)
+	defer run(t, p)()
+	time.Sleep(Settle)
+
+	const publishers, each = 10, 10
+	errs := make(chan error, publishers*each)
+	var wg sync.WaitGroup
+	for i := 0; i < publishers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < each; j++ {
+				errs <- p.Publish(ch, []byte(fmt.Sprintf("%d.%d", i, j)))
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	seen := make(map[string]bool)
+	for _, msg := range receive(t, msgs, publishers*each) {
+		seen[string(msg.Data)] = true
+	}
+	require.Equal(t, publishers*each, len(seen))
+}
+
+func testPubSubLargePayload(t *testing.T, makeTransport func() qp.PubSubTransport) {
+	p := makeTransport()
+	ch := channel("large")
+	handler, msgs := collect()
+	_, err := p.Subscribe(ch, handler)
+	require.NoError(t, err)
+	defer run(t, p)()
+	time.Sleep(Settle)
+
+	data := payload(LargePayload)
+	require.NoError(t, p.Publish(ch, data))
+	require.Equal(t, data, receive(t, msgs, 1)[0].Data)
+}
+
+func testPubSubStopDrains(t *testing.T, makeTransport func() qp.PubSubTransport) {
+	p := makeTransport()
+	ch := channel("stopdrains")
+	handler, started, release := blocking()
+	_, err := p.Subscribe(ch, handler)
+	require.NoError(t, err)
+	require.NoError(t, p.Start())
+	time.Sleep(Settle)
+
+	require.NoError(t, p.Publish(ch, []byte("one")))
+	receive(t, started, 1)
+	stopDrains(t, p, release)
+}
+
+func testPubSubRestart(t *testing.T, makeTransport func() qp.PubSubTransport) {
+	p := makeTransport()
+	ch := channel("restart")
+	handler, msgs := collect()
+	_, err := p.Subscribe(ch, handler)
+	require.NoError(t, err)
+	require.NoError(t, p.Start())
+	p.Stop(stop.NoWait)
+	requireStopped(t, p, "after Stop")
+	defer run(t, p)()
+	time.Sleep(Settle)
+
+	require.NoError(t, p.Publish(ch, []byte("one")))
+	require.Equal(t, "one", string(receive(t, msgs, 1)[0].Data))
+}